@@ -0,0 +1,100 @@
+// Package election elects a single leader among the replicas of a service, on top of a KVWrapper.
+package election
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	"github.com/behance/go-common/kvwrapper_etcd_v3"
+	log "github.com/behance/go-logging/log"
+)
+
+var (
+	ErrLeader    = errors.New("Already the leader")
+	ErrNotLeader = errors.New("Not the leader")
+	ErrNoLeader  = errors.New("No leader elected")
+)
+
+// DefaultTTL is the ttl, in seconds, of the elections created with a ttl of 0
+var DefaultTTL uint64 = 60
+
+// PollInterval is how often candidates and observers check the election again,
+// in case the KV store did not report a change of leader
+var PollInterval = time.Second
+
+// Election is shared by every candidate using the same key on the same KV store.
+//
+// The leader keeps its leadership alive until it resigns; should it die, the next candidate is
+// elected ttl seconds later. Each candidate campaigns with a value that identifies it (its
+// address, for instance), which is what the observers of the election are told.
+type Election interface {
+	// Campaign waits until the candidate is elected or ctx is done
+	Campaign(ctx context.Context, val string) error
+	// Resign gives up the leadership, returning ErrNotLeader if it was lost in the meantime
+	Resign() error
+	// Leader returns the value of the current leader, ErrNoLeader if there is none
+	Leader() (string, error)
+	// Observe streams the value of the current leader, then of every new one, until ctx is done
+	Observe(ctx context.Context) <-chan string
+	// Lost is closed once the candidate is no longer the leader: when it resigns, or loses the
+	// leadership because it expired without the candidate noticing
+	Lost() <-chan struct{}
+}
+
+// NewElection returns the Election stored under key on kv. On etcd v3 it is built on the
+// concurrency package of clientv3; on the other stores, KVFaker included, the leader is whoever
+// created key, and refreshes it with conditional writes. Only a bare EtcdV3Wrapper is recognized:
+// wrapped in a namespace, the metrics or the retries, it is treated as any other store.
+func NewElection(kv kvwrapper.KVWrapper, key string, ttl uint64) Election {
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	if kv, ok := kv.(kvwrapper_etcd_v3.EtcdV3Wrapper); ok {
+		return newEtcdV3Election(kv, key, ttl)
+	}
+	return newKVElection(kv, key, ttl)
+}
+
+// observe streams the value leader returns every time key changes, until ctx is done
+func observe(ctx context.Context, kv kvwrapper.KVWrapper, key string, recursive bool, leader func() (string, error)) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+
+		events, err := kv.Watch(ctx, key, recursive)
+		if err != nil {
+			log.Warn("Could not watch election, polling it instead.", "key", key, "err", err)
+			events = nil
+		}
+		ticker := time.NewTicker(PollInterval)
+		defer ticker.Stop()
+
+		last := ""
+		for {
+			val, err := leader()
+			if err == ErrNoLeader {
+				last = ""
+			} else if err == nil && val != last {
+				select {
+				case ch <- val:
+					last = val
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case _, ok := <-events:
+				if !ok {
+					events = nil
+				}
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
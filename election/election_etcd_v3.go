@@ -0,0 +1,123 @@
+package election
+
+import (
+	"context"
+	"sync"
+
+	"github.com/behance/go-common/internal/kvlock"
+	"github.com/behance/go-common/kvwrapper"
+	"github.com/behance/go-common/kvwrapper_etcd_v3"
+	etcdv3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+// etcdV3Election is built on the concurrency package of clientv3: each candidate creates a key
+// below key, attached to the lease of a session, and the oldest of them leads. The session keeps
+// the lease alive until Resign.
+type etcdV3Election struct {
+	kv  kvwrapper_etcd_v3.EtcdV3Wrapper
+	key string
+	ttl uint64
+
+	mutex    sync.Mutex
+	session  *concurrency.Session
+	election *concurrency.Election
+}
+
+func newEtcdV3Election(kv kvwrapper_etcd_v3.EtcdV3Wrapper, key string, ttl uint64) *etcdV3Election {
+	return &etcdV3Election{kv: kv, key: key, ttl: ttl}
+}
+
+func (e *etcdV3Election) Campaign(ctx context.Context, val string) error {
+	if e.leading() {
+		return ErrLeader
+	}
+
+	session, err := concurrency.NewSession(e.kv.Client(), concurrency.WithTTL(int(e.ttl)))
+	if err != nil {
+		return err
+	}
+	election := concurrency.NewElection(session, e.key)
+	err = election.Campaign(ctx, val)
+	if err != nil {
+		session.Close()
+		return err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.session != nil {
+		// another call on this very Election got there first
+		session.Close()
+		return ErrLeader
+	}
+	e.session, e.election = session, election
+	return nil
+}
+
+// Resign deletes the key of the leader, then closes the session
+func (e *etcdV3Election) Resign() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.session == nil {
+		return ErrNotLeader
+	}
+	session, election := e.session, e.election
+	e.session, e.election = nil, nil
+
+	lost := false
+	select {
+	case <-session.Done():
+		lost = true
+	default:
+	}
+	ctx, cancel := kvwrapper.TimeoutContext(e.kv.Timeout)
+	defer cancel()
+	err := election.Resign(ctx)
+	if closeErr := session.Close(); closeErr == rpctypes.ErrLeaseNotFound {
+		// the lease expired, and the key of the leader with it
+		lost = true
+	}
+	if lost {
+		return ErrNotLeader
+	}
+	return err
+}
+
+func (e *etcdV3Election) leading() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.session != nil
+}
+
+// Leader reads the oldest key below key, as concurrency.Election does. It does not go through
+// concurrency.Election, which needs a session of its own.
+func (e *etcdV3Election) Leader() (string, error) {
+	ctx, cancel := kvwrapper.TimeoutContext(e.kv.Timeout)
+	defer cancel()
+
+	r, err := e.kv.Client().Get(ctx, e.key+"/", etcdv3.WithFirstCreate()...)
+	if err != nil {
+		return "", err
+	}
+	if len(r.Kvs) == 0 {
+		return "", ErrNoLeader
+	}
+	return string(r.Kvs[0].Value), nil
+}
+
+func (e *etcdV3Election) Observe(ctx context.Context) <-chan string {
+	return observe(ctx, e.kv, e.key+"/", true, e.Leader)
+}
+
+func (e *etcdV3Election) Lost() <-chan struct{} {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.session == nil {
+		return kvlock.Released
+	}
+	return e.session.Done()
+}
@@ -0,0 +1,57 @@
+package election
+
+import (
+	"context"
+
+	"github.com/behance/go-common/internal/kvlock"
+	"github.com/behance/go-common/kvwrapper"
+)
+
+// kvElection is led by whoever created its key, with its value. The key is refreshed with
+// conditional writes by kvlock, the way the keys of the locks of the lock package are.
+type kvElection struct {
+	kv  kvwrapper.KVWrapper
+	key string
+
+	leader *kvlock.Key
+}
+
+func newKVElection(kv kvwrapper.KVWrapper, key string, ttl uint64) *kvElection {
+	return &kvElection{kv: kv, key: key, leader: kvlock.New(kv, key, ttl)}
+}
+
+func (e *kvElection) Campaign(ctx context.Context, val string) error {
+	_, err := e.leader.Acquire(ctx, val, PollInterval)
+	if err == kvlock.ErrHeld {
+		return ErrLeader
+	}
+	return err
+}
+
+// Resign removes the key of the election. Should that fail, the next candidate is elected anyway
+// once its ttl runs out.
+func (e *kvElection) Resign() error {
+	err := e.leader.Release()
+	if err == kvlock.ErrNotHeld {
+		return ErrNotLeader
+	}
+	return err
+}
+
+func (e *kvElection) Leader() (string, error) {
+	kv, err := e.kv.GetVal(e.key)
+	if err == kvwrapper.ErrKeyNotFound {
+		return "", ErrNoLeader
+	} else if err != nil {
+		return "", err
+	}
+	return kv.Value, nil
+}
+
+func (e *kvElection) Observe(ctx context.Context) <-chan string {
+	return observe(ctx, e.kv, e.key, false, e.Leader)
+}
+
+func (e *kvElection) Lost() <-chan struct{} {
+	return e.leader.Done()
+}
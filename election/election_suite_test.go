@@ -0,0 +1,30 @@
+package election_test
+
+import (
+	"github.com/behance/go-common/internal/etcdtest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+// server is the etcd the specs run against, besides KVFaker
+var server *etcdtest.Server
+
+var _ = BeforeSuite(func() {
+	var err error
+	server, err = etcdtest.Start()
+	Expect(err).To(BeNil())
+})
+
+var _ = AfterSuite(func() {
+	if server != nil {
+		server.Close()
+	}
+})
+
+func TestElection(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Election Suite")
+}
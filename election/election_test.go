@@ -0,0 +1,168 @@
+package election_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/behance/go-common/election"
+	"github.com/behance/go-common/kvwrapper"
+	"github.com/behance/go-common/kvwrapper_etcd"
+	"github.com/behance/go-common/kvwrapper_etcd_v3"
+	log "github.com/behance/go-common/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// backend is a store the specs run against
+type backend struct {
+	name string
+	new  func() kvwrapper.KVWrapper
+	// lose makes the leader lose the leadership, the way it would if it expired
+	lose func(kv kvwrapper.KVWrapper)
+}
+
+var backends = []backend{
+	{
+		name: "KVFaker",
+		new: func() kvwrapper.KVWrapper {
+			return kvwrapper.NewKVWrapper(nil, kvwrapper.KVFaker{})
+		},
+		lose: func(kv kvwrapper.KVWrapper) {
+			kv.(kvwrapper.KVFaker).Advance(time.Duration(DefaultTTL) * time.Second)
+		},
+	},
+	{
+		name: "etcd v2",
+		new: func() kvwrapper.KVWrapper {
+			return kvwrapper.NewKVWrapper(server.Servers(), kvwrapper_etcd.EtcdWrapper{})
+		},
+		lose: deleteLeader,
+	},
+	{
+		name: "etcd v3",
+		new: func() kvwrapper.KVWrapper {
+			return kvwrapper.NewKVWrapper(server.Servers(), kvwrapper_etcd_v3.EtcdV3Wrapper{})
+		},
+		lose: func(kv kvwrapper.KVWrapper) {
+			// the leadership belongs to the lease of a session
+			cli := kv.(kvwrapper_etcd_v3.EtcdV3Wrapper).Client()
+			leases, err := cli.Leases(context.Background())
+			Expect(err).To(BeNil())
+			for _, lease := range leases.Leases {
+				cli.Revoke(context.Background(), lease.ID)
+			}
+		},
+	},
+}
+
+func deleteLeader(kv kvwrapper.KVWrapper) {
+	Expect(kv.Delete("elections/scheduler")).To(BeNil())
+}
+
+var _ = Describe("Election", func() {
+	for _, b := range backends {
+		b := b
+		Context("On "+b.name, func() {
+			describeElection(b)
+		})
+	}
+})
+
+func describeElection(b backend) {
+	var (
+		kv kvwrapper.KVWrapper
+		e1 Election
+		e2 Election
+	)
+
+	BeforeEach(func() {
+		log.SetLevel(log.PanicLevel)
+		kv = b.new()
+		Expect(kv).ToNot(BeNil())
+		e1 = NewElection(kv, "elections/scheduler", 0)
+		e2 = NewElection(kv, "elections/scheduler", 0)
+	})
+
+	AfterEach(func() {
+		e1.Resign()
+		e2.Resign()
+		kv.DeleteList("elections")
+	})
+
+	Describe("Campaign", func() {
+		It("Elects the first candidate", func() {
+			_, err := e1.Leader()
+			Expect(err).To(MatchError(ErrNoLeader))
+
+			Expect(e1.Campaign(context.Background(), "host1")).To(BeNil())
+			leader, err := e2.Leader()
+			Expect(err).To(BeNil())
+			Expect(leader).To(Equal("host1"))
+
+			Expect(e1.Campaign(context.Background(), "host1")).To(MatchError(ErrLeader))
+		})
+		It("Waits for the leader to resign", func() {
+			e1.Campaign(context.Background(), "host1")
+
+			elected := make(chan error)
+			go func() {
+				defer GinkgoRecover()
+				elected <- e2.Campaign(context.Background(), "host2")
+			}()
+			Consistently(elected, 100*time.Millisecond).ShouldNot(Receive())
+
+			Expect(e1.Resign()).To(BeNil())
+			Eventually(elected).Should(Receive(BeNil()))
+			leader, _ := e1.Leader()
+			Expect(leader).To(Equal("host2"))
+		})
+		It("Gives up when the context is done", func() {
+			e1.Campaign(context.Background(), "host1")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			Expect(e2.Campaign(ctx, "host2")).To(MatchError(context.DeadlineExceeded))
+		})
+	})
+
+	Describe("Resign", func() {
+		It("Fails when not leading", func() {
+			Expect(e1.Resign()).To(MatchError(ErrNotLeader))
+		})
+		It("Closes the lost channel", func() {
+			e1.Campaign(context.Background(), "host1")
+			lost := e1.Lost()
+			Expect(lost).ToNot(BeClosed())
+
+			e1.Resign()
+			Expect(lost).To(BeClosed())
+		})
+		It("Fails when the leadership was lost", func() {
+			e1.Campaign(context.Background(), "host1")
+			lost := e1.Lost()
+
+			b.lose(kv)
+			Expect(e1.Resign()).To(MatchError(ErrNotLeader))
+			Eventually(lost).Should(BeClosed())
+		})
+	})
+
+	Describe("Observe", func() {
+		It("Streams every new leader", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			e1.Campaign(context.Background(), "host1")
+			leaders := e2.Observe(ctx)
+			Eventually(leaders).Should(Receive(Equal("host1")))
+
+			e1.Resign()
+			e2.Campaign(context.Background(), "host2")
+			Eventually(leaders).Should(Receive(Equal("host2")))
+
+			cancel()
+			Eventually(leaders).Should(BeClosed())
+		})
+	})
+}
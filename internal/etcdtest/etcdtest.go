@@ -0,0 +1,135 @@
+// Package etcdtest runs an etcd server inside the test process, serving the v2 and v3 APIs on
+// random local ports, so the etcd wrappers and the packages built on them can be tested without
+// an etcd of their own.
+package etcdtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	etcdv3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+)
+
+// StartTimeout bounds how long Start waits for the server to be ready
+var StartTimeout = 30 * time.Second
+
+// Server is an etcd server running in the process
+type Server struct {
+	// URL is the client URL of the server, for both the v2 and v3 APIs
+	URL string
+
+	etcd *embed.Etcd
+	dir  string
+}
+
+// Start starts a single member cluster, with its data in a temporary directory
+func Start() (*Server, error) {
+	ports, err := freePorts(2)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "etcdtest")
+	if err != nil {
+		return nil, err
+	}
+
+	client := url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", ports[0])}
+	peer := url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", ports[1])}
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.EnableV2 = true
+	cfg.LCUrls, cfg.ACUrls = []url.URL{client}, []url.URL{client}
+	cfg.LPUrls, cfg.APUrls = []url.URL{peer}, []url.URL{peer}
+	cfg.InitialCluster = cfg.Name + "=" + peer.String()
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case err := <-e.Err():
+		e.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	case <-time.After(StartTimeout):
+		e.Close()
+		os.RemoveAll(dir)
+		return nil, errors.New("etcd did not start in time")
+	}
+	return &Server{URL: client.String(), etcd: e, dir: dir}, nil
+}
+
+// freePorts returns n ports nothing listens on. They are only free until someone else takes them.
+func freePorts(n int) ([]int, error) {
+	ports := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+	}
+	return ports, nil
+}
+
+// Servers returns the endpoints to hand to the wrappers
+func (s *Server) Servers() []string {
+	return []string{s.URL}
+}
+
+// EnableAuth creates the root user with password and turns authentication on, for both the
+// v2 and v3 APIs. Anonymous requests are refused from then on.
+func (s *Server) EnableAuth(password string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cli, err := etcdv3.New(etcdv3.Config{Endpoints: s.Servers()})
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	if _, err := cli.UserAdd(ctx, "root", password); err != nil {
+		return err
+	}
+	if _, err := cli.UserGrantRole(ctx, "root", "root"); err != nil {
+		return err
+	}
+	if _, err := cli.AuthEnable(ctx); err != nil {
+		return err
+	}
+
+	// v2 keeps users of its own, and lets the guest role read and write everything by default
+	v2, err := etcd.New(etcd.Config{Endpoints: s.Servers()})
+	if err != nil {
+		return err
+	}
+	if err := etcd.NewAuthUserAPI(v2).AddUser(ctx, "root", password); err != nil {
+		return err
+	}
+	if err := etcd.NewAuthAPI(v2).Enable(ctx); err != nil {
+		return err
+	}
+	root, err := etcd.New(etcd.Config{Endpoints: s.Servers(), Username: "root", Password: password})
+	if err != nil {
+		return err
+	}
+	_, err = etcd.NewAuthRoleAPI(root).RevokeRoleKV(ctx, "guest", []string{"/*"}, etcd.ReadWritePermission)
+	return err
+}
+
+// Close stops the server and removes its data
+func (s *Server) Close() {
+	s.etcd.Close()
+	os.RemoveAll(s.dir)
+}
@@ -0,0 +1,190 @@
+// Package kvlock holds a key of a KVWrapper on behalf of a single holder at a time: the key is
+// created with a value naming its holder, refreshed with conditional writes until it is released,
+// and removed only if it still holds that value. The lock and election packages are built on it
+// for the stores that have no native locking.
+package kvlock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	log "github.com/behance/go-logging/log"
+)
+
+var (
+	// ErrHeld is returned when the key is already held through the same Key
+	ErrHeld = errors.New("Key is already held")
+	// ErrNotHeld is returned when the key is not held through the Key, or was lost in the meantime
+	ErrNotHeld = errors.New("Key is not held")
+)
+
+// Released is the Done channel of the keys that are not held
+var Released = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// Key is held by whoever created it. The holder refreshes the key every third of its ttl,
+// compare-and-swapping its own value so that it notices if the key was taken over.
+type Key struct {
+	kv  kvwrapper.KVWrapper
+	key string
+	// ttl is 0 for a key that never expires, which needs no refresh
+	ttl uint64
+
+	mutex sync.Mutex
+	val   string
+	rev   int64
+	stop  context.CancelFunc
+	done  chan struct{}
+}
+
+// New returns the Key stored under key on kv, created with a ttl of ttl seconds
+func New(kv kvwrapper.KVWrapper, key string, ttl uint64) *Key {
+	return &Key{kv: kv, key: key, ttl: ttl, done: Released}
+}
+
+// Acquire waits until the key is created with val or ctx is done, checking the key again every
+// interval in case the KV store did not report its removal, and returns the revision at which
+// it was created
+func (k *Key) Acquire(ctx context.Context, val string, interval time.Duration) (int64, error) {
+	if k.Revision() != 0 {
+		return 0, ErrHeld
+	}
+	for {
+		// the watch starts before trying, so that a release in between is not missed
+		watchCtx, cancel := context.WithCancel(ctx)
+		events, err := k.kv.Watch(watchCtx, k.key, false)
+		if err != nil {
+			log.Warn("Could not watch key, polling it instead.", "key", k.key, "err", err)
+			events = nil
+		}
+
+		rev, err := k.TryAcquire(val)
+		if err != kvwrapper.ErrConflict {
+			cancel()
+			return rev, err
+		}
+
+		err = wait(ctx, events, interval)
+		cancel()
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// wait returns once the key may have been removed, or ctx is done
+func wait(ctx context.Context, events <-chan *kvwrapper.WatchEvent, interval time.Duration) error {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+			} else if ev.Type != kvwrapper.EventPut {
+				return nil
+			}
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// TryAcquire creates the key with val if it does not exist, returning ErrConflict otherwise, and
+// returns the revision at which it was created
+func (k *Key) TryAcquire(val string) (int64, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.rev != 0 {
+		return 0, ErrHeld
+	}
+	rev, err := k.kv.Create(k.key, val, k.ttl)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	k.val, k.rev, k.stop, k.done = val, rev, cancel, make(chan struct{})
+	if k.ttl > 0 {
+		go k.refresh(ctx, val)
+	}
+	return rev, nil
+}
+
+// refresh keeps the key of val from expiring until ctx is done
+func (k *Key) refresh(ctx context.Context, val string) {
+	ticker := time.NewTicker(time.Duration(k.ttl) * time.Second / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		_, err := k.kv.CompareAndSwap(k.key, val, val, k.ttl)
+		if err == kvwrapper.ErrKeyNotFound || err == kvwrapper.ErrConflict {
+			log.Warn("Lost key.", "key", k.key, "err", err)
+			k.mutex.Lock()
+			if k.val == val {
+				k.release()
+			}
+			k.mutex.Unlock()
+			return
+		} else if err != nil {
+			// the key is still held until its ttl runs out, the next refresh may go through
+			log.Warn("Could not refresh key.", "key", k.key, "err", err)
+		}
+	}
+}
+
+// Release removes the key. Should that fail, the key is removed anyway once its ttl runs out.
+func (k *Key) Release() error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.rev == 0 {
+		return ErrNotHeld
+	}
+	val := k.val
+	k.release()
+
+	err := k.kv.CompareAndDelete(k.key, val)
+	if err == kvwrapper.ErrKeyNotFound || err == kvwrapper.ErrConflict {
+		return ErrNotHeld
+	}
+	return err
+}
+
+// release must be called with the mutex held
+func (k *Key) release() {
+	k.stop()
+	close(k.done)
+	k.val, k.rev, k.stop, k.done = "", 0, nil, Released
+}
+
+// Revision returns the revision at which the key was created, 0 if it is not held
+func (k *Key) Revision() int64 {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.rev
+}
+
+// Done is closed once the key is no longer held: when it is released, or lost because it
+// expired without its holder noticing
+func (k *Key) Done() <-chan struct{} {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.done
+}
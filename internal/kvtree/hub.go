@@ -0,0 +1,106 @@
+package kvtree
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Hub delivers the events of a Tree to the watches on its keys. Events are queued per watch,
+// so a slow reader never blocks the writers publishing them.
+type Hub struct {
+	mutex   sync.Mutex
+	watches map[*watch]struct{}
+}
+
+type watch struct {
+	key       string
+	recursive bool
+	events    chan Event
+	wake      chan struct{}
+
+	mutex sync.Mutex
+	queue []Event
+}
+
+// Watch returns the events on key, or on key and every key below it if recursive is set,
+// until ctx is done, at which point the returned channel is closed
+func (h *Hub) Watch(ctx context.Context, key string, recursive bool) <-chan Event {
+	w := &watch{
+		key:       Clean(key),
+		recursive: recursive,
+		events:    make(chan Event),
+		wake:      make(chan struct{}, 1),
+	}
+
+	h.mutex.Lock()
+	if h.watches == nil {
+		h.watches = make(map[*watch]struct{})
+	}
+	h.watches[w] = struct{}{}
+	h.mutex.Unlock()
+
+	go func() {
+		w.run(ctx)
+		h.mutex.Lock()
+		delete(h.watches, w)
+		h.mutex.Unlock()
+	}()
+	return w.events
+}
+
+// Publish queues events for the watches they concern
+func (h *Hub) Publish(events ...Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for w := range h.watches {
+		for _, ev := range events {
+			if w.matches(ev.Node.Key) {
+				w.push(ev)
+			}
+		}
+	}
+}
+
+func (w *watch) matches(key string) bool {
+	if key == w.key {
+		return true
+	}
+	return w.recursive && strings.HasPrefix(key, strings.TrimSuffix(w.key, "/")+"/")
+}
+
+func (w *watch) push(ev Event) {
+	w.mutex.Lock()
+	w.queue = append(w.queue, ev)
+	w.mutex.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watch) run(ctx context.Context) {
+	defer close(w.events)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+		}
+
+		w.mutex.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mutex.Unlock()
+
+		for _, ev := range queue {
+			select {
+			case w.events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,397 @@
+// Package kvtree is an in-memory tree of keys with the semantics of etcd v2: keys are paths,
+// setting a key creates the directories above it, directories are deleted recursively only,
+// and keys can expire. It backs the KVWrappers that keep their keys in the process.
+package kvtree
+
+import (
+	"container/heap"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrKeyNotFound = errors.New("Key not found")
+	// ErrNotFile is returned when a key is a directory, where a key holding a value is expected
+	ErrNotFile = errors.New("Key is a directory")
+	// ErrNotDir is returned when a key sits below a key holding a value
+	ErrNotDir = errors.New("Key is below a key that is not a directory")
+)
+
+// EventType is the kind of change a mutation made
+type EventType int
+
+const (
+	EventSet EventType = iota
+	EventDelete
+	EventExpire
+)
+
+// Node is a key of the tree. The nodes returned by a Tree are copies.
+type Node struct {
+	Key           string
+	Value         string
+	Dir           bool
+	Expiration    time.Time
+	CreatedIndex  uint64
+	ModifiedIndex uint64
+	// Version counts the sets of the key since it was created
+	Version int64
+
+	children map[string]*Node
+}
+
+func (n *Node) copy() *Node {
+	c := *n
+	c.children = nil
+	return &c
+}
+
+// Event is a change made to a key holding a value. Node is its state after a set, and before
+// a delete or expiry.
+type Event struct {
+	Type  EventType
+	Node  *Node
+	Index uint64
+}
+
+// Tree holds the keys. It is not safe for concurrent use.
+type Tree struct {
+	now      func() time.Time
+	index    uint64
+	root     *Node
+	expiries expiryHeap
+	// undo reverts the mutations made since Begin, nil when they are not recorded
+	undo []func()
+}
+
+// New returns an empty Tree, whose keys expire according to now (time.Now if nil)
+func New(now func() time.Time) *Tree {
+	if now == nil {
+		now = time.Now
+	}
+	return &Tree{
+		now:  now,
+		root: &Node{Key: "/", Dir: true, children: make(map[string]*Node)},
+	}
+}
+
+// Clean returns the canonical form of key: rooted at "/", without trailing or repeated slashes
+func Clean(key string) string {
+	return path.Clean("/" + key)
+}
+
+// Index returns the index of the last mutation
+func (t *Tree) Index() uint64 {
+	return t.index
+}
+
+// SetIndex moves the index of the tree, so that the next mutation happens at index + 1
+func (t *Tree) SetIndex(index uint64) {
+	t.index = index
+}
+
+// Now returns the current time, according to the clock of the tree
+func (t *Tree) Now() time.Time {
+	return t.now()
+}
+
+// TTL returns the number of seconds left before n expires, rounded up as etcd does, 0 if it does not expire
+func (t *Tree) TTL(n *Node) int64 {
+	if n.Expiration.IsZero() {
+		return 0
+	}
+	left := n.Expiration.Sub(t.now())
+	if left <= 0 {
+		return 0
+	}
+	return int64((left + time.Second - 1) / time.Second)
+}
+
+// Begin records the mutations made from now on, until Commit keeps them or Rollback reverts them
+func (t *Tree) Begin() {
+	index := t.index
+	t.undo = []func(){func() { t.index = index }}
+}
+
+// Commit keeps the mutations made since Begin
+func (t *Tree) Commit() {
+	t.undo = nil
+}
+
+// Rollback reverts the mutations made since Begin, latest first
+func (t *Tree) Rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+	t.undo = nil
+}
+
+// record keeps undo to revert a mutation, if the mutations are being recorded
+func (t *Tree) record(undo func()) {
+	if t.undo != nil {
+		t.undo = append(t.undo, undo)
+	}
+}
+
+// lookup returns the node at key, nil if there is none
+func (t *Tree) lookup(key string) *Node {
+	n := t.root
+	for _, name := range split(key) {
+		if !n.Dir {
+			return nil
+		}
+		n = n.children[name]
+		if n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+func split(key string) []string {
+	key = strings.Trim(Clean(key), "/")
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, "/")
+}
+
+// Get returns the node at key
+func (t *Tree) Get(key string) (*Node, error) {
+	n := t.lookup(key)
+	if n == nil {
+		return nil, ErrKeyNotFound
+	}
+	return n.copy(), nil
+}
+
+// Children returns the nodes directly below key, sorted by key. A key holding a value has none.
+func (t *Tree) Children(key string) ([]*Node, error) {
+	n := t.lookup(key)
+	if n == nil {
+		return nil, ErrKeyNotFound
+	}
+	children := make([]*Node, 0, len(n.children))
+	for _, child := range n.children {
+		children = append(children, child.copy())
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Key < children[j].Key })
+	return children, nil
+}
+
+// Walk calls fn on key and every node below it, parents first, siblings sorted by key
+func (t *Tree) Walk(key string, fn func(n *Node)) {
+	if n := t.lookup(key); n != nil {
+		walk(n, fn)
+	}
+}
+
+func walk(n *Node, fn func(n *Node)) {
+	fn(n.copy())
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		walk(n.children[name], fn)
+	}
+}
+
+// Set sets key = val, expiring at expiration unless it is zero. The directories above key are
+// created as needed. A key that already exists keeps its CreatedIndex.
+func (t *Tree) Set(key string, val string, expiration time.Time) (Event, error) {
+	key = Clean(key)
+	if key == "/" {
+		return Event{}, ErrNotFile
+	}
+
+	// the directories created along the way share the index of the key
+	parent, err := t.mkdirAll(path.Dir(key), t.index+1)
+	if err != nil {
+		return Event{}, err
+	}
+	name := path.Base(key)
+	n := parent.children[name]
+	if n != nil && n.Dir {
+		return Event{}, ErrNotFile
+	}
+
+	t.index++
+	if n == nil {
+		n = &Node{Key: key, CreatedIndex: t.index}
+		parent.children[name] = n
+		t.record(func() { delete(parent.children, name) })
+	} else {
+		prev := *n
+		t.record(func() { *n = prev })
+	}
+	n.Value = val
+	n.Expiration = expiration
+	n.ModifiedIndex = t.index
+	n.Version++
+	if !expiration.IsZero() {
+		heap.Push(&t.expiries, expiry{key: key, at: expiration})
+	}
+	return Event{Type: EventSet, Node: n.copy(), Index: t.index}, nil
+}
+
+// Mkdir creates the directory key, and the ones above it
+func (t *Tree) Mkdir(key string) error {
+	if n := t.lookup(key); n != nil {
+		if !n.Dir {
+			return ErrNotDir
+		}
+		return nil
+	}
+	_, err := t.mkdirAll(Clean(key), t.index+1)
+	if err == nil {
+		t.index++
+	}
+	return err
+}
+
+// mkdirAll returns the directory key, creating it and the ones above it at index as needed
+func (t *Tree) mkdirAll(key string, index uint64) (*Node, error) {
+	n := t.root
+	for _, name := range split(key) {
+		child := n.children[name]
+		if child == nil {
+			child = &Node{
+				Key:           path.Join(n.Key, name),
+				Dir:           true,
+				CreatedIndex:  index,
+				ModifiedIndex: index,
+				children:      make(map[string]*Node),
+			}
+			parent, name := n, name
+			parent.children[name] = child
+			t.record(func() { delete(parent.children, name) })
+		} else if !child.Dir {
+			return nil, ErrNotDir
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// Restore puts n back as it was, indexes included, creating the directories above it as needed.
+// It is meant to rebuild a tree from a copy of its nodes.
+func (t *Tree) Restore(n Node) error {
+	key := Clean(n.Key)
+	if key == "/" {
+		return nil
+	}
+	parent, err := t.mkdirAll(path.Dir(key), n.CreatedIndex)
+	if err != nil {
+		return err
+	}
+	name := path.Base(key)
+	if prev := parent.children[name]; prev != nil && prev.Dir != n.Dir {
+		if prev.Dir {
+			return ErrNotFile
+		}
+		return ErrNotDir
+	} else if prev != nil && n.Dir {
+		return nil
+	}
+
+	restored := n.copy()
+	restored.Key = key
+	if n.Dir {
+		restored.children = make(map[string]*Node)
+	} else if !n.Expiration.IsZero() {
+		heap.Push(&t.expiries, expiry{key: key, at: n.Expiration})
+	}
+	parent.children[name] = restored
+	if n.ModifiedIndex > t.index {
+		t.index = n.ModifiedIndex
+	}
+	return nil
+}
+
+// Delete removes key, which has to hold a value unless recursive is set, in which case key and
+// everything below it is removed. It returns an event for each key holding a value it removed.
+// The root itself is never removed, only emptied.
+func (t *Tree) Delete(key string, recursive bool) ([]Event, error) {
+	key = Clean(key)
+	n := t.lookup(key)
+	if n == nil {
+		return nil, ErrKeyNotFound
+	}
+	if n.Dir && !recursive {
+		return nil, ErrNotFile
+	}
+
+	t.index++
+	events := []Event{}
+	walk(n, func(c *Node) {
+		if !c.Dir {
+			events = append(events, Event{Type: EventDelete, Node: c, Index: t.index})
+		}
+	})
+	if n == t.root {
+		children := n.children
+		n.children = make(map[string]*Node)
+		t.record(func() { n.children = children })
+	} else {
+		t.unlink(key, n)
+	}
+	return events, nil
+}
+
+// Expire removes the keys whose expiration passed, and returns an event for each of them
+func (t *Tree) Expire() []Event {
+	now := t.now()
+	events := []Event{}
+	for t.expiries.Len() > 0 && !t.expiries[0].at.After(now) {
+		e := heap.Pop(&t.expiries).(expiry)
+		n := t.lookup(e.key)
+		if n == nil || n.Dir || !n.Expiration.Equal(e.at) {
+			// the key was removed or set again since
+			continue
+		}
+		t.index++
+		events = append(events, Event{Type: EventExpire, Node: n.copy(), Index: t.index})
+		t.unlink(e.key, n)
+	}
+	return events
+}
+
+// unlink removes n, found at key, from its parent
+func (t *Tree) unlink(key string, n *Node) {
+	parent, name := t.lookup(path.Dir(key)), path.Base(key)
+	delete(parent.children, name)
+	t.record(func() { parent.children[name] = n })
+}
+
+// NextExpiration returns when the next key expires, zero if none will
+func (t *Tree) NextExpiration() time.Time {
+	if t.expiries.Len() == 0 {
+		return time.Time{}
+	}
+	return t.expiries[0].at
+}
+
+type expiry struct {
+	key string
+	at  time.Time
+}
+
+// expiryHeap orders the expiries soonest first. Entries are not removed when their key is
+// set again, deleted or rolled back, Expire skips them instead.
+type expiryHeap []expiry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,321 @@
+package kvtree
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrConflict is returned by the conditional writes when the key does not match the expected state
+var ErrConflict = errors.New("Key does not match the expected state")
+
+// Change is a mutation of the tree, as a journal records it: Node is the key that was set, or
+// nil if Key was deleted along with everything below it
+type Change struct {
+	Node  *Node
+	Key   string
+	Index uint64
+}
+
+// Store guards a Tree with a mutex. The keys whose ttl ran out are expired before every
+// operation, and the changes are handed to the journal, if any, then to the watches once the
+// journal recorded them.
+type Store struct {
+	mutex   sync.Mutex
+	tree    *Tree
+	hub     Hub
+	journal func(changes []Change) error
+}
+
+// NewStore returns a Store over tree. journal is called with the mutex held for every
+// mutation. When it fails, the mutation is rolled back and its error returned by the operation.
+func NewStore(tree *Tree, journal func(changes []Change) error) *Store {
+	return &Store{tree: tree, journal: journal}
+}
+
+// Expire removes the keys whose ttl ran out
+func (s *Store) Expire() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire()
+}
+
+// expire must be called with the mutex held, before every operation, so that nothing expired
+// is ever returned
+func (s *Store) expire() {
+	events := s.tree.Expire()
+	if len(events) == 0 {
+		return
+	}
+	if s.journal != nil {
+		changes := make([]Change, 0, len(events))
+		for _, ev := range events {
+			changes = append(changes, Change{Key: ev.Node.Key, Index: ev.Index})
+		}
+		// expiries are not rolled back: a journal that missed them expires the keys again
+		// once replayed
+		s.journal(changes)
+	}
+	s.hub.Publish(events...)
+}
+
+// apply journals the changes made to the tree since Begin, then hands events to the watches.
+// The changes are rolled back if the journal fails. It must be called with the mutex held.
+func (s *Store) apply(changes []Change, events []Event) error {
+	if s.journal != nil && len(changes) > 0 {
+		if err := s.journal(changes); err != nil {
+			s.tree.Rollback()
+			return err
+		}
+	}
+	s.tree.Commit()
+	s.hub.Publish(events...)
+	return nil
+}
+
+// TTL returns the number of seconds left before n expires, 0 if it does not expire
+func (s *Store) TTL(n *Node) int64 {
+	return s.tree.TTL(n)
+}
+
+// expiration returns when a key set now with ttl expires, zero if ttl is 0
+func (s *Store) expiration(ttl uint64) time.Time {
+	if ttl == 0 {
+		return time.Time{}
+	}
+	return s.tree.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+// set must be called with the mutex held
+func (s *Store) set(key string, val string, ttl uint64) (uint64, error) {
+	s.tree.Begin()
+	ev, err := s.tree.Set(key, val, s.expiration(ttl))
+	if err != nil {
+		s.tree.Rollback()
+		return 0, err
+	}
+	change := Change{Node: ev.Node, Key: ev.Node.Key, Index: ev.Index}
+	return ev.Index, s.apply([]Change{change}, []Event{ev})
+}
+
+// leaf returns the node at key, which has to hold a value. It must be called with the mutex held.
+func (s *Store) leaf(key string) (*Node, error) {
+	n, err := s.tree.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if n.Dir {
+		return nil, ErrNotFile
+	}
+	return n, nil
+}
+
+// remove must be called with the mutex held
+func (s *Store) remove(key string, recursive bool) (int64, error) {
+	s.tree.Begin()
+	events, err := s.tree.Delete(key, recursive)
+	if err != nil {
+		s.tree.Rollback()
+		return 0, err
+	}
+	change := Change{Key: Clean(key), Index: s.tree.Index()}
+	return int64(len(events)), s.apply([]Change{change}, events)
+}
+
+// Get returns the node at key
+func (s *Store) Get(key string) (*Node, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expire()
+	return s.tree.Get(key)
+}
+
+// Children returns the nodes directly below key, sorted by key
+func (s *Store) Children(key string) ([]*Node, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expire()
+	return s.tree.Children(key)
+}
+
+// Set sets key = val with a ttl of ttl seconds, and returns the index of the change
+func (s *Store) Set(key string, val string, ttl uint64) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expire()
+	return s.set(key, val, ttl)
+}
+
+// Create sets key = val only if key does not exist yet
+func (s *Store) Create(key string, val string, ttl uint64) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expire()
+	if _, err := s.tree.Get(key); err == nil {
+		return 0, ErrConflict
+	}
+	return s.set(key, val, ttl)
+}
+
+// CompareAndSwap sets key = val only if the current value of key is prevVal
+func (s *Store) CompareAndSwap(key string, val string, prevVal string, ttl uint64) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expire()
+	n, err := s.leaf(key)
+	if err != nil {
+		return 0, err
+	}
+	if n.Value != prevVal {
+		return 0, ErrConflict
+	}
+	return s.set(key, val, ttl)
+}
+
+// CompareAndSwapIndex sets key = val only if key was last modified at prevIndex
+func (s *Store) CompareAndSwapIndex(key string, val string, prevIndex uint64, ttl uint64) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expire()
+	n, err := s.leaf(key)
+	if err != nil {
+		return 0, err
+	}
+	if n.ModifiedIndex != prevIndex {
+		return 0, ErrConflict
+	}
+	return s.set(key, val, ttl)
+}
+
+// CompareAndDelete removes key only if its current value is prevVal
+func (s *Store) CompareAndDelete(key string, prevVal string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expire()
+	n, err := s.leaf(key)
+	if err != nil {
+		return err
+	}
+	if n.Value != prevVal {
+		return ErrConflict
+	}
+	_, err = s.remove(key, false)
+	return err
+}
+
+// Delete removes key, recursively if it is a directory and recursive is set, and returns the
+// number of keys (not directories) that were removed
+func (s *Store) Delete(key string, recursive bool) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expire()
+	return s.remove(key, recursive)
+}
+
+// OpType is the kind of operation performed by an Op
+type OpType int
+
+const (
+	OpSet OpType = iota
+	OpDelete
+	OpGet
+)
+
+// Op is a single operation of a transaction. Value and TTL only apply to OpSet.
+type Op struct {
+	Type  OpType
+	Key   string
+	Value string
+	TTL   uint64
+}
+
+// OpResult is the outcome of a single Op: the Node read by OpGet, nil if there is none, or
+// the number of keys removed by OpDelete
+type OpResult struct {
+	Node    *Node
+	Deleted int64
+}
+
+// Compare is a condition of a transaction on Key. Holds is handed the node at Key, nil if there
+// is none or if it is a directory.
+type Compare struct {
+	Key   string
+	Holds func(leaf *Node) bool
+}
+
+// TxnResult is the outcome of a transaction, Index being the index of the tree once it is applied
+type TxnResult struct {
+	Succeeded bool
+	Results   []OpResult
+	Index     uint64
+}
+
+// Txn applies thenOps if every compare holds, elseOps otherwise, all at once while holding the
+// mutex. The operations are applied in order, and rolled back as a whole if any of them fails.
+func (s *Store) Txn(compares []Compare, thenOps []Op, elseOps []Op) (*TxnResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expire()
+	r := &TxnResult{Succeeded: true}
+	for _, cmp := range compares {
+		n, _ := s.leaf(cmp.Key)
+		if !cmp.Holds(n) {
+			r.Succeeded = false
+			break
+		}
+	}
+
+	ops := thenOps
+	if !r.Succeeded {
+		ops = elseOps
+	}
+	s.tree.Begin()
+	changes, events := []Change{}, []Event{}
+	for _, op := range ops {
+		result := OpResult{}
+		switch op.Type {
+		case OpSet:
+			ev, err := s.tree.Set(op.Key, op.Value, s.expiration(op.TTL))
+			if err != nil {
+				s.tree.Rollback()
+				return nil, err
+			}
+			changes = append(changes, Change{Node: ev.Node, Key: ev.Node.Key, Index: ev.Index})
+			events = append(events, ev)
+		case OpDelete:
+			deleted, err := s.tree.Delete(op.Key, false)
+			if err == nil {
+				changes = append(changes, Change{Key: Clean(op.Key), Index: s.tree.Index()})
+				events = append(events, deleted...)
+			} else if err != ErrKeyNotFound {
+				s.tree.Rollback()
+				return nil, err
+			}
+			result.Deleted = int64(len(deleted))
+		case OpGet:
+			result.Node, _ = s.tree.Get(op.Key)
+		}
+		r.Results = append(r.Results, result)
+	}
+	r.Index = s.tree.Index()
+	if err := s.apply(changes, events); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Watch returns the events on key, or on key and every key below it if recursive is set,
+// until ctx is done, at which point the returned channel is closed
+func (s *Store) Watch(ctx context.Context, key string, recursive bool) <-chan Event {
+	return s.hub.Watch(ctx, key, recursive)
+}
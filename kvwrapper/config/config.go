@@ -0,0 +1,350 @@
+// Package config loads configuration structs from a KV subtree, and keeps them up to date as the
+// keys change.
+//
+// Each exported field of the struct is read from the key named by its kv tag, below the key of the
+// struct, or from its name in lower case when it has no tag. A "-" tag skips the field, and the
+// "required" option fails the load when the key is missing. Missing keys otherwise take the value
+// of the default tag, if any:
+//
+//	type Config struct {
+//		Host    string        `kv:"host,required"`
+//		Port    int           `kv:"port" default:"8080"`
+//		Timeout time.Duration `kv:"timeout" default:"5s"`
+//		Tags    []string      `kv:"tags"`
+//		DB      struct {
+//			User string `kv:"user"`
+//		} `kv:"db"`
+//		Limits map[string]int `kv:"limits"`
+//	}
+//
+// Nested structs are read from the directory of the same name, maps from the keys right below
+// theirs, and slices from comma separated values. Values are converted to strings, bools,
+// numbers, time.Durations, or any type implementing encoding.TextUnmarshaler.
+package config
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	log "github.com/behance/go-logging/log"
+)
+
+// ErrMissingKey is the error of a FieldError about a required key that is missing
+var ErrMissingKey = errors.New("Required key is missing")
+
+// DefaultPollInterval is how often the watchers of loaders that were not given a PollInterval
+// read the configuration again, when the KV store cannot be watched
+var DefaultPollInterval = 10 * time.Second
+
+// FieldError reports a field that could not be loaded from its key
+type FieldError struct {
+	Field string
+	Key   string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("Could not load %s from key %s: %s", e.Field, e.Key, e.Err)
+}
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Loader loads configuration structs from the keys below Prefix in KV
+type Loader struct {
+	KV     kvwrapper.KVWrapper
+	Prefix string
+	// PollInterval is how often a Watcher reads the configuration again when KV cannot be watched
+	PollInterval time.Duration
+}
+
+// Load loads the configuration below prefix in kv into v, a pointer to a struct
+func Load(kv kvwrapper.KVWrapper, prefix string, v interface{}) error {
+	return Loader{KV: kv, Prefix: prefix}.Load(v)
+}
+
+// Load loads the configuration into v, a pointer to a struct. It returns a *FieldError naming the
+// first field that could not be loaded.
+func (l Loader) Load(v interface{}) error {
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() || ptr.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Load needs a pointer to a struct, not %T", v)
+	}
+	return l.loadStruct(ptr.Elem(), strings.TrimSuffix(l.Prefix, "/"), ptr.Elem().Type().Name())
+}
+
+func (l Loader) loadStruct(v reflect.Value, key string, name string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("kv"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		fieldKey := tag[0]
+		if fieldKey == "" {
+			fieldKey = strings.ToLower(f.Name)
+		}
+		required := false
+		for _, opt := range tag[1:] {
+			if opt == "required" {
+				required = true
+			}
+		}
+		def, hasDefault := f.Tag.Lookup("default")
+
+		if err := l.loadField(v.Field(i), key+"/"+fieldKey, name+"."+f.Name, required, def, hasDefault); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l Loader) loadField(v reflect.Value, key string, name string, required bool, def string, hasDefault bool) error {
+	switch {
+	case v.Kind() == reflect.Struct && !reflect.PtrTo(v.Type()).Implements(textUnmarshalerType):
+		return l.loadStruct(v, key, name)
+	case v.Kind() == reflect.Map:
+		return l.loadMap(v, key, name, required)
+	}
+
+	s, err := l.KV.GetVal(key)
+	switch {
+	case err == kvwrapper.ErrKeyNotFound && required:
+		return &FieldError{Field: name, Key: key, Err: ErrMissingKey}
+	case err == kvwrapper.ErrKeyNotFound && hasDefault:
+		s = &kvwrapper.KeyValue{Key: key, Value: def}
+	case err == kvwrapper.ErrKeyNotFound:
+		return nil
+	case err != nil:
+		return &FieldError{Field: name, Key: key, Err: err}
+	}
+	if err := setValue(v, s.Value); err != nil {
+		return &FieldError{Field: name, Key: key, Err: err}
+	}
+	return nil
+}
+
+// loadMap loads the keys right below key into v, a map keyed by string
+func (l Loader) loadMap(v reflect.Value, key string, name string, required bool) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return &FieldError{Field: name, Key: key, Err: fmt.Errorf("unsupported type %s", v.Type())}
+	}
+	kvs, err := l.KV.GetList(key, false)
+	switch {
+	case err == kvwrapper.ErrKeyNotFound && required:
+		return &FieldError{Field: name, Key: key, Err: ErrMissingKey}
+	case err == kvwrapper.ErrKeyNotFound:
+		return nil
+	case err != nil:
+		return &FieldError{Field: name, Key: key, Err: err}
+	}
+
+	elemType := v.Type().Elem()
+	m := reflect.MakeMap(v.Type())
+	for _, kv := range kvs {
+		// stores without directories list every key below key
+		if path.Dir("/"+strings.Trim(kv.Key, "/")) != "/"+strings.Trim(key, "/") {
+			continue
+		}
+		base := path.Base(kv.Key)
+		elem := reflect.New(elemType).Elem()
+		if kv.HasChildren {
+			if elemType.Kind() != reflect.Struct {
+				continue
+			}
+			if err := l.loadStruct(elem, key+"/"+base, name+"["+base+"]"); err != nil {
+				return err
+			}
+		} else if err := setValue(elem, kv.Value); err != nil {
+			return &FieldError{Field: name + "[" + base + "]", Key: kv.Key, Err: err}
+		}
+		m.SetMapIndex(reflect.ValueOf(base).Convert(v.Type().Key()), elem)
+	}
+	v.Set(m)
+	return nil
+}
+
+// setValue converts s to the type of v
+func setValue(v reflect.Value, s string) error {
+	if reflect.PtrTo(v.Type()).Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		slice := reflect.MakeSlice(v.Type(), 0, 0)
+		if s != "" {
+			for _, elem := range strings.Split(s, ",") {
+				e := reflect.New(v.Type().Elem()).Elem()
+				if err := setValue(e, strings.TrimSpace(elem)); err != nil {
+					return err
+				}
+				slice = reflect.Append(slice, e)
+			}
+		}
+		v.Set(slice)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Watcher keeps a configuration up to date with the KV store. Every change loads a new struct,
+// so the structs handed out are never modified.
+type Watcher struct {
+	loader  Loader
+	typ     reflect.Type
+	cancel  context.CancelFunc
+	mutex   sync.Mutex
+	current interface{}
+	subs    []func(old, new interface{})
+}
+
+// Watch loads the configuration into v, a pointer to a struct, and keeps loading it again as the
+// keys below Prefix change, until the Watcher is closed. The changes are watched when KV supports
+// it, and polled every PollInterval otherwise. A configuration that fails to load is logged and
+// ignored, the previous one staying current.
+func (l Loader) Watch(v interface{}) (*Watcher, error) {
+	if err := l.Load(v); err != nil {
+		return nil, err
+	}
+	if l.PollInterval <= 0 {
+		l.PollInterval = DefaultPollInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Watcher{
+		loader:  l,
+		typ:     reflect.TypeOf(v).Elem(),
+		cancel:  cancel,
+		current: v,
+	}
+
+	// the empty prefix watches the whole keyspace, the keys without a leading "/" included
+	events, err := l.KV.Watch(ctx, l.Prefix, true)
+	if err != nil {
+		log.Warn("Could not watch the configuration, polling it instead.", "prefix", l.Prefix, "err", err)
+		go w.poll(ctx)
+	} else {
+		go w.watch(ctx, events)
+	}
+	return w, nil
+}
+
+// Config returns the current configuration, a pointer to the type of struct given to Watch
+func (w *Watcher) Config() interface{} {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.current
+}
+
+// Subscribe calls fn with the previous and the new configuration whenever it changes. fn is
+// called from the goroutine of the Watcher, one change at a time.
+func (w *Watcher) Subscribe(fn func(old, new interface{})) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.subs = append(w.subs, fn)
+}
+
+// Close stops keeping the configuration up to date
+func (w *Watcher) Close() {
+	w.cancel()
+}
+
+// watch reloads the configuration on every event, until the watch ends. A watch that ends on
+// its own is replaced by polling.
+func (w *Watcher) watch(ctx context.Context, events <-chan *kvwrapper.WatchEvent) {
+	for range events {
+		w.reload()
+	}
+	if ctx.Err() == nil {
+		log.Warn("Lost the watch on the configuration, polling it instead.", "prefix", w.loader.Prefix)
+		w.reload()
+		w.poll(ctx)
+	}
+}
+
+func (w *Watcher) poll(ctx context.Context) {
+	ticker := time.NewTicker(w.loader.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.reload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload loads the configuration, and notifies the subscribers if it changed
+func (w *Watcher) reload() {
+	fresh := reflect.New(w.typ).Interface()
+	if err := w.loader.Load(fresh); err != nil {
+		log.Warn("Could not reload the configuration, keeping the current one.", "prefix", w.loader.Prefix, "err", err)
+		return
+	}
+
+	w.mutex.Lock()
+	old := w.current
+	if reflect.DeepEqual(old, fresh) {
+		w.mutex.Unlock()
+		return
+	}
+	w.current = fresh
+	subs := append([]func(old, new interface{}){}, w.subs...)
+	w.mutex.Unlock()
+
+	for _, fn := range subs {
+		fn(old, fresh)
+	}
+}
@@ -0,0 +1,174 @@
+package config_test
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	. "github.com/behance/go-common/kvwrapper/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type unwatchable struct {
+	kvwrapper.KVFaker
+}
+
+func (u unwatchable) Watch(ctx context.Context, key string, recursive bool) (<-chan *kvwrapper.WatchEvent, error) {
+	return nil, kvwrapper.ErrNotSupported
+}
+
+type db struct {
+	User string `kv:"user" default:"app"`
+	Port uint16 `kv:"port"`
+}
+
+type serviceConfig struct {
+	Host     string            `kv:"host,required"`
+	Port     int               `kv:"port" default:"8080"`
+	Debug    bool              `kv:"debug"`
+	Ratio    float64           `kv:"ratio"`
+	Timeout  time.Duration     `kv:"timeout" default:"5s"`
+	Tags     []string          `kv:"tags"`
+	IP       net.IP            `kv:"ip"`
+	DB       db                `kv:"db"`
+	Limits   map[string]int    `kv:"limits"`
+	Replicas map[string]db     `kv:"replicas"`
+	Name     string            // read from "name"
+	Ignored  string            `kv:"-"`
+	Labels   map[string]string `kv:"labels,required"`
+}
+
+var _ = Describe("Config", func() {
+	var (
+		kv kvwrapper.KVWrapper
+	)
+
+	BeforeEach(func() {
+		kv = kvwrapper.NewKVWrapper(nil, kvwrapper.KVFaker{})
+		kv.Set("/app/host", "example.com", 0)
+		kv.Set("/app/debug", "true", 0)
+		kv.Set("/app/ratio", "0.5", 0)
+		kv.Set("/app/tags", "a, b,c", 0)
+		kv.Set("/app/ip", "10.0.0.1", 0)
+		kv.Set("/app/db/port", "5432", 0)
+		kv.Set("/app/limits/reads", "10", 0)
+		kv.Set("/app/limits/writes", "5", 0)
+		kv.Set("/app/replicas/east/port", "5433", 0)
+		kv.Set("/app/name", "service", 0)
+		kv.Set("/app/ignored", "value", 0)
+		kv.Set("/app/labels/team", "core", 0)
+	})
+
+	It("Loads a struct from a subtree", func() {
+		var c serviceConfig
+		Expect(Load(kv, "/app", &c)).To(BeNil())
+		Expect(c).To(Equal(serviceConfig{
+			Host:     "example.com",
+			Port:     8080,
+			Debug:    true,
+			Ratio:    0.5,
+			Timeout:  5 * time.Second,
+			Tags:     []string{"a", "b", "c"},
+			IP:       net.ParseIP("10.0.0.1"),
+			DB:       db{User: "app", Port: 5432},
+			Limits:   map[string]int{"reads": 10, "writes": 5},
+			Replicas: map[string]db{"east": {User: "app", Port: 5433}},
+			Name:     "service",
+			Labels:   map[string]string{"team": "core"},
+		}))
+	})
+
+	It("Fails on missing required keys", func() {
+		kv.Delete("/app/host")
+
+		var c serviceConfig
+		err := Load(kv, "/app", &c)
+		Expect(err).To(BeAssignableToTypeOf(&FieldError{}))
+		Expect(err.(*FieldError).Field).To(Equal("serviceConfig.Host"))
+		Expect(err.(*FieldError).Key).To(Equal("/app/host"))
+		Expect(err.(*FieldError).Err).To(Equal(ErrMissingKey))
+
+		kv.Set("/app/host", "example.com", 0)
+		kv.DeleteList("/app/labels")
+		err = Load(kv, "/app", &c)
+		Expect(err.(*FieldError).Err).To(Equal(ErrMissingKey))
+	})
+
+	It("Names the field whose value cannot be converted", func() {
+		kv.Set("/app/db/port", "not a port", 0)
+
+		var c serviceConfig
+		err := Load(kv, "/app", &c)
+		Expect(err).To(BeAssignableToTypeOf(&FieldError{}))
+		Expect(err.(*FieldError).Field).To(Equal("serviceConfig.DB.Port"))
+		Expect(err.Error()).To(ContainSubstring("/app/db/port"))
+	})
+
+	It("Needs a pointer to a struct", func() {
+		var c serviceConfig
+		Expect(Load(kv, "/app", c)).NotTo(BeNil())
+	})
+
+	Describe("Watcher", func() {
+		It("Keeps the configuration up to date", func() {
+			var c serviceConfig
+			w, err := Loader{KV: kv, Prefix: "/app"}.Watch(&c)
+			Expect(err).To(BeNil())
+			defer w.Close()
+			Expect(w.Config()).To(Equal(&c))
+
+			changes := make(chan [2]*serviceConfig, 10)
+			w.Subscribe(func(old, new interface{}) {
+				changes <- [2]*serviceConfig{old.(*serviceConfig), new.(*serviceConfig)}
+			})
+
+			kv.Set("/app/port", "9090", 0)
+			var change [2]*serviceConfig
+			Eventually(changes).Should(Receive(&change))
+			Expect(change[0].Port).To(Equal(8080))
+			Expect(change[1].Port).To(Equal(9090))
+			Expect(w.Config()).To(Equal(change[1]))
+			Expect(c.Port).To(Equal(8080))
+		})
+
+		It("Keeps the current configuration when the new one fails to load", func() {
+			var c serviceConfig
+			w, err := Loader{KV: kv, Prefix: "/app"}.Watch(&c)
+			Expect(err).To(BeNil())
+			defer w.Close()
+
+			changes := make(chan interface{}, 10)
+			w.Subscribe(func(old, new interface{}) { changes <- new })
+
+			kv.Delete("/app/host")
+			Consistently(changes, 100*time.Millisecond).ShouldNot(Receive())
+			Expect(w.Config().(*serviceConfig).Host).To(Equal("example.com"))
+
+			kv.Set("/app/host", "other.example.com", 0)
+			Eventually(changes).Should(Receive())
+			Expect(w.Config().(*serviceConfig).Host).To(Equal("other.example.com"))
+		})
+
+		It("Polls the stores that cannot be watched", func() {
+			faker := kv.(kvwrapper.KVFaker)
+			var c serviceConfig
+			w, err := Loader{KV: unwatchable{faker}, Prefix: "/app", PollInterval: 10 * time.Millisecond}.Watch(&c)
+			Expect(err).To(BeNil())
+			defer w.Close()
+
+			kv.Set("/app/debug", "false", 0)
+			Eventually(func() bool { return w.Config().(*serviceConfig).Debug }).Should(BeFalse())
+		})
+
+		It("Fails when the configuration cannot be loaded", func() {
+			kv.Delete("/app/host")
+
+			var c serviceConfig
+			_, err := Loader{KV: kv, Prefix: "/app"}.Watch(&c)
+			Expect(err).NotTo(BeNil())
+		})
+	})
+})
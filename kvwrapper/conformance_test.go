@@ -0,0 +1,20 @@
+package kvwrapper_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/behance/go-common/kvwrapper"
+	"github.com/behance/go-common/kvwrapper/kvwrappertest"
+)
+
+func TestConformance(t *testing.T) {
+	kvwrappertest.Suite{
+		New: func(t *testing.T) KVWrapper {
+			return NewKVWrapper(nil, KVFaker{})
+		},
+		Advance: func(kv KVWrapper, d time.Duration) {
+			kv.(KVFaker).Advance(d)
+		},
+	}.Run(t)
+}
@@ -0,0 +1,56 @@
+package kvwrapper_test
+
+import (
+	. "github.com/behance/go-common/kvwrapper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// unreachable is a wrapper that cannot be initialized, and cannot tell why
+type unreachable struct {
+	KVFaker
+}
+
+func (u unreachable) NewKVWrapper(servers []string, username, password string) KVWrapper {
+	return nil
+}
+
+// refusing is a wrapper whose credentials are always refused
+type refusing struct {
+	KVFaker
+}
+
+func (r refusing) Connect(servers []string, username, password string) (KVWrapper, error) {
+	return nil, ErrUnauthorized
+}
+
+var _ = Describe("Connect", func() {
+	It("Initializes wrappers", func() {
+		kv, err := Connect(nil, KVFaker{}, "", "")
+		Expect(err).To(BeNil())
+		Expect(kv.Set("/key", "val", 0)).To(BeNil())
+	})
+
+	It("Fails with ErrCouldNotConnect on the wrappers that cannot tell why they failed", func() {
+		_, ok := KVWrapper(unreachable{}).(ConnectingKVWrapper)
+		Expect(ok).To(BeFalse())
+
+		_, err := Connect(nil, unreachable{}, "", "")
+		Expect(err).To(Equal(ErrCouldNotConnect))
+	})
+
+	It("Returns the errors of the wrappers that can tell why they failed", func() {
+		_, err := Connect(nil, refusing{}, "user", "wrong")
+		Expect(err).To(Equal(ErrUnauthorized))
+	})
+
+	It("Returns the errors of the backends of namespaces", func() {
+		_, err := Connect(nil, NamespacedWrapper{Backend: refusing{}, Prefix: "/app"}, "user", "wrong")
+		Expect(err).To(Equal(ErrUnauthorized))
+
+		kv, err := Connect(nil, NamespacedWrapper{Backend: KVFaker{}, Prefix: "/app"}, "", "")
+		Expect(err).To(BeNil())
+		Expect(kv).To(BeAssignableToTypeOf(NamespacedWrapper{}))
+	})
+})
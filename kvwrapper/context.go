@@ -0,0 +1,134 @@
+package kvwrapper
+
+import (
+	"context"
+	"time"
+)
+
+// ContextKVWrapper is implemented by the KVWrappers whose operations can be bound to a context,
+// so callers can propagate their deadlines and cancellation down to the KV store. Their
+// transactions are bound to a context by Txn.CommitContext.
+type ContextKVWrapper interface {
+	KVWrapper
+	SetContext(ctx context.Context, key string, val string, ttl uint64) error
+	GetValContext(ctx context.Context, key string) (*KeyValue, error)
+	GetListContext(ctx context.Context, key string, sort bool) ([]*KeyValue, error)
+	CreateContext(ctx context.Context, key string, val string, ttl uint64) (int64, error)
+	CompareAndSwapContext(ctx context.Context, key string, val string, prevVal string, ttl uint64) (int64, error)
+	CompareAndSwapRevisionContext(ctx context.Context, key string, val string, prevRev int64, ttl uint64) (int64, error)
+	CompareAndDeleteContext(ctx context.Context, key string, prevVal string) error
+	DeleteContext(ctx context.Context, key string) error
+	DeleteListContext(ctx context.Context, key string) (int64, error)
+}
+
+// TimeoutContext returns the context bounding an operation called without one:
+// it expires after timeout, or DefaultTimeout if timeout is 0.
+func TimeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// The functions below call the operation bound to ctx on the wrappers implementing
+// ContextKVWrapper. The other wrappers are called without a context, once checked that ctx is
+// not done, so that decorators can hand the contexts they are given down to any wrapper.
+
+// SetContext sets key = val on kv, bound to ctx
+func SetContext(ctx context.Context, kv KVWrapper, key string, val string, ttl uint64) error {
+	if c, ok := kv.(ContextKVWrapper); ok {
+		return c.SetContext(ctx, key, val, ttl)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return kv.Set(key, val, ttl)
+}
+
+// GetValContext returns the KeyValue at key on kv, bound to ctx
+func GetValContext(ctx context.Context, kv KVWrapper, key string) (*KeyValue, error) {
+	if c, ok := kv.(ContextKVWrapper); ok {
+		return c.GetValContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return kv.GetVal(key)
+}
+
+// GetListContext returns the KeyValues below key on kv, bound to ctx
+func GetListContext(ctx context.Context, kv KVWrapper, key string, sort bool) ([]*KeyValue, error) {
+	if c, ok := kv.(ContextKVWrapper); ok {
+		return c.GetListContext(ctx, key, sort)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return kv.GetList(key, sort)
+}
+
+// CreateContext creates key = val on kv, bound to ctx
+func CreateContext(ctx context.Context, kv KVWrapper, key string, val string, ttl uint64) (int64, error) {
+	if c, ok := kv.(ContextKVWrapper); ok {
+		return c.CreateContext(ctx, key, val, ttl)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return kv.Create(key, val, ttl)
+}
+
+// CompareAndSwapContext swaps the value of key on kv, bound to ctx
+func CompareAndSwapContext(ctx context.Context, kv KVWrapper, key string, val string, prevVal string, ttl uint64) (int64, error) {
+	if c, ok := kv.(ContextKVWrapper); ok {
+		return c.CompareAndSwapContext(ctx, key, val, prevVal, ttl)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return kv.CompareAndSwap(key, val, prevVal, ttl)
+}
+
+// CompareAndSwapRevisionContext swaps the value of key on kv by revision, bound to ctx
+func CompareAndSwapRevisionContext(ctx context.Context, kv KVWrapper, key string, val string, prevRev int64, ttl uint64) (int64, error) {
+	if c, ok := kv.(ContextKVWrapper); ok {
+		return c.CompareAndSwapRevisionContext(ctx, key, val, prevRev, ttl)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return kv.CompareAndSwapRevision(key, val, prevRev, ttl)
+}
+
+// CompareAndDeleteContext removes key from kv by value, bound to ctx
+func CompareAndDeleteContext(ctx context.Context, kv KVWrapper, key string, prevVal string) error {
+	if c, ok := kv.(ContextKVWrapper); ok {
+		return c.CompareAndDeleteContext(ctx, key, prevVal)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return kv.CompareAndDelete(key, prevVal)
+}
+
+// DeleteContext removes the single key from kv, bound to ctx
+func DeleteContext(ctx context.Context, kv KVWrapper, key string) error {
+	if c, ok := kv.(ContextKVWrapper); ok {
+		return c.DeleteContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return kv.Delete(key)
+}
+
+// DeleteListContext removes key and the keys below it from kv, bound to ctx
+func DeleteListContext(ctx context.Context, kv KVWrapper, key string) (int64, error) {
+	if c, ok := kv.(ContextKVWrapper); ok {
+		return c.DeleteListContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return kv.DeleteList(key)
+}
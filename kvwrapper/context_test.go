@@ -0,0 +1,87 @@
+package kvwrapper_test
+
+import (
+	"context"
+
+	. "github.com/behance/go-common/kvwrapper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Contexts", func() {
+	var (
+		kv       KVWrapper
+		canceled context.Context
+	)
+
+	BeforeEach(func() {
+		kv = NewKVWrapper(nil, KVFaker{})
+		kv.Set("/parent/child1", "child1val", 0)
+
+		var cancel context.CancelFunc
+		canceled, cancel = context.WithCancel(context.Background())
+		cancel()
+	})
+
+	It("Calls the wrappers that cannot be bound to contexts while the context is live", func() {
+		plain := listOnly{kv}
+		_, ok := KVWrapper(plain).(ContextKVWrapper)
+		Expect(ok).To(BeFalse())
+
+		ctx := context.Background()
+		Expect(SetContext(ctx, plain, "/parent/child2", "child2val", 0)).To(BeNil())
+		s, err := GetValContext(ctx, plain, "/parent/child2")
+		Expect(err).To(BeNil())
+		Expect(s.Value).To(Equal("child2val"))
+
+		_, err = CompareAndSwapContext(ctx, plain, "/parent/child2", "newval", "child2val", 0)
+		Expect(err).To(BeNil())
+		Expect(CompareAndDeleteContext(ctx, plain, "/parent/child2", "newval")).To(BeNil())
+		kvs, err := GetListContext(ctx, plain, "/parent", false)
+		Expect(err).To(BeNil())
+		Expect(kvs).To(HaveLen(1))
+	})
+
+	It("Fails with the error of the context once it is done", func() {
+		for _, w := range []KVWrapper{kv, listOnly{kv}} {
+			Expect(SetContext(canceled, w, "/parent/child1", "newval", 0)).To(MatchError(context.Canceled))
+			_, err := CreateContext(canceled, w, "/parent/child2", "child2val", 0)
+			Expect(err).To(MatchError(context.Canceled))
+			_, err = CompareAndSwapContext(canceled, w, "/parent/child1", "newval", "child1val", 0)
+			Expect(err).To(MatchError(context.Canceled))
+			_, err = CompareAndSwapRevisionContext(canceled, w, "/parent/child1", "newval", 1, 0)
+			Expect(err).To(MatchError(context.Canceled))
+			Expect(CompareAndDeleteContext(canceled, w, "/parent/child1", "child1val")).To(MatchError(context.Canceled))
+			Expect(DeleteContext(canceled, w, "/parent/child1")).To(MatchError(context.Canceled))
+			_, err = DeleteListContext(canceled, w, "/parent")
+			Expect(err).To(MatchError(context.Canceled))
+			_, err = GetValContext(canceled, w, "/parent/child1")
+			Expect(err).To(MatchError(context.Canceled))
+		}
+
+		kvs, err := kv.GetList("/parent", false)
+		Expect(err).To(BeNil())
+		Expect(kvs).To(HaveLen(1))
+		Expect(kvs[0].Value).To(Equal("child1val"))
+	})
+
+	It("Commits transactions bound to contexts", func() {
+		_, err := kv.Txn().Then(SetOp("/parent/child1", "newval", 0)).CommitContext(canceled)
+		Expect(err).To(MatchError(context.Canceled))
+		s, _ := kv.GetVal("/parent/child1")
+		Expect(s.Value).To(Equal("child1val"))
+
+		var bound context.Context
+		txn := NewContextTxn(nil, func(ctx context.Context, compares []Compare, thenOps []Op, elseOps []Op) (*TxnResponse, error) {
+			bound = ctx
+			return kv.Txn().If(compares...).Then(thenOps...).Else(elseOps...).Commit()
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		r, err := txn.Then(SetOp("/parent/child1", "newval", 0)).CommitContext(ctx)
+		Expect(err).To(BeNil())
+		Expect(r.Succeeded).To(BeTrue())
+		Expect(bound).To(Equal(ctx))
+	})
+})
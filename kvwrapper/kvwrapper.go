@@ -1,17 +1,39 @@
 package kvwrapper
 
 import (
+	"context"
 	"errors"
 	"strconv"
-	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/behance/go-common/internal/kvtree"
 )
 
+// The errors of the KV stores. The wrappers map the errors of their clients onto these, so that
+// callers can tell them apart with == whatever the store. ErrTimeout is also returned when the
+// deadline of the context given to an operation passes, and the errors without an equivalent,
+// such as a context canceled by the caller, are returned as they are. ErrInvalidKey is returned for
+// the keys outside of a namespace, and by KVFaker and kvwrapper_file for a key below a key holding
+// a value, or a directory where a key holding a value is expected.
 var (
 	ErrKeyNotFound     = errors.New("Key not found")
 	ErrCouldNotConnect = errors.New("Could not connect to KV store")
+	ErrConflict        = errors.New("Key does not match the expected state")
+	ErrNotSupported    = errors.New("Operation not supported by KV store")
+	ErrInvalidKey      = errors.New("Key is invalid in the KV store")
+	ErrUnauthorized    = errors.New("Credentials refused by KV store")
+	ErrTimeout         = errors.New("KV store did not answer in time")
 )
 
+// DefaultTimeout bounds the operations called without a context on the wrappers
+// that were not configured with a timeout of their own
+var DefaultTimeout = 5 * time.Second
+
+// WatchRetryDelay is how long a Watch waits before re-establishing a broken watch
+// with the KV store. The watch resumes from the last revision it delivered.
+var WatchRetryDelay = time.Second
+
 // KVWrapper is an interface that any Key Value Store (etcd, consul) needs to implement
 // when used by flight director.
 type KVWrapper interface {
@@ -19,19 +41,92 @@ type KVWrapper interface {
 	Set(key string, val string, ttl uint64) error
 	GetVal(key string) (*KeyValue, error)
 	GetList(key string, sort bool) ([]*KeyValue, error)
+	// Create sets key = val only if key does not exist yet, returning ErrConflict otherwise.
+	// Conditional writes return the revision at which the write happened.
+	Create(key string, val string, ttl uint64) (int64, error)
+	// CompareAndSwap sets key = val only if the current value of key is prevVal. Like the other
+	// compares, it fails with ErrKeyNotFound if key does not exist, even if prevVal is empty.
+	CompareAndSwap(key string, val string, prevVal string, ttl uint64) (int64, error)
+	// CompareAndSwapRevision sets key = val only if key was last modified at revision prevRev
+	CompareAndSwapRevision(key string, val string, prevRev int64, ttl uint64) (int64, error)
+	// CompareAndDelete removes key only if its current value is prevVal
+	CompareAndDelete(key string, prevVal string) error
+	// Txn starts a transaction applying several operations atomically.
+	// Stores that cannot do so return ErrNotSupported when it is committed.
+	Txn() *Txn
+	// Delete removes a single key, returning ErrKeyNotFound if it does not exist
+	Delete(key string) error
+	// DeleteList removes key and every key below it, returning how many keys were removed
+	// or ErrKeyNotFound if there was nothing to remove
+	DeleteList(key string) (int64, error)
+	// Watch streams the changes made to key (or to every key below it, if recursive is set)
+	// until ctx is done, at which point the returned channel is closed. The channel is also
+	// closed when the store can no longer deliver every change, such as when the history a broken
+	// watch would resume from is gone, so callers should read the keys again when that happens.
+	Watch(ctx context.Context, key string, recursive bool) (<-chan *WatchEvent, error)
 }
 
-// KeyValue entity represents the unit returned by queries to a Key Value store.
+// KeyValue entity represents the unit returned by queries to a Key Value store: a key, with its
+// value and what the store reports about it. The metadata a store does not track is left zero.
 type KeyValue struct {
 	Key         string
 	Value       string
 	HasChildren bool
+	// TTL is the number of seconds left before the key expires, and Expiration when it does.
+	// Both are zero for keys that do not expire.
+	TTL        int64
+	Expiration time.Time
+	// CreateRevision is the revision of the store the key was created at, and ModRevision the
+	// one it was last modified at, as expected by CompareAndSwapRevision
+	CreateRevision int64
+	ModRevision    int64
+	// Version counts the writes to the key since it was created, starting at 1
+	Version int64
+	// LeaseID is the etcd-v3 lease the key is attached to
+	LeaseID int64
 }
 
 func (kv *KeyValue) String() string {
 	return kv.Key + " : " + kv.Value + " : " + strconv.FormatBool(kv.HasChildren)
 }
 
+// EventType is the kind of change reported by a WatchEvent
+type EventType int
+
+const (
+	// EventPut is sent when a key is created or its value is changed
+	EventPut EventType = iota
+	// EventDelete is sent when a key is removed
+	EventDelete
+	// EventExpire is sent when a key is removed because its ttl ran out
+	EventExpire
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	}
+	return "unknown"
+}
+
+// WatchEvent entity represents a single change delivered by Watch.
+// Value is empty for delete and expire events.
+type WatchEvent struct {
+	Type     EventType
+	Key      string
+	Value    string
+	Revision int64
+}
+
+func (ev *WatchEvent) String() string {
+	return ev.Type.String() + " : " + ev.Key + " : " + ev.Value + " : " + strconv.FormatInt(ev.Revision, 10)
+}
+
 // NewKVWrapper takes a list of server urls, username and password and an empty specifc wrapper (like kvwrapper_etcd)
 // and returns an initialized instance of KVWrapper
 func NewKVWrapperWithAuth(servers []string, wrapper KVWrapper, username, password string) KVWrapper {
@@ -44,75 +139,59 @@ func NewKVWrapper(servers []string, wrapper KVWrapper) KVWrapper {
 	return kvw
 }
 
-type KVFaker struct {
-	c     map[string][]*KeyValue
-	mutex *sync.Mutex
+// ConnectingKVWrapper is implemented by the wrappers that can tell why they could not be
+// initialized
+type ConnectingKVWrapper interface {
+	KVWrapper
+	// Connect is NewKVWrapper, returning an error such as ErrCouldNotConnect or ErrUnauthorized
+	// instead of nil when it fails
+	Connect(servers []string, username, password string) (KVWrapper, error)
 }
 
-func (f KVFaker) NewKVWrapper(servers []string, username, password string) KVWrapper {
-	f.c = make(map[string][]*KeyValue)
-	f.mutex = &sync.Mutex{}
-	return f
-}
-
-func (f KVFaker) Set(key string, val string, ttl uint64) error {
-	f.mutex.Lock()
-	defer f.mutex.Unlock()
-
-	keys := strings.Split(key, "/")
-	lastKey := ""
-	var newKey string
-	for i := 0; i < len(keys); i++ {
-		newKey = newKey + keys[i]
-		if _, ok := f.c[newKey]; !ok {
-			f.c[newKey] = make([]*KeyValue, 0)
-		}
-		kv := KeyValue{
-			Key:         newKey,
-			Value:       val,
-			HasChildren: false,
-		}
-		if i < len(keys)-1 {
-			//kv.Value = ""
-			kv.HasChildren = true
-			if lastKey != "" {
-				f.c[lastKey] = append(f.c[lastKey], &kv)
-			}
-		} else {
-			kvlast := KeyValue{
-				Key:         newKey,
-				Value:       val,
-				HasChildren: true,
-			}
-			f.c[lastKey] = append(f.c[lastKey], &kvlast)
-			f.c[newKey] = append(f.c[newKey], &kv)
-		}
-		newKey += "/"
-		lastKey = newKey
-
+// Connect initializes wrapper with servers, username and password, like NewKVWrapperWithAuth.
+// Wrappers that do not implement ConnectingKVWrapper fail with ErrCouldNotConnect when they
+// cannot be initialized.
+func Connect(servers []string, wrapper KVWrapper, username, password string) (KVWrapper, error) {
+	if c, ok := wrapper.(ConnectingKVWrapper); ok {
+		return c.Connect(servers, username, password)
 	}
-	//log.Warn(f.c)
-	return nil
+	kvw := wrapper.NewKVWrapper(servers, username, password)
+	if kvw == nil {
+		return nil, ErrCouldNotConnect
+	}
+	return kvw, nil
 }
 
-func (f KVFaker) GetVal(key string) (*KeyValue, error) {
-	f.mutex.Lock()
-	defer f.mutex.Unlock()
+// KVFaker is an in-memory KVWrapper for tests, with the semantics of kvwrapper_etcd (v2): keys
+// are paths, the directories above a key are created along with it and show up with HasChildren
+// set, Delete refuses directories and DeleteList removes them with everything below them.
+// Keys with a ttl expire on the clock of the faker, which stands still unless moved with Advance,
+// or follows Now when it is set. Expired keys are removed by the next operation, or by Advance.
+type KVFaker struct {
+	// Now is the clock the ttls run on, if set
+	Now func() time.Time
 
-	if kv, ok := f.c[key]; ok {
-		return kv[len(kv)-1], nil
-	} else {
-		return nil, ErrKeyNotFound
-	}
+	StoreWrapper
+	// offset is the time.Duration Advance moved the clock by
+	offset *int64
 }
 
-func (f KVFaker) GetList(key string, sort bool) ([]*KeyValue, error) {
-	f.mutex.Lock()
-	defer f.mutex.Unlock()
+func (f KVFaker) NewKVWrapper(servers []string, username, password string) KVWrapper {
+	f.offset = new(int64)
 
-	if _, ok := f.c[key]; !ok {
-		return nil, ErrKeyNotFound
+	now := f.Now
+	if now == nil {
+		start := time.Now()
+		now = func() time.Time { return start }
 	}
+	f.StoreWrapper = NewStoreWrapper(kvtree.NewStore(kvtree.New(func() time.Time {
+		return now().Add(time.Duration(atomic.LoadInt64(f.offset)))
+	}), nil))
+	return f
+}
 
-	return f.c[key], nil
+// Advance moves the clock of the faker forward by d, expiring the keys whose ttl ran out
+func (f KVFaker) Advance(d time.Duration) {
+	atomic.AddInt64(f.offset, int64(d))
+	f.store.Expire()
 }
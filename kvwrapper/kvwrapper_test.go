@@ -1,6 +1,9 @@
 package kvwrapper_test
 
 import (
+	"context"
+	"time"
+
 	. "github.com/behance/go-common/kvwrapper"
 	log "github.com/behance/go-common/log"
 
@@ -8,6 +11,11 @@ import (
 	. "github.com/onsi/gomega"
 )
 
+// plain drops the metadata of kv, which depends on the history of the store
+func plain(kv *KeyValue) KeyValue {
+	return KeyValue{Key: kv.Key, Value: kv.Value, HasChildren: kv.HasChildren}
+}
+
 var _ = Describe("Kvwrapper", func() {
 	var (
 		kv KVWrapper
@@ -37,6 +45,27 @@ var _ = Describe("Kvwrapper", func() {
 			Expect(err).To(BeNil())
 			Expect(len(l)).To(Equal(2))
 		})
+		It("Lists the immediate children of a key", func() {
+			kv.Set("parent/sub/child3", "child3val", 0)
+			kv.Set("parent/a", "aval", 0)
+
+			l, err := kv.GetList("parent", true)
+			Expect(err).To(BeNil())
+			Expect(l).To(HaveLen(4))
+			Expect(plain(l[0])).To(Equal(KeyValue{Key: "/parent/a", Value: "aval"}))
+			Expect(plain(l[1])).To(Equal(KeyValue{Key: "/parent/child1", Value: "child1val"}))
+			Expect(plain(l[2])).To(Equal(KeyValue{Key: "/parent/child2", Value: "child2val"}))
+			Expect(plain(l[3])).To(Equal(KeyValue{Key: "/parent/sub", HasChildren: true}))
+
+			l, err = kv.GetList("parent", false)
+			Expect(err).To(BeNil())
+			Expect(l[0].Key).To(Equal("/parent/child1"))
+			Expect(l[3].Key).To(Equal("/parent/a"))
+
+			l, err = kv.GetList("parent/child1", false)
+			Expect(err).To(BeNil())
+			Expect(l).To(BeEmpty())
+		})
 	})
 
 	Describe("Set Wrapper", func() {
@@ -50,6 +79,299 @@ var _ = Describe("Kvwrapper", func() {
 			s, err = kv.GetVal("a/test/path")
 			Expect(s.Value).To(Equal("value"))
 		})
+		It("Overwrites values", func() {
+			kv.Set("parent/child1", "newval", 0)
+			kv.Set("parent/child1", "newerval", 0)
+
+			s, err := kv.GetVal("parent/child1")
+			Expect(err).To(BeNil())
+			Expect(s.Value).To(Equal("newerval"))
+
+			l, err := kv.GetList("parent/", false)
+			Expect(err).To(BeNil())
+			Expect(l).To(HaveLen(2))
+		})
+		It("Does not set keys below a value, or over a directory", func() {
+			Expect(kv.Set("parent/child1/below", "value", 0)).To(MatchError(ErrInvalidKey))
+			Expect(kv.Set("parent", "value", 0)).To(MatchError(ErrInvalidKey))
+		})
+		It("Expires keys as the clock moves", func() {
+			kv.Set("parent/child1", "newval", 10)
+
+			kv.(KVFaker).Advance(9 * time.Second)
+			s, err := kv.GetVal("parent/child1")
+			Expect(err).To(BeNil())
+			Expect(s.Value).To(Equal("newval"))
+
+			kv.(KVFaker).Advance(time.Second)
+			_, err = kv.GetVal("parent/child1")
+			Expect(err).To(MatchError(ErrKeyNotFound))
+
+			kv.Set("parent/child2", "newval", 10)
+			kv.Set("parent/child2", "newerval", 0)
+			kv.(KVFaker).Advance(time.Minute)
+			_, err = kv.GetVal("parent/child2")
+			Expect(err).To(BeNil())
+		})
+		It("Reports the metadata of keys", func() {
+			now := time.Now()
+			kv = NewKVWrapper(nil, KVFaker{Now: func() time.Time { return now }})
+			kv.Set("parent/child1", "child1val", 0)
+			kv.Set("parent/child1", "newval", 10)
+			kv.(KVFaker).Advance(3500 * time.Millisecond)
+
+			s, err := kv.GetVal("parent/child1")
+			Expect(err).To(BeNil())
+			Expect(s.TTL).To(Equal(int64(7)))
+			Expect(s.Expiration).To(Equal(now.Add(10 * time.Second)))
+			Expect(s.CreateRevision).To(Equal(int64(1)))
+			Expect(s.ModRevision).To(Equal(int64(2)))
+			Expect(s.Version).To(Equal(int64(2)))
+		})
+		It("Follows the clock it is given", func() {
+			now := time.Now()
+			kv = NewKVWrapper(nil, KVFaker{Now: func() time.Time { return now }})
+			kv.Set("parent/child1", "child1val", 5)
+
+			now = now.Add(5 * time.Second)
+			_, err := kv.GetVal("parent/child1")
+			Expect(err).To(MatchError(ErrKeyNotFound))
+		})
+	})
+
+	Describe("Conditional Set Wrapper", func() {
+		It("Creates keys only once", func() {
+			rev, err := kv.Create("parent/child3", "child3val", 0)
+			Expect(err).To(BeNil())
+			Expect(rev).To(BeNumerically(">", 0))
+
+			_, err = kv.Create("parent/child3", "other", 0)
+			Expect(err).To(MatchError(ErrConflict))
+
+			s, err := kv.GetVal("parent/child3")
+			Expect(s.Value).To(Equal("child3val"))
+		})
+		It("Swaps values that match", func() {
+			_, err := kv.CompareAndSwap("parent/child1", "newval", "child1val", 0)
+			Expect(err).To(BeNil())
+
+			_, err = kv.CompareAndSwap("parent/child1", "newerval", "child1val", 0)
+			Expect(err).To(MatchError(ErrConflict))
+
+			s, err := kv.GetVal("parent/child1")
+			Expect(s.Value).To(Equal("newval"))
+
+			_, err = kv.CompareAndSwap("xxxxxxxx", "newval", "child1val", 0)
+			Expect(err).To(MatchError(ErrKeyNotFound))
+		})
+		It("Swaps revisions that match", func() {
+			rev, err := kv.CompareAndSwap("parent/child1", "newval", "child1val", 0)
+			Expect(err).To(BeNil())
+
+			newRev, err := kv.CompareAndSwapRevision("parent/child1", "newerval", rev, 0)
+			Expect(err).To(BeNil())
+			Expect(newRev).To(BeNumerically(">", rev))
+
+			_, err = kv.CompareAndSwapRevision("parent/child1", "newestval", rev, 0)
+			Expect(err).To(MatchError(ErrConflict))
+		})
+		It("Deletes values that match", func() {
+			err := kv.CompareAndDelete("parent/child1", "xxxxxxxx")
+			Expect(err).To(MatchError(ErrConflict))
+
+			err = kv.CompareAndDelete("parent/child1", "child1val")
+			Expect(err).To(BeNil())
+
+			_, err = kv.GetVal("parent/child1")
+			Expect(err).To(MatchError(ErrKeyNotFound))
+		})
+	})
+
+	Describe("Txn Wrapper", func() {
+		It("Applies the Then operations when every compare holds", func() {
+			r, err := kv.Txn().
+				If(ValueEquals("parent/child1", "child1val"), KeyMissing("parent/child3")).
+				Then(SetOp("parent/child3", "child3val", 0), DeleteOp("parent/child2"), GetOp("parent/child1")).
+				Else(SetOp("parent/child4", "child4val", 0)).
+				Commit()
+			Expect(err).To(BeNil())
+			Expect(r.Succeeded).To(Equal(true))
+			Expect(len(r.Results)).To(Equal(3))
+			Expect(r.Results[1].Deleted).To(Equal(int64(1)))
+			Expect(r.Results[2].KeyValue.Value).To(Equal("child1val"))
+
+			s, err := kv.GetVal("parent/child3")
+			Expect(s.Value).To(Equal("child3val"))
+			_, err = kv.GetVal("parent/child2")
+			Expect(err).To(MatchError(ErrKeyNotFound))
+			_, err = kv.GetVal("parent/child4")
+			Expect(err).To(MatchError(ErrKeyNotFound))
+		})
+		It("Applies the Else operations when a compare fails", func() {
+			r, err := kv.Txn().
+				If(KeyExists("parent/child1"), ValueNotEquals("parent/child2", "child2val")).
+				Then(SetOp("parent/child3", "child3val", 0)).
+				Else(GetOp("parent/child2"), GetOp("xxxxxxxx")).
+				Commit()
+			Expect(err).To(BeNil())
+			Expect(r.Succeeded).To(Equal(false))
+			Expect(r.Results[0].KeyValue.Value).To(Equal("child2val"))
+			Expect(r.Results[1].KeyValue).To(BeNil())
+
+			_, err = kv.GetVal("parent/child3")
+			Expect(err).To(MatchError(ErrKeyNotFound))
+		})
+		It("Rolls back transactions that fail halfway", func() {
+			_, err := kv.Txn().Then(SetOp("a", "x", 0), SetOp("a/b", "y", 0)).Commit()
+			Expect(err).To(MatchError(ErrInvalidKey))
+			_, err = kv.GetVal("a")
+			Expect(err).To(MatchError(ErrKeyNotFound))
+		})
+		It("Never matches values of missing keys", func() {
+			r, err := kv.Txn().If(ValueNotEquals("xxxxxxxx", "value")).Commit()
+			Expect(err).To(BeNil())
+			Expect(r.Succeeded).To(Equal(false))
+		})
+	})
+
+	Describe("Delete Wrapper", func() {
+		It("Deletes a single key", func() {
+			err := kv.Delete("parent/child1")
+			Expect(err).To(BeNil())
+
+			s, err := kv.GetVal("parent/child1")
+			Expect(err).To(MatchError(ErrKeyNotFound))
+			Expect(s).To(BeNil())
+
+			l, err := kv.GetList("parent/", false)
+			Expect(err).To(BeNil())
+			Expect(len(l)).To(Equal(1))
+		})
+		It("Deletes every key below a prefix", func() {
+			n, err := kv.DeleteList("parent/")
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(int64(2)))
+
+			_, err = kv.GetVal("parent/child2")
+			Expect(err).To(MatchError(ErrKeyNotFound))
+		})
+		It("Deletes directories with DeleteList only", func() {
+			kv.Set("parent/sub/child3", "child3val", 0)
+			Expect(kv.Delete("parent/sub")).To(MatchError(ErrInvalidKey))
+
+			n, err := kv.DeleteList("parent")
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(int64(3)))
+			_, err = kv.GetVal("parent")
+			Expect(err).To(MatchError(ErrKeyNotFound))
+		})
+		It("Handles invalid keys", func() {
+			err := kv.Delete("xxxxxxxx")
+			Expect(err).To(MatchError(ErrKeyNotFound))
+
+			n, err := kv.DeleteList("xxxxxxxx/")
+			Expect(err).To(MatchError(ErrKeyNotFound))
+			Expect(n).To(Equal(int64(0)))
+		})
+	})
+
+	Describe("Context Wrapper", func() {
+		It("Implements ContextKVWrapper", func() {
+			_, ok := kv.(ContextKVWrapper)
+			Expect(ok).To(Equal(true))
+		})
+		It("Honors cancelled contexts", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			ckv := kv.(ContextKVWrapper)
+
+			s, err := ckv.GetValContext(ctx, "parent/child1")
+			Expect(err).To(BeNil())
+			Expect(s.Value).To(Equal("child1val"))
+
+			cancel()
+			err = ckv.SetContext(ctx, "parent/child1", "newval", 0)
+			Expect(err).To(MatchError(context.Canceled))
+			_, err = ckv.GetListContext(ctx, "parent/", false)
+			Expect(err).To(MatchError(context.Canceled))
+			_, err = ckv.DeleteListContext(ctx, "parent/")
+			Expect(err).To(MatchError(context.Canceled))
+
+			s, err = kv.GetVal("parent/child1")
+			Expect(s.Value).To(Equal("child1val"))
+		})
+	})
+
+	Describe("Watch Wrapper", func() {
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+		)
+
+		BeforeEach(func() {
+			ctx, cancel = context.WithCancel(context.Background())
+		})
+		AfterEach(func() {
+			cancel()
+		})
+
+		It("Streams changes to a key", func() {
+			events, err := kv.Watch(ctx, "parent/child1", false)
+			Expect(err).To(BeNil())
+
+			kv.Set("parent/child2", "ignored", 0)
+			kv.Set("parent/child1", "newval", 0)
+
+			var ev *WatchEvent
+			Eventually(events).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(EventPut))
+			Expect(ev.Key).To(Equal("/parent/child1"))
+			Expect(ev.Value).To(Equal("newval"))
+			Expect(ev.Revision).To(BeNumerically(">", 0))
+		})
+		It("Streams changes below a prefix", func() {
+			events, err := kv.Watch(ctx, "parent/", true)
+			Expect(err).To(BeNil())
+
+			kv.Set("parent/child1", "a", 0)
+			kv.Set("parent/child3", "b", 0)
+
+			var first, second *WatchEvent
+			Eventually(events).Should(Receive(&first))
+			Eventually(events).Should(Receive(&second))
+			Expect(first.Key).To(Equal("/parent/child1"))
+			Expect(second.Key).To(Equal("/parent/child3"))
+			Expect(second.Revision).To(BeNumerically(">", first.Revision))
+		})
+		It("Streams deletes", func() {
+			events, err := kv.Watch(ctx, "parent/child2", false)
+			Expect(err).To(BeNil())
+
+			kv.Delete("parent/child2")
+
+			var ev *WatchEvent
+			Eventually(events).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(EventDelete))
+			Expect(ev.Key).To(Equal("/parent/child2"))
+		})
+		It("Streams expiries", func() {
+			kv.Set("parent/child2", "newval", 10)
+			events, err := kv.Watch(ctx, "parent/child2", false)
+			Expect(err).To(BeNil())
+
+			kv.(KVFaker).Advance(10 * time.Second)
+
+			var ev *WatchEvent
+			Eventually(events).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(EventExpire))
+			Expect(ev.Key).To(Equal("/parent/child2"))
+		})
+		It("Closes the stream when cancelled", func() {
+			events, err := kv.Watch(ctx, "parent/", true)
+			Expect(err).To(BeNil())
+
+			cancel()
+			Eventually(events).Should(BeClosed())
+		})
 	})
 
 })
@@ -0,0 +1,479 @@
+// Package kvwrappertest is a conformance suite for KVWrapper implementations. It checks that a
+// store behaves like kvwrapper_etcd (v2), the reference the other implementations follow:
+//
+//	func TestConformance(t *testing.T) {
+//		kvwrappertest.Suite{
+//			New: func(t *testing.T) kvwrapper.KVWrapper {
+//				return kvwrapper.NewKVWrapper([]string{"http://localhost:2379"}, MyWrapper{})
+//			},
+//		}.Run(t)
+//	}
+package kvwrappertest
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+)
+
+// Prefix is the key below which the suite works. Every test uses a key of its own below it,
+// removed before and after the test, so the store may hold other keys.
+var Prefix = "/kvwrappertest"
+
+// Suite runs the conformance tests against the wrappers returned by New
+type Suite struct {
+	// New returns the wrapper a test runs against
+	New func(t *testing.T) kvwrapper.KVWrapper
+	// Advance moves the clock the ttls of kv run on by d. If nil, the tests wait for the ttls to
+	// run out for real, which takes a few seconds.
+	Advance func(kv kvwrapper.KVWrapper, d time.Duration)
+	// Flat is set for the stores without directories: GetList returns every key below a prefix,
+	// not only the immediate children, and no key has children.
+	Flat bool
+	// MinTTL is the shortest ttl the store honors, in seconds, for the stores raising the shorter
+	// ones to it
+	MinTTL uint64
+}
+
+// Run runs every test of the suite as a subtest of t
+func (s Suite) Run(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, kv kvwrapper.KVWrapper, prefix string)
+	}{
+		{"SetGet", s.testSetGet},
+		{"NotFound", s.testNotFound},
+		{"List", s.testList},
+		{"Sort", s.testSort},
+		{"TTL", s.testTTL},
+		{"Delete", s.testDelete},
+		{"Conditional", s.testConditional},
+		{"Metadata", s.testMetadata},
+		{"Pages", s.testPages},
+		{"ListOptions", s.testListOptions},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			kv := s.New(t)
+			if kv == nil {
+				t.Fatal("New returned no wrapper")
+			}
+			prefix := Prefix + "/" + test.name
+			kv.DeleteList(prefix)
+			defer kv.DeleteList(prefix)
+
+			test.fn(t, kv, prefix)
+		})
+	}
+}
+
+func set(t *testing.T, kv kvwrapper.KVWrapper, key string, val string, ttl uint64) {
+	if err := kv.Set(key, val, ttl); err != nil {
+		t.Fatalf("Set(%q) failed: %v", key, err)
+	}
+}
+
+func expectVal(t *testing.T, kv kvwrapper.KVWrapper, key string, val string) {
+	s, err := kv.GetVal(key)
+	if err != nil {
+		t.Errorf("GetVal(%q) failed: %v", key, err)
+		return
+	}
+	want := kvwrapper.KeyValue{Key: key, Value: val}
+	if plain(s) != want {
+		t.Errorf("GetVal(%q) = %v, want %v", key, s, &want)
+	}
+}
+
+// plain drops the metadata of kv, which differs from a store to the other
+func plain(kv *kvwrapper.KeyValue) kvwrapper.KeyValue {
+	return kvwrapper.KeyValue{Key: kv.Key, Value: kv.Value, HasChildren: kv.HasChildren}
+}
+
+func expectMissing(t *testing.T, kv kvwrapper.KVWrapper, key string) {
+	if s, err := kv.GetVal(key); err != kvwrapper.ErrKeyNotFound {
+		t.Errorf("GetVal(%q) = %v, %v, want ErrKeyNotFound", key, s, err)
+	}
+}
+
+func expectList(t *testing.T, kv kvwrapper.KVWrapper, key string, sorted bool, want []kvwrapper.KeyValue) {
+	l, err := kv.GetList(key, sorted)
+	if err != nil {
+		t.Errorf("GetList(%q) failed: %v", key, err)
+		return
+	}
+	got := make([]kvwrapper.KeyValue, 0, len(l))
+	for _, kv := range l {
+		got = append(got, plain(kv))
+	}
+	if !sorted {
+		// no order is promised, compare them sorted
+		sort.Slice(got, func(i, j int) bool { return got[i].Key < got[j].Key })
+	}
+	if len(got) != len(want) {
+		t.Errorf("GetList(%q, %t) = %v, want %v", key, sorted, got, want)
+		return
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("GetList(%q, %t) = %v, want %v", key, sorted, got, want)
+			return
+		}
+	}
+}
+
+func (s Suite) testSetGet(t *testing.T, kv kvwrapper.KVWrapper, prefix string) {
+	set(t, kv, prefix+"/key", "value", 0)
+	expectVal(t, kv, prefix+"/key", "value")
+
+	set(t, kv, prefix+"/key", "newvalue", 0)
+	expectVal(t, kv, prefix+"/key", "newvalue")
+	expectList(t, kv, prefix, true, []kvwrapper.KeyValue{{Key: prefix + "/key", Value: "newvalue"}})
+
+	set(t, kv, prefix+"/empty", "", 0)
+	expectVal(t, kv, prefix+"/empty", "")
+}
+
+func (s Suite) testNotFound(t *testing.T, kv kvwrapper.KVWrapper, prefix string) {
+	expectMissing(t, kv, prefix+"/missing")
+	if l, err := kv.GetList(prefix+"/missing", false); err != kvwrapper.ErrKeyNotFound {
+		t.Errorf("GetList of a missing key = %v, %v, want ErrKeyNotFound", l, err)
+	}
+	if err := kv.Delete(prefix + "/missing"); err != kvwrapper.ErrKeyNotFound {
+		t.Errorf("Delete of a missing key = %v, want ErrKeyNotFound", err)
+	}
+	if n, err := kv.DeleteList(prefix + "/missing"); err != kvwrapper.ErrKeyNotFound || n != 0 {
+		t.Errorf("DeleteList of a missing key = %d, %v, want ErrKeyNotFound", n, err)
+	}
+}
+
+func (s Suite) testList(t *testing.T, kv kvwrapper.KVWrapper, prefix string) {
+	set(t, kv, prefix+"/b", "bval", 0)
+	set(t, kv, prefix+"/a", "aval", 0)
+	set(t, kv, prefix+"/dir/c", "cval", 0)
+
+	if s.Flat {
+		expectList(t, kv, prefix, true, []kvwrapper.KeyValue{
+			{Key: prefix + "/a", Value: "aval"},
+			{Key: prefix + "/b", Value: "bval"},
+			{Key: prefix + "/dir/c", Value: "cval"},
+		})
+		return
+	}
+
+	expectList(t, kv, prefix, true, []kvwrapper.KeyValue{
+		{Key: prefix + "/a", Value: "aval"},
+		{Key: prefix + "/b", Value: "bval"},
+		{Key: prefix + "/dir", HasChildren: true},
+	})
+	expectList(t, kv, prefix+"/dir", false, []kvwrapper.KeyValue{{Key: prefix + "/dir/c", Value: "cval"}})
+	// a key holding a value has no children
+	expectList(t, kv, prefix+"/a", false, []kvwrapper.KeyValue{})
+
+	dir, err := kv.GetVal(prefix + "/dir")
+	if err != nil || !dir.HasChildren {
+		t.Errorf("GetVal of a directory = %v, %v, want HasChildren", dir, err)
+	}
+}
+
+func (s Suite) testSort(t *testing.T, kv kvwrapper.KVWrapper, prefix string) {
+	want := []kvwrapper.KeyValue{}
+	for _, name := range []string{"m", "z", "a", "q", "b"} {
+		set(t, kv, prefix+"/"+name, name+"val", 0)
+		want = append(want, kvwrapper.KeyValue{Key: prefix + "/" + name, Value: name + "val"})
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].Key < want[j].Key })
+
+	expectList(t, kv, prefix, true, want)
+	expectList(t, kv, prefix, false, want)
+}
+
+func (s Suite) testTTL(t *testing.T, kv kvwrapper.KVWrapper, prefix string) {
+	ttl := uint64(2)
+	if s.MinTTL > ttl {
+		ttl = s.MinTTL
+	}
+	set(t, kv, prefix+"/ttl", "value", ttl)
+	set(t, kv, prefix+"/cleared", "value", ttl)
+	set(t, kv, prefix+"/cleared", "newvalue", 0)
+	set(t, kv, prefix+"/forever", "value", 0)
+	expectVal(t, kv, prefix+"/ttl", "value")
+
+	if s.Advance != nil {
+		s.Advance(kv, time.Duration(ttl)*time.Second/2)
+		expectVal(t, kv, prefix+"/ttl", "value")
+		s.Advance(kv, time.Duration(ttl)*time.Second)
+		expectMissing(t, kv, prefix+"/ttl")
+	} else {
+		// the stores check their ttls on their own schedule, give them some leeway
+		deadline := time.Now().Add(time.Duration(ttl)*time.Second + 5*time.Second)
+		for {
+			if _, err := kv.GetVal(prefix + "/ttl"); err == kvwrapper.ErrKeyNotFound {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s/ttl did not expire", prefix)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	expectVal(t, kv, prefix+"/cleared", "newvalue")
+	expectVal(t, kv, prefix+"/forever", "value")
+}
+
+func (s Suite) testDelete(t *testing.T, kv kvwrapper.KVWrapper, prefix string) {
+	set(t, kv, prefix+"/a", "aval", 0)
+	set(t, kv, prefix+"/b", "bval", 0)
+	set(t, kv, prefix+"/dir/c", "cval", 0)
+	set(t, kv, prefix+"/dir/sub/d", "dval", 0)
+
+	if err := kv.Delete(prefix + "/a"); err != nil {
+		t.Errorf("Delete failed: %v", err)
+	}
+	expectMissing(t, kv, prefix+"/a")
+	expectVal(t, kv, prefix+"/b", "bval")
+
+	n, err := kv.DeleteList(prefix + "/dir")
+	if err != nil || n != 2 {
+		t.Errorf("DeleteList = %d, %v, want 2", n, err)
+	}
+	expectMissing(t, kv, prefix+"/dir/c")
+	expectMissing(t, kv, prefix+"/dir/sub/d")
+	expectVal(t, kv, prefix+"/b", "bval")
+}
+
+func (s Suite) testConditional(t *testing.T, kv kvwrapper.KVWrapper, prefix string) {
+	key := prefix + "/key"
+	rev, err := kv.Create(key, "value", 0)
+	if err != nil || rev <= 0 {
+		t.Fatalf("Create = %d, %v", rev, err)
+	}
+	if _, err := kv.Create(key, "other", 0); err != kvwrapper.ErrConflict {
+		t.Errorf("Create of an existing key = %v, want ErrConflict", err)
+	}
+
+	if _, err := kv.CompareAndSwap(key, "newvalue", "other", 0); err != kvwrapper.ErrConflict {
+		t.Errorf("CompareAndSwap of another value = %v, want ErrConflict", err)
+	}
+	if _, err := kv.CompareAndSwap(prefix+"/missing", "newvalue", "value", 0); err != kvwrapper.ErrKeyNotFound {
+		t.Errorf("CompareAndSwap of a missing key = %v, want ErrKeyNotFound", err)
+	}
+	newRev, err := kv.CompareAndSwap(key, "newvalue", "value", 0)
+	if err != nil || newRev <= rev {
+		t.Errorf("CompareAndSwap = %d, %v, want a revision above %d", newRev, err, rev)
+	}
+
+	if _, err := kv.CompareAndSwapRevision(key, "newervalue", rev, 0); err != kvwrapper.ErrConflict {
+		t.Errorf("CompareAndSwapRevision of an old revision = %v, want ErrConflict", err)
+	}
+	if _, err := kv.CompareAndSwapRevision(key, "newervalue", newRev, 0); err != nil {
+		t.Errorf("CompareAndSwapRevision failed: %v", err)
+	}
+	expectVal(t, kv, key, "newervalue")
+
+	if err := kv.CompareAndDelete(key, "value"); err != kvwrapper.ErrConflict {
+		t.Errorf("CompareAndDelete of another value = %v, want ErrConflict", err)
+	}
+	if err := kv.CompareAndDelete(key, "newervalue"); err != nil {
+		t.Errorf("CompareAndDelete failed: %v", err)
+	}
+	expectMissing(t, kv, key)
+
+	// an empty value or a revision of 0 is a precondition like any other
+	empty := prefix + "/empty"
+	set(t, kv, key, "value", 0)
+	if _, err := kv.CompareAndSwap(key, "newvalue", "", 0); err != kvwrapper.ErrConflict {
+		t.Errorf("CompareAndSwap of a set value with an empty one = %v, want ErrConflict", err)
+	}
+	if err := kv.CompareAndDelete(key, ""); err != kvwrapper.ErrConflict {
+		t.Errorf("CompareAndDelete of a set value with an empty one = %v, want ErrConflict", err)
+	}
+	if _, err := kv.CompareAndSwapRevision(key, "newvalue", 0, 0); err != kvwrapper.ErrConflict {
+		t.Errorf("CompareAndSwapRevision with a revision of 0 = %v, want ErrConflict", err)
+	}
+	expectVal(t, kv, key, "value")
+	if _, err := kv.CompareAndSwap(empty, "newvalue", "", 0); err != kvwrapper.ErrKeyNotFound {
+		t.Errorf("CompareAndSwap of a missing key with an empty value = %v, want ErrKeyNotFound", err)
+	}
+	if err := kv.CompareAndDelete(empty, ""); err != kvwrapper.ErrKeyNotFound {
+		t.Errorf("CompareAndDelete of a missing key with an empty value = %v, want ErrKeyNotFound", err)
+	}
+	if _, err := kv.CompareAndSwapRevision(empty, "newvalue", 0, 0); err != kvwrapper.ErrKeyNotFound {
+		t.Errorf("CompareAndSwapRevision of a missing key with a revision of 0 = %v, want ErrKeyNotFound", err)
+	}
+	expectMissing(t, kv, empty)
+
+	set(t, kv, empty, "", 0)
+	if _, err := kv.CompareAndSwap(empty, "newvalue", "", 0); err != nil {
+		t.Errorf("CompareAndSwap of an empty value failed: %v", err)
+	}
+	expectVal(t, kv, empty, "newvalue")
+	set(t, kv, empty, "", 0)
+	if err := kv.CompareAndDelete(empty, ""); err != nil {
+		t.Errorf("CompareAndDelete of an empty value failed: %v", err)
+	}
+	expectMissing(t, kv, empty)
+}
+
+func (s Suite) testMetadata(t *testing.T, kv kvwrapper.KVWrapper, prefix string) {
+	key := prefix + "/key"
+	rev, err := kv.Create(key, "value", 0)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	created, err := kv.GetVal(key)
+	if err != nil {
+		t.Fatalf("GetVal failed: %v", err)
+	}
+	if created.CreateRevision != rev || created.ModRevision != rev {
+		t.Errorf("GetVal of a created key = %+v, want revisions %d", created, rev)
+	}
+	if created.TTL != 0 || !created.Expiration.IsZero() {
+		t.Errorf("GetVal of a key without ttl = %+v, want no expiration", created)
+	}
+
+	newRev, err := kv.CompareAndSwap(key, "newvalue", "value", 0)
+	if err != nil {
+		t.Fatalf("CompareAndSwap failed: %v", err)
+	}
+	modified, err := kv.GetVal(key)
+	if err != nil {
+		t.Fatalf("GetVal failed: %v", err)
+	}
+	if modified.CreateRevision != rev || modified.ModRevision != newRev {
+		t.Errorf("GetVal of a modified key = %+v, want CreateRevision %d and ModRevision %d", modified, rev, newRev)
+	}
+	// not every store counts versions
+	if created.Version != 0 && modified.Version != created.Version+1 {
+		t.Errorf("GetVal of a modified key = %+v, want Version %d", modified, created.Version+1)
+	}
+
+	const ttl = 10
+	before := time.Now()
+	set(t, kv, prefix+"/ttl", "value", ttl)
+	expiring, err := kv.GetVal(prefix + "/ttl")
+	if err != nil {
+		t.Fatalf("GetVal failed: %v", err)
+	}
+	if expiring.TTL <= 0 || expiring.TTL > ttl {
+		t.Errorf("GetVal of a key with a ttl = %+v, want a TTL up to %d", expiring, ttl)
+	}
+	if s.Advance == nil && (expiring.Expiration.Before(before) || expiring.Expiration.After(time.Now().Add(ttl*time.Second+time.Second))) {
+		t.Errorf("GetVal of a key with a ttl = %+v, want an Expiration within %ds", expiring, ttl)
+	}
+
+	l, err := kv.GetList(prefix, true)
+	if err != nil {
+		t.Fatalf("GetList failed: %v", err)
+	}
+	for _, listed := range l {
+		if listed.Key == key && (listed.CreateRevision != rev || listed.ModRevision != newRev) {
+			t.Errorf("GetList = %+v, want CreateRevision %d and ModRevision %d for %s", listed, rev, newRev, key)
+		}
+	}
+}
+
+func (s Suite) testPages(t *testing.T, kv kvwrapper.KVWrapper, prefix string) {
+	for _, name := range []string{"d", "b", "e", "a", "c"} {
+		set(t, kv, prefix+"/"+name, name+"val", 0)
+	}
+	ctx := context.Background()
+
+	var keys []string
+	token := ""
+	for pages := 0; ; pages++ {
+		page, err := kvwrapper.GetPage(ctx, kv, prefix, 2, token)
+		if err != nil {
+			t.Fatalf("GetPage(%q, 2, %q) failed: %v", prefix, token, err)
+		}
+		if len(page.KeyValues) > 2 || pages > 3 {
+			t.Fatalf("GetPage(%q, 2, %q) = %d keys on page %d, want pages of up to 2 keys", prefix, token, len(page.KeyValues), pages)
+		}
+		for _, kv := range page.KeyValues {
+			keys = append(keys, kv.Key)
+		}
+		if page.Next == "" {
+			break
+		}
+		token = page.Next
+	}
+
+	var iterated []string
+	it := kvwrapper.Iterate(ctx, kv, prefix, 3)
+	for it.Next() {
+		iterated = append(iterated, it.KeyValue().Key)
+	}
+	if err := it.Err(); err != nil {
+		t.Errorf("Iterate(%q) failed: %v", prefix, err)
+	}
+
+	want := []string{prefix + "/a", prefix + "/b", prefix + "/c", prefix + "/d", prefix + "/e"}
+	for _, got := range [][]string{keys, iterated} {
+		if len(got) != len(want) {
+			t.Errorf("Listing %q by pages = %v, want %v", prefix, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("Listing %q by pages = %v, want %v", prefix, got, want)
+				break
+			}
+		}
+	}
+
+	if _, err := kvwrapper.GetPage(ctx, kv, prefix+"/missing", 2, ""); err != kvwrapper.ErrKeyNotFound {
+		t.Errorf("GetPage of a missing key = %v, want ErrKeyNotFound", err)
+	}
+	it = kvwrapper.Iterate(ctx, kv, prefix+"/missing", 2)
+	if it.Next() || it.Err() != kvwrapper.ErrKeyNotFound {
+		t.Errorf("Iterate of a missing key = %v, want ErrKeyNotFound", it.Err())
+	}
+}
+
+func (s Suite) testListOptions(t *testing.T, kv kvwrapper.KVWrapper, prefix string) {
+	set(t, kv, prefix+"/a", "2", 0)
+	set(t, kv, prefix+"/b", "3", 0)
+	set(t, kv, prefix+"/c", "1", 0)
+	ctx := context.Background()
+
+	result, err := kvwrapper.List(ctx, kv, prefix, kvwrapper.ListOptions{SortBy: kvwrapper.SortByValue, Order: kvwrapper.SortDescend})
+	if err != nil {
+		t.Fatalf("List(%q) by value failed: %v", prefix, err)
+	}
+	want := []string{prefix + "/b", prefix + "/a", prefix + "/c"}
+	if len(result.KeyValues) != len(want) || result.Count != int64(len(want)) {
+		t.Fatalf("List(%q) by value = %d keys (count %d), want %v", prefix, len(result.KeyValues), result.Count, want)
+	}
+	for i := range want {
+		if result.KeyValues[i].Key != want[i] {
+			t.Errorf("List(%q) by value = %v, want %v", prefix, result.KeyValues, want)
+			break
+		}
+	}
+
+	result, err = kvwrapper.List(ctx, kv, prefix, kvwrapper.ListOptions{Order: kvwrapper.SortDescend, KeysOnly: true})
+	if err != nil {
+		t.Fatalf("List(%q) of keys failed: %v", prefix, err)
+	}
+	if len(result.KeyValues) != 3 || result.KeyValues[0].Key != prefix+"/c" {
+		t.Errorf("List(%q) of keys by descending key = %v, want %s first", prefix, result.KeyValues, prefix+"/c")
+	}
+	for _, listed := range result.KeyValues {
+		if listed.Value != "" {
+			t.Errorf("List(%q) of keys = %+v, want no value", prefix, listed)
+		}
+	}
+
+	result, err = kvwrapper.List(ctx, kv, prefix, kvwrapper.ListOptions{CountOnly: true})
+	if err != nil || result.Count != 3 || len(result.KeyValues) != 0 {
+		t.Errorf("List(%q) counting keys = %+v, %v, want a count of 3", prefix, result, err)
+	}
+
+	if _, err := kvwrapper.List(ctx, kv, prefix+"/missing", kvwrapper.ListOptions{}); err != kvwrapper.ErrKeyNotFound {
+		t.Errorf("List of a missing key = %v, want ErrKeyNotFound", err)
+	}
+}
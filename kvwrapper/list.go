@@ -0,0 +1,114 @@
+package kvwrapper
+
+import (
+	"context"
+	"sort"
+)
+
+// SortTarget is what the keys of a listing are sorted by
+type SortTarget int
+
+const (
+	SortByKey SortTarget = iota
+	SortByValue
+	SortByCreateRevision
+	SortByModRevision
+)
+
+// SortOrder is the order the keys of a listing are sorted in
+type SortOrder int
+
+const (
+	// SortNone leaves the keys in the order of the store, unless SortBy is not SortByKey, in
+	// which case they are sorted in ascending order, as etcd-v3 does
+	SortNone SortOrder = iota
+	SortAscend
+	SortDescend
+)
+
+// ListOptions tunes what List returns
+type ListOptions struct {
+	SortBy SortTarget
+	Order  SortOrder
+	// KeysOnly leaves out the values of the keys, keeping the rest of their metadata
+	KeysOnly bool
+	// CountOnly only counts the keys, returning none of them
+	CountOnly bool
+}
+
+// ListResult holds the keys List returns, and how many there are
+type ListResult struct {
+	KeyValues []*KeyValue
+	Count     int64
+}
+
+// ListingKVWrapper is implemented by the KVWrappers that can sort, or leave out the values of,
+// the keys they list on their own
+type ListingKVWrapper interface {
+	KVWrapper
+	// List returns the keys GetList would return for key, as tuned by opts
+	List(ctx context.Context, key string, opts ListOptions) (*ListResult, error)
+}
+
+// List returns the keys below key, as tuned by opts. Wrappers that do not implement
+// ListingKVWrapper list key with GetList, and sort the keys and strip their values afterwards.
+func List(ctx context.Context, kv KVWrapper, key string, opts ListOptions) (*ListResult, error) {
+	if l, ok := kv.(ListingKVWrapper); ok {
+		return l.List(ctx, key, opts)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	kvs, err := kv.GetList(key, opts.Sorted())
+	if err != nil {
+		return nil, err
+	}
+	return opts.Apply(kvs), nil
+}
+
+// Sorted tells whether the keys are sorted at all
+func (o ListOptions) Sorted() bool {
+	return o.Order != SortNone || o.SortBy != SortByKey
+}
+
+// Apply sorts kvs and strips their values as the options ask. It is meant for the wrappers that
+// cannot do it on their own, and expects kvs in the order of GetList, sorted by key when the
+// listing is sorted. Keys sorted by anything but their key stay in the order of their keys when tied.
+func (o ListOptions) Apply(kvs []*KeyValue) *ListResult {
+	if o.CountOnly {
+		return &ListResult{Count: int64(len(kvs))}
+	}
+	if o.Sorted() {
+		sorted := make([]*KeyValue, len(kvs))
+		copy(sorted, kvs)
+		less := o.less()
+		if o.Order == SortDescend {
+			sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[j], sorted[i]) })
+		} else {
+			sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+		}
+		kvs = sorted
+	}
+	if o.KeysOnly {
+		stripped := make([]*KeyValue, 0, len(kvs))
+		for _, kv := range kvs {
+			k := *kv
+			k.Value = ""
+			stripped = append(stripped, &k)
+		}
+		kvs = stripped
+	}
+	return &ListResult{KeyValues: kvs, Count: int64(len(kvs))}
+}
+
+func (o ListOptions) less() func(a, b *KeyValue) bool {
+	switch o.SortBy {
+	case SortByValue:
+		return func(a, b *KeyValue) bool { return a.Value < b.Value }
+	case SortByCreateRevision:
+		return func(a, b *KeyValue) bool { return a.CreateRevision < b.CreateRevision }
+	case SortByModRevision:
+		return func(a, b *KeyValue) bool { return a.ModRevision < b.ModRevision }
+	}
+	return func(a, b *KeyValue) bool { return a.Key < b.Key }
+}
@@ -0,0 +1,102 @@
+package kvwrapper_test
+
+import (
+	"context"
+
+	. "github.com/behance/go-common/kvwrapper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("List", func() {
+	var (
+		kv  KVWrapper
+		ctx context.Context
+	)
+
+	BeforeEach(func() {
+		kv = NewKVWrapper(nil, KVFaker{})
+		kv.Set("/parent/b", "2", 0)
+		kv.Set("/parent/c", "1", 0)
+		kv.Set("/parent/a", "3", 0)
+		kv.Set("/parent/d", "1", 0)
+		ctx = context.Background()
+	})
+
+	It("Leaves the keys in the order of the store without a sort", func() {
+		result, err := List(ctx, kv, "/parent", ListOptions{})
+		Expect(err).To(BeNil())
+		Expect(keysOf(result.KeyValues)).To(Equal([]string{"/parent/b", "/parent/c", "/parent/a", "/parent/d"}))
+		Expect(result.Count).To(Equal(int64(4)))
+	})
+
+	It("Sorts by key in descending order", func() {
+		result, err := List(ctx, kv, "/parent", ListOptions{Order: SortDescend})
+		Expect(err).To(BeNil())
+		Expect(keysOf(result.KeyValues)).To(Equal([]string{"/parent/d", "/parent/c", "/parent/b", "/parent/a"}))
+	})
+
+	It("Sorts by value, keeping tied keys in order", func() {
+		result, err := List(ctx, kv, "/parent", ListOptions{SortBy: SortByValue})
+		Expect(err).To(BeNil())
+		Expect(keysOf(result.KeyValues)).To(Equal([]string{"/parent/c", "/parent/d", "/parent/b", "/parent/a"}))
+
+		result, err = List(ctx, kv, "/parent", ListOptions{SortBy: SortByValue, Order: SortDescend})
+		Expect(err).To(BeNil())
+		Expect(keysOf(result.KeyValues)).To(Equal([]string{"/parent/a", "/parent/b", "/parent/c", "/parent/d"}))
+	})
+
+	It("Sorts by revision", func() {
+		kv.Set("/parent/b", "4", 0)
+
+		result, err := List(ctx, kv, "/parent", ListOptions{SortBy: SortByCreateRevision, Order: SortAscend})
+		Expect(err).To(BeNil())
+		Expect(keysOf(result.KeyValues)).To(Equal([]string{"/parent/b", "/parent/c", "/parent/a", "/parent/d"}))
+
+		result, err = List(ctx, kv, "/parent", ListOptions{SortBy: SortByModRevision, Order: SortDescend})
+		Expect(err).To(BeNil())
+		Expect(keysOf(result.KeyValues)).To(Equal([]string{"/parent/b", "/parent/d", "/parent/a", "/parent/c"}))
+	})
+
+	It("Leaves out the values", func() {
+		result, err := List(ctx, kv, "/parent", ListOptions{KeysOnly: true})
+		Expect(err).To(BeNil())
+		Expect(result.KeyValues).To(HaveLen(4))
+		for _, listed := range result.KeyValues {
+			Expect(listed.Value).To(BeEmpty())
+			Expect(listed.ModRevision).NotTo(BeZero())
+		}
+
+		stored, err := kv.GetVal("/parent/a")
+		Expect(err).To(BeNil())
+		Expect(stored.Value).To(Equal("3"))
+	})
+
+	It("Only counts the keys", func() {
+		result, err := List(ctx, kv, "/parent", ListOptions{CountOnly: true})
+		Expect(err).To(BeNil())
+		Expect(result.KeyValues).To(BeEmpty())
+		Expect(result.Count).To(Equal(int64(4)))
+	})
+
+	It("Falls back to GetList on the wrappers that cannot list with options", func() {
+		_, ok := KVWrapper(listOnly{kv}).(ListingKVWrapper)
+		Expect(ok).To(BeFalse())
+
+		result, err := List(ctx, listOnly{kv}, "/parent", ListOptions{SortBy: SortByValue, Order: SortDescend, KeysOnly: true})
+		Expect(err).To(BeNil())
+		Expect(keysOf(result.KeyValues)).To(Equal([]string{"/parent/a", "/parent/b", "/parent/c", "/parent/d"}))
+		Expect(result.KeyValues[0].Value).To(BeEmpty())
+
+		_, err = List(ctx, listOnly{kv}, "/missing", ListOptions{})
+		Expect(err).To(Equal(ErrKeyNotFound))
+	})
+
+	It("Lists namespaces", func() {
+		ns := Namespace(kv, "/parent")
+		result, err := ns.List(ctx, "", ListOptions{Order: SortAscend})
+		Expect(err).To(BeNil())
+		Expect(keysOf(result.KeyValues)).To(Equal([]string{"a", "b", "c", "d"}))
+	})
+})
@@ -0,0 +1,358 @@
+package kvwrapper
+
+import (
+	"context"
+	"strings"
+)
+
+// NamespacedWrapper confines the operations of Backend to the keys below Prefix, so that several
+// applications can share a store. Keys are given relative to Prefix, "" being Prefix itself, and
+// the keys returned are relative to it as well. Keys starting with "/" or holding a ".." element
+// would leave the namespace, and are rejected with ErrInvalidKey.
+// Unlike the other decorators it lives in this package, as Open confines the wrappers of the DSNs
+// with a path to it: a package of its own would import kvwrapper, and could not be imported back.
+type NamespacedWrapper struct {
+	// Backend is the wrapped store: a template built by NewKVWrapper, or a wrapper handed to Namespace
+	Backend KVWrapper
+	Prefix  string
+}
+
+// Namespace returns kv, an initialized wrapper, confined to the keys below prefix
+func Namespace(kv KVWrapper, prefix string) NamespacedWrapper {
+	return NamespacedWrapper{Backend: kv, Prefix: prefix}
+}
+
+// NewKVWrapper initializes Backend with servers, username and password, and confines it to Prefix
+func (n NamespacedWrapper) NewKVWrapper(servers []string, username, password string) KVWrapper {
+	kv := n.Backend.NewKVWrapper(servers, username, password)
+	if kv == nil {
+		return nil
+	}
+	return Namespace(kv, n.Prefix)
+}
+
+// Connect is NewKVWrapper, returning the error of Backend when it cannot be initialized
+func (n NamespacedWrapper) Connect(servers []string, username, password string) (KVWrapper, error) {
+	kv, err := Connect(servers, n.Backend, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return Namespace(kv, n.Prefix), nil
+}
+
+// key returns the key of the backend for key
+func (n NamespacedWrapper) key(key string) (string, error) {
+	if strings.HasPrefix(key, "/") {
+		return "", ErrInvalidKey
+	}
+	for _, elem := range strings.Split(key, "/") {
+		if elem == ".." {
+			return "", ErrInvalidKey
+		}
+	}
+	// the namespace itself ends with a "/", so that listing it on a store without directories
+	// does not match the keys next to it
+	return strings.TrimSuffix(n.Prefix, "/") + "/" + key, nil
+}
+
+// strip returns key, returned by the backend, relative to the namespace
+func (n NamespacedWrapper) strip(key string) string {
+	prefix := strings.Trim(n.Prefix, "/")
+	key = strings.TrimPrefix(key, "/")
+	if key == prefix {
+		return ""
+	}
+	return strings.TrimPrefix(key, prefix+"/")
+}
+
+func (n NamespacedWrapper) stripKV(kv *KeyValue) *KeyValue {
+	if kv == nil {
+		return nil
+	}
+	stripped := *kv
+	stripped.Key = n.strip(kv.Key)
+	return &stripped
+}
+
+func (n NamespacedWrapper) Set(key string, val string, ttl uint64) error {
+	k, err := n.key(key)
+	if err != nil {
+		return err
+	}
+	return n.Backend.Set(k, val, ttl)
+}
+
+func (n NamespacedWrapper) SetContext(ctx context.Context, key string, val string, ttl uint64) error {
+	k, err := n.key(key)
+	if err != nil {
+		return err
+	}
+	return SetContext(ctx, n.Backend, k, val, ttl)
+}
+
+func (n NamespacedWrapper) GetVal(key string) (*KeyValue, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return nil, err
+	}
+	kv, err := n.Backend.GetVal(k)
+	return n.stripKV(kv), err
+}
+
+func (n NamespacedWrapper) GetValContext(ctx context.Context, key string) (*KeyValue, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return nil, err
+	}
+	kv, err := GetValContext(ctx, n.Backend, k)
+	return n.stripKV(kv), err
+}
+
+func (n NamespacedWrapper) GetList(key string, sort bool) ([]*KeyValue, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return nil, err
+	}
+	return n.stripKVs(n.Backend.GetList(k, sort))
+}
+
+func (n NamespacedWrapper) GetListContext(ctx context.Context, key string, sort bool) ([]*KeyValue, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return nil, err
+	}
+	return n.stripKVs(GetListContext(ctx, n.Backend, k, sort))
+}
+
+func (n NamespacedWrapper) stripKVs(kvs []*KeyValue, err error) ([]*KeyValue, error) {
+	if kvs == nil {
+		return nil, err
+	}
+	stripped := make([]*KeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		stripped = append(stripped, n.stripKV(kv))
+	}
+	return stripped, err
+}
+
+// GetPage returns a page of the keys below key through GetPage on Backend. The tokens are the
+// ones of Backend.
+func (n NamespacedWrapper) GetPage(ctx context.Context, key string, limit int64, token string) (*Page, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return nil, err
+	}
+	page, err := GetPage(ctx, n.Backend, k, limit, token)
+	if err != nil {
+		return nil, err
+	}
+	stripped := &Page{KeyValues: make([]*KeyValue, 0, len(page.KeyValues)), Next: page.Next}
+	for _, kv := range page.KeyValues {
+		stripped.KeyValues = append(stripped.KeyValues, n.stripKV(kv))
+	}
+	return stripped, nil
+}
+
+// List returns the keys below key through List on Backend
+func (n NamespacedWrapper) List(ctx context.Context, key string, opts ListOptions) (*ListResult, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return nil, err
+	}
+	result, err := List(ctx, n.Backend, k, opts)
+	if err != nil {
+		return nil, err
+	}
+	stripped := &ListResult{Count: result.Count}
+	for _, kv := range result.KeyValues {
+		stripped.KeyValues = append(stripped.KeyValues, n.stripKV(kv))
+	}
+	return stripped, nil
+}
+
+func (n NamespacedWrapper) Create(key string, val string, ttl uint64) (int64, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return n.Backend.Create(k, val, ttl)
+}
+
+func (n NamespacedWrapper) CreateContext(ctx context.Context, key string, val string, ttl uint64) (int64, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return CreateContext(ctx, n.Backend, k, val, ttl)
+}
+
+func (n NamespacedWrapper) CompareAndSwap(key string, val string, prevVal string, ttl uint64) (int64, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return n.Backend.CompareAndSwap(k, val, prevVal, ttl)
+}
+
+func (n NamespacedWrapper) CompareAndSwapContext(ctx context.Context, key string, val string, prevVal string, ttl uint64) (int64, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return CompareAndSwapContext(ctx, n.Backend, k, val, prevVal, ttl)
+}
+
+func (n NamespacedWrapper) CompareAndSwapRevision(key string, val string, prevRev int64, ttl uint64) (int64, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return n.Backend.CompareAndSwapRevision(k, val, prevRev, ttl)
+}
+
+func (n NamespacedWrapper) CompareAndSwapRevisionContext(ctx context.Context, key string, val string, prevRev int64, ttl uint64) (int64, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return CompareAndSwapRevisionContext(ctx, n.Backend, k, val, prevRev, ttl)
+}
+
+func (n NamespacedWrapper) CompareAndDelete(key string, prevVal string) error {
+	k, err := n.key(key)
+	if err != nil {
+		return err
+	}
+	return n.Backend.CompareAndDelete(k, prevVal)
+}
+
+func (n NamespacedWrapper) CompareAndDeleteContext(ctx context.Context, key string, prevVal string) error {
+	k, err := n.key(key)
+	if err != nil {
+		return err
+	}
+	return CompareAndDeleteContext(ctx, n.Backend, k, prevVal)
+}
+
+// Txn commits through Backend, with the keys of the compares and operations moved into the namespace
+func (n NamespacedWrapper) Txn() *Txn {
+	return NewContextTxn(
+		func(compares []Compare, thenOps []Op, elseOps []Op) (*TxnResponse, error) {
+			return n.commit(compares, thenOps, elseOps, (*Txn).Commit)
+		},
+		func(ctx context.Context, compares []Compare, thenOps []Op, elseOps []Op) (*TxnResponse, error) {
+			return n.commit(compares, thenOps, elseOps, func(t *Txn) (*TxnResponse, error) {
+				return t.CommitContext(ctx)
+			})
+		})
+}
+
+// commit commits the transaction of Backend built from the operations with commit
+func (n NamespacedWrapper) commit(compares []Compare, thenOps []Op, elseOps []Op, commit func(*Txn) (*TxnResponse, error)) (*TxnResponse, error) {
+	nsCompares := make([]Compare, 0, len(compares))
+	for _, cmp := range compares {
+		k, err := n.key(cmp.Key)
+		if err != nil {
+			return nil, err
+		}
+		cmp.Key = k
+		nsCompares = append(nsCompares, cmp)
+	}
+	nsThen, err := n.ops(thenOps)
+	if err != nil {
+		return nil, err
+	}
+	nsElse, err := n.ops(elseOps)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := commit(n.Backend.Txn().If(nsCompares...).Then(nsThen...).Else(nsElse...))
+	if err != nil {
+		return nil, err
+	}
+	ops := thenOps
+	if !r.Succeeded {
+		ops = elseOps
+	}
+	for i, result := range r.Results {
+		result.KeyValue = n.stripKV(result.KeyValue)
+		if i < len(ops) {
+			result.Op = ops[i]
+		}
+	}
+	return r, nil
+}
+
+func (n NamespacedWrapper) ops(ops []Op) ([]Op, error) {
+	nsOps := make([]Op, 0, len(ops))
+	for _, op := range ops {
+		k, err := n.key(op.Key)
+		if err != nil {
+			return nil, err
+		}
+		op.Key = k
+		nsOps = append(nsOps, op)
+	}
+	return nsOps, nil
+}
+
+func (n NamespacedWrapper) Delete(key string) error {
+	k, err := n.key(key)
+	if err != nil {
+		return err
+	}
+	return n.Backend.Delete(k)
+}
+
+func (n NamespacedWrapper) DeleteContext(ctx context.Context, key string) error {
+	k, err := n.key(key)
+	if err != nil {
+		return err
+	}
+	return DeleteContext(ctx, n.Backend, k)
+}
+
+func (n NamespacedWrapper) DeleteList(key string) (int64, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return n.Backend.DeleteList(k)
+}
+
+func (n NamespacedWrapper) DeleteListContext(ctx context.Context, key string) (int64, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return DeleteListContext(ctx, n.Backend, k)
+}
+
+// Watch watches Backend, reporting the keys relative to the namespace
+func (n NamespacedWrapper) Watch(ctx context.Context, key string, recursive bool) (<-chan *WatchEvent, error) {
+	k, err := n.key(key)
+	if err != nil {
+		return nil, err
+	}
+	events, err := n.Backend.Watch(ctx, k, recursive)
+	if err != nil {
+		return nil, err
+	}
+
+	stripped := make(chan *WatchEvent)
+	go func() {
+		defer close(stripped)
+
+		for ev := range events {
+			s := *ev
+			s.Key = n.strip(ev.Key)
+			select {
+			case stripped <- &s:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return stripped, nil
+}
@@ -0,0 +1,131 @@
+package kvwrapper_test
+
+import (
+	"context"
+
+	. "github.com/behance/go-common/kvwrapper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NamespacedWrapper", func() {
+	var (
+		backend KVWrapper
+		kv      KVWrapper
+	)
+
+	BeforeEach(func() {
+		backend = NewKVWrapper(nil, KVFaker{})
+		backend.Set("/app/parent/child1", "child1val", 0)
+		backend.Set("/app/parent/child2", "child2val", 0)
+		backend.Set("/other/child", "otherval", 0)
+		kv = Namespace(backend, "/app")
+	})
+
+	It("Reads and writes below the prefix", func() {
+		s, err := kv.GetVal("parent/child1")
+		Expect(err).To(BeNil())
+		Expect(plain(s)).To(Equal(KeyValue{Key: "parent/child1", Value: "child1val"}))
+
+		Expect(kv.Set("parent/child3", "child3val", 0)).To(BeNil())
+		s, err = backend.GetVal("/app/parent/child3")
+		Expect(err).To(BeNil())
+		Expect(s.Value).To(Equal("child3val"))
+
+		_, err = kv.GetVal("other/child")
+		Expect(err).To(MatchError(ErrKeyNotFound))
+	})
+
+	It("Returns keys relative to the prefix", func() {
+		l, err := kv.GetList("parent", true)
+		Expect(err).To(BeNil())
+		Expect(l).To(HaveLen(2))
+		Expect(l[0].Key).To(Equal("parent/child1"))
+		Expect(l[1].Key).To(Equal("parent/child2"))
+
+		l, err = kv.GetList("", true)
+		Expect(err).To(BeNil())
+		Expect(l).To(HaveLen(1))
+		Expect(plain(l[0])).To(Equal(KeyValue{Key: "parent", HasChildren: true}))
+	})
+
+	It("Rejects keys leaving the namespace", func() {
+		_, err := kv.GetVal("/other/child")
+		Expect(err).To(MatchError(ErrInvalidKey))
+		_, err = kv.GetVal("parent/../../other/child")
+		Expect(err).To(MatchError(ErrInvalidKey))
+		Expect(kv.Set("../other/child", "value", 0)).To(MatchError(ErrInvalidKey))
+		_, err = kv.DeleteList("..")
+		Expect(err).To(MatchError(ErrInvalidKey))
+		_, err = kv.Txn().Then(SetOp("parent/child1", "value", 0), DeleteOp("../other/child")).Commit()
+		Expect(err).To(MatchError(ErrInvalidKey))
+
+		s, _ := backend.GetVal("/other/child")
+		Expect(s.Value).To(Equal("otherval"))
+		s, _ = backend.GetVal("/app/parent/child1")
+		Expect(s.Value).To(Equal("child1val"))
+	})
+
+	It("Moves transactions into the namespace", func() {
+		r, err := kv.Txn().
+			If(ValueEquals("parent/child1", "child1val")).
+			Then(SetOp("parent/child3", "child3val", 0), GetOp("parent/child2")).
+			Commit()
+		Expect(err).To(BeNil())
+		Expect(r.Succeeded).To(BeTrue())
+		Expect(r.Results[0].Op.Key).To(Equal("parent/child3"))
+		Expect(plain(r.Results[1].KeyValue)).To(Equal(KeyValue{Key: "parent/child2", Value: "child2val"}))
+
+		_, err = backend.GetVal("/app/parent/child3")
+		Expect(err).To(BeNil())
+	})
+
+	It("Watches below the prefix", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events, err := kv.Watch(ctx, "", true)
+		Expect(err).To(BeNil())
+
+		backend.Set("/other/child", "ignored", 0)
+		kv.Set("parent/child1", "newval", 0)
+
+		var ev *WatchEvent
+		Eventually(events).Should(Receive(&ev))
+		Expect(ev.Key).To(Equal("parent/child1"))
+		Expect(ev.Value).To(Equal("newval"))
+	})
+
+	It("Binds operations to contexts", func() {
+		ckv, ok := kv.(ContextKVWrapper)
+		Expect(ok).To(BeTrue())
+
+		ctx := context.Background()
+		Expect(ckv.SetContext(ctx, "parent/child3", "child3val", 0)).To(BeNil())
+		s, err := backend.GetVal("/app/parent/child3")
+		Expect(err).To(BeNil())
+		Expect(s.Value).To(Equal("child3val"))
+		kvs, err := ckv.GetListContext(ctx, "parent", true)
+		Expect(err).To(BeNil())
+		Expect(keysOf(kvs)).To(Equal([]string{"parent/child1", "parent/child2", "parent/child3"}))
+		_, err = ckv.GetValContext(ctx, "../other/child")
+		Expect(err).To(MatchError(ErrInvalidKey))
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err = ckv.CompareAndSwapContext(canceled, "parent/child1", "newval", "child1val", 0)
+		Expect(err).To(MatchError(context.Canceled))
+		_, err = kv.Txn().Then(SetOp("parent/child1", "newval", 0)).CommitContext(canceled)
+		Expect(err).To(MatchError(context.Canceled))
+		s, _ = backend.GetVal("/app/parent/child1")
+		Expect(s.Value).To(Equal("child1val"))
+	})
+
+	It("Builds its backend from a template", func() {
+		kv = NewKVWrapper(nil, NamespacedWrapper{Backend: KVFaker{}, Prefix: "app"})
+		Expect(kv.Set("key", "value", 0)).To(BeNil())
+		s, err := kv.GetVal("key")
+		Expect(err).To(BeNil())
+		Expect(plain(s)).To(Equal(KeyValue{Key: "key", Value: "value"}))
+	})
+})
@@ -0,0 +1,223 @@
+package kvwrapper
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Driver opens the wrappers of a KV store, from the DSNs of the scheme it is registered under
+type Driver interface {
+	Open(dsn *DSN) (KVWrapper, error)
+}
+
+// DriverFunc lets a function opening wrappers be registered as a Driver
+type DriverFunc func(dsn *DSN) (KVWrapper, error)
+
+// Open calls f
+func (f DriverFunc) Open(dsn *DSN) (KVWrapper, error) {
+	return f(dsn)
+}
+
+var (
+	driversMutex sync.RWMutex
+	drivers      = make(map[string]Driver)
+)
+
+func init() {
+	Register("mem", DriverFunc(openMem))
+}
+
+// Register makes driver available to Open under scheme. The packages of the KV stores register
+// their drivers when they are imported, so a program only has to import the ones it may open:
+//
+//	import _ "github.com/behance/go-common/kvwrapper_etcd_v3"
+//
+// It panics if driver is nil, or if a driver is already registered under scheme.
+func Register(scheme string, driver Driver) {
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+
+	if driver == nil {
+		panic("kvwrapper: Register driver is nil")
+	}
+	if _, dup := drivers[scheme]; dup {
+		panic("kvwrapper: Register called twice for scheme " + scheme)
+	}
+	drivers[scheme] = driver
+}
+
+// Drivers returns the sorted schemes of the registered drivers
+func Drivers() []string {
+	driversMutex.RLock()
+	defer driversMutex.RUnlock()
+
+	schemes := make([]string, 0, len(drivers))
+	for scheme := range drivers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// DSN is a parsed data source name, naming a KV store as a URL:
+//
+//	etcd2://user:pass@h1:2379,h2:2379/prefix?timeout=5s
+//
+// The hosts are separated by commas, with or without a port, IPv6 hosts in brackets. The path is
+// the namespace of the wrapper Open returns, and the query holds the options of the driver.
+type DSN struct {
+	Scheme   string
+	Username string
+	Password string
+	Hosts    []string
+	// Prefix is the path of the DSN, without its trailing "/". Drivers that take the path for
+	// something else than a namespace clear it.
+	Prefix  string
+	Options url.Values
+}
+
+// ParseDSN parses dsn, a URL such as etcd3://h1:2379,h2:2379/prefix. The hosts are split on
+// their commas before being parsed one by one, as net/url only takes a single host: each of them
+// may have a port or not, and IPv6 hosts are given in brackets, such as [::1]:2379.
+func ParseDSN(dsn string) (*DSN, error) {
+	i := strings.Index(dsn, "://")
+	if i <= 0 {
+		return nil, fmt.Errorf("DSN %q is not a URL such as scheme://host", dsn)
+	}
+	authority, rest := dsn[i+len("://"):], ""
+	if end := strings.IndexAny(authority, "/?#"); end >= 0 {
+		authority, rest = authority[:end], authority[end:]
+	}
+	userinfo, hosts := "", authority
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		userinfo, hosts = authority[:at+1], authority[at+1:]
+	}
+
+	// the DSN is parsed without its hosts, which are parsed on their own below
+	u, err := url.Parse(dsn[:i] + "://" + userinfo + rest)
+	if err != nil {
+		return nil, err
+	}
+	d := &DSN{
+		Scheme:  u.Scheme,
+		Prefix:  strings.TrimSuffix(u.Path, "/"),
+		Options: u.Query(),
+	}
+	if u.User != nil {
+		d.Username = u.User.Username()
+		d.Password, _ = u.User.Password()
+	}
+	for _, host := range strings.Split(hosts, ",") {
+		if host == "" {
+			continue
+		}
+		h, err := url.Parse("//" + host)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid host %q in DSN %q: %s", host, dsn, err)
+		}
+		d.Hosts = append(d.Hosts, h.Host)
+	}
+	return d, nil
+}
+
+// Servers returns the hosts as http URLs, such as http://h1:2379, or as https URLs if the tls
+// option is set
+func (d *DSN) Servers() ([]string, error) {
+	tls, err := d.Bool("tls")
+	if err != nil {
+		return nil, err
+	}
+	scheme := "http"
+	if tls {
+		scheme = "https"
+	}
+	servers := make([]string, 0, len(d.Hosts))
+	for _, host := range d.Hosts {
+		servers = append(servers, scheme+"://"+host)
+	}
+	return servers, nil
+}
+
+// CheckOptions fails on the options of the DSN that are not among known
+func (d *DSN) CheckOptions(known ...string) error {
+	for name := range d.Options {
+		found := false
+		for _, k := range known {
+			if name == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown option %q for %s", name, d.Scheme)
+		}
+	}
+	return nil
+}
+
+// Duration returns the option name as a time.Duration, 0 if it is not set
+func (d *DSN) Duration(name string) (time.Duration, error) {
+	s := d.Options.Get(name)
+	if s == "" {
+		return 0, nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid option %s=%q: %s", name, s, err)
+	}
+	return v, nil
+}
+
+// Bool returns the option name as a bool, false if it is not set
+func (d *DSN) Bool(name string) (bool, error) {
+	s := d.Options.Get(name)
+	if s == "" {
+		return false, nil
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("Invalid option %s=%q: %s", name, s, err)
+	}
+	return v, nil
+}
+
+// Open returns the wrapper of the KV store named by dsn, through the driver registered under its
+// scheme. A DSN with a path opens a NamespacedWrapper confined to it, taking keys relative to it:
+//
+//	kv, err := kvwrapper.Open("etcd3://user:pass@h1:2379,h2:2379/app?timeout=5s")
+//
+// mem:// opens a KVFaker, the other schemes are registered by the packages of the KV stores.
+func Open(dsn string) (KVWrapper, error) {
+	d, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	driversMutex.RLock()
+	driver, ok := drivers[d.Scheme]
+	driversMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown KV store %q, is its package imported?", d.Scheme)
+	}
+
+	kv, err := driver.Open(d)
+	if err != nil {
+		return nil, err
+	}
+	if d.Prefix != "" {
+		kv = Namespace(kv, d.Prefix)
+	}
+	return kv, nil
+}
+
+// openMem opens a KVFaker, ignoring the hosts of dsn
+func openMem(dsn *DSN) (KVWrapper, error) {
+	if err := dsn.CheckOptions(); err != nil {
+		return nil, err
+	}
+	return NewKVWrapper(nil, KVFaker{}), nil
+}
@@ -0,0 +1,115 @@
+package kvwrapper_test
+
+import (
+	"time"
+
+	. "github.com/behance/go-common/kvwrapper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Open", func() {
+	It("Parses DSNs", func() {
+		dsn, err := ParseDSN("etcd2://user:p%40ss@h1:2379,h2:2379/app/?timeout=5s&tls=true")
+		Expect(err).To(BeNil())
+		Expect(dsn.Scheme).To(Equal("etcd2"))
+		Expect(dsn.Username).To(Equal("user"))
+		Expect(dsn.Password).To(Equal("p@ss"))
+		Expect(dsn.Hosts).To(Equal([]string{"h1:2379", "h2:2379"}))
+		Expect(dsn.Prefix).To(Equal("/app"))
+
+		timeout, err := dsn.Duration("timeout")
+		Expect(err).To(BeNil())
+		Expect(timeout).To(Equal(5 * time.Second))
+		servers, err := dsn.Servers()
+		Expect(err).To(BeNil())
+		Expect(servers).To(Equal([]string{"https://h1:2379", "https://h2:2379"}))
+
+		Expect(dsn.CheckOptions("timeout", "tls")).To(BeNil())
+		Expect(dsn.CheckOptions("timeout")).NotTo(BeNil())
+	})
+
+	It("Parses DSNs whose hosts have no port, or are IPv6 addresses", func() {
+		dsn, err := ParseDSN("etcd2://h1:2379,h2/p")
+		Expect(err).To(BeNil())
+		Expect(dsn.Hosts).To(Equal([]string{"h1:2379", "h2"}))
+		Expect(dsn.Prefix).To(Equal("/p"))
+
+		dsn, err = ParseDSN("etcd3://user:pass@[::1]:2379,[::2]:2379?tls=true")
+		Expect(err).To(BeNil())
+		Expect(dsn.Username).To(Equal("user"))
+		Expect(dsn.Hosts).To(Equal([]string{"[::1]:2379", "[::2]:2379"}))
+		servers, err := dsn.Servers()
+		Expect(err).To(BeNil())
+		Expect(servers).To(Equal([]string{"https://[::1]:2379", "https://[::2]:2379"}))
+
+		dsn, err = ParseDSN("consul://[::1],h2:8500")
+		Expect(err).To(BeNil())
+		Expect(dsn.Hosts).To(Equal([]string{"[::1]", "h2:8500"}))
+		Expect(dsn.Prefix).To(BeEmpty())
+	})
+
+	It("Rejects invalid hosts", func() {
+		_, err := ParseDSN("etcd3://h1:2379,[::1:2379")
+		Expect(err).NotTo(BeNil())
+		_, err = ParseDSN("etcd3://h1:port")
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("Rejects DSNs without a scheme or with invalid options", func() {
+		_, err := ParseDSN("h1:2379")
+		Expect(err).NotTo(BeNil())
+		_, err = ParseDSN("//h1:2379")
+		Expect(err).NotTo(BeNil())
+
+		dsn, err := ParseDSN("etcd3://h1?timeout=soon")
+		Expect(err).To(BeNil())
+		_, err = dsn.Duration("timeout")
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("Opens KVFakers", func() {
+		kv, err := Open("mem://")
+		Expect(err).To(BeNil())
+		Expect(kv).To(BeAssignableToTypeOf(KVFaker{}))
+		Expect(kv.Set("/key", "val", 0)).To(BeNil())
+	})
+
+	It("Confines the wrapper to the path of the DSN", func() {
+		kv, err := Open("mem:///app")
+		Expect(err).To(BeNil())
+		ns, ok := kv.(NamespacedWrapper)
+		Expect(ok).To(BeTrue())
+		Expect(ns.Prefix).To(Equal("/app"))
+
+		Expect(kv.Set("key", "val", 0)).To(BeNil())
+		stored, err := ns.Backend.GetVal("/app/key")
+		Expect(err).To(BeNil())
+		Expect(stored.Value).To(Equal("val"))
+	})
+
+	It("Fails on unknown schemes and options", func() {
+		_, err := Open("nope://h1")
+		Expect(err).NotTo(BeNil())
+		_, err = Open("mem://?timeout=5s")
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("Registers drivers", func() {
+		opened := false
+		Register("test", DriverFunc(func(dsn *DSN) (KVWrapper, error) {
+			opened = true
+			Expect(dsn.Hosts).To(Equal([]string{"h1"}))
+			return NewKVWrapper(nil, KVFaker{}), nil
+		}))
+		Expect(Drivers()).To(ContainElement("test"))
+
+		_, err := Open("test://h1")
+		Expect(err).To(BeNil())
+		Expect(opened).To(BeTrue())
+
+		Expect(func() { Register("test", DriverFunc(nil)) }).To(Panic())
+		Expect(func() { Register("other", nil) }).To(Panic())
+	})
+})
@@ -0,0 +1,120 @@
+package kvwrapper
+
+import (
+	"context"
+	"sort"
+)
+
+// DefaultPageSize is how many keys the wrappers listing a prefix in pages fetch at once, when
+// they are not given a page size
+var DefaultPageSize int64 = 1000
+
+// Page is a page of the keys GetList would return, sorted by key
+type Page struct {
+	KeyValues []*KeyValue
+	// Next is the token of the following page, empty on the last page
+	Next string
+}
+
+// PagingKVWrapper is implemented by the KVWrappers that can list a prefix one page at a time,
+// without holding it all in memory
+type PagingKVWrapper interface {
+	KVWrapper
+	// GetPage returns up to limit of the keys GetList would return for key, sorted by key,
+	// starting at the page of token, "" for the first page. A limit of 0 or less returns them all.
+	// The pages are not a snapshot: keys changed while listing may be reported as they were or as they are.
+	GetPage(ctx context.Context, key string, limit int64, token string) (*Page, error)
+}
+
+// GetPage returns a page of the keys below key. Wrappers that do not implement PagingKVWrapper
+// list key in full with GetList, and return the requested page of it.
+func GetPage(ctx context.Context, kv KVWrapper, key string, limit int64, token string) (*Page, error) {
+	if p, ok := kv.(PagingKVWrapper); ok {
+		return p.GetPage(ctx, key, limit, token)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	kvs, err := kv.GetList(key, true)
+	if err != nil {
+		return nil, err
+	}
+	return Paginate(kvs, limit, token), nil
+}
+
+// Paginate returns the page of kvs, sorted by key, that starts after the key token and holds
+// up to limit keys. It is meant for the wrappers that have to list a prefix in full anyway.
+func Paginate(kvs []*KeyValue, limit int64, token string) *Page {
+	start := 0
+	if token != "" {
+		start = sort.Search(len(kvs), func(i int) bool { return kvs[i].Key > token })
+	}
+	kvs = kvs[start:]
+	if limit <= 0 || int64(len(kvs)) <= limit {
+		return &Page{KeyValues: kvs}
+	}
+	kvs = kvs[:limit]
+	return &Page{KeyValues: kvs, Next: kvs[len(kvs)-1].Key}
+}
+
+// Iterator walks the keys below a prefix, fetching them a page at a time:
+//
+//	it := kvwrapper.Iterate(ctx, kv, "/registry", 500)
+//	for it.Next() {
+//		use(it.KeyValue())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	ctx      context.Context
+	kv       KVWrapper
+	key      string
+	pageSize int64
+
+	page    []*KeyValue
+	current *KeyValue
+	next    string
+	started bool
+	err     error
+}
+
+// Iterate returns an Iterator over the keys GetList would return for key, sorted by key, fetched
+// pageSize at a time, or DefaultPageSize if pageSize is 0 or less
+func Iterate(ctx context.Context, kv KVWrapper, key string, pageSize int64) *Iterator {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	return &Iterator{ctx: ctx, kv: kv, key: key, pageSize: pageSize}
+}
+
+// Next moves to the next key, fetching the next page when needed. It returns false once every
+// key has been walked through, or an error occurred.
+func (it *Iterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.err != nil || it.started && it.next == "" {
+			it.current = nil
+			return false
+		}
+		p, err := GetPage(it.ctx, it.kv, it.key, it.pageSize, it.next)
+		it.started = true
+		if err != nil {
+			it.err = err
+			continue
+		}
+		it.page, it.next = p.KeyValues, p.Next
+	}
+	it.current, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// KeyValue returns the key Next moved to
+func (it *Iterator) KeyValue() *KeyValue {
+	return it.current
+}
+
+// Err returns the error that stopped the iteration, if any. A missing prefix is ErrKeyNotFound,
+// as with GetList.
+func (it *Iterator) Err() error {
+	return it.err
+}
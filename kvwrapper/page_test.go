@@ -0,0 +1,104 @@
+package kvwrapper_test
+
+import (
+	"context"
+
+	. "github.com/behance/go-common/kvwrapper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// listOnly hides every method of the wrapper it holds but the ones of KVWrapper
+type listOnly struct {
+	KVWrapper
+}
+
+func keysOf(kvs []*KeyValue) []string {
+	keys := []string{}
+	for _, kv := range kvs {
+		keys = append(keys, kv.Key)
+	}
+	return keys
+}
+
+var _ = Describe("Pages", func() {
+	var (
+		kv  KVWrapper
+		ctx context.Context
+	)
+
+	BeforeEach(func() {
+		kv = NewKVWrapper(nil, KVFaker{})
+		for _, name := range []string{"c", "a", "e", "b", "d"} {
+			kv.Set("/parent/"+name, name+"val", 0)
+		}
+		kv.Set("/parent/sub/child", "childval", 0)
+		ctx = context.Background()
+	})
+
+	It("Lists a prefix one page at a time", func() {
+		Expect(kv).To(BeAssignableToTypeOf(KVFaker{}))
+		_, ok := kv.(PagingKVWrapper)
+		Expect(ok).To(BeTrue())
+
+		page, err := GetPage(ctx, kv, "/parent", 4, "")
+		Expect(err).To(BeNil())
+		Expect(keysOf(page.KeyValues)).To(Equal([]string{"/parent/a", "/parent/b", "/parent/c", "/parent/d"}))
+		Expect(page.Next).To(Equal("/parent/d"))
+
+		page, err = GetPage(ctx, kv, "/parent", 4, page.Next)
+		Expect(err).To(BeNil())
+		Expect(keysOf(page.KeyValues)).To(Equal([]string{"/parent/e", "/parent/sub"}))
+		Expect(page.KeyValues[1].HasChildren).To(BeTrue())
+		Expect(page.Next).To(BeEmpty())
+	})
+
+	It("Lists everything without a limit", func() {
+		page, err := GetPage(ctx, kv, "/parent", 0, "")
+		Expect(err).To(BeNil())
+		Expect(page.KeyValues).To(HaveLen(6))
+		Expect(page.Next).To(BeEmpty())
+	})
+
+	It("Falls back to GetList on the wrappers that cannot page", func() {
+		_, ok := KVWrapper(listOnly{kv}).(PagingKVWrapper)
+		Expect(ok).To(BeFalse())
+
+		page, err := GetPage(ctx, listOnly{kv}, "/parent", 5, "/parent/b")
+		Expect(err).To(BeNil())
+		Expect(keysOf(page.KeyValues)).To(Equal([]string{"/parent/c", "/parent/d", "/parent/e", "/parent/sub"}))
+		Expect(page.Next).To(BeEmpty())
+	})
+
+	It("Iterates over a prefix", func() {
+		it := Iterate(ctx, listOnly{kv}, "/parent", 2)
+		keys := []string{}
+		for it.Next() {
+			keys = append(keys, it.KeyValue().Key)
+		}
+		Expect(it.Err()).To(BeNil())
+		Expect(keys).To(Equal([]string{"/parent/a", "/parent/b", "/parent/c", "/parent/d", "/parent/e", "/parent/sub"}))
+		Expect(it.KeyValue()).To(BeNil())
+	})
+
+	It("Stops iterating on errors", func() {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		it := Iterate(cancelled, kv, "/parent", 2)
+		Expect(it.Next()).To(BeFalse())
+		Expect(it.Err()).To(Equal(context.Canceled))
+	})
+
+	It("Lists namespaces one page at a time", func() {
+		ns := Namespace(kv, "/parent")
+		page, err := ns.GetPage(ctx, "", 2, "")
+		Expect(err).To(BeNil())
+		Expect(keysOf(page.KeyValues)).To(Equal([]string{"a", "b"}))
+
+		page, err = ns.GetPage(ctx, "", 2, page.Next)
+		Expect(err).To(BeNil())
+		Expect(keysOf(page.KeyValues)).To(Equal([]string{"c", "d"}))
+	})
+})
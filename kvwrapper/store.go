@@ -0,0 +1,292 @@
+package kvwrapper
+
+import (
+	"context"
+	"sort"
+
+	"github.com/behance/go-common/internal/kvtree"
+)
+
+// StoreWrapper implements the operations of a KVWrapper over a kvtree.Store, with the semantics
+// of kvwrapper_etcd (v2). KVFaker and kvwrapper_file embed it, and add the way their store is
+// created and kept.
+type StoreWrapper struct {
+	store *kvtree.Store
+}
+
+// NewStoreWrapper returns the StoreWrapper over store
+func NewStoreWrapper(store *kvtree.Store) StoreWrapper {
+	return StoreWrapper{store: store}
+}
+
+// storeError maps the errors of the store onto the ones of the wrappers
+func storeError(err error) error {
+	switch err {
+	case kvtree.ErrKeyNotFound:
+		return ErrKeyNotFound
+	case kvtree.ErrConflict:
+		return ErrConflict
+	case kvtree.ErrNotDir, kvtree.ErrNotFile:
+		return ErrInvalidKey
+	}
+	return err
+}
+
+// Set sets key = val with a ttl of ttl. The directories above key are created as needed.
+func (s StoreWrapper) Set(key string, val string, ttl uint64) error {
+	_, err := s.store.Set(key, val, ttl)
+	return storeError(err)
+}
+
+// Create sets key = val only if key does not exist yet
+func (s StoreWrapper) Create(key string, val string, ttl uint64) (int64, error) {
+	index, err := s.store.Create(key, val, ttl)
+	return int64(index), storeError(err)
+}
+
+// CompareAndSwap sets key = val only if the current value of key is prevVal
+func (s StoreWrapper) CompareAndSwap(key string, val string, prevVal string, ttl uint64) (int64, error) {
+	index, err := s.store.CompareAndSwap(key, val, prevVal, ttl)
+	return int64(index), storeError(err)
+}
+
+// CompareAndSwapRevision sets key = val only if key was last modified at revision prevRev
+func (s StoreWrapper) CompareAndSwapRevision(key string, val string, prevRev int64, ttl uint64) (int64, error) {
+	index, err := s.store.CompareAndSwapIndex(key, val, uint64(prevRev), ttl)
+	return int64(index), storeError(err)
+}
+
+// CompareAndDelete removes key only if its current value is prevVal
+func (s StoreWrapper) CompareAndDelete(key string, prevVal string) error {
+	return storeError(s.store.CompareAndDelete(key, prevVal))
+}
+
+func (s StoreWrapper) keyValue(key string, n *kvtree.Node) *KeyValue {
+	return &KeyValue{
+		Key:            key,
+		Value:          n.Value,
+		HasChildren:    n.Dir,
+		TTL:            s.store.TTL(n),
+		Expiration:     n.Expiration,
+		CreateRevision: int64(n.CreatedIndex),
+		ModRevision:    int64(n.ModifiedIndex),
+		Version:        n.Version,
+	}
+}
+
+// GetVal returns the KeyValue at key, under the key it was asked for as etcd does
+func (s StoreWrapper) GetVal(key string) (*KeyValue, error) {
+	n, err := s.store.Get(key)
+	if err != nil {
+		return nil, ErrKeyNotFound
+	}
+	return s.keyValue(key, n), nil
+}
+
+// GetList returns the KeyValues directly below key, under their full path. They are sorted
+// by key if sort is set, and in the order they were created otherwise.
+func (s StoreWrapper) GetList(key string, sorted bool) ([]*KeyValue, error) {
+	children, err := s.store.Children(key)
+	if err != nil {
+		return nil, ErrKeyNotFound
+	}
+	if !sorted {
+		sort.SliceStable(children, func(i, j int) bool { return children[i].CreatedIndex < children[j].CreatedIndex })
+	}
+	kvs := make([]*KeyValue, 0, len(children))
+	for _, n := range children {
+		kvs = append(kvs, s.keyValue(n.Key, n))
+	}
+	return kvs, nil
+}
+
+// SetContext is Set, failing if ctx is already done
+func (s StoreWrapper) SetContext(ctx context.Context, key string, val string, ttl uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Set(key, val, ttl)
+}
+
+// GetValContext is GetVal, failing if ctx is already done
+func (s StoreWrapper) GetValContext(ctx context.Context, key string) (*KeyValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetVal(key)
+}
+
+// GetListContext is GetList, failing if ctx is already done
+func (s StoreWrapper) GetListContext(ctx context.Context, key string, sort bool) ([]*KeyValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetList(key, sort)
+}
+
+// CreateContext is Create, failing if ctx is already done
+func (s StoreWrapper) CreateContext(ctx context.Context, key string, val string, ttl uint64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Create(key, val, ttl)
+}
+
+// CompareAndSwapContext is CompareAndSwap, failing if ctx is already done
+func (s StoreWrapper) CompareAndSwapContext(ctx context.Context, key string, val string, prevVal string, ttl uint64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.CompareAndSwap(key, val, prevVal, ttl)
+}
+
+// CompareAndSwapRevisionContext is CompareAndSwapRevision, failing if ctx is already done
+func (s StoreWrapper) CompareAndSwapRevisionContext(ctx context.Context, key string, val string, prevRev int64, ttl uint64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.CompareAndSwapRevision(key, val, prevRev, ttl)
+}
+
+// CompareAndDeleteContext is CompareAndDelete, failing if ctx is already done
+func (s StoreWrapper) CompareAndDeleteContext(ctx context.Context, key string, prevVal string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.CompareAndDelete(key, prevVal)
+}
+
+// GetPage returns a page of the keys GetList returns, failing if ctx is already done
+func (s StoreWrapper) GetPage(ctx context.Context, key string, limit int64, token string) (*Page, error) {
+	kvs, err := s.GetListContext(ctx, key, true)
+	if err != nil {
+		return nil, err
+	}
+	return Paginate(kvs, limit, token), nil
+}
+
+// List returns the keys GetList returns, sorted and stripped of their values in memory
+func (s StoreWrapper) List(ctx context.Context, key string, opts ListOptions) (*ListResult, error) {
+	kvs, err := s.GetListContext(ctx, key, opts.Sorted())
+	if err != nil {
+		return nil, err
+	}
+	return opts.Apply(kvs), nil
+}
+
+// DeleteContext is Delete, failing if ctx is already done
+func (s StoreWrapper) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Delete(key)
+}
+
+// DeleteListContext is DeleteList, failing if ctx is already done
+func (s StoreWrapper) DeleteListContext(ctx context.Context, key string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.DeleteList(key)
+}
+
+// Txn is emulated by applying the whole transaction while holding the mutex of the store
+func (s StoreWrapper) Txn() *Txn {
+	return NewTxn(s.commit)
+}
+
+func (s StoreWrapper) commit(compares []Compare, thenOps []Op, elseOps []Op) (*TxnResponse, error) {
+	storeCompares := make([]kvtree.Compare, 0, len(compares))
+	for _, cmp := range compares {
+		cmp := cmp
+		storeCompares = append(storeCompares, kvtree.Compare{Key: cmp.Key, Holds: func(n *kvtree.Node) bool {
+			if n == nil {
+				return cmp.Holds(nil, 0)
+			}
+			return cmp.Holds(s.keyValue(cmp.Key, n), int64(n.ModifiedIndex))
+		}})
+	}
+
+	tr, err := s.store.Txn(storeCompares, storeOps(thenOps), storeOps(elseOps))
+	if err != nil {
+		return nil, storeError(err)
+	}
+	ops := thenOps
+	if !tr.Succeeded {
+		ops = elseOps
+	}
+	r := &TxnResponse{Succeeded: tr.Succeeded, Revision: int64(tr.Index)}
+	for i, op := range ops {
+		result := &OpResult{Op: op, Deleted: tr.Results[i].Deleted}
+		if n := tr.Results[i].Node; n != nil {
+			result.KeyValue = s.keyValue(op.Key, n)
+		}
+		r.Results = append(r.Results, result)
+	}
+	return r, nil
+}
+
+// storeOps converts ops to the ones of the store
+func storeOps(ops []Op) []kvtree.Op {
+	converted := make([]kvtree.Op, 0, len(ops))
+	for _, op := range ops {
+		c := kvtree.Op{Key: op.Key, Value: op.Value, TTL: op.TTL}
+		switch op.Type {
+		case OpSet:
+			c.Type = kvtree.OpSet
+		case OpDelete:
+			c.Type = kvtree.OpDelete
+		case OpGet:
+			c.Type = kvtree.OpGet
+		}
+		converted = append(converted, c)
+	}
+	return converted
+}
+
+// Delete removes a single key. Directories have to be removed with DeleteList.
+func (s StoreWrapper) Delete(key string) error {
+	_, err := s.store.Delete(key, false)
+	return storeError(err)
+}
+
+// DeleteList removes key, recursively if it is a directory, and returns the number of
+// keys (not directories) that were removed
+func (s StoreWrapper) DeleteList(key string) (int64, error) {
+	deleted, err := s.store.Delete(key, true)
+	return deleted, storeError(err)
+}
+
+// Watch delivers the changes made to the store, under the full path of their keys.
+// Events are queued per watch, so a slow reader never blocks writers.
+func (s StoreWrapper) Watch(ctx context.Context, key string, recursive bool) (<-chan *WatchEvent, error) {
+	changes := s.store.Watch(ctx, key, recursive)
+
+	events := make(chan *WatchEvent)
+	go func() {
+		defer close(events)
+
+		for change := range changes {
+			ev := &WatchEvent{
+				Key:      change.Node.Key,
+				Revision: int64(change.Index),
+			}
+			switch change.Type {
+			case kvtree.EventSet:
+				ev.Type = EventPut
+				ev.Value = change.Node.Value
+			case kvtree.EventDelete:
+				ev.Type = EventDelete
+			case kvtree.EventExpire:
+				ev.Type = EventExpire
+			}
+
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
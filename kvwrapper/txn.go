@@ -0,0 +1,199 @@
+package kvwrapper
+
+import (
+	"context"
+	"strings"
+)
+
+// CompareTarget is the part of a key's state a Compare looks at
+type CompareTarget int
+
+const (
+	// CompareValue compares the current value of the key
+	CompareValue CompareTarget = iota
+	// CompareRevision compares the revision at which the key was last modified, 0 if it does not exist
+	CompareRevision
+)
+
+// Compare is a condition on the state of a key, evaluated when a Txn is committed.
+// Result is one of "=", "!=", "<" or ">". As in etcd v3, a value comparison on a key
+// that does not exist always fails.
+type Compare struct {
+	Key      string
+	Target   CompareTarget
+	Result   string
+	Value    string
+	Revision int64
+}
+
+// Holds tells whether the compare holds for a key currently set to kv and last modified at
+// revision rev. kv is nil, and rev 0, if the key does not exist. It is meant to be used by the
+// KVWrapper implementations that evaluate compares themselves.
+func (c Compare) Holds(kv *KeyValue, rev int64) bool {
+	var diff int
+	switch c.Target {
+	case CompareValue:
+		if kv == nil {
+			return false
+		}
+		diff = strings.Compare(kv.Value, c.Value)
+	case CompareRevision:
+		if rev < c.Revision {
+			diff = -1
+		} else if rev > c.Revision {
+			diff = 1
+		}
+	}
+
+	switch c.Result {
+	case "=":
+		return diff == 0
+	case "!=":
+		return diff != 0
+	case "<":
+		return diff < 0
+	case ">":
+		return diff > 0
+	}
+	return false
+}
+
+// ValueEquals holds if the value of key is val
+func ValueEquals(key string, val string) Compare {
+	return Compare{Key: key, Target: CompareValue, Result: "=", Value: val}
+}
+
+// ValueNotEquals holds if key exists with a value other than val
+func ValueNotEquals(key string, val string) Compare {
+	return Compare{Key: key, Target: CompareValue, Result: "!=", Value: val}
+}
+
+// RevisionEquals holds if key was last modified at revision rev
+func RevisionEquals(key string, rev int64) Compare {
+	return Compare{Key: key, Target: CompareRevision, Result: "=", Revision: rev}
+}
+
+// KeyExists holds if key exists
+func KeyExists(key string) Compare {
+	return Compare{Key: key, Target: CompareRevision, Result: ">", Revision: 0}
+}
+
+// KeyMissing holds if key does not exist
+func KeyMissing(key string) Compare {
+	return Compare{Key: key, Target: CompareRevision, Result: "=", Revision: 0}
+}
+
+// OpType is the kind of operation performed by an Op
+type OpType int
+
+const (
+	// OpSet sets a key
+	OpSet OpType = iota
+	// OpDelete removes a single key
+	OpDelete
+	// OpGet reads a single key
+	OpGet
+)
+
+// Op is a single operation performed by a Txn
+type Op struct {
+	Type  OpType
+	Key   string
+	Value string
+	TTL   uint64
+}
+
+// SetOp sets key = val with a ttl of ttl
+func SetOp(key string, val string, ttl uint64) Op {
+	return Op{Type: OpSet, Key: key, Value: val, TTL: ttl}
+}
+
+// DeleteOp removes the single key
+func DeleteOp(key string) Op {
+	return Op{Type: OpDelete, Key: key}
+}
+
+// GetOp reads the single key
+func GetOp(key string) Op {
+	return Op{Type: OpGet, Key: key}
+}
+
+// OpResult is the outcome of a single Op. KeyValue is set for OpGet, and left nil
+// if the key does not exist. Deleted is set for OpDelete.
+type OpResult struct {
+	Op       Op
+	KeyValue *KeyValue
+	Deleted  int64
+}
+
+// TxnResponse is the outcome of a committed Txn. Succeeded tells whether the compares
+// held, hence whether Results belong to the Then or the Else operations.
+type TxnResponse struct {
+	Succeeded bool
+	Revision  int64
+	Results   []*OpResult
+}
+
+// TxnCommitFunc applies a transaction atomically
+type TxnCommitFunc func(compares []Compare, thenOps []Op, elseOps []Op) (*TxnResponse, error)
+
+// TxnContextCommitFunc applies a transaction atomically, bound to ctx
+type TxnContextCommitFunc func(ctx context.Context, compares []Compare, thenOps []Op, elseOps []Op) (*TxnResponse, error)
+
+// Txn builds a transaction: when committed, if every compare holds the Then operations
+// are applied, otherwise the Else operations are.
+type Txn struct {
+	compares []Compare
+	thenOps  []Op
+	elseOps  []Op
+	commit   TxnCommitFunc
+	// commitContext is nil for the wrappers that cannot bind a transaction to a context
+	commitContext TxnContextCommitFunc
+}
+
+// NewTxn returns an empty Txn applied by commit. It is meant to be used by the KVWrapper implementations.
+func NewTxn(commit TxnCommitFunc) *Txn {
+	return &Txn{commit: commit}
+}
+
+// NewContextTxn returns an empty Txn applied by commit, or by commitContext when it is committed
+// with CommitContext. It is meant to be used by the KVWrapper implementations that can bind a
+// transaction to a context.
+func NewContextTxn(commit TxnCommitFunc, commitContext TxnContextCommitFunc) *Txn {
+	return &Txn{commit: commit, commitContext: commitContext}
+}
+
+// If adds compares to the transaction
+func (t *Txn) If(compares ...Compare) *Txn {
+	t.compares = append(t.compares, compares...)
+	return t
+}
+
+// Then adds operations applied when every compare holds
+func (t *Txn) Then(ops ...Op) *Txn {
+	t.thenOps = append(t.thenOps, ops...)
+	return t
+}
+
+// Else adds operations applied when any compare fails
+func (t *Txn) Else(ops ...Op) *Txn {
+	t.elseOps = append(t.elseOps, ops...)
+	return t
+}
+
+// Commit applies the transaction
+func (t *Txn) Commit() (*TxnResponse, error) {
+	return t.commit(t.compares, t.thenOps, t.elseOps)
+}
+
+// CommitContext applies the transaction bound to ctx. The transactions of the wrappers that
+// cannot bind them to a context are applied by Commit, once checked that ctx is not done.
+func (t *Txn) CommitContext(ctx context.Context) (*TxnResponse, error) {
+	if t.commitContext != nil {
+		return t.commitContext(ctx, t.compares, t.thenOps, t.elseOps)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return t.Commit()
+}
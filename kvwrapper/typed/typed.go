@@ -0,0 +1,167 @@
+// Package typed stores Go values in any KVWrapper, encoded by a pluggable Codec, so that callers
+// do not have to marshal and unmarshal the values around Set and GetVal themselves.
+package typed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/behance/go-common/kvwrapper"
+	"github.com/golang/protobuf/proto"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ErrNotProtoMessage is returned by Protobuf for the values that are not protobuf messages
+var ErrNotProtoMessage = errors.New("Value is not a protobuf message")
+
+// Codec encodes the values stored in the KV store
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// The codecs shipped with the package. Protobuf only handles proto.Message values.
+var (
+	JSON     Codec = jsonCodec{}
+	YAML     Codec = yamlCodec{}
+	Protobuf Codec = protobufCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type yamlCodec struct{}
+
+func (yamlCodec) Marshal(v interface{}) ([]byte, error)      { return yaml.Marshal(v) }
+func (yamlCodec) Unmarshal(data []byte, v interface{}) error { return yaml.Unmarshal(data, v) }
+
+type protobufCodec struct{}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrNotProtoMessage
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return ErrNotProtoMessage
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// DecodeError reports a value of the KV store that could not be decoded
+type DecodeError struct {
+	Key string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Could not decode the value of key %s: %s", e.Key, e.Err)
+}
+
+// Store stores the values encoded by Codec in KV
+type Store struct {
+	KV    kvwrapper.KVWrapper
+	Codec Codec
+}
+
+// New returns a Store encoding the values of kv with codec
+func New(kv kvwrapper.KVWrapper, codec Codec) Store {
+	return Store{KV: kv, Codec: codec}
+}
+
+// Set encodes v and stores it at key
+func (s Store) Set(key string, v interface{}, ttl uint64) error {
+	data, err := s.Codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.KV.Set(key, string(data), ttl)
+}
+
+// Create encodes v and stores it at key, failing with ErrConflict if key already exists
+func (s Store) Create(key string, v interface{}, ttl uint64) (int64, error) {
+	data, err := s.Codec.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	return s.KV.Create(key, string(data), ttl)
+}
+
+// Get decodes the value stored at key into v, a pointer. It returns a *DecodeError if the value
+// cannot be decoded.
+func (s Store) Get(key string, v interface{}) error {
+	kv, err := s.KV.GetVal(key)
+	if err != nil {
+		return err
+	}
+	return s.decode(kv, v)
+}
+
+func (s Store) decode(kv *kvwrapper.KeyValue, v interface{}) error {
+	if err := s.Codec.Unmarshal([]byte(kv.Value), v); err != nil {
+		return &DecodeError{Key: kv.Key, Err: err}
+	}
+	return nil
+}
+
+// List decodes the values below key into v, a pointer to a slice or to a map keyed by string, whose
+// elements are values or pointers. The map is keyed by the keys the KV store returns, and the slice
+// follows the order of GetList. Directories are skipped. It returns a *DecodeError naming the first
+// value that cannot be decoded.
+func (s Store) List(key string, sort bool, v interface{}) error {
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return fmt.Errorf("List needs a pointer to a slice or a map, not %T", v)
+	}
+	dst := ptr.Elem()
+	switch {
+	case dst.Kind() == reflect.Slice:
+	case dst.Kind() == reflect.Map && dst.Type().Key().Kind() == reflect.String:
+	default:
+		return fmt.Errorf("List needs a pointer to a slice or a map keyed by string, not %T", v)
+	}
+
+	kvs, err := s.KV.GetList(key, sort)
+	if err != nil {
+		return err
+	}
+
+	elemType := dst.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+	if dst.Kind() == reflect.Slice {
+		dst.Set(reflect.MakeSlice(dst.Type(), 0, len(kvs)))
+	} else {
+		dst.Set(reflect.MakeMap(dst.Type()))
+	}
+
+	for _, kv := range kvs {
+		if kv.HasChildren {
+			continue
+		}
+		elem := reflect.New(elemType)
+		if err := s.decode(kv, elem.Interface()); err != nil {
+			return err
+		}
+		if !isPtr {
+			elem = elem.Elem()
+		}
+		if dst.Kind() == reflect.Slice {
+			dst.Set(reflect.Append(dst, elem))
+		} else {
+			dst.SetMapIndex(reflect.ValueOf(kv.Key).Convert(dst.Type().Key()), elem)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package typed_test
+
+import (
+	"github.com/behance/go-common/kvwrapper"
+	. "github.com/behance/go-common/kvwrapper/typed"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type service struct {
+	Name string `json:"name" yaml:"name"`
+	Port int    `json:"port" yaml:"port"`
+}
+
+var _ = Describe("Typed", func() {
+	var (
+		kv kvwrapper.KVWrapper
+		s  Store
+	)
+
+	BeforeEach(func() {
+		kv = kvwrapper.NewKVWrapper(nil, kvwrapper.KVFaker{})
+		s = New(kv, JSON)
+	})
+
+	It("Stores and loads JSON values", func() {
+		Expect(s.Set("/services/web", service{Name: "web", Port: 80}, 0)).To(BeNil())
+
+		raw, err := kv.GetVal("/services/web")
+		Expect(err).To(BeNil())
+		Expect(raw.Value).To(Equal(`{"name":"web","port":80}`))
+
+		var svc service
+		Expect(s.Get("/services/web", &svc)).To(BeNil())
+		Expect(svc).To(Equal(service{Name: "web", Port: 80}))
+	})
+
+	It("Stores and loads YAML values", func() {
+		s = New(kv, YAML)
+		Expect(s.Set("/services/web", service{Name: "web", Port: 80}, 0)).To(BeNil())
+
+		raw, _ := kv.GetVal("/services/web")
+		Expect(raw.Value).To(Equal("name: web\nport: 80\n"))
+
+		var svc service
+		Expect(s.Get("/services/web", &svc)).To(BeNil())
+		Expect(svc).To(Equal(service{Name: "web", Port: 80}))
+	})
+
+	It("Stores and loads protobuf messages", func() {
+		s = New(kv, Protobuf)
+		Expect(s.Set("/services/web", &wrappers.StringValue{Value: "web"}, 0)).To(BeNil())
+
+		var v wrappers.StringValue
+		Expect(s.Get("/services/web", &v)).To(BeNil())
+		Expect(v.Value).To(Equal("web"))
+
+		Expect(s.Set("/services/web", service{}, 0)).To(Equal(ErrNotProtoMessage))
+	})
+
+	It("Creates values", func() {
+		_, err := s.Create("/services/web", service{Name: "web"}, 0)
+		Expect(err).To(BeNil())
+		_, err = s.Create("/services/web", service{Name: "other"}, 0)
+		Expect(err).To(Equal(kvwrapper.ErrConflict))
+	})
+
+	It("Returns the errors of the KV store", func() {
+		var svc service
+		Expect(s.Get("/services/missing", &svc)).To(Equal(kvwrapper.ErrKeyNotFound))
+	})
+
+	It("Names the key whose value cannot be decoded", func() {
+		kv.Set("/services/broken", "{not json", 0)
+
+		var svc service
+		err := s.Get("/services/broken", &svc)
+		Expect(err).To(BeAssignableToTypeOf(&DecodeError{}))
+		Expect(err.(*DecodeError).Key).To(Equal("/services/broken"))
+		Expect(err.Error()).To(ContainSubstring("/services/broken"))
+	})
+
+	Describe("List", func() {
+		BeforeEach(func() {
+			s.Set("/services/web", service{Name: "web", Port: 80}, 0)
+			s.Set("/services/api", service{Name: "api", Port: 8080}, 0)
+			kv.Set("/services/dir/nested", "{}", 0)
+		})
+
+		It("Decodes a prefix into a slice", func() {
+			var svcs []service
+			Expect(s.List("/services", true, &svcs)).To(BeNil())
+			Expect(svcs).To(Equal([]service{{Name: "api", Port: 8080}, {Name: "web", Port: 80}}))
+		})
+
+		It("Decodes a prefix into a map of pointers", func() {
+			var svcs map[string]*service
+			Expect(s.List("/services", false, &svcs)).To(BeNil())
+			Expect(svcs).To(HaveLen(2))
+			Expect(*svcs["/services/web"]).To(Equal(service{Name: "web", Port: 80}))
+			Expect(*svcs["/services/api"]).To(Equal(service{Name: "api", Port: 8080}))
+		})
+
+		It("Names the key whose value cannot be decoded", func() {
+			kv.Set("/services/broken", "{not json", 0)
+
+			var svcs []service
+			err := s.List("/services", true, &svcs)
+			Expect(err).To(BeAssignableToTypeOf(&DecodeError{}))
+			Expect(err.(*DecodeError).Key).To(Equal("/services/broken"))
+		})
+
+		It("Needs a pointer to a slice or a map", func() {
+			var svcs []service
+			Expect(s.List("/services", true, svcs)).NotTo(BeNil())
+			var m map[int]service
+			Expect(s.List("/services", true, &m)).NotTo(BeNil())
+		})
+	})
+})
@@ -0,0 +1,526 @@
+package kvwrapper_cache
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	log "github.com/behance/go-logging/log"
+)
+
+var (
+	// DefaultSize is how many results are cached by the wrappers that were not given a Size
+	DefaultSize = 1024
+	// DefaultTTL is how long results are cached by the wrappers that were not given a TTL
+	DefaultTTL = time.Minute
+	// DefaultPollInterval is how often the cached results are checked against a store that cannot be
+	// watched, for the wrappers that were not given a PollInterval
+	DefaultPollInterval = 10 * time.Second
+)
+
+// CacheWrapper serves GetVal and GetList from memory, reading through to Backend on a miss.
+// Cached results are dropped when Backend reports a change below them through Watch, or, if it
+// cannot be watched, when polling finds they changed. Writes made through the wrapper drop the
+// results they affect right away, so a caller always reads its own writes.
+// Any other operation goes straight to Backend. The TTL of a cached KeyValue is the one it had when
+// read, its Expiration stays accurate.
+type CacheWrapper struct {
+	// Backend is the wrapped store: a template built by NewKVWrapper, or a wrapper handed to Wrap
+	Backend kvwrapper.KVWrapper
+	// Size bounds how many results are cached, the least recently used ones being evicted first
+	Size int
+	// TTL bounds how long a result is cached
+	TTL time.Duration
+	// Prefix is the part of the keyspace that is cached, and watched. Keys outside of it are never
+	// cached. The whole keyspace if left blank.
+	Prefix string
+	// PollInterval is how often the cached results are checked against a Backend that cannot be watched
+	PollInterval time.Duration
+
+	cache *cache
+}
+
+// Stats counts what happened to the reads of a CacheWrapper
+type Stats struct {
+	// Hits is how many reads were served from memory
+	Hits uint64
+	// Misses is how many reads went to the backend
+	Misses uint64
+	// Evictions is how many results were dropped to stay within Size
+	Evictions uint64
+	// Invalidations is how many results were dropped because their keys changed
+	Invalidations uint64
+}
+
+// cache is shared by the copies of a CacheWrapper
+type cache struct {
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// gen changes with every invalidation, so that a result read before it is not cached after it
+	gen    uint64
+	stats  Stats
+	cancel context.CancelFunc
+}
+
+// entry is the cached result of a GetVal, or of a GetList if list is set
+type entry struct {
+	id      string
+	key     string
+	list    bool
+	sorted  bool
+	kv      *kvwrapper.KeyValue
+	kvs     []*kvwrapper.KeyValue
+	err     error
+	expires time.Time
+}
+
+// NewKVWrapper initializes Backend with servers, username and password, and wraps it
+func (c CacheWrapper) NewKVWrapper(servers []string, username, password string) kvwrapper.KVWrapper {
+	kv := c.Backend.NewKVWrapper(servers, username, password)
+	if kv == nil {
+		return nil
+	}
+	return c.Wrap(kv)
+}
+
+// Connect is NewKVWrapper, returning the error of Backend when it cannot be initialized
+func (c CacheWrapper) Connect(servers []string, username, password string) (kvwrapper.KVWrapper, error) {
+	kv, err := kvwrapper.Connect(servers, c.Backend, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return c.Wrap(kv), nil
+}
+
+// Wrap returns a CacheWrapper in front of kv, an initialized wrapper, configured as c
+func (c CacheWrapper) Wrap(kv kvwrapper.KVWrapper) CacheWrapper {
+	if c.Size <= 0 {
+		c.Size = DefaultSize
+	}
+	if c.TTL <= 0 {
+		c.TTL = DefaultTTL
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = DefaultPollInterval
+	}
+	c.Backend = kv
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cache = &cache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		cancel:  cancel,
+	}
+
+	// the empty prefix watches the whole keyspace, the keys without a leading "/" included
+	events, err := kv.Watch(ctx, c.Prefix, true)
+	if err != nil {
+		log.Warn("Could not watch the KV store, polling it instead.", "prefix", c.Prefix, "err", err)
+		go c.poll(ctx)
+	} else {
+		go c.invalidate(ctx, events)
+	}
+	return c
+}
+
+// Close stops watching or polling the backend. The results cached until then are kept.
+func (c CacheWrapper) Close() {
+	c.cache.cancel()
+}
+
+// Stats returns the counts of the reads so far
+func (c CacheWrapper) Stats() Stats {
+	c.cache.mutex.Lock()
+	defer c.cache.mutex.Unlock()
+	return c.cache.stats
+}
+
+// invalidate drops the results the events are about, until the watch ends. A watch that ends
+// on its own may have missed events, so everything is dropped and the backend polled instead.
+func (c CacheWrapper) invalidate(ctx context.Context, events <-chan *kvwrapper.WatchEvent) {
+	for ev := range events {
+		c.cache.drop(ev.Key)
+	}
+	if ctx.Err() == nil {
+		log.Warn("Lost the watch on the KV store, polling it instead.", "prefix", c.Prefix)
+		c.cache.dropAll()
+		c.poll(ctx)
+	}
+}
+
+// poll reads the cached results again every PollInterval, and drops the ones that changed
+func (c CacheWrapper) poll(ctx context.Context) {
+	ticker := time.NewTicker(c.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		for _, e := range c.cache.snapshot() {
+			var fresh *entry
+			if e.list {
+				kvs, err := c.Backend.GetList(e.key, e.sorted)
+				fresh = &entry{kvs: kvs, err: err}
+			} else {
+				kv, err := c.Backend.GetVal(e.key)
+				fresh = &entry{kv: kv, err: err}
+			}
+			if !e.same(fresh) {
+				c.cache.drop(e.key)
+			}
+		}
+	}
+}
+
+func (e *entry) same(o *entry) bool {
+	if e.err != o.err {
+		return false
+	}
+	if (e.kv == nil) != (o.kv == nil) || e.kv != nil && !sameKV(e.kv, o.kv) {
+		return false
+	}
+	if len(e.kvs) != len(o.kvs) {
+		return false
+	}
+	for i := range e.kvs {
+		if !sameKV(e.kvs[i], o.kvs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameKV tells whether a and b are the same state of a key. Their remaining ttls do not count,
+// as they go down on every read.
+func sameKV(a, b *kvwrapper.KeyValue) bool {
+	return a.Key == b.Key && a.Value == b.Value && a.HasChildren == b.HasChildren &&
+		a.CreateRevision == b.CreateRevision && a.ModRevision == b.ModRevision
+}
+
+// trim returns key without its leading and trailing slashes, so that the forms of a key compare equal
+func trim(key string) string {
+	return strings.Trim(key, "/")
+}
+
+func (c CacheWrapper) cached(key string) bool {
+	key, prefix := trim(key), trim(c.Prefix)
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+func valID(key string) string {
+	return "val " + key
+}
+
+func listID(key string, sorted bool) string {
+	if sorted {
+		return "list sorted " + key
+	}
+	return "list " + key
+}
+
+// get returns the cached result id, nil if there is none
+func (c *cache) get(id string) *entry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[id]
+	if ok && time.Now().Before(elem.Value.(*entry).expires) {
+		c.lru.MoveToFront(elem)
+		c.stats.Hits++
+		return elem.Value.(*entry)
+	}
+	if ok {
+		c.remove(elem)
+	}
+	c.stats.Misses++
+	return nil
+}
+
+// generation returns the current generation, to hand to put along with what is read from the backend
+func (c *cache) generation() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.gen
+}
+
+// put caches e, unless an invalidation happened since gen
+func (c *cache) put(e *entry, gen uint64, size int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	if elem, ok := c.entries[e.id]; ok {
+		c.remove(elem)
+	}
+	c.entries[e.id] = c.lru.PushFront(e)
+	for c.lru.Len() > size {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove must be called with the mutex held
+func (c *cache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*entry).id)
+}
+
+// drop removes the results that a change to key may affect: the ones for key itself, for the
+// keys above it, whose listings include it, and for the keys below it, in case it was a directory
+func (c *cache) drop(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.gen++
+	key = trim(key)
+	for _, elem := range c.entries {
+		cached := trim(elem.Value.(*entry).key)
+		if strings.HasPrefix(key, cached) || strings.HasPrefix(cached, key) {
+			c.remove(elem)
+			c.stats.Invalidations++
+		}
+	}
+}
+
+func (c *cache) dropAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.gen++
+	c.stats.Invalidations += uint64(c.lru.Len())
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+func (c *cache) snapshot() []*entry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entries := make([]*entry, 0, c.lru.Len())
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, elem.Value.(*entry))
+	}
+	return entries
+}
+
+// cacheable tells whether a result read from the backend can be cached: values and keys that
+// do not exist can, failures to read cannot
+func cacheable(err error) bool {
+	return err == nil || err == kvwrapper.ErrKeyNotFound
+}
+
+func copyKV(kv *kvwrapper.KeyValue) *kvwrapper.KeyValue {
+	if kv == nil {
+		return nil
+	}
+	c := *kv
+	return &c
+}
+
+func copyList(l []*kvwrapper.KeyValue) []*kvwrapper.KeyValue {
+	if l == nil {
+		return nil
+	}
+	c := make([]*kvwrapper.KeyValue, 0, len(l))
+	for _, kv := range l {
+		c = append(c, copyKV(kv))
+	}
+	return c
+}
+
+// GetVal returns the KeyValue at key from memory, reading it from Backend if it is not cached
+func (c CacheWrapper) GetVal(key string) (*kvwrapper.KeyValue, error) {
+	return c.getVal(key, func() (*kvwrapper.KeyValue, error) {
+		return c.Backend.GetVal(key)
+	})
+}
+
+// GetValContext is GetVal, reading from Backend bound to ctx
+func (c CacheWrapper) GetValContext(ctx context.Context, key string) (*kvwrapper.KeyValue, error) {
+	return c.getVal(key, func() (*kvwrapper.KeyValue, error) {
+		return kvwrapper.GetValContext(ctx, c.Backend, key)
+	})
+}
+
+// getVal returns the KeyValue at key from memory, reading it with read if it is not cached
+func (c CacheWrapper) getVal(key string, read func() (*kvwrapper.KeyValue, error)) (*kvwrapper.KeyValue, error) {
+	if !c.cached(key) {
+		return read()
+	}
+	if e := c.cache.get(valID(key)); e != nil {
+		return copyKV(e.kv), e.err
+	}
+
+	gen := c.cache.generation()
+	kv, err := read()
+	if cacheable(err) {
+		e := &entry{id: valID(key), key: key, kv: copyKV(kv), err: err, expires: time.Now().Add(c.TTL)}
+		c.cache.put(e, gen, c.Size)
+	}
+	return kv, err
+}
+
+// GetList returns the KeyValues found at key from memory, reading them from Backend if they are not cached
+func (c CacheWrapper) GetList(key string, sort bool) ([]*kvwrapper.KeyValue, error) {
+	return c.getList(key, sort, func() ([]*kvwrapper.KeyValue, error) {
+		return c.Backend.GetList(key, sort)
+	})
+}
+
+// GetListContext is GetList, reading from Backend bound to ctx
+func (c CacheWrapper) GetListContext(ctx context.Context, key string, sort bool) ([]*kvwrapper.KeyValue, error) {
+	return c.getList(key, sort, func() ([]*kvwrapper.KeyValue, error) {
+		return kvwrapper.GetListContext(ctx, c.Backend, key, sort)
+	})
+}
+
+// getList returns the KeyValues found at key from memory, reading them with read if they are not cached
+func (c CacheWrapper) getList(key string, sort bool, read func() ([]*kvwrapper.KeyValue, error)) ([]*kvwrapper.KeyValue, error) {
+	if !c.cached(key) {
+		return read()
+	}
+	id := listID(key, sort)
+	if e := c.cache.get(id); e != nil {
+		return copyList(e.kvs), e.err
+	}
+
+	gen := c.cache.generation()
+	kvs, err := read()
+	if cacheable(err) {
+		e := &entry{id: id, key: key, list: true, sorted: sort, kvs: copyList(kvs), err: err, expires: time.Now().Add(c.TTL)}
+		c.cache.put(e, gen, c.Size)
+	}
+	return kvs, err
+}
+
+// GetPage reads straight from Backend: the prefixes listed a page at a time are too large to cache
+func (c CacheWrapper) GetPage(ctx context.Context, key string, limit int64, token string) (*kvwrapper.Page, error) {
+	return kvwrapper.GetPage(ctx, c.Backend, key, limit, token)
+}
+
+// List reads straight from Backend: only the listings of GetList are cached
+func (c CacheWrapper) List(ctx context.Context, key string, opts kvwrapper.ListOptions) (*kvwrapper.ListResult, error) {
+	return kvwrapper.List(ctx, c.Backend, key, opts)
+}
+
+// Set writes through to Backend
+func (c CacheWrapper) Set(key string, val string, ttl uint64) error {
+	defer c.cache.drop(key)
+	return c.Backend.Set(key, val, ttl)
+}
+
+// SetContext writes through to Backend, bound to ctx
+func (c CacheWrapper) SetContext(ctx context.Context, key string, val string, ttl uint64) error {
+	defer c.cache.drop(key)
+	return kvwrapper.SetContext(ctx, c.Backend, key, val, ttl)
+}
+
+// Create writes through to Backend
+func (c CacheWrapper) Create(key string, val string, ttl uint64) (int64, error) {
+	defer c.cache.drop(key)
+	return c.Backend.Create(key, val, ttl)
+}
+
+// CreateContext writes through to Backend, bound to ctx
+func (c CacheWrapper) CreateContext(ctx context.Context, key string, val string, ttl uint64) (int64, error) {
+	defer c.cache.drop(key)
+	return kvwrapper.CreateContext(ctx, c.Backend, key, val, ttl)
+}
+
+// CompareAndSwap writes through to Backend
+func (c CacheWrapper) CompareAndSwap(key string, val string, prevVal string, ttl uint64) (int64, error) {
+	defer c.cache.drop(key)
+	return c.Backend.CompareAndSwap(key, val, prevVal, ttl)
+}
+
+// CompareAndSwapContext writes through to Backend, bound to ctx
+func (c CacheWrapper) CompareAndSwapContext(ctx context.Context, key string, val string, prevVal string, ttl uint64) (int64, error) {
+	defer c.cache.drop(key)
+	return kvwrapper.CompareAndSwapContext(ctx, c.Backend, key, val, prevVal, ttl)
+}
+
+// CompareAndSwapRevision writes through to Backend
+func (c CacheWrapper) CompareAndSwapRevision(key string, val string, prevRev int64, ttl uint64) (int64, error) {
+	defer c.cache.drop(key)
+	return c.Backend.CompareAndSwapRevision(key, val, prevRev, ttl)
+}
+
+// CompareAndSwapRevisionContext writes through to Backend, bound to ctx
+func (c CacheWrapper) CompareAndSwapRevisionContext(ctx context.Context, key string, val string, prevRev int64, ttl uint64) (int64, error) {
+	defer c.cache.drop(key)
+	return kvwrapper.CompareAndSwapRevisionContext(ctx, c.Backend, key, val, prevRev, ttl)
+}
+
+// CompareAndDelete writes through to Backend
+func (c CacheWrapper) CompareAndDelete(key string, prevVal string) error {
+	defer c.cache.drop(key)
+	return c.Backend.CompareAndDelete(key, prevVal)
+}
+
+// CompareAndDeleteContext writes through to Backend, bound to ctx
+func (c CacheWrapper) CompareAndDeleteContext(ctx context.Context, key string, prevVal string) error {
+	defer c.cache.drop(key)
+	return kvwrapper.CompareAndDeleteContext(ctx, c.Backend, key, prevVal)
+}
+
+// Txn commits through Backend, then drops the results for every key it wrote to
+func (c CacheWrapper) Txn() *kvwrapper.Txn {
+	return kvwrapper.NewContextTxn(
+		func(compares []kvwrapper.Compare, thenOps []kvwrapper.Op, elseOps []kvwrapper.Op) (*kvwrapper.TxnResponse, error) {
+			defer c.dropOps(thenOps, elseOps)
+			return c.Backend.Txn().If(compares...).Then(thenOps...).Else(elseOps...).Commit()
+		},
+		func(ctx context.Context, compares []kvwrapper.Compare, thenOps []kvwrapper.Op, elseOps []kvwrapper.Op) (*kvwrapper.TxnResponse, error) {
+			defer c.dropOps(thenOps, elseOps)
+			return c.Backend.Txn().If(compares...).Then(thenOps...).Else(elseOps...).CommitContext(ctx)
+		})
+}
+
+// dropOps drops the results for every key written to by the operations of a transaction
+func (c CacheWrapper) dropOps(thenOps []kvwrapper.Op, elseOps []kvwrapper.Op) {
+	for _, ops := range [][]kvwrapper.Op{thenOps, elseOps} {
+		for _, op := range ops {
+			if op.Type != kvwrapper.OpGet {
+				c.cache.drop(op.Key)
+			}
+		}
+	}
+}
+
+// Delete writes through to Backend
+func (c CacheWrapper) Delete(key string) error {
+	defer c.cache.drop(key)
+	return c.Backend.Delete(key)
+}
+
+// DeleteContext writes through to Backend, bound to ctx
+func (c CacheWrapper) DeleteContext(ctx context.Context, key string) error {
+	defer c.cache.drop(key)
+	return kvwrapper.DeleteContext(ctx, c.Backend, key)
+}
+
+// DeleteList writes through to Backend
+func (c CacheWrapper) DeleteList(key string) (int64, error) {
+	defer c.cache.drop(key)
+	return c.Backend.DeleteList(key)
+}
+
+// DeleteListContext writes through to Backend, bound to ctx
+func (c CacheWrapper) DeleteListContext(ctx context.Context, key string) (int64, error) {
+	defer c.cache.drop(key)
+	return kvwrapper.DeleteListContext(ctx, c.Backend, key)
+}
+
+// Watch watches Backend
+func (c CacheWrapper) Watch(ctx context.Context, key string, recursive bool) (<-chan *kvwrapper.WatchEvent, error) {
+	return c.Backend.Watch(ctx, key, recursive)
+}
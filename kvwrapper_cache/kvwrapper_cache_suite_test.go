@@ -0,0 +1,13 @@
+package kvwrapper_cache_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestKvwrapperCache(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "KvwrapperCache Suite")
+}
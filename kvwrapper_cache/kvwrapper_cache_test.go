@@ -0,0 +1,191 @@
+package kvwrapper_cache_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	. "github.com/behance/go-common/kvwrapper_cache"
+	log "github.com/behance/go-common/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// unwatchable is a store that cannot be watched, so the cache has to poll it
+type unwatchable struct {
+	kvwrapper.KVFaker
+}
+
+func (u unwatchable) Watch(ctx context.Context, key string, recursive bool) (<-chan *kvwrapper.WatchEvent, error) {
+	return nil, kvwrapper.ErrNotSupported
+}
+
+var _ = Describe("KvwrapperCache", func() {
+	var (
+		backend kvwrapper.KVWrapper
+		kv      CacheWrapper
+	)
+
+	BeforeEach(func() {
+		log.SetLevel(log.PanicLevel)
+		backend = kvwrapper.NewKVWrapper(nil, kvwrapper.KVFaker{})
+		backend.Set("/parent/child1", "child1val", 0)
+		backend.Set("/parent/child2", "child2val", 0)
+		kv = CacheWrapper{}.Wrap(backend)
+	})
+
+	AfterEach(func() {
+		kv.Close()
+	})
+
+	Describe("Reads", func() {
+		It("Serves repeated reads from memory", func() {
+			for i := 0; i < 3; i++ {
+				s, err := kv.GetVal("/parent/child1")
+				Expect(err).To(BeNil())
+				Expect(s.Value).To(Equal("child1val"))
+			}
+			for i := 0; i < 2; i++ {
+				l, err := kv.GetList("/parent", true)
+				Expect(err).To(BeNil())
+				Expect(l).To(HaveLen(2))
+			}
+			Expect(kv.Stats()).To(Equal(Stats{Hits: 3, Misses: 2}))
+		})
+		It("Caches missing keys", func() {
+			_, err := kv.GetVal("/missing")
+			Expect(err).To(MatchError(kvwrapper.ErrKeyNotFound))
+			_, err = kv.GetVal("/missing")
+			Expect(err).To(MatchError(kvwrapper.ErrKeyNotFound))
+			Expect(kv.Stats().Hits).To(Equal(uint64(1)))
+		})
+		It("Hands out copies", func() {
+			s, _ := kv.GetVal("/parent/child1")
+			s.Value = "changed"
+
+			s, _ = kv.GetVal("/parent/child1")
+			Expect(s.Value).To(Equal("child1val"))
+		})
+		It("Only caches the keys below Prefix", func() {
+			kv.Close()
+			kv = CacheWrapper{Prefix: "/parent"}.Wrap(backend)
+			backend.Set("/parentless", "value", 0)
+
+			kv.GetVal("/parentless")
+			kv.GetVal("/parentless")
+			kv.GetVal("/parent/child1")
+			kv.GetVal("/parent/child1")
+			Expect(kv.Stats()).To(Equal(Stats{Hits: 1, Misses: 1}))
+		})
+	})
+
+	Describe("Bounds", func() {
+		It("Evicts the least recently used results", func() {
+			kv.Close()
+			kv = CacheWrapper{Size: 2}.Wrap(backend)
+
+			kv.GetVal("/parent/child1")
+			kv.GetVal("/parent/child2")
+			kv.GetVal("/parent/child1")
+			kv.GetVal("/missing")
+			Expect(kv.Stats().Evictions).To(Equal(uint64(1)))
+
+			kv.GetVal("/parent/child1")
+			Expect(kv.Stats().Hits).To(Equal(uint64(2)))
+			kv.GetVal("/parent/child2")
+			Expect(kv.Stats().Hits).To(Equal(uint64(2)))
+		})
+		It("Expires results after TTL", func() {
+			kv.Close()
+			kv = CacheWrapper{TTL: 10 * time.Millisecond}.Wrap(backend)
+
+			kv.GetVal("/parent/child1")
+			time.Sleep(20 * time.Millisecond)
+			kv.GetVal("/parent/child1")
+			Expect(kv.Stats()).To(Equal(Stats{Misses: 2}))
+		})
+	})
+
+	Describe("Invalidation", func() {
+		It("Reads its own writes", func() {
+			kv.GetVal("/parent/child1")
+			kv.GetList("/parent", false)
+
+			Expect(kv.Set("/parent/child1", "newval", 0)).To(BeNil())
+			s, _ := kv.GetVal("/parent/child1")
+			Expect(s.Value).To(Equal("newval"))
+
+			kv.Set("/parent/child3", "child3val", 0)
+			l, _ := kv.GetList("/parent", false)
+			Expect(l).To(HaveLen(3))
+
+			_, err := kv.Txn().Then(kvwrapper.DeleteOp("/parent/child3")).Commit()
+			Expect(err).To(BeNil())
+			l, _ = kv.GetList("/parent", false)
+			Expect(l).To(HaveLen(2))
+		})
+		It("Reads its own writes bound to contexts", func() {
+			ctx := context.Background()
+			kv.GetValContext(ctx, "/parent/child1")
+			s, err := kv.GetValContext(ctx, "/parent/child1")
+			Expect(err).To(BeNil())
+			Expect(s.Value).To(Equal("child1val"))
+			Expect(kv.Stats().Hits).To(Equal(uint64(1)))
+
+			_, err = kv.CompareAndSwapContext(ctx, "/parent/child1", "newval", "child1val", 0)
+			Expect(err).To(BeNil())
+			s, _ = kv.GetValContext(ctx, "/parent/child1")
+			Expect(s.Value).To(Equal("newval"))
+
+			canceled, cancel := context.WithCancel(ctx)
+			cancel()
+			Expect(kv.DeleteContext(canceled, "/parent/child1")).To(MatchError(context.Canceled))
+			_, err = kv.GetListContext(canceled, "/parent/child2", false)
+			Expect(err).To(MatchError(context.Canceled))
+			_, err = kv.Txn().Then(kvwrapper.DeleteOp("/parent/child1")).CommitContext(canceled)
+			Expect(err).To(MatchError(context.Canceled))
+			s, _ = backend.GetVal("/parent/child1")
+			Expect(s.Value).To(Equal("newval"))
+		})
+		It("Drops the results the backend reports changed", func() {
+			kv.GetVal("/parent/child1")
+			kv.GetList("/parent", false)
+
+			backend.Set("/parent/child1", "newval", 0)
+			Eventually(func() string {
+				s, _ := kv.GetVal("/parent/child1")
+				return s.Value
+			}).Should(Equal("newval"))
+
+			backend.DeleteList("/parent")
+			Eventually(func() error {
+				_, err := kv.GetList("/parent", false)
+				return err
+			}).Should(MatchError(kvwrapper.ErrKeyNotFound))
+			Expect(kv.Stats().Invalidations).To(BeNumerically(">=", 2))
+		})
+		It("Polls the backends that cannot be watched", func() {
+			kv.Close()
+			backend = unwatchable{backend.(kvwrapper.KVFaker)}
+			kv = CacheWrapper{PollInterval: 10 * time.Millisecond}.Wrap(backend)
+
+			kv.GetVal("/parent/child1")
+			backend.Set("/parent/child1", "newval", 0)
+			Eventually(func() string {
+				s, _ := kv.GetVal("/parent/child1")
+				return s.Value
+			}).Should(Equal("newval"))
+		})
+	})
+
+	It("Builds its backend from a template", func() {
+		wrapped := kvwrapper.NewKVWrapper(nil, CacheWrapper{Backend: kvwrapper.KVFaker{}})
+		defer wrapped.(CacheWrapper).Close()
+
+		Expect(wrapped.Set("/key", "value", 0)).To(BeNil())
+		s, err := wrapped.GetVal("/key")
+		Expect(err).To(BeNil())
+		Expect(s.Value).To(Equal("value"))
+	})
+})
@@ -0,0 +1,25 @@
+package kvwrapper_consul_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	"github.com/behance/go-common/kvwrapper/kvwrappertest"
+	. "github.com/behance/go-common/kvwrapper_consul"
+)
+
+func TestConformance(t *testing.T) {
+	consul := newFakeConsul("")
+	defer consul.Close()
+
+	kvwrappertest.Suite{
+		New: func(t *testing.T) kvwrapper.KVWrapper {
+			return kvwrapper.NewKVWrapper([]string{consul.URL}, ConsulWrapper{})
+		},
+		Advance: func(kv kvwrapper.KVWrapper, d time.Duration) {
+			consul.advance(d)
+		},
+		MinTTL: MinTTL,
+	}.Run(t)
+}
@@ -0,0 +1,331 @@
+package kvwrapper_consul_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeConsul is a stand-in for the parts of the Consul HTTP API the wrapper uses: the KV store
+// with blocking queries, transactions and sessions. Sessions run on a clock that only moves with
+// advance, and expire plays the ttl of every session running out.
+type fakeConsul struct {
+	*httptest.Server
+	token string
+
+	mutex sync.Mutex
+	index uint64
+	kvs   map[string]*fakeKV
+	// sessions holds when each session expires, on the clock moved by advance
+	sessions map[string]time.Duration
+	now      time.Duration
+	created  int
+	changed  chan struct{}
+}
+
+type fakeKV struct {
+	Key         string
+	Value       []byte
+	Flags       uint64
+	Session     string `json:",omitempty"`
+	LockIndex   uint64
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+type fakeTxnOp struct {
+	KV fakeTxnKV
+}
+
+type fakeTxnKV struct {
+	Verb    string
+	Key     string
+	Value   []byte
+	Flags   uint64
+	Index   uint64
+	Session string
+}
+
+func newFakeConsul(token string) *fakeConsul {
+	f := &fakeConsul{
+		token:    token,
+		index:    1,
+		kvs:      make(map[string]*fakeKV),
+		sessions: make(map[string]time.Duration),
+		changed:  make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/kv/", f.handleKV)
+	mux.HandleFunc("/v1/txn", f.handleTxn)
+	mux.HandleFunc("/v1/session/create", f.handleSessionCreate)
+	mux.HandleFunc("/v1/session/destroy/", f.handleSessionDestroy)
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.token != "" && r.Header.Get("X-Consul-Token") != f.token {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	return f
+}
+
+// commit must be called with the mutex held, once a request changed the store
+func (f *fakeConsul) commit() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// expire invalidates every session, as if their ttl ran out
+func (f *fakeConsul) expire() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for session := range f.sessions {
+		f.invalidate(session)
+	}
+	f.commit()
+}
+
+// advance moves the clock of the sessions by d, invalidating the ones whose ttl ran out
+func (f *fakeConsul) advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.now += d
+	for session, expiration := range f.sessions {
+		if expiration <= f.now {
+			f.invalidate(session)
+		}
+	}
+	f.commit()
+}
+
+// invalidate must be called with the mutex held. It removes the keys attached to session.
+func (f *fakeConsul) invalidate(session string) {
+	delete(f.sessions, session)
+	for key, kv := range f.kvs {
+		if kv.Session == session {
+			delete(f.kvs, key)
+		}
+	}
+}
+
+func (f *fakeConsul) handleKV(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	query := r.URL.Query()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch r.Method {
+	case "GET":
+		if index, err := strconv.ParseUint(query.Get("index"), 10, 64); err == nil && index >= f.index {
+			changed := f.changed
+			f.mutex.Unlock()
+			select {
+			case <-changed:
+			case <-time.After(time.Minute):
+			case <-r.Context().Done():
+			}
+			f.mutex.Lock()
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+
+		_, recurse := query["recurse"]
+		_, keys := query["keys"]
+		switch {
+		case keys:
+			found := []string{}
+			seen := make(map[string]bool)
+			for _, k := range f.sortedKeys(key) {
+				rest := strings.TrimPrefix(k, key)
+				if sep := query.Get("separator"); sep != "" && strings.Contains(rest, sep) {
+					k = key + rest[:strings.Index(rest, sep)+len(sep)]
+				}
+				if !seen[k] {
+					seen[k] = true
+					found = append(found, k)
+				}
+			}
+			f.reply(w, found, len(found))
+		case recurse:
+			found := []*fakeKV{}
+			for _, k := range f.sortedKeys(key) {
+				found = append(found, f.kvs[k])
+			}
+			f.reply(w, found, len(found))
+		default:
+			if kv, ok := f.kvs[key]; ok {
+				f.reply(w, []*fakeKV{kv}, 1)
+			} else {
+				f.reply(w, nil, 0)
+			}
+		}
+	case "DELETE":
+		_, recurse := query["recurse"]
+		for k := range f.kvs {
+			if k == key || recurse && strings.HasPrefix(k, key) {
+				delete(f.kvs, k)
+			}
+		}
+		f.commit()
+		json.NewEncoder(w).Encode(true)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// sortedKeys must be called with the mutex held
+func (f *fakeConsul) sortedKeys(prefix string) []string {
+	keys := []string{}
+	for k := range f.kvs {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeConsul) reply(w http.ResponseWriter, v interface{}, found int) {
+	if found == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeConsul) handleTxn(w http.ResponseWriter, r *http.Request) {
+	var ops []fakeTxnOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// apply the operations to a copy, kept only if they all succeed
+	kvs := make(map[string]*fakeKV, len(f.kvs))
+	for k, kv := range f.kvs {
+		copied := *kv
+		kvs[k] = &copied
+	}
+	index := f.index + 1
+	results := []map[string]*fakeKV{}
+	for i, op := range ops {
+		kv, exists := kvs[op.KV.Key]
+		failed := ""
+		switch op.KV.Verb {
+		case "set":
+			kvs[op.KV.Key] = f.put(kv, op.KV, index)
+		case "check-not-exists":
+			if exists {
+				failed = "key exists"
+			}
+		case "check-index":
+			if !exists || kv.ModifyIndex != op.KV.Index {
+				failed = "index mismatch"
+			}
+		case "delete-cas":
+			if !exists || kv.ModifyIndex != op.KV.Index {
+				failed = "index mismatch"
+			}
+			delete(kvs, op.KV.Key)
+		case "lock":
+			if _, ok := f.sessions[op.KV.Session]; !ok || exists && kv.Session != "" && kv.Session != op.KV.Session {
+				failed = "could not lock"
+				break
+			}
+			kv = f.put(kv, op.KV, index)
+			kv.Session = op.KV.Session
+			kv.LockIndex++
+			kvs[op.KV.Key] = kv
+		case "unlock":
+			if !exists || kv.Session != op.KV.Session {
+				failed = "could not unlock"
+				break
+			}
+			kv = f.put(kv, op.KV, index)
+			kv.Session = ""
+			kvs[op.KV.Key] = kv
+		default:
+			failed = "unknown verb " + op.KV.Verb
+		}
+
+		if failed != "" {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"Errors": []map[string]interface{}{{"OpIndex": i, "What": failed}},
+			})
+			return
+		}
+		if kv, ok := kvs[op.KV.Key]; ok && op.KV.Verb != "delete-cas" {
+			result := *kv
+			result.Value = nil
+			results = append(results, map[string]*fakeKV{"KV": &result})
+		}
+	}
+
+	f.kvs = kvs
+	f.commit()
+	json.NewEncoder(w).Encode(map[string]interface{}{"Results": results})
+}
+
+func (f *fakeConsul) put(kv *fakeKV, op fakeTxnKV, index uint64) *fakeKV {
+	if kv == nil {
+		kv = &fakeKV{Key: op.Key, CreateIndex: index}
+	}
+	kv.Value = op.Value
+	kv.Flags = op.Flags
+	kv.ModifyIndex = index
+	return kv
+}
+
+func (f *fakeConsul) handleSessionCreate(w http.ResponseWriter, r *http.Request) {
+	var session struct {
+		TTL       string
+		Behavior  string
+		LockDelay string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&session); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl, err := time.ParseDuration(session.TTL)
+	if err != nil || ttl < 10*time.Second || session.Behavior != "delete" {
+		http.Error(w, "Invalid session", http.StatusBadRequest)
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.created++
+	id := fmt.Sprintf("session-%d", f.created)
+	f.sessions[id] = f.now + ttl
+	json.NewEncoder(w).Encode(map[string]string{"ID": id})
+}
+
+func (f *fakeConsul) handleSessionDestroy(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.invalidate(strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/"))
+	f.commit()
+	json.NewEncoder(w).Encode(true)
+}
+
+// sessionCount returns how many sessions are alive
+func (f *fakeConsul) sessionCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.sessions)
+}
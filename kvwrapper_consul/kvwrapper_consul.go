@@ -0,0 +1,731 @@
+package kvwrapper_consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	log "github.com/behance/go-logging/log"
+)
+
+// MinTTL is the shortest ttl, in seconds, Consul accepts for a session. Shorter ttls are raised to it.
+const MinTTL = 10
+
+// ConsulWrapper talks to the KV store of Consul over its HTTP API so it can implement the KVWrapper interface
+type ConsulWrapper struct {
+	// Timeout bounds the operations called without a context, kvwrapper.DefaultTimeout if left blank
+	Timeout time.Duration
+
+	servers []string
+	token   string
+	client  *http.Client
+}
+
+// consulKV is a key as returned by the Consul KV API. Value is sent base64 encoded,
+// which encoding/json takes care of for a []byte.
+type consulKV struct {
+	Key         string
+	Value       []byte
+	Flags       uint64
+	Session     string
+	LockIndex   uint64
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+type txnOp struct {
+	KV *txnKV
+}
+
+type txnKV struct {
+	Verb    string
+	Key     string
+	Value   []byte `json:",omitempty"`
+	Flags   uint64 `json:",omitempty"`
+	Index   uint64 `json:",omitempty"`
+	Session string `json:",omitempty"`
+}
+
+type txnResponse struct {
+	Results []struct {
+		KV *consulKV
+	}
+	Errors []struct {
+		OpIndex int
+		What    string
+	}
+}
+
+// statusError is returned when Consul answers a request with an unexpected status
+type statusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("consul: %d %s", e.StatusCode, strings.TrimSpace(e.Message))
+}
+
+// NewKVWrapper returns a new kvwrapper_consul as a KVWrapper. Requests go to the first of servers
+// that answers. Consul has no users: password is sent as the ACL token, and username is ignored.
+func (c ConsulWrapper) NewKVWrapper(servers []string, username, password string) kvwrapper.KVWrapper {
+	if len(servers) == 0 {
+		// even though this is a critical error, we don't want to issue log.Fatal, since that would os.Exit(1) from within the lib
+		log.Warn("Could not instantiate Consul client.", "err", "no server given")
+		return nil
+	}
+	urls := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if !strings.Contains(server, "://") {
+			server = "http://" + server
+		}
+		urls = append(urls, strings.TrimRight(server, "/"))
+	}
+	return ConsulWrapper{Timeout: c.Timeout, servers: urls, token: password, client: &http.Client{}}
+}
+
+func init() {
+	kvwrapper.Register("consul", kvwrapper.DriverFunc(open))
+}
+
+// open opens the wrapper of a DSN such as consul://:token@h1:8500,h2:8500/prefix?timeout=5s,
+// reaching the hosts over https if tls=true, and http otherwise
+func open(dsn *kvwrapper.DSN) (kvwrapper.KVWrapper, error) {
+	if err := dsn.CheckOptions("timeout", "tls"); err != nil {
+		return nil, err
+	}
+	timeout, err := dsn.Duration("timeout")
+	if err != nil {
+		return nil, err
+	}
+	servers, err := dsn.Servers()
+	if err != nil {
+		return nil, err
+	}
+	kv := ConsulWrapper{Timeout: timeout}.NewKVWrapper(servers, dsn.Username, dsn.Password)
+	if kv == nil {
+		return nil, kvwrapper.ErrCouldNotConnect
+	}
+	return kv, nil
+}
+
+// context returns the context bounding an operation called without one
+func (c ConsulWrapper) context() (context.Context, context.CancelFunc) {
+	return kvwrapper.TimeoutContext(c.Timeout)
+}
+
+// do sends a request to the first server that answers, and decodes its JSON response into out.
+// It returns the status of the response, which is either 200, 404 or 409 (for transactions),
+// along with its X-Consul-Index.
+func (c ConsulWrapper) do(ctx context.Context, method string, path string, query url.Values, in interface{}, out interface{}) (int, uint64, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	var err error
+	for _, server := range c.servers {
+		var req *http.Request
+		req, err = http.NewRequest(method, server+path, bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.URL.RawQuery = query.Encode()
+		if c.token != "" {
+			req.Header.Set("X-Consul-Token", c.token)
+		}
+
+		var resp *http.Response
+		resp, err = c.client.Do(req.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, 0, ctx.Err()
+			}
+			continue
+		}
+		return decode(resp, out)
+	}
+	log.Warn("Could not reach Consul.", "servers", c.servers, "err", err)
+	return 0, 0, kvwrapper.ErrCouldNotConnect
+}
+
+func decode(resp *http.Response, out interface{}) (int, uint64, error) {
+	defer resp.Body.Close()
+
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusConflict:
+		if out != nil {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				return resp.StatusCode, index, err
+			}
+		}
+	case http.StatusNotFound:
+	case http.StatusForbidden:
+		// the ACL token is missing, or does not grant the request
+		return resp.StatusCode, index, kvwrapper.ErrUnauthorized
+	default:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, index, &statusError{StatusCode: resp.StatusCode, Message: string(msg)}
+	}
+	return resp.StatusCode, index, nil
+}
+
+// kvPath returns the path of key in the KV API. Consul keys have no leading slash.
+func kvPath(key string) string {
+	return "/v1/kv/" + (&url.URL{Path: strings.TrimPrefix(key, "/")}).EscapedPath()
+}
+
+// keyOf returns the Consul key as the caller spelled like, with or without a leading slash
+func keyOf(consulKey string, like string) string {
+	if strings.HasPrefix(like, "/") {
+		return "/" + consulKey
+	}
+	return consulKey
+}
+
+// dirOf returns the prefix of the keys below key
+func dirOf(key string) string {
+	if strings.HasSuffix(key, "/") {
+		return key
+	}
+	return key + "/"
+}
+
+// get returns the keys found at key, according to query, and the index they were read at
+func (c ConsulWrapper) get(ctx context.Context, key string, query url.Values) ([]*consulKV, uint64, error) {
+	var kvs []*consulKV
+	status, index, err := c.do(ctx, "GET", kvPath(key), query, nil, &kvs)
+	if err != nil {
+		return nil, index, err
+	}
+	if status == http.StatusNotFound || len(kvs) == 0 {
+		return nil, index, kvwrapper.ErrKeyNotFound
+	}
+	return kvs, index, nil
+}
+
+// getOne returns the single key
+func (c ConsulWrapper) getOne(ctx context.Context, key string) (*consulKV, error) {
+	kvs, _, err := c.get(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return kvs[0], nil
+}
+
+// txn applies ops atomically, returning ErrConflict if any of them failed
+func (c ConsulWrapper) txn(ctx context.Context, ops []txnOp) (*txnResponse, error) {
+	r := &txnResponse{}
+	status, _, err := c.do(ctx, "PUT", "/v1/txn", nil, ops, r)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusConflict {
+		log.Debug("Consul transaction rolled back.", "errors", r.Errors)
+		return nil, kvwrapper.ErrConflict
+	}
+	return r, nil
+}
+
+// createSession returns a session that removes the keys attached to it once its ttl runs out
+func (c ConsulWrapper) createSession(ctx context.Context, ttl uint64) (string, error) {
+	if ttl < MinTTL {
+		ttl = MinTTL
+	}
+	session := map[string]string{
+		"Name":     "go-common kvwrapper",
+		"TTL":      strconv.FormatUint(ttl, 10) + "s",
+		"Behavior": "delete",
+		// by default Consul keeps the keys of an invalidated session locked for 15s
+		"LockDelay": "0s",
+	}
+	var r struct {
+		ID string
+	}
+	_, _, err := c.do(ctx, "PUT", "/v1/session/create", nil, session, &r)
+	if err != nil {
+		log.Warn("Could not create session in Consul.", "err", err)
+		return "", err
+	}
+	return r.ID, nil
+}
+
+// destroySession gets rid of a session the keys do not use anymore
+func (c ConsulWrapper) destroySession(session string) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	_, _, err := c.do(ctx, "PUT", "/v1/session/destroy/"+session, nil, nil, nil)
+	if err != nil {
+		log.Debug("Could not destroy Consul session.", "session", session, "err", err)
+	}
+}
+
+// write sets key = val in a transaction, after the checks on the state of key. With a ttl, key
+// is attached to a new session that removes it when the ttl runs out, and its flags hold when
+// that is due. The session key was attached to before, prevSession, is released and destroyed.
+func (c ConsulWrapper) write(ctx context.Context, key string, val string, ttl uint64, prevSession string, checks ...txnOp) (int64, error) {
+	path := strings.TrimPrefix(key, "/")
+	ops := checks
+	if prevSession != "" {
+		ops = append(ops, txnOp{KV: &txnKV{Verb: "unlock", Key: path, Value: []byte(val), Session: prevSession}})
+	}
+	session := ""
+	if ttl > 0 {
+		var err error
+		session, err = c.createSession(ctx, ttl)
+		if err != nil {
+			return 0, err
+		}
+		if ttl < MinTTL {
+			ttl = MinTTL
+		}
+		expiration := uint64(time.Now().Add(time.Duration(ttl) * time.Second).UnixNano())
+		ops = append(ops, txnOp{KV: &txnKV{Verb: "lock", Key: path, Value: []byte(val), Flags: expiration, Session: session}})
+	} else {
+		ops = append(ops, txnOp{KV: &txnKV{Verb: "set", Key: path, Value: []byte(val)}})
+	}
+
+	r, err := c.txn(ctx, ops)
+	if err != nil {
+		if session != "" {
+			c.destroySession(session)
+		}
+		return 0, err
+	}
+	if prevSession != "" {
+		c.destroySession(prevSession)
+	}
+	if len(r.Results) == 0 || r.Results[len(r.Results)-1].KV == nil {
+		return 0, nil
+	}
+	return int64(r.Results[len(r.Results)-1].KV.ModifyIndex), nil
+}
+
+// Set sets the key = val with a ttl of ttl.
+// Consul handles ttls with sessions: the key is attached to a session of its own, that removes
+// it when it expires. Note that Consul may take up to twice the ttl to notice, and that ttls are
+// at least MinTTL seconds long.
+func (c ConsulWrapper) Set(key string, val string, ttl uint64) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.SetContext(ctx, key, val, ttl)
+}
+
+// SetContext is Set bound to ctx
+func (c ConsulWrapper) SetContext(ctx context.Context, key string, val string, ttl uint64) error {
+	prevSession := ""
+	kv, err := c.getOne(ctx, key)
+	if err == nil {
+		prevSession = kv.Session
+	} else if err != kvwrapper.ErrKeyNotFound {
+		log.Warn("Could not set key in Consul.", "key", key, "err", err)
+		return err
+	}
+
+	_, err = c.write(ctx, key, val, ttl, prevSession)
+	if err != nil {
+		log.Warn("Could not set key in Consul.", "key", key, "err", err)
+		return err
+	}
+	return nil
+}
+
+// Create sets key = val only if key does not exist yet
+func (c ConsulWrapper) Create(key string, val string, ttl uint64) (int64, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.CreateContext(ctx, key, val, ttl)
+}
+
+// CreateContext is Create bound to ctx
+func (c ConsulWrapper) CreateContext(ctx context.Context, key string, val string, ttl uint64) (int64, error) {
+	check := txnOp{KV: &txnKV{Verb: "check-not-exists", Key: strings.TrimPrefix(key, "/")}}
+	rev, err := c.write(ctx, key, val, ttl, "", check)
+	if err != nil && err != kvwrapper.ErrConflict {
+		log.Warn("Could not set key in Consul.", "key", key, "err", err)
+	}
+	return rev, err
+}
+
+// CompareAndSwap sets key = val only if the current value of key is prevVal.
+// Consul can only compare indexes, so the value is read first, and the write fails with
+// ErrConflict if key changed in between.
+func (c ConsulWrapper) CompareAndSwap(key string, val string, prevVal string, ttl uint64) (int64, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.CompareAndSwapContext(ctx, key, val, prevVal, ttl)
+}
+
+// CompareAndSwapContext is CompareAndSwap bound to ctx
+func (c ConsulWrapper) CompareAndSwapContext(ctx context.Context, key string, val string, prevVal string, ttl uint64) (int64, error) {
+	kv, err := c.getOne(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if string(kv.Value) != prevVal {
+		return 0, kvwrapper.ErrConflict
+	}
+	return c.swap(ctx, kv, val, ttl)
+}
+
+// CompareAndSwapRevision sets key = val only if key was last modified at index prevRev
+func (c ConsulWrapper) CompareAndSwapRevision(key string, val string, prevRev int64, ttl uint64) (int64, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.CompareAndSwapRevisionContext(ctx, key, val, prevRev, ttl)
+}
+
+// CompareAndSwapRevisionContext is CompareAndSwapRevision bound to ctx
+func (c ConsulWrapper) CompareAndSwapRevisionContext(ctx context.Context, key string, val string, prevRev int64, ttl uint64) (int64, error) {
+	kv, err := c.getOne(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if int64(kv.ModifyIndex) != prevRev {
+		return 0, kvwrapper.ErrConflict
+	}
+	return c.swap(ctx, kv, val, ttl)
+}
+
+// swap sets the key kv was read from to val, unless it changed since
+func (c ConsulWrapper) swap(ctx context.Context, kv *consulKV, val string, ttl uint64) (int64, error) {
+	check := txnOp{KV: &txnKV{Verb: "check-index", Key: kv.Key, Index: kv.ModifyIndex}}
+	rev, err := c.write(ctx, keyOf(kv.Key, ""), val, ttl, kv.Session, check)
+	if err != nil && err != kvwrapper.ErrConflict {
+		log.Warn("Could not set key in Consul.", "key", kv.Key, "err", err)
+	}
+	return rev, err
+}
+
+// CompareAndDelete removes key only if its current value is prevVal
+func (c ConsulWrapper) CompareAndDelete(key string, prevVal string) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.CompareAndDeleteContext(ctx, key, prevVal)
+}
+
+// CompareAndDeleteContext is CompareAndDelete bound to ctx
+func (c ConsulWrapper) CompareAndDeleteContext(ctx context.Context, key string, prevVal string) error {
+	kv, err := c.getOne(ctx, key)
+	if err != nil {
+		return err
+	}
+	if string(kv.Value) != prevVal {
+		return kvwrapper.ErrConflict
+	}
+
+	ops := []txnOp{{KV: &txnKV{Verb: "delete-cas", Key: kv.Key, Index: kv.ModifyIndex}}}
+	_, err = c.txn(ctx, ops)
+	if err != nil {
+		if err != kvwrapper.ErrConflict {
+			log.Warn("Could not delete key from Consul.", "key", key, "err", err)
+		}
+		return err
+	}
+	if kv.Session != "" {
+		c.destroySession(kv.Session)
+	}
+	return nil
+}
+
+// Txn is not supported: Consul transactions fail as a whole instead of choosing between
+// two branches, and cannot compare values, so committing the returned transaction always
+// fails with ErrNotSupported
+func (c ConsulWrapper) Txn() *kvwrapper.Txn {
+	return kvwrapper.NewTxn(func(compares []kvwrapper.Compare, thenOps []kvwrapper.Op, elseOps []kvwrapper.Op) (*kvwrapper.TxnResponse, error) {
+		return nil, kvwrapper.ErrNotSupported
+	})
+}
+
+// GetVal returns a single KeyValue found at key
+func (c ConsulWrapper) GetVal(key string) (*kvwrapper.KeyValue, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.GetValContext(ctx, key)
+}
+
+// GetValContext is GetVal bound to ctx. Consul has no directories, so a key that does not exist
+// but has keys below it is returned as one, with HasChildren set, the way etcd v2 does.
+func (c ConsulWrapper) GetValContext(ctx context.Context, key string) (*kvwrapper.KeyValue, error) {
+	kv, err := c.getOne(ctx, key)
+	if err == nil {
+		r := keyValue(key, kv)
+		r.HasChildren = strings.HasSuffix(kv.Key, "/")
+		return r, nil
+	}
+	if err != kvwrapper.ErrKeyNotFound {
+		log.Warn("Could not retrieve key from Consul.", "key", key, "err", err)
+		return nil, err
+	}
+
+	var keys []string
+	query := url.Values{"keys": {""}, "separator": {"/"}}
+	status, _, err := c.do(ctx, "GET", kvPath(dirOf(key)), query, nil, &keys)
+	if err != nil {
+		log.Warn("Could not retrieve key from Consul.", "key", key, "err", err)
+		return nil, err
+	}
+	if status == http.StatusNotFound || len(keys) == 0 {
+		return nil, kvwrapper.ErrKeyNotFound
+	}
+	return &kvwrapper.KeyValue{Key: key, HasChildren: true}, nil
+}
+
+// keyValue converts kv, found at key. The keys attached to a session were written with a ttl,
+// and their flags hold when it runs out, although Consul may take up to twice the ttl to notice.
+func keyValue(key string, kv *consulKV) *kvwrapper.KeyValue {
+	r := &kvwrapper.KeyValue{
+		Key:            key,
+		Value:          string(kv.Value),
+		CreateRevision: int64(kv.CreateIndex),
+		ModRevision:    int64(kv.ModifyIndex),
+	}
+	if kv.Session == "" || kv.Flags == 0 {
+		return r
+	}
+	expiration := time.Unix(0, int64(kv.Flags))
+	if left := time.Until(expiration); left > 0 {
+		r.TTL = int64((left + time.Second - 1) / time.Second)
+		r.Expiration = expiration
+	}
+	return r
+}
+
+// GetList returns a []KeyValue found at key
+func (c ConsulWrapper) GetList(key string, sort bool) ([]*kvwrapper.KeyValue, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.GetListContext(ctx, key, sort)
+}
+
+// GetListContext is GetList bound to ctx. It returns the keys directly below key, like etcd v2:
+// the deeper keys show up as their first path segment below key, with HasChildren set, and a
+// key holding a value has none. Consul always returns keys sorted.
+func (c ConsulWrapper) GetListContext(ctx context.Context, key string, sort bool) ([]*kvwrapper.KeyValue, error) {
+	dir := dirOf(key)
+	kvs, _, err := c.get(ctx, dir, url.Values{"recurse": {""}})
+	if err == kvwrapper.ErrKeyNotFound {
+		if _, err = c.getOne(ctx, key); err == nil {
+			return make([]*kvwrapper.KeyValue, 0), nil
+		}
+	}
+	if err != nil {
+		if err != kvwrapper.ErrKeyNotFound {
+			log.Warn("Could not retrieve key from Consul.", "key", key, "err", err)
+		}
+		return nil, err
+	}
+
+	prefix := strings.TrimPrefix(dir, "/")
+	list := make([]*kvwrapper.KeyValue, 0)
+	seen := make(map[string]bool)
+	for _, kv := range kvs {
+		rest := strings.TrimPrefix(kv.Key, prefix)
+		if rest == "" {
+			continue
+		}
+		if i := strings.Index(rest, "/"); i >= 0 {
+			child := prefix + rest[:i]
+			if !seen[child] {
+				seen[child] = true
+				list = append(list, &kvwrapper.KeyValue{Key: keyOf(child, key), HasChildren: true})
+			}
+			continue
+		}
+		list = append(list, keyValue(keyOf(kv.Key, key), kv))
+	}
+	return list, nil
+}
+
+// Delete removes the single key
+func (c ConsulWrapper) Delete(key string) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.DeleteContext(ctx, key)
+}
+
+// DeleteContext is Delete bound to ctx
+func (c ConsulWrapper) DeleteContext(ctx context.Context, key string) error {
+	kv, err := c.getOne(ctx, key)
+	if err != nil {
+		if err != kvwrapper.ErrKeyNotFound {
+			log.Warn("Could not delete key from Consul.", "key", key, "err", err)
+		}
+		return err
+	}
+
+	_, _, err = c.do(ctx, "DELETE", kvPath(key), nil, nil, nil)
+	if err != nil {
+		log.Warn("Could not delete key from Consul.", "key", key, "err", err)
+		return err
+	}
+	if kv.Session != "" {
+		c.destroySession(kv.Session)
+	}
+	return nil
+}
+
+// DeleteList removes key and every key below it, and returns the number of keys that were removed
+func (c ConsulWrapper) DeleteList(key string) (int64, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.DeleteListContext(ctx, key)
+}
+
+// DeleteListContext is DeleteList bound to ctx
+func (c ConsulWrapper) DeleteListContext(ctx context.Context, key string) (int64, error) {
+	// Consul does not report what a recursive delete removed, so count it beforehand.
+	// The prefix is matched as is, so keep the keys that merely start like key out of the count.
+	kvs, _, err := c.get(ctx, key, url.Values{"recurse": {""}})
+	if err != nil {
+		if err != kvwrapper.ErrKeyNotFound {
+			log.Warn("Could not retrieve key from Consul.", "key", key, "err", err)
+		}
+		return 0, err
+	}
+	path := strings.TrimPrefix(key, "/")
+	dir := dirOf(path)
+	var deleted int64
+	sessions := []string{}
+	for _, kv := range kvs {
+		if kv.Key == path || strings.HasPrefix(kv.Key, dir) {
+			deleted++
+			if kv.Session != "" {
+				sessions = append(sessions, kv.Session)
+			}
+		}
+	}
+	if deleted == 0 {
+		return 0, kvwrapper.ErrKeyNotFound
+	}
+
+	_, _, err = c.do(ctx, "DELETE", kvPath(dir), url.Values{"recurse": {""}}, nil, nil)
+	if err == nil && path != dir {
+		_, _, err = c.do(ctx, "DELETE", kvPath(path), nil, nil, nil)
+	}
+	if err != nil {
+		log.Warn("Could not delete key from Consul.", "key", key, "err", err)
+		return 0, err
+	}
+	for _, session := range sessions {
+		c.destroySession(session)
+	}
+	return deleted, nil
+}
+
+// Watch streams the changes made to key, or to every key starting with key if recursive is set.
+// It relies on blocking queries, and compares the keys Consul returns with the previous ones:
+// changes made in between two queries are merged, and keys removed because their session
+// expired are reported as deleted. The channel is closed once the ACL token is refused.
+func (c ConsulWrapper) Watch(ctx context.Context, key string, recursive bool) (<-chan *kvwrapper.WatchEvent, error) {
+	query := url.Values{}
+	if recursive {
+		query.Set("recurse", "")
+	}
+	// start from the current index, so nothing that happens after Watch returns is missed
+	known, index, err := c.snapshot(ctx, key, query)
+	if err != nil {
+		log.Warn("Could not watch key in Consul.", "key", key, "err", err)
+		return nil, err
+	}
+
+	events := make(chan *kvwrapper.WatchEvent)
+	go func() {
+		defer close(events)
+
+		for {
+			query.Set("index", strconv.FormatUint(index, 10))
+			current, currentIndex, err := c.snapshot(ctx, key, query)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if err == kvwrapper.ErrUnauthorized {
+					// the token was revoked, every retry would be refused as well
+					log.Warn("Watch on Consul key refused.", "key", key, "err", err)
+					return
+				}
+				log.Warn("Watch on Consul key interrupted, resuming.", "key", key, "err", err)
+				select {
+				case <-time.After(kvwrapper.WatchRetryDelay):
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			for _, ev := range changes(known, current, currentIndex, key) {
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+			known, index = current, currentIndex
+			if index == 0 {
+				// Consul may reset its index, in which case blocking queries start over
+				index = 1
+			}
+		}
+	}()
+	return events, nil
+}
+
+// snapshot returns the keys found at key, according to query, and the index they were read at
+func (c ConsulWrapper) snapshot(ctx context.Context, key string, query url.Values) (map[string]*consulKV, uint64, error) {
+	kvs, index, err := c.get(ctx, key, query)
+	if err != nil && err != kvwrapper.ErrKeyNotFound {
+		return nil, 0, err
+	}
+	snapshot := make(map[string]*consulKV, len(kvs))
+	for _, kv := range kvs {
+		snapshot[kv.Key] = kv
+	}
+	return snapshot, index, nil
+}
+
+// changes returns the events turning the known keys into the current ones, in the order they happened
+func changes(known map[string]*consulKV, current map[string]*consulKV, index uint64, like string) []*kvwrapper.WatchEvent {
+	events := []*kvwrapper.WatchEvent{}
+	for key, kv := range current {
+		if prev, ok := known[key]; !ok || prev.ModifyIndex != kv.ModifyIndex {
+			events = append(events, &kvwrapper.WatchEvent{
+				Type:     kvwrapper.EventPut,
+				Key:      keyOf(key, like),
+				Value:    string(kv.Value),
+				Revision: int64(kv.ModifyIndex),
+			})
+		}
+	}
+	for key := range known {
+		if _, ok := current[key]; !ok {
+			events = append(events, &kvwrapper.WatchEvent{
+				Type:     kvwrapper.EventDelete,
+				Key:      keyOf(key, like),
+				Revision: int64(index),
+			})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Revision != events[j].Revision {
+			return events[i].Revision < events[j].Revision
+		}
+		return events[i].Key < events[j].Key
+	})
+	return events
+}
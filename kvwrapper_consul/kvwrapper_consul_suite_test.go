@@ -0,0 +1,13 @@
+package kvwrapper_consul_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestKvwrapperConsul(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "KvwrapperConsul Suite")
+}
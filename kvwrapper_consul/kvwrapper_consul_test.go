@@ -0,0 +1,205 @@
+package kvwrapper_consul_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	. "github.com/behance/go-common/kvwrapper_consul"
+	log "github.com/behance/go-common/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// plain drops the metadata of kv, which depends on the history of the store
+func plain(kv *kvwrapper.KeyValue) kvwrapper.KeyValue {
+	return kvwrapper.KeyValue{Key: kv.Key, Value: kv.Value, HasChildren: kv.HasChildren}
+}
+
+var _ = Describe("KvwrapperConsul", func() {
+	var (
+		consul *fakeConsul
+		kv     kvwrapper.KVWrapper
+	)
+
+	BeforeEach(func() {
+		log.SetLevel(log.PanicLevel)
+		consul = newFakeConsul("")
+		kv = kvwrapper.NewKVWrapper([]string{consul.URL}, ConsulWrapper{})
+		kv.Set("/parent/child1", "child1val", 0)
+		kv.Set("/parent/child2", "child2val", 0)
+		kv.Set("/parent/sub/child3", "child3val", 0)
+	})
+
+	AfterEach(func() {
+		consul.Close()
+	})
+
+	Describe("Get Wrapper", func() {
+		It("Gets single values", func() {
+			s, err := kv.GetVal("/parent/child1")
+			Expect(err).To(BeNil())
+			Expect(s.Key).To(Equal("/parent/child1"))
+			Expect(s.Value).To(Equal("child1val"))
+			Expect(s.HasChildren).To(BeFalse())
+		})
+		It("Reports the indexes of the keys as revisions", func() {
+			rev, err := kv.CompareAndSwap("/parent/child1", "newval", "child1val", 0)
+			Expect(err).To(BeNil())
+
+			s, err := kv.GetVal("/parent/child1")
+			Expect(err).To(BeNil())
+			Expect(s.ModRevision).To(Equal(rev))
+			Expect(s.CreateRevision).To(BeNumerically("<", rev))
+		})
+		It("Derives directories from the key separators", func() {
+			s, err := kv.GetVal("/parent/sub")
+			Expect(err).To(BeNil())
+			Expect(s.HasChildren).To(BeTrue())
+
+			l, err := kv.GetList("/parent", true)
+			Expect(err).To(BeNil())
+			Expect(l).To(HaveLen(3))
+			Expect(plain(l[0])).To(Equal(kvwrapper.KeyValue{Key: "/parent/child1", Value: "child1val"}))
+			Expect(plain(l[1])).To(Equal(kvwrapper.KeyValue{Key: "/parent/child2", Value: "child2val"}))
+			Expect(plain(l[2])).To(Equal(kvwrapper.KeyValue{Key: "/parent/sub", HasChildren: true}))
+		})
+		It("Handles invalid values", func() {
+			s, err := kv.GetVal("xxxxxxxx")
+			Expect(err).To(MatchError(kvwrapper.ErrKeyNotFound))
+			Expect(s).To(BeNil())
+
+			l, err := kv.GetList("xxxxxxxx/phpinfo", false)
+			Expect(err).To(MatchError(kvwrapper.ErrKeyNotFound))
+			Expect(l).To(BeEmpty())
+		})
+	})
+
+	Describe("Set Wrapper", func() {
+		It("Expires keys set with a ttl along with their session", func() {
+			Expect(kv.Set("/ttl/key", "value", 30)).To(BeNil())
+			Expect(consul.sessionCount()).To(Equal(1))
+
+			consul.expire()
+			_, err := kv.GetVal("/ttl/key")
+			Expect(err).To(MatchError(kvwrapper.ErrKeyNotFound))
+		})
+		It("Replaces the session of a key set again", func() {
+			kv.Set("/ttl/key", "value", 30)
+			kv.Set("/ttl/key", "newvalue", 30)
+			Expect(consul.sessionCount()).To(Equal(1))
+
+			Expect(kv.Set("/ttl/key", "newestvalue", 0)).To(BeNil())
+			Expect(consul.sessionCount()).To(Equal(0))
+			consul.expire()
+			s, err := kv.GetVal("/ttl/key")
+			Expect(err).To(BeNil())
+			Expect(s.Value).To(Equal("newestvalue"))
+		})
+	})
+
+	Describe("Conditional Set Wrapper", func() {
+		It("Creates keys only once", func() {
+			rev, err := kv.Create("/parent/child4", "child4val", 0)
+			Expect(err).To(BeNil())
+			Expect(rev).To(BeNumerically(">", 0))
+
+			_, err = kv.Create("/parent/child4", "other", 0)
+			Expect(err).To(MatchError(kvwrapper.ErrConflict))
+		})
+		It("Swaps values and revisions that match", func() {
+			rev, err := kv.CompareAndSwap("/parent/child1", "newval", "child1val", 0)
+			Expect(err).To(BeNil())
+
+			_, err = kv.CompareAndSwap("/parent/child1", "newerval", "child1val", 0)
+			Expect(err).To(MatchError(kvwrapper.ErrConflict))
+
+			_, err = kv.CompareAndSwapRevision("/parent/child1", "newerval", rev, 0)
+			Expect(err).To(BeNil())
+			_, err = kv.CompareAndSwapRevision("/parent/child1", "newestval", rev, 0)
+			Expect(err).To(MatchError(kvwrapper.ErrConflict))
+
+			_, err = kv.CompareAndSwap("xxxxxxxx", "newval", "child1val", 0)
+			Expect(err).To(MatchError(kvwrapper.ErrKeyNotFound))
+		})
+		It("Deletes values that match", func() {
+			Expect(kv.CompareAndDelete("/parent/child1", "other")).To(MatchError(kvwrapper.ErrConflict))
+			Expect(kv.CompareAndDelete("/parent/child1", "child1val")).To(BeNil())
+			Expect(kv.CompareAndDelete("/parent/child1", "child1val")).To(MatchError(kvwrapper.ErrKeyNotFound))
+		})
+		It("Does not support transactions", func() {
+			_, err := kv.Txn().Then(kvwrapper.SetOp("/parent/child1", "newval", 0)).Commit()
+			Expect(err).To(MatchError(kvwrapper.ErrNotSupported))
+		})
+	})
+
+	Describe("Delete Wrapper", func() {
+		It("Deletes a single key", func() {
+			Expect(kv.Delete("/parent/child1")).To(BeNil())
+			Expect(kv.Delete("/parent/child1")).To(MatchError(kvwrapper.ErrKeyNotFound))
+		})
+		It("Deletes every key below a prefix", func() {
+			kv.Set("/parentless", "value", 0)
+
+			n, err := kv.DeleteList("/parent")
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(int64(3)))
+
+			_, err = kv.GetVal("/parentless")
+			Expect(err).To(BeNil())
+			_, err = kv.DeleteList("/parent")
+			Expect(err).To(MatchError(kvwrapper.ErrKeyNotFound))
+		})
+	})
+
+	Describe("Watch Wrapper", func() {
+		It("Streams changes below a prefix", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events, err := kv.Watch(ctx, "/parent/", true)
+			Expect(err).To(BeNil())
+
+			kv.Set("/parent/child1", "newval", 0)
+			var ev *kvwrapper.WatchEvent
+			Eventually(events).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(kvwrapper.EventPut))
+			Expect(ev.Key).To(Equal("/parent/child1"))
+			Expect(ev.Value).To(Equal("newval"))
+
+			kv.Delete("/parent/child2")
+			Eventually(events).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(kvwrapper.EventDelete))
+			Expect(ev.Key).To(Equal("/parent/child2"))
+
+			cancel()
+			Eventually(events, time.Second).Should(BeClosed())
+		})
+	})
+
+	Describe("Servers", func() {
+		It("Fails over to the next server", func() {
+			kv = kvwrapper.NewKVWrapper([]string{"http://127.0.0.1:1", consul.URL}, ConsulWrapper{})
+			s, err := kv.GetVal("/parent/child1")
+			Expect(err).To(BeNil())
+			Expect(s.Value).To(Equal("child1val"))
+		})
+		It("Fails when no server answers", func() {
+			kv = kvwrapper.NewKVWrapper([]string{"http://127.0.0.1:1"}, ConsulWrapper{})
+			_, err := kv.GetVal("/parent/child1")
+			Expect(err).To(MatchError(kvwrapper.ErrCouldNotConnect))
+		})
+		It("Sends the password as the ACL token", func() {
+			secured := newFakeConsul("secret")
+			defer secured.Close()
+
+			kv = kvwrapper.NewKVWrapper([]string{secured.URL}, ConsulWrapper{})
+			Expect(kv.Set("/key", "value", 0)).To(MatchError(kvwrapper.ErrUnauthorized))
+			_, err := kv.GetVal("/key")
+			Expect(err).To(MatchError(kvwrapper.ErrUnauthorized))
+
+			kv = kvwrapper.NewKVWrapperWithAuth([]string{secured.URL}, ConsulWrapper{}, "", "secret")
+			Expect(kv.Set("/key", "value", 0)).To(BeNil())
+		})
+	})
+})
@@ -2,6 +2,8 @@ package kvwrapper_etcd
 
 import (
 	"context"
+	"net"
+	"net/http"
 	"time"
 
 	"github.com/behance/go-common/kvwrapper"
@@ -11,11 +13,45 @@ import (
 
 // EtcdWrapper wraps the go-etcd client so it can implement the KVWrapper interface
 type EtcdWrapper struct {
+	// Timeout bounds the operations called without a context, kvwrapper.DefaultTimeout if left blank
+	Timeout time.Duration
+	// CheckConnection makes Connect and NewKVWrapper ask the servers for their version, failing if
+	// none of them answers. v2 only checks credentials when keys are read or written.
+	CheckConnection bool
+
 	kapi etcd.KeysAPI
+	// wapi is kapi on the connections of watchTransport
+	wapi etcd.KeysAPI
+}
+
+// watchTransport carries the watches, over connections that are not kept alive: the client closes
+// the body of a watch it stops while still reading it, which can leave the connection unfit for
+// the requests that would reuse it.
+var watchTransport etcd.CancelableTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	Dial: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).Dial,
+	TLSHandshakeTimeout: 10 * time.Second,
+	DisableKeepAlives:   true,
 }
 
-// NewKVWrapper returns a new kvwrapper_etcd as a KVWrapper
+// NewKVWrapper returns a new kvwrapper_etcd as a KVWrapper, or nil if Connect fails
 func (e EtcdWrapper) NewKVWrapper(servers []string, username, password string) kvwrapper.KVWrapper {
+	kv, err := e.Connect(servers, username, password)
+	if err != nil {
+		// Connect logged the error already; even though it is critical, we don't want to issue
+		// log.Fatal, since that would os.Exit(1) from within the lib
+		return nil
+	}
+	return kv
+}
+
+// Connect returns a new kvwrapper_etcd as a KVWrapper. It fails with ErrCouldNotConnect if the
+// client cannot be set up and, when CheckConnection is set, with ErrCouldNotConnect or ErrTimeout
+// if no server answers.
+func (e EtcdWrapper) Connect(servers []string, username, password string) (kvwrapper.KVWrapper, error) {
 	config := etcd.Config{
 		Endpoints: servers,
 		Transport: etcd.DefaultTransport,
@@ -24,70 +60,486 @@ func (e EtcdWrapper) NewKVWrapper(servers []string, username, password string) k
 	}
 	client, err := etcd.New(config)
 	if err != nil {
-		// even though this is a critical error, wedon't want to issue log.Fatal, since that would os.Exit(1) from within the lib
 		log.Warn("Could not instantiate etcd V2 client.", "err", err)
-		return nil
+		return nil, kvwrapper.ErrCouldNotConnect
+	}
+	config.Transport = watchTransport
+	watchClient, err := etcd.New(config)
+	if err != nil {
+		log.Warn("Could not instantiate etcd V2 client.", "err", err)
+		return nil, kvwrapper.ErrCouldNotConnect
+	}
+	if e.CheckConnection {
+		ctx, cancel := e.context()
+		defer cancel()
+		if _, err := client.GetVersion(ctx); err != nil {
+			log.Warn("Could not reach etcd.", "servers", servers, "err", err)
+			return nil, clientError(err)
+		}
+	}
+	return EtcdWrapper{
+		kapi:            etcd.NewKeysAPI(client),
+		wapi:            etcd.NewKeysAPI(watchClient),
+		Timeout:         e.Timeout,
+		CheckConnection: e.CheckConnection,
+	}, nil
+}
+
+func init() {
+	kvwrapper.Register("etcd2", kvwrapper.DriverFunc(open))
+}
+
+// open opens the wrapper of a DSN such as etcd2://user:pass@h1:2379,h2:2379/prefix?timeout=5s,
+// reaching the hosts over https if tls=true, and http otherwise. check=true sets CheckConnection.
+func open(dsn *kvwrapper.DSN) (kvwrapper.KVWrapper, error) {
+	if err := dsn.CheckOptions("timeout", "tls", "check"); err != nil {
+		return nil, err
+	}
+	timeout, err := dsn.Duration("timeout")
+	if err != nil {
+		return nil, err
+	}
+	check, err := dsn.Bool("check")
+	if err != nil {
+		return nil, err
+	}
+	servers, err := dsn.Servers()
+	if err != nil {
+		return nil, err
 	}
-	return EtcdWrapper{kapi: etcd.NewKeysAPI(client)}
+	return EtcdWrapper{Timeout: timeout, CheckConnection: check}.Connect(servers, dsn.Username, dsn.Password)
+}
+
+// context returns the context bounding an operation called without one
+func (e EtcdWrapper) context() (context.Context, context.CancelFunc) {
+	return kvwrapper.TimeoutContext(e.Timeout)
 }
 
 // Set sets the key = val with a ttl of ttl. If key is a path, it will be created.
 func (e EtcdWrapper) Set(key string, val string, ttl uint64) error {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.SetContext(ctx, key, val, ttl)
+}
+
+// SetContext is Set bound to ctx
+func (e EtcdWrapper) SetContext(ctx context.Context, key string, val string, ttl uint64) error {
 	options := &etcd.SetOptions{
 		TTL: time.Duration(ttl) * time.Second,
 	}
-	_, err := e.kapi.Set(context.Background(), key, val, options)
+	_, err := e.kapi.Set(ctx, key, val, options)
 	if err != nil {
 		log.Warn("Could not set key in etcd.", "key", key, "err", err)
-		return err
+		return clientError(err)
 	}
 	return nil
 }
 
+// Create sets key = val only if key does not exist yet
+func (e EtcdWrapper) Create(key string, val string, ttl uint64) (int64, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.CreateContext(ctx, key, val, ttl)
+}
+
+// CreateContext is Create bound to ctx
+func (e EtcdWrapper) CreateContext(ctx context.Context, key string, val string, ttl uint64) (int64, error) {
+	options := &etcd.SetOptions{
+		TTL:       time.Duration(ttl) * time.Second,
+		PrevExist: etcd.PrevNoExist,
+	}
+	return e.setIf(ctx, key, val, options)
+}
+
+// CompareAndSwap sets key = val only if the current value of key is prevVal.
+// v2 ignores an empty PrevValue, so an empty prevVal is compared against the value read
+// beforehand, and the write fails with ErrConflict if key changed in between.
+func (e EtcdWrapper) CompareAndSwap(key string, val string, prevVal string, ttl uint64) (int64, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.CompareAndSwapContext(ctx, key, val, prevVal, ttl)
+}
+
+// CompareAndSwapContext is CompareAndSwap bound to ctx
+func (e EtcdWrapper) CompareAndSwapContext(ctx context.Context, key string, val string, prevVal string, ttl uint64) (int64, error) {
+	options := &etcd.SetOptions{
+		TTL:       time.Duration(ttl) * time.Second,
+		PrevExist: etcd.PrevExist,
+		PrevValue: prevVal,
+	}
+	if prevVal == "" {
+		index, err := e.emptyIndex(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		options.PrevIndex = index
+	}
+	return e.setIf(ctx, key, val, options)
+}
+
+// CompareAndSwapRevision sets key = val only if key was last modified at index prevRev.
+// v2 ignores a PrevIndex of 0, and no key is ever modified at index 0, so a prevRev of 0 fails
+// with ErrConflict, or ErrKeyNotFound if key does not exist.
+func (e EtcdWrapper) CompareAndSwapRevision(key string, val string, prevRev int64, ttl uint64) (int64, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.CompareAndSwapRevisionContext(ctx, key, val, prevRev, ttl)
+}
+
+// CompareAndSwapRevisionContext is CompareAndSwapRevision bound to ctx
+func (e EtcdWrapper) CompareAndSwapRevisionContext(ctx context.Context, key string, val string, prevRev int64, ttl uint64) (int64, error) {
+	if prevRev == 0 {
+		if _, err := e.GetValContext(ctx, key); err != nil {
+			return 0, err
+		}
+		return 0, kvwrapper.ErrConflict
+	}
+	options := &etcd.SetOptions{
+		TTL:       time.Duration(ttl) * time.Second,
+		PrevExist: etcd.PrevExist,
+		PrevIndex: uint64(prevRev),
+	}
+	return e.setIf(ctx, key, val, options)
+}
+
+// emptyIndex returns the index key was last modified at, failing with ErrConflict unless its
+// value is empty. It stands in for an empty PrevValue, which v2 ignores.
+func (e EtcdWrapper) emptyIndex(ctx context.Context, key string) (uint64, error) {
+	kv, err := e.GetValContext(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if kv.Value != "" || kv.HasChildren {
+		return 0, kvwrapper.ErrConflict
+	}
+	return uint64(kv.ModRevision), nil
+}
+
+func (e EtcdWrapper) setIf(ctx context.Context, key string, val string, options *etcd.SetOptions) (int64, error) {
+	r, err := e.kapi.Set(ctx, key, val, options)
+	if err != nil {
+		kvErr := clientError(err)
+		if kvErr != kvwrapper.ErrConflict && kvErr != kvwrapper.ErrKeyNotFound {
+			log.Warn("Could not set key in etcd.", "key", key, "err", err)
+		}
+		return 0, kvErr
+	}
+	return int64(r.Node.ModifiedIndex), nil
+}
+
+// CompareAndDelete removes key only if its current value is prevVal. As with CompareAndSwap,
+// an empty prevVal is compared against the value read beforehand.
+func (e EtcdWrapper) CompareAndDelete(key string, prevVal string) error {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.CompareAndDeleteContext(ctx, key, prevVal)
+}
+
+// CompareAndDeleteContext is CompareAndDelete bound to ctx
+func (e EtcdWrapper) CompareAndDeleteContext(ctx context.Context, key string, prevVal string) error {
+	options := &etcd.DeleteOptions{
+		PrevValue: prevVal,
+	}
+	if prevVal == "" {
+		index, err := e.emptyIndex(ctx, key)
+		if err != nil {
+			return err
+		}
+		options.PrevIndex = index
+	}
+	_, err := e.kapi.Delete(ctx, key, options)
+	if err != nil {
+		kvErr := clientError(err)
+		if kvErr != kvwrapper.ErrConflict && kvErr != kvwrapper.ErrKeyNotFound {
+			log.Warn("Could not delete key from etcd.", "key", key, "err", err)
+		}
+		return kvErr
+	}
+	return nil
+}
+
+// clientError maps the errors of the etcd client onto kvwrapper errors: failed preconditions,
+// refused credentials, servers that cannot be reached and deadlines that passed
+func clientError(err error) error {
+	switch clientErr := err.(type) {
+	case etcd.Error:
+		switch clientErr.Code {
+		case etcd.ErrorCodeKeyNotFound:
+			return kvwrapper.ErrKeyNotFound
+		case etcd.ErrorCodeTestFailed, etcd.ErrorCodeNodeExist:
+			return kvwrapper.ErrConflict
+		case etcd.ErrorCodeUnauthorized:
+			return kvwrapper.ErrUnauthorized
+		}
+	case *etcd.ClusterError:
+		// every server failed
+		return kvwrapper.ErrCouldNotConnect
+	}
+	switch err {
+	case context.DeadlineExceeded:
+		return kvwrapper.ErrTimeout
+	case etcd.ErrNoEndpoints, etcd.ErrClusterUnavailable:
+		return kvwrapper.ErrCouldNotConnect
+	}
+	return err
+}
+
+// Txn is not supported: v2 has no way to apply writes to several keys atomically,
+// so committing the returned transaction always fails with ErrNotSupported
+func (e EtcdWrapper) Txn() *kvwrapper.Txn {
+	return kvwrapper.NewTxn(func(compares []kvwrapper.Compare, thenOps []kvwrapper.Op, elseOps []kvwrapper.Op) (*kvwrapper.TxnResponse, error) {
+		return nil, kvwrapper.ErrNotSupported
+	})
+}
+
 // GetVal returns a single KeyValue found at key
 func (e EtcdWrapper) GetVal(key string) (*kvwrapper.KeyValue, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.GetValContext(ctx, key)
+}
+
+// GetValContext is GetVal bound to ctx
+func (e EtcdWrapper) GetValContext(ctx context.Context, key string) (*kvwrapper.KeyValue, error) {
 	options := &etcd.GetOptions{
 		Sort:      false,
 		Recursive: false,
 	}
-	r, err := e.kapi.Get(context.Background(), key, options)
+	r, err := e.kapi.Get(ctx, key, options)
 	if err != nil {
 		if etcd.IsKeyNotFound(err) {
 			return nil, kvwrapper.ErrKeyNotFound
 		}
 		log.Warn("Could not retrieve key from etcd.", "key", key, "err", err)
-		return nil, err
+		return nil, clientError(err)
 	}
+	return keyValue(key, r.Node), nil
+}
+
+func keyValue(key string, n *etcd.Node) *kvwrapper.KeyValue {
 	kv := &kvwrapper.KeyValue{
-		Key:         key,
-		Value:       r.Node.Value,
-		HasChildren: r.Node.Dir,
+		Key:            key,
+		Value:          n.Value,
+		HasChildren:    n.Dir,
+		TTL:            n.TTL,
+		CreateRevision: int64(n.CreatedIndex),
+		ModRevision:    int64(n.ModifiedIndex),
 	}
-	return kv, nil
+	if n.Expiration != nil {
+		kv.Expiration = *n.Expiration
+	}
+	return kv
 }
 
 // GetList returns a []KeyValue found at key
 func (e EtcdWrapper) GetList(key string, sort bool) ([]*kvwrapper.KeyValue, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.GetListContext(ctx, key, sort)
+}
+
+// GetListContext is GetList bound to ctx. Only the keys directly below key are fetched, the
+// directories among them come without the keys below them.
+func (e EtcdWrapper) GetListContext(ctx context.Context, key string, sort bool) ([]*kvwrapper.KeyValue, error) {
 	options := &etcd.GetOptions{
 		Sort:      sort,
-		Recursive: true,
+		Recursive: false,
 	}
-	r, err := e.kapi.Get(context.Background(), key, options)
+	r, err := e.kapi.Get(ctx, key, options)
 	if err != nil {
 		if etcd.IsKeyNotFound(err) {
 			return nil, kvwrapper.ErrKeyNotFound
 		}
 		log.Warn("Could not retrieve key from etcd.", "key", key, "err", err)
-		return nil, err
+		return nil, clientError(err)
 	}
 	kvs := make([]*kvwrapper.KeyValue, 0)
 	for i := 0; i < r.Node.Nodes.Len(); i++ {
-		kv := &kvwrapper.KeyValue{
-			Key:         r.Node.Nodes[i].Key,
-			Value:       r.Node.Nodes[i].Value,
-			HasChildren: r.Node.Nodes[i].Dir,
-		}
-		kvs = append(kvs, kv)
+		kvs = append(kvs, keyValue(r.Node.Nodes[i].Key, r.Node.Nodes[i]))
 	}
 	return kvs, nil
 }
+
+// GetPage returns a page of the keys GetList returns. v2 cannot limit a listing, so every page
+// fetches all the keys directly below key, without the keys below them, and pages them here:
+// unlike v3, paging a v2 directory saves neither memory nor requests over GetList.
+func (e EtcdWrapper) GetPage(ctx context.Context, key string, limit int64, token string) (*kvwrapper.Page, error) {
+	kvs, err := e.GetListContext(ctx, key, true)
+	if err != nil {
+		return nil, err
+	}
+	return kvwrapper.Paginate(kvs, limit, token), nil
+}
+
+// List returns the keys GetList returns. v2 can only sort by key, so the keys are sorted by
+// anything else, and stripped of their values, once fetched.
+func (e EtcdWrapper) List(ctx context.Context, key string, opts kvwrapper.ListOptions) (*kvwrapper.ListResult, error) {
+	kvs, err := e.GetListContext(ctx, key, opts.Sorted())
+	if err != nil {
+		return nil, err
+	}
+	return opts.Apply(kvs), nil
+}
+
+// Delete removes the single key. Directories have to be removed with DeleteList.
+func (e EtcdWrapper) Delete(key string) error {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.DeleteContext(ctx, key)
+}
+
+// DeleteContext is Delete bound to ctx
+func (e EtcdWrapper) DeleteContext(ctx context.Context, key string) error {
+	_, err := e.kapi.Delete(ctx, key, nil)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return kvwrapper.ErrKeyNotFound
+		}
+		log.Warn("Could not delete key from etcd.", "key", key, "err", err)
+		return clientError(err)
+	}
+	return nil
+}
+
+// DeleteList removes key, recursively if it is a directory, and returns the number of
+// keys (not directories) that were removed
+func (e EtcdWrapper) DeleteList(key string) (int64, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.DeleteListContext(ctx, key)
+}
+
+// DeleteListContext is DeleteList bound to ctx
+func (e EtcdWrapper) DeleteListContext(ctx context.Context, key string) (int64, error) {
+	// v2 does not report what a recursive delete removed, so count it beforehand
+	r, err := e.kapi.Get(ctx, key, &etcd.GetOptions{Recursive: true})
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return 0, kvwrapper.ErrKeyNotFound
+		}
+		log.Warn("Could not retrieve key from etcd.", "key", key, "err", err)
+		return 0, clientError(err)
+	}
+
+	options := &etcd.DeleteOptions{
+		Recursive: true,
+	}
+	_, err = e.kapi.Delete(ctx, key, options)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return 0, kvwrapper.ErrKeyNotFound
+		}
+		log.Warn("Could not delete key from etcd.", "key", key, "err", err)
+		return 0, clientError(err)
+	}
+	return countKeys(r.Node), nil
+}
+
+func countKeys(node *etcd.Node) int64 {
+	if !node.Dir {
+		return 1
+	}
+	var n int64
+	for _, child := range node.Nodes {
+		n += countKeys(child)
+	}
+	return n
+}
+
+// Watch streams the changes made to key, or to its whole subtree if recursive is set.
+// If the connection to etcd breaks, the watch is re-established from the last index it
+// delivered, so no change is lost as long as it is still in etcd's event history. Once it is
+// not, the channel is closed, since the changes in between can no longer be delivered. It is
+// closed as well once the credentials are refused, or the client fails on its own.
+func (e EtcdWrapper) Watch(ctx context.Context, key string, recursive bool) (<-chan *kvwrapper.WatchEvent, error) {
+	// start from the current index, so nothing that happens after Watch returns is missed
+	var afterIndex uint64
+	r, err := e.kapi.Get(ctx, key, nil)
+	if err != nil {
+		// a missing key can be watched, from the index of the error
+		etcdErr, ok := err.(etcd.Error)
+		if !ok || etcdErr.Code == etcd.ErrorCodeUnauthorized {
+			log.Warn("Could not watch key in etcd.", "key", key, "err", err)
+			return nil, clientError(err)
+		}
+		afterIndex = etcdErr.Index
+	} else {
+		afterIndex = r.Index
+	}
+	return e.watch(ctx, key, recursive, afterIndex), nil
+}
+
+// watchRetryable tells whether a watch that failed with err may succeed once re-established:
+// the servers could not be reached, answered late, or failed on their side. Refused credentials,
+// and the errors of the client itself, would fail every retry.
+func watchRetryable(err error) bool {
+	switch clientErr := err.(type) {
+	case etcd.Error:
+		return clientErr.Code != etcd.ErrorCodeUnauthorized
+	case *etcd.ClusterError:
+		return true
+	}
+	return err == context.DeadlineExceeded || err == etcd.ErrClusterUnavailable
+}
+
+// watch streams the changes made to key after afterIndex
+func (e EtcdWrapper) watch(ctx context.Context, key string, recursive bool, afterIndex uint64) <-chan *kvwrapper.WatchEvent {
+	events := make(chan *kvwrapper.WatchEvent)
+	go func() {
+		defer close(events)
+
+		for {
+			options := &etcd.WatcherOptions{
+				AfterIndex: afterIndex,
+				Recursive:  recursive,
+			}
+			w := e.wapi.Watcher(key, options)
+			for {
+				r, err := w.Next(ctx)
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeEventIndexCleared {
+						log.Warn("Watch on etcd key lost the history it was resuming from.", "key", key, "err", err)
+						return
+					}
+					if !watchRetryable(err) {
+						log.Warn("Watch on etcd key failed.", "key", key, "err", err)
+						return
+					}
+					log.Warn("Watch on etcd key interrupted, resuming.", "key", key, "err", err)
+					break
+				}
+
+				afterIndex = r.Node.ModifiedIndex
+				ev := &kvwrapper.WatchEvent{
+					Key:      r.Node.Key,
+					Value:    r.Node.Value,
+					Revision: int64(r.Node.ModifiedIndex),
+				}
+				switch r.Action {
+				case "delete", "compareAndDelete":
+					ev.Type = kvwrapper.EventDelete
+				case "expire":
+					ev.Type = kvwrapper.EventExpire
+				default:
+					ev.Type = kvwrapper.EventPut
+				}
+
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-time.After(kvwrapper.WatchRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
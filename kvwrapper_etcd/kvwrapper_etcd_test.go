@@ -0,0 +1,287 @@
+package kvwrapper_etcd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/behance/go-common/internal/etcdtest"
+	"github.com/behance/go-common/kvwrapper"
+	"github.com/behance/go-common/kvwrapper/kvwrappertest"
+)
+
+// server is the etcd the tests run against
+var server *etcdtest.Server
+
+func TestMain(m *testing.M) {
+	var err error
+	server, err = etcdtest.Start()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not start etcd:", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
+func newKV(t *testing.T) kvwrapper.KVWrapper {
+	kv := kvwrapper.NewKVWrapper(server.Servers(), EtcdWrapper{})
+	if kv == nil {
+		t.Fatal("Could not create the wrapper")
+	}
+	return kv
+}
+
+func TestConformance(t *testing.T) {
+	kvwrappertest.Suite{New: newKV}.Run(t)
+}
+
+func TestDirectories(t *testing.T) {
+	kv := newKV(t)
+	defer kv.DeleteList("/dirs")
+
+	kv.Set("/dirs/a/1", "1", 0)
+	kv.Set("/dirs/a/2", "2", 0)
+	kv.Set("/dirs/b", "3", 0)
+
+	s, err := kv.GetVal("/dirs/a")
+	if err != nil || !s.HasChildren {
+		t.Errorf("Expected /dirs/a to be a directory, got %v, %v", s, err)
+	}
+	if err := kv.Delete("/dirs/a"); err == nil {
+		t.Error("Expected Delete of a directory to fail")
+	}
+	n, err := kv.DeleteList("/dirs")
+	if err != nil || n != 3 {
+		t.Errorf("Expected DeleteList to remove 3 keys, got %d, %v", n, err)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	_, err := newKV(t).Txn().Then(kvwrapper.GetOp("/txn")).Commit()
+	if err != kvwrapper.ErrNotSupported {
+		t.Errorf("Expected Txn to fail with ErrNotSupported, got %v", err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	kv := newKV(t).(kvwrapper.ContextKVWrapper)
+	defer kv.Delete("/context")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := kv.SetContext(ctx, "/context", "value", 0); err != context.Canceled {
+		t.Errorf("Expected SetContext to fail with context.Canceled, got %v", err)
+	}
+	if err := kv.Set("/context", "value", 0); err != nil {
+		t.Errorf("Set failed: %v", err)
+	}
+
+	short := EtcdWrapper{Timeout: time.Nanosecond}.NewKVWrapper(server.Servers(), "", "")
+	if _, err := short.GetVal("/context"); err != kvwrapper.ErrTimeout {
+		t.Errorf("Expected GetVal to fail with ErrTimeout, got %v", err)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	kv, err := EtcdWrapper{CheckConnection: true}.Connect(server.Servers(), "", "")
+	if err != nil {
+		t.Fatalf("Expected Connect to reach etcd, got %v", err)
+	}
+	if err := kv.Set("/connect", "value", 0); err != nil {
+		t.Errorf("Set failed: %v", err)
+	}
+	kv.Delete("/connect")
+
+	down := []string{"http://127.0.0.1:1"}
+	if _, err := (EtcdWrapper{CheckConnection: true}).Connect(down, "", ""); err != kvwrapper.ErrCouldNotConnect {
+		t.Errorf("Expected Connect to a down server to fail with ErrCouldNotConnect, got %v", err)
+	}
+	if kv := (EtcdWrapper{CheckConnection: true}).NewKVWrapper(down, "", ""); kv != nil {
+		t.Errorf("Expected NewKVWrapper to a down server to return nil, got %v", kv)
+	}
+	unchecked, err := EtcdWrapper{}.Connect(down, "", "")
+	if err != nil {
+		t.Fatalf("Expected Connect without CheckConnection to succeed, got %v", err)
+	}
+	if _, err := unchecked.GetVal("/connect"); err != kvwrapper.ErrCouldNotConnect {
+		t.Errorf("Expected GetVal on a down server to fail with ErrCouldNotConnect, got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	kv := newKV(t)
+	defer kv.DeleteList("/watch")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := kv.Watch(ctx, "/watch", true)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	kv.Set("/watch/a", "1", 0)
+	kv.Set("/watch/b", "2", 1)
+	want := []struct {
+		Type kvwrapper.EventType
+		Key  string
+	}{
+		{kvwrapper.EventPut, "/watch/a"},
+		{kvwrapper.EventPut, "/watch/b"},
+		{kvwrapper.EventExpire, "/watch/b"},
+	}
+	timeout := time.After(10 * time.Second)
+	for _, w := range want {
+		select {
+		case ev := <-events:
+			if ev.Type != w.Type || ev.Key != w.Key {
+				t.Errorf("Expected %s %s, got %v", w.Type, w.Key, ev)
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %s %s", w.Type, w.Key)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatchHistoryCleared(t *testing.T) {
+	kv := newKV(t).(EtcdWrapper)
+	defer kv.Delete("/cleared")
+
+	if err := kv.Set("/cleared", "0", 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	s, err := kv.GetVal("/cleared")
+	if err != nil {
+		t.Fatalf("GetVal failed: %v", err)
+	}
+	// etcd keeps the last 1000 events
+	for i := 1; i <= 1010; i++ {
+		if err := kv.Set("/cleared", fmt.Sprint(i), 0); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := kv.watch(ctx, "/cleared", false, uint64(s.ModRevision))
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			t.Fatalf("Expected the watch to close once its history is gone, got %v", ev)
+		case <-timeout:
+			t.Fatal("Timed out waiting for the watch to close")
+		}
+	}
+}
+
+func TestWatchStopped(t *testing.T) {
+	kv := newKV(t)
+	defer kv.Delete("/stopped")
+
+	// a watch stopped while waiting, then watches stopped as they receive an event, must leave
+	// the connections of the other requests alone
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	if _, err := kv.Watch(ctx, "/stopped", false); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	<-ctx.Done()
+	cancel()
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 10; i++ {
+			ctx, cancel := context.WithCancel(context.Background())
+			kv.Watch(ctx, "/stopped", false)
+			kv.Create("/stopped", "val", 0)
+			cancel()
+			if err := kv.CompareAndDelete("/stopped", "val"); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("CompareAndDelete failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out deleting keys while stopping watches")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	hosts := []string{}
+	for _, s := range server.Servers() {
+		hosts = append(hosts, strings.TrimPrefix(s, "http://"))
+	}
+	kv, err := kvwrapper.Open("etcd2://" + strings.Join(hosts, ",") + "/open?timeout=5s")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	backend, ok := kv.(kvwrapper.NamespacedWrapper).Backend.(EtcdWrapper)
+	if !ok || backend.Timeout != 5*time.Second {
+		t.Fatalf("Expected an EtcdWrapper with a timeout of 5s, got %v", kv)
+	}
+	defer backend.DeleteList("/open")
+
+	if err := kv.Set("key", "value", 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if stored, err := backend.GetVal("/open/key"); err != nil || stored.Value != "value" {
+		t.Errorf("Expected key to be set below /open, got %v, %v", stored, err)
+	}
+
+	if _, err := kvwrapper.Open("etcd2://" + hosts[0] + "?retries=3"); err == nil {
+		t.Error("Expected Open to fail on an unknown option")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	authServer, err := etcdtest.Start()
+	if err != nil {
+		t.Fatalf("Could not start etcd: %v", err)
+	}
+	defer authServer.Close()
+	if err := authServer.EnableAuth("secret"); err != nil {
+		t.Fatalf("Could not enable auth: %v", err)
+	}
+
+	kv := kvwrapper.NewKVWrapperWithAuth(authServer.Servers(), EtcdWrapper{}, "root", "secret")
+	if err := kv.Set("/auth", "value", 0); err != nil {
+		t.Errorf("Expected Set with valid credentials to succeed, got %v", err)
+	}
+	if s, err := kv.GetVal("/auth"); err != nil || s.Value != "value" {
+		t.Errorf("Expected to get value with valid credentials, got %v, %v", s, err)
+	}
+
+	anonymous := kvwrapper.NewKVWrapper(authServer.Servers(), EtcdWrapper{})
+	if _, err := anonymous.GetVal("/auth"); err != kvwrapper.ErrUnauthorized {
+		t.Errorf("Expected GetVal without credentials to fail with ErrUnauthorized, got %v", err)
+	}
+	select {
+	case ev, ok := <-anonymous.(EtcdWrapper).watch(context.Background(), "/auth", false, 0):
+		if ok {
+			t.Errorf("Expected the watch without credentials to close, got %v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the watch without credentials to close")
+	}
+	wrong := kvwrapper.NewKVWrapperWithAuth(authServer.Servers(), EtcdWrapper{}, "root", "wrong")
+	if err := wrong.Set("/auth", "other", 0); err != kvwrapper.ErrUnauthorized {
+		t.Errorf("Expected Set with a wrong password to fail with ErrUnauthorized, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package kvwrapper_etcd_v3
+
+import (
+	"context"
+	"strings"
+
+	"github.com/behance/go-common/kvwrapper"
+	log "github.com/behance/go-logging/log"
+	etcdv3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+// v3 has a flat keyspace. Unless Flat is set, the wrapper derives directories from the "/"
+// separators in the keys, the way v2 reports them: the directory "/a" exists as long as a key
+// begins with "/a/", and lists the keys right below it, along with the directories below it.
+
+// dirOf returns the prefix of the keys below the directory key
+func dirOf(key string) string {
+	return strings.TrimSuffix(key, "/") + "/"
+}
+
+// inDir returns a matcher for the directory key, and the keys below it
+func inDir(key string) func(k string) bool {
+	dir := dirOf(key)
+	return func(k string) bool {
+		return k == strings.TrimSuffix(key, "/") || strings.HasPrefix(k, dir)
+	}
+}
+
+// hasChildren tells whether some key begins with the directory key
+func (e EtcdV3Wrapper) hasChildren(ctx context.Context, key string) (bool, error) {
+	r, err := e.kapi.Get(ctx, dirOf(key), etcdv3.WithPrefix(), etcdv3.WithCountOnly())
+	if err != nil {
+		return false, err
+	}
+	return r.Count > 0, nil
+}
+
+// childrenPage returns up to limit of the keys and directories right below the directory key,
+// starting after token. Going through the keys of the store in order, a directory shows up where
+// its first key is, so directories sort as if their key ended with "/". The token of a directory
+// does end with "/", so that the next page starts after the keys below it.
+// A key holding a value with keys below it is listed once, where its value is, with HasChildren
+// set: the directory it also is gets left out.
+func (e EtcdV3Wrapper) childrenPage(ctx context.Context, key string, limit int64, token string, ttls map[int64]int64) (*kvwrapper.Page, error) {
+	dir := dirOf(key)
+	end := etcdv3.GetPrefixRangeEnd(dir)
+	start := dir
+	if token != "" {
+		start = after(token)
+	}
+	first := start
+
+	page := &kvwrapper.Page{KeyValues: make([]*kvwrapper.KeyValue, 0)}
+	last := ""
+	// the keys holding a value listed so far, whose directory is left out
+	listed := map[string]bool{}
+	for {
+		r, err := e.kapi.Get(ctx, start,
+			etcdv3.WithRange(end),
+			etcdv3.WithSort(etcdv3.SortByKey, etcdv3.SortAscend),
+			etcdv3.WithLimit(kvwrapper.DefaultPageSize))
+		if err != nil {
+			if err == rpctypes.ErrKeyNotFound {
+				return nil, kvwrapper.ErrKeyNotFound
+			}
+			log.Warn("Could not retrieve key from etcd.", "key", key, "err", err)
+			return nil, e.clientError(err)
+		}
+
+		for i, kv := range r.Kvs {
+			k := string(kv.Key)
+			rest := strings.TrimPrefix(k, dir)
+			if rest == "" {
+				continue
+			}
+			if j := strings.Index(rest, "/"); j >= 0 {
+				child := dir + rest[:j+1]
+				if child == last {
+					continue
+				}
+				merged, err := e.listedBefore(ctx, child, first, listed)
+				if err != nil {
+					return nil, err
+				}
+				if merged {
+					last = child
+					continue
+				}
+				if limit > 0 && int64(len(page.KeyValues)) == limit {
+					page.Next = last
+					return page, nil
+				}
+				page.KeyValues = append(page.KeyValues, &kvwrapper.KeyValue{Key: strings.TrimSuffix(child, "/"), HasChildren: true})
+				last = child
+				continue
+			}
+			if limit > 0 && int64(len(page.KeyValues)) == limit {
+				page.Next = last
+				return page, nil
+			}
+			entry := e.keyValue(ctx, k, r.Kvs[i], ttls)
+			switch {
+			case i+1 < len(r.Kvs) && !strings.HasPrefix(string(r.Kvs[i+1].Key), k):
+				// a key below k would sort before the next one
+			case i+1 < len(r.Kvs) && strings.HasPrefix(string(r.Kvs[i+1].Key), k+"/"):
+				entry.HasChildren = true
+			case i+1 < len(r.Kvs) || r.More:
+				// keys such as k+"-x" sort in between, or the next batch holds the keys below k
+				if entry.HasChildren, err = e.hasChildren(ctx, k); err != nil {
+					log.Warn("Could not retrieve key from etcd.", "key", k, "err", err)
+					return nil, e.clientError(err)
+				}
+			}
+			page.KeyValues = append(page.KeyValues, entry)
+			listed[k] = entry.HasChildren
+			last = k
+		}
+
+		if !r.More || len(r.Kvs) == 0 {
+			break
+		}
+		start = string(r.Kvs[len(r.Kvs)-1].Key) + "\x00"
+		if last != "" && strings.HasSuffix(last, "/") && strings.HasPrefix(start, last) {
+			// skip the rest of the directory being walked through
+			start = after(last)
+		}
+	}
+
+	if len(page.KeyValues) == 0 && token == "" {
+		// listing a key holding a value lists nothing, as on v2
+		r, err := e.kapi.Get(ctx, key, etcdv3.WithCountOnly())
+		if err != nil {
+			log.Warn("Could not retrieve key from etcd.", "key", key, "err", err)
+			return nil, e.clientError(err)
+		}
+		if r.Count == 0 {
+			return nil, kvwrapper.ErrKeyNotFound
+		}
+	}
+	return page, nil
+}
+
+// listedBefore tells whether the directory child was already listed along with the key holding a
+// value at its path, which sorts before it: by this page, or by a previous one if that key comes
+// before first, where this page starts
+func (e EtcdV3Wrapper) listedBefore(ctx context.Context, child string, first string, listed map[string]bool) (bool, error) {
+	key := strings.TrimSuffix(child, "/")
+	if hasChildren, ok := listed[key]; ok {
+		return hasChildren, nil
+	}
+	if key >= first {
+		return false, nil
+	}
+	r, err := e.kapi.Get(ctx, key, etcdv3.WithCountOnly())
+	if err != nil {
+		log.Warn("Could not retrieve key from etcd.", "key", key, "err", err)
+		return false, e.clientError(err)
+	}
+	return r.Count > 0, nil
+}
+
+// after returns the first key following token: right after it, or after every key below it
+// for the token of a directory
+func after(token string) string {
+	if strings.HasSuffix(token, "/") {
+		return etcdv3.GetPrefixRangeEnd(token)
+	}
+	return token + "\x00"
+}
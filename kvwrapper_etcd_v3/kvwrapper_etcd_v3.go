@@ -2,6 +2,7 @@ package kvwrapper_etcd_v3
 
 import (
 	"context"
+	"sort"
 	"strings"
 	"time"
 
@@ -9,16 +10,48 @@ import (
 	log "github.com/behance/go-logging/log"
 	etcdv3 "github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // EtcdWrapper wraps the go-etcd client so it can implement the KVWrapper interface
 type EtcdV3Wrapper struct {
-	kapi etcdv3.KV
-	cli  etcdv3.Client
+	// Timeout bounds the operations called without a context, kvwrapper.DefaultTimeout if left blank
+	Timeout time.Duration
+	// Flat keeps the keyspace flat: GetList and DeleteList work on every key beginning with the
+	// key given, and no key has children. Otherwise directories are derived from the "/" in the
+	// keys, as v2 reports them.
+	Flat bool
+	// CheckConnection makes Connect and NewKVWrapper ask the servers for their status, failing if
+	// none of them answers. The credentials are checked when connecting either way.
+	CheckConnection bool
+	// LookupTTLs makes the reads ask etcd for the ttl left on the leases the wrapper did not grant
+	// itself, one request per lease. Otherwise the keys attached to such leases report their
+	// LeaseID but no TTL.
+	LookupTTLs bool
+
+	kapi   etcdv3.KV
+	cli    *etcdv3.Client
+	leases *leaseTracker
 }
 
-// NewKVWrapper returns a new kvwrapper_etcd as a KVWrapper
+// NewKVWrapper returns a new kvwrapper_etcd as a KVWrapper, or nil if Connect fails
 func (e EtcdV3Wrapper) NewKVWrapper(servers []string, username, password string) kvwrapper.KVWrapper {
+	kv, err := e.Connect(servers, username, password)
+	if err != nil {
+		// Connect logged the error already; even though it is critical, we don't want to issue
+		// log.Fatal, since that would os.Exit(1) from within the lib
+		return nil
+	}
+	return kv
+}
+
+// Connect returns a new kvwrapper_etcd as a KVWrapper. It fails with ErrUnauthorized if the
+// credentials are refused, with ErrCouldNotConnect if the client cannot be set up and, when
+// CheckConnection is set, with ErrCouldNotConnect or ErrTimeout if no server answers.
+func (e EtcdV3Wrapper) Connect(servers []string, username, password string) (kvwrapper.KVWrapper, error) {
 	config := etcdv3.Config{
 		Endpoints:   servers,
 		Username:    username,
@@ -27,12 +60,124 @@ func (e EtcdV3Wrapper) NewKVWrapper(servers []string, username, password string)
 	}
 	client, err := etcdv3.New(config)
 	if err != nil {
-		// even though this is a critical error, wedon't want to issue log.Fatal, since that would os.Exit(1) from within the lib
 		log.Warn("Could not instantiate etcd V3 client.", "err", err)
-		return nil
+		if e.clientError(err) == kvwrapper.ErrUnauthorized {
+			return nil, kvwrapper.ErrUnauthorized
+		}
+		return nil, kvwrapper.ErrCouldNotConnect
+	}
+	if e.CheckConnection {
+		if err := e.checkConnection(client); err != nil {
+			log.Warn("Could not reach etcd.", "servers", servers, "err", err)
+			client.Close()
+			return nil, e.clientError(err)
+		}
+	}
+
+	return EtcdV3Wrapper{
+		kapi:            etcdv3.NewKV(client),
+		cli:             client,
+		leases:          newLeaseTracker(),
+		Timeout:         e.Timeout,
+		Flat:            e.Flat,
+		CheckConnection: e.CheckConnection,
+		LookupTTLs:      e.LookupTTLs,
+	}, nil
+}
+
+// checkConnection asks the endpoints of client for their status, until one answers
+func (e EtcdV3Wrapper) checkConnection(client *etcdv3.Client) error {
+	ctx, cancel := e.context()
+	defer cancel()
+
+	err := etcdv3.ErrNoAvailableEndpoints
+	for _, endpoint := range client.Endpoints() {
+		if _, err = client.Status(ctx, endpoint); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func init() {
+	kvwrapper.Register("etcd3", kvwrapper.DriverFunc(open))
+}
+
+// open opens the wrapper of a DSN such as etcd3://user:pass@h1:2379,h2:2379/prefix?timeout=5s,
+// reaching the hosts over https if tls=true, and http otherwise. flat=true sets Flat,
+// check=true sets CheckConnection, and ttls=true sets LookupTTLs.
+func open(dsn *kvwrapper.DSN) (kvwrapper.KVWrapper, error) {
+	if err := dsn.CheckOptions("timeout", "tls", "flat", "check", "ttls"); err != nil {
+		return nil, err
+	}
+	timeout, err := dsn.Duration("timeout")
+	if err != nil {
+		return nil, err
+	}
+	flat, err := dsn.Bool("flat")
+	if err != nil {
+		return nil, err
+	}
+	check, err := dsn.Bool("check")
+	if err != nil {
+		return nil, err
 	}
+	ttls, err := dsn.Bool("ttls")
+	if err != nil {
+		return nil, err
+	}
+	servers, err := dsn.Servers()
+	if err != nil {
+		return nil, err
+	}
+	return EtcdV3Wrapper{Timeout: timeout, Flat: flat, CheckConnection: check, LookupTTLs: ttls}.Connect(servers, dsn.Username, dsn.Password)
+}
+
+// Client returns the etcd client behind the wrapper, for the features of etcd v3 the KVWrapper
+// interface does not cover (see the lock and election packages)
+func (e EtcdV3Wrapper) Client() *etcdv3.Client {
+	return e.cli
+}
 
-	return EtcdV3Wrapper{kapi: etcdv3.NewKV(client), cli: *client}
+// context returns the context bounding an operation called without one
+func (e EtcdV3Wrapper) context() (context.Context, context.CancelFunc) {
+	return kvwrapper.TimeoutContext(e.Timeout)
+}
+
+// clientError maps the errors of the etcd client onto kvwrapper errors: refused credentials,
+// servers that cannot be reached, closed clients and deadlines that passed
+func (e EtcdV3Wrapper) clientError(err error) error {
+	if err == nil {
+		return nil
+	}
+	// the calls on a closed client fail with context.Canceled, as those whose context is canceled
+	if e.cli != nil && e.cli.Ctx().Err() != nil {
+		return kvwrapper.ErrCouldNotConnect
+	}
+	switch err {
+	case context.Canceled:
+		return err
+	case context.DeadlineExceeded, rpctypes.ErrTimeout, rpctypes.ErrTimeoutDueToLeaderFail,
+		rpctypes.ErrTimeoutDueToConnectionLost:
+		return kvwrapper.ErrTimeout
+	case rpctypes.ErrAuthFailed, rpctypes.ErrAuthNotEnabled, rpctypes.ErrInvalidAuthToken,
+		rpctypes.ErrInvalidAuthMgmt, rpctypes.ErrPermissionDenied, rpctypes.ErrUserEmpty,
+		rpctypes.ErrRoleNotGranted:
+		return kvwrapper.ErrUnauthorized
+	case etcdv3.ErrNoAvailableEndpoints, grpc.ErrClientConnClosing, rpctypes.ErrNoLeader:
+		return kvwrapper.ErrCouldNotConnect
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable:
+			return kvwrapper.ErrCouldNotConnect
+		case codes.DeadlineExceeded:
+			return kvwrapper.ErrTimeout
+		case codes.Unauthenticated, codes.PermissionDenied:
+			return kvwrapper.ErrUnauthorized
+		}
+	}
+	return err
 }
 
 // Set sets the key = val with a ttl of ttl. If key is a path, it will be created.
@@ -41,135 +186,705 @@ func (e EtcdV3Wrapper) NewKVWrapper(servers []string, username, password string)
 // hence there is no need to convert to time.Duration (which is in nanoseconds) as is done in version 2
 // note! The API assumes that a ttl of 0, implies a wish that the key/value pair not expire
 // implementing that behavior in v3, by not acquiring a lease
+// Setting a key again reuses the lease it was given last time if the ttl did not change,
+// and otherwise revokes it, so leases do not pile up for keys that get refreshed periodically.
 func (e EtcdV3Wrapper) Set(key string, val string, ttl uint64) error {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.SetContext(ctx, key, val, ttl)
+}
+
+// SetContext is Set bound to ctx
+func (e EtcdV3Wrapper) SetContext(ctx context.Context, key string, val string, ttl uint64) error {
 	// acquire a lease to which we'll attach the new key/value pair
-	// lease.grant takes an int64 as the ttl, hence casting is necessary
 	log.Debug("called Set with key/value: ", key, val, " and ttl ", ttl)
 	if ttl == 0 {
-		_, put_err := e.kapi.Put(context.Background(), key, val)
+		_, put_err := e.kapi.Put(ctx, key, val)
 		if put_err != nil {
 			log.Warn("Could not set key in etcd.", "key", key, "err", put_err)
-			return put_err
+			return e.clientError(put_err)
 		}
 	} else {
-		lease, lease_err := e.cli.Grant(context.Background(), int64(ttl))
+		leaseID, lease_err := e.attachLease(ctx, key, ttl)
 		if lease_err != nil {
-			log.Fatal(lease_err)
 			return lease_err
 		}
 
-		log.Debug("go-common: Set - got lease", lease.ID, " with a ttl of ", lease.TTL)
+		log.Debug("go-common: Set - got lease", leaseID, " with a ttl of ", ttl)
 		// Insert key with a lease of ttl second TTL
-		_, put_err := e.kapi.Put(context.Background(), key, val, etcdv3.WithLease(lease.ID))
+		_, put_err := e.kapi.Put(ctx, key, val, etcdv3.WithLease(leaseID))
 		if put_err != nil {
 			log.Warn("Could not set key in etcd.", "key", key, "err", put_err)
 			// if the Put op failed, clean up the lease
-			_, revoke_err := e.cli.Revoke(context.Background(), lease.ID)
-			if revoke_err != nil {
-				log.Warn("Attempt to revoke lease failed with error ", revoke_err, " for lease.ID ", lease.ID)
-			}
-			return put_err
+			e.discardLease(key, leaseID)
+			return e.clientError(put_err)
+		}
+		e.ownLease(key, leaseID, ttl)
+		return nil
+	}
+	e.ownLease(key, etcdv3.NoLease, 0)
+	return nil
+}
+
+// Create sets key = val only if key does not exist yet
+func (e EtcdV3Wrapper) Create(key string, val string, ttl uint64) (int64, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.CreateContext(ctx, key, val, ttl)
+}
+
+// CreateContext is Create bound to ctx
+func (e EtcdV3Wrapper) CreateContext(ctx context.Context, key string, val string, ttl uint64) (int64, error) {
+	return e.putIf(ctx, key, val, ttl, etcdv3.Compare(etcdv3.CreateRevision(key), "=", 0))
+}
+
+// CompareAndSwap sets key = val only if the current value of key is prevVal
+func (e EtcdV3Wrapper) CompareAndSwap(key string, val string, prevVal string, ttl uint64) (int64, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.CompareAndSwapContext(ctx, key, val, prevVal, ttl)
+}
+
+// CompareAndSwapContext is CompareAndSwap bound to ctx
+func (e EtcdV3Wrapper) CompareAndSwapContext(ctx context.Context, key string, val string, prevVal string, ttl uint64) (int64, error) {
+	return e.putIf(ctx, key, val, ttl, etcdv3.Compare(etcdv3.Value(key), "=", prevVal))
+}
+
+// CompareAndSwapRevision sets key = val only if key was last modified at revision prevRev.
+// A missing key has a revision of 0 in v3, so the key is also required to exist.
+func (e EtcdV3Wrapper) CompareAndSwapRevision(key string, val string, prevRev int64, ttl uint64) (int64, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.CompareAndSwapRevisionContext(ctx, key, val, prevRev, ttl)
+}
+
+// CompareAndSwapRevisionContext is CompareAndSwapRevision bound to ctx
+func (e EtcdV3Wrapper) CompareAndSwapRevisionContext(ctx context.Context, key string, val string, prevRev int64, ttl uint64) (int64, error) {
+	return e.putIf(ctx, key, val, ttl,
+		etcdv3.Compare(etcdv3.ModRevision(key), "=", prevRev),
+		etcdv3.Compare(etcdv3.CreateRevision(key), ">", 0))
+}
+
+// putIf puts key = val in a transaction guarded by cmps. When a cmp fails, the current
+// state of key is fetched in the same transaction to tell a conflict from a missing key.
+func (e EtcdV3Wrapper) putIf(ctx context.Context, key string, val string, ttl uint64, cmps ...etcdv3.Cmp) (int64, error) {
+	leaseID, err := e.attachLease(ctx, key, ttl)
+	if err != nil {
+		return 0, err
+	}
+	options := []etcdv3.OpOption{}
+	if leaseID != etcdv3.NoLease {
+		options = append(options, etcdv3.WithLease(leaseID))
+	}
+
+	r, err := e.kapi.Txn(ctx).
+		If(cmps...).
+		Then(etcdv3.OpPut(key, val, options...)).
+		Else(etcdv3.OpGet(key, etcdv3.WithCountOnly())).
+		Commit()
+	if err == nil && !r.Succeeded {
+		err = kvwrapper.ErrConflict
+		if r.Responses[0].GetResponseRange().Count == 0 {
+			err = kvwrapper.ErrKeyNotFound
+		}
+	}
+	if err != nil {
+		if err != kvwrapper.ErrConflict && err != kvwrapper.ErrKeyNotFound {
+			log.Warn("Could not set key in etcd.", "key", key, "err", err)
 		}
+		e.discardLease(key, leaseID)
+		return 0, e.clientError(err)
 	}
+	e.ownLease(key, leaseID, ttl)
+	return r.Header.Revision, nil
+}
+
+// CompareAndDelete removes key only if its current value is prevVal
+func (e EtcdV3Wrapper) CompareAndDelete(key string, prevVal string) error {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.CompareAndDeleteContext(ctx, key, prevVal)
+}
+
+// CompareAndDeleteContext is CompareAndDelete bound to ctx
+func (e EtcdV3Wrapper) CompareAndDeleteContext(ctx context.Context, key string, prevVal string) error {
+	r, err := e.kapi.Txn(ctx).
+		If(etcdv3.Compare(etcdv3.Value(key), "=", prevVal)).
+		Then(etcdv3.OpDelete(key)).
+		Else(etcdv3.OpGet(key, etcdv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		log.Warn("Could not delete key from etcd.", "key", key, "err", err)
+		return e.clientError(err)
+	}
+	if !r.Succeeded {
+		if r.Responses[0].GetResponseRange().Count == 0 {
+			return kvwrapper.ErrKeyNotFound
+		}
+		return kvwrapper.ErrConflict
+	}
+	e.releaseLeases(isKey(key))
 	return nil
 }
 
+// Txn starts a transaction applied natively by an etcd v3 transaction
+func (e EtcdV3Wrapper) Txn() *kvwrapper.Txn {
+	return kvwrapper.NewContextTxn(e.commit, e.commitContext)
+}
+
+func (e EtcdV3Wrapper) commit(compares []kvwrapper.Compare, thenOps []kvwrapper.Op, elseOps []kvwrapper.Op) (*kvwrapper.TxnResponse, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.commitContext(ctx, compares, thenOps, elseOps)
+}
+
+func (e EtcdV3Wrapper) commitContext(ctx context.Context, compares []kvwrapper.Compare, thenOps []kvwrapper.Op, elseOps []kvwrapper.Op) (*kvwrapper.TxnResponse, error) {
+	cmps := make([]etcdv3.Cmp, 0, len(compares))
+	for _, cmp := range compares {
+		switch cmp.Target {
+		case kvwrapper.CompareValue:
+			cmps = append(cmps, etcdv3.Compare(etcdv3.Value(cmp.Key), cmp.Result, cmp.Value))
+		case kvwrapper.CompareRevision:
+			cmps = append(cmps, etcdv3.Compare(etcdv3.ModRevision(cmp.Key), cmp.Result, cmp.Revision))
+		}
+	}
+
+	// keys set with the same ttl in one transaction share a lease, as they expire together anyway.
+	// The leases granted for the branch that did not run are revoked once the outcome is known.
+	thenLeases := make(map[uint64]etcdv3.LeaseID)
+	elseLeases := make(map[uint64]etcdv3.LeaseID)
+	thenV3, err := e.txnOps(ctx, thenOps, thenLeases)
+	var elseV3 []etcdv3.Op
+	if err == nil {
+		elseV3, err = e.txnOps(ctx, elseOps, elseLeases)
+	}
+	var r *etcdv3.TxnResponse
+	if err == nil {
+		r, err = e.kapi.Txn(ctx).If(cmps...).Then(thenV3...).Else(elseV3...).Commit()
+	}
+	if err != nil {
+		log.Warn("Could not commit transaction in etcd.", "err", err)
+		e.revokeLeases(thenLeases)
+		e.revokeLeases(elseLeases)
+		return nil, e.clientError(err)
+	}
+
+	if r.Succeeded {
+		e.revokeLeases(elseLeases)
+		e.releaseWritten(thenOps)
+		return e.txnResponse(ctx, r, thenOps), nil
+	}
+	e.revokeLeases(thenLeases)
+	e.releaseWritten(elseOps)
+	return e.txnResponse(ctx, r, elseOps), nil
+}
+
+// releaseWritten revokes the leases owned by the keys a transaction set or deleted, which
+// no longer hold on to them
+func (e EtcdV3Wrapper) releaseWritten(ops []kvwrapper.Op) {
+	for _, op := range ops {
+		if op.Type == kvwrapper.OpSet || op.Type == kvwrapper.OpDelete {
+			e.releaseLeases(isKey(op.Key))
+		}
+	}
+}
+
+// txnOps converts ops to their v3 counterparts, granting the leases their ttls require
+func (e EtcdV3Wrapper) txnOps(ctx context.Context, ops []kvwrapper.Op, leases map[uint64]etcdv3.LeaseID) ([]etcdv3.Op, error) {
+	v3Ops := make([]etcdv3.Op, 0, len(ops))
+	for _, op := range ops {
+		switch op.Type {
+		case kvwrapper.OpSet:
+			options := []etcdv3.OpOption{}
+			if op.TTL > 0 {
+				leaseID, ok := leases[op.TTL]
+				if !ok {
+					var err error
+					leaseID, err = e.grantLease(ctx, op.TTL)
+					if err != nil {
+						return nil, err
+					}
+					leases[op.TTL] = leaseID
+				}
+				options = append(options, etcdv3.WithLease(leaseID))
+			}
+			v3Ops = append(v3Ops, etcdv3.OpPut(op.Key, op.Value, options...))
+		case kvwrapper.OpDelete:
+			v3Ops = append(v3Ops, etcdv3.OpDelete(op.Key))
+		case kvwrapper.OpGet:
+			v3Ops = append(v3Ops, etcdv3.OpGet(op.Key))
+		}
+	}
+	return v3Ops, nil
+}
+
+func (e EtcdV3Wrapper) txnResponse(ctx context.Context, r *etcdv3.TxnResponse, ops []kvwrapper.Op) *kvwrapper.TxnResponse {
+	ttls := make(map[int64]int64)
+	resp := &kvwrapper.TxnResponse{
+		Succeeded: r.Succeeded,
+		Revision:  r.Header.Revision,
+	}
+	for i, op := range ops {
+		result := &kvwrapper.OpResult{Op: op}
+		switch op.Type {
+		case kvwrapper.OpDelete:
+			result.Deleted = r.Responses[i].GetResponseDeleteRange().Deleted
+		case kvwrapper.OpGet:
+			if kvs := r.Responses[i].GetResponseRange().Kvs; len(kvs) > 0 {
+				result.KeyValue = e.keyValue(ctx, op.Key, kvs[0], ttls)
+			}
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	return resp
+}
+
+func (e EtcdV3Wrapper) revokeLeases(leases map[uint64]etcdv3.LeaseID) {
+	for _, leaseID := range leases {
+		e.revokeLease(leaseID)
+	}
+}
+
+// grantLease acquires a lease of ttl seconds. A ttl of 0 needs no lease, in which case NoLease is returned.
+func (e EtcdV3Wrapper) grantLease(ctx context.Context, ttl uint64) (etcdv3.LeaseID, error) {
+	if ttl == 0 {
+		return etcdv3.NoLease, nil
+	}
+	// lease.grant takes an int64 as the ttl, hence casting is necessary
+	lease, err := e.cli.Grant(ctx, int64(ttl))
+	if err != nil {
+		log.Warn("Could not grant lease in etcd.", "ttl", ttl, "err", err)
+		return etcdv3.NoLease, e.clientError(err)
+	}
+	e.leases.renewed(lease.ID, lease.TTL)
+	return lease.ID, nil
+}
+
+// revokeLease cleans up a lease that ended up unused. It is not bound to the context of the
+// failed operation, which may well be the reason the lease was not used.
+func (e EtcdV3Wrapper) revokeLease(leaseID etcdv3.LeaseID) {
+	if leaseID == etcdv3.NoLease {
+		return
+	}
+	ctx, cancel := e.context()
+	defer cancel()
+
+	e.leases.revoked(leaseID)
+	_, err := e.cli.Revoke(ctx, leaseID)
+	if err != nil {
+		log.Warn("Attempt to revoke lease failed with error ", err, " for lease.ID ", leaseID)
+	}
+}
+
 // GetVal returns a single KeyValue found at key
 func (e EtcdV3Wrapper) GetVal(key string) (*kvwrapper.KeyValue, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.GetValContext(ctx, key)
+}
+
+// GetValContext is GetVal bound to ctx
+func (e EtcdV3Wrapper) GetValContext(ctx context.Context, key string) (*kvwrapper.KeyValue, error) {
 	// by default no sorting nor range expansion is performed
 	log.Debug("entering GetVal with key ", key)
 
-	r, err := e.kapi.Get(context.Background(), key)
+	r, err := e.kapi.Get(ctx, key)
 	if err != nil {
-		if err == context.Canceled {
-			log.Warn("Context Cancelled could not retrieve key ", key, " receiving error ", err)
-			return nil, err
-			// else if handles case grpc.ErrClientConnClosing by checking if message contains "client"
-		} else if strings.Contains(err.Error(), "client") {
-			log.Warn("Client Connection Closed - could not retrieve key ", key, " receiving error ", err)
-			return nil, err
-		}
-	}
-	if err != nil || r.Kvs == nil || len(r.Kvs) < 1 {
-		log.Info("could not retrieve key ", key, " receiving error ", err)
-		if err == rpctypes.ErrKeyNotFound || r.Kvs == nil || len(r.Kvs) == 0 {
+		if err == rpctypes.ErrKeyNotFound {
 			return nil, kvwrapper.ErrKeyNotFound
 		}
 		log.Warn("Could not retrieve key from etcd.", "key", key, "err", err)
-		return nil, err
+		return nil, e.clientError(err)
+	}
+	if len(r.Kvs) == 0 {
+		if !e.Flat {
+			// a key with keys below it is a directory
+			dir, err := e.hasChildren(ctx, key)
+			if err != nil {
+				log.Warn("Could not retrieve key from etcd.", "key", key, "err", err)
+				return nil, e.clientError(err)
+			}
+			if dir {
+				return &kvwrapper.KeyValue{Key: key, HasChildren: true}, nil
+			}
+		}
+		log.Info("could not retrieve key ", key)
+		return nil, kvwrapper.ErrKeyNotFound
 	}
 
-	kv := &kvwrapper.KeyValue{
-		Key:         key,
-		Value:       string(r.Kvs[0].Value),
-		HasChildren: false,
+	return e.keyValue(ctx, key, r.Kvs[0], make(map[int64]int64)), nil
+}
+
+// keyValue converts kv, found at key. The ttl left on its lease is known when the wrapper granted
+// or renewed it; otherwise, with LookupTTLs set, it is looked up unless it is in ttls, which
+// caches the ttls of the leases looked up so far.
+func (e EtcdV3Wrapper) keyValue(ctx context.Context, key string, kv *mvccpb.KeyValue, ttls map[int64]int64) *kvwrapper.KeyValue {
+	r := &kvwrapper.KeyValue{
+		Key:            key,
+		Value:          string(kv.Value),
+		HasChildren:    false,
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Version:        kv.Version,
+		LeaseID:        kv.Lease,
+	}
+	if kv.Lease == int64(etcdv3.NoLease) {
+		return r
+	}
+	ttl, ok := e.leases.ttl(etcdv3.LeaseID(kv.Lease))
+	if !ok && e.LookupTTLs {
+		if ttl, ok = ttls[kv.Lease]; !ok {
+			ttl = e.leaseTTL(ctx, kv.Lease)
+			ttls[kv.Lease] = ttl
+		}
+	}
+	if ttl > 0 {
+		r.TTL = ttl
+		r.Expiration = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+	return r
+}
+
+// leaseTTL returns the number of seconds left before the lease expires, 0 if that is unknown
+func (e EtcdV3Wrapper) leaseTTL(ctx context.Context, leaseID int64) int64 {
+	r, err := e.cli.TimeToLive(ctx, etcdv3.LeaseID(leaseID))
+	if err != nil {
+		log.Warn("Could not look up lease in etcd.", "lease", leaseID, "err", err)
+		return 0
 	}
-	return kv, nil
+	return r.TTL
 }
 
-// GetList returns a[]KeyValue found whose keys all begin with key as prefix
+// GetList returns the keys and directories right below the directory key, like v2, or with Flat
+// set every key beginning with key as prefix. They are fetched kvwrapper.DefaultPageSize at a
+// time, to stay below the message size limits of gRPC. They are sorted by key if sort is set, and
+// otherwise come in the order of the store, where a directory sorts as if its key ended with "/".
 func (e EtcdV3Wrapper) GetList(key string, sort bool) ([]*kvwrapper.KeyValue, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.GetListContext(ctx, key, sort)
+}
+
+// GetListContext is GetList bound to ctx
+func (e EtcdV3Wrapper) GetListContext(ctx context.Context, key string, sorted bool) ([]*kvwrapper.KeyValue, error) {
+	kvs := make([]*kvwrapper.KeyValue, 0)
+	ttls := make(map[int64]int64)
+	token := ""
+	for {
+		page, err := e.getPage(ctx, key, kvwrapper.DefaultPageSize, token, ttls)
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, page.KeyValues...)
+		if page.Next == "" {
+			break
+		}
+		token = page.Next
+	}
+	if sorted && !e.Flat {
+		// directories come in the order of their keys followed by "/"
+		sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	}
+	return kvs, nil
+}
+
+// GetPage returns up to limit of the keys GetList returns, fetched with range limits. Without
+// Flat, the directories come in the order of their keys followed by "/".
+func (e EtcdV3Wrapper) GetPage(ctx context.Context, key string, limit int64, token string) (*kvwrapper.Page, error) {
+	return e.getPage(ctx, key, limit, token, make(map[int64]int64))
+}
+
+// getPage is GetPage, with ttls caching the ttls of the leases looked up so far
+func (e EtcdV3Wrapper) getPage(ctx context.Context, key string, limit int64, token string, ttls map[int64]int64) (*kvwrapper.Page, error) {
+	if !e.Flat {
+		return e.childrenPage(ctx, key, limit, token, ttls)
+	}
+	return e.prefixPage(ctx, key, limit, token, ttls)
+}
+
+// prefixPage returns up to limit of the keys beginning with key as prefix, starting after token
+func (e EtcdV3Wrapper) prefixPage(ctx context.Context, key string, limit int64, token string, ttls map[int64]int64) (*kvwrapper.Page, error) {
+	// the page starts right after the last key of the previous one
+	start := key
+	if token != "" {
+		start = token + "\x00"
+	}
+	if start == "" {
+		start = "\x00"
+	}
 	options := []etcdv3.OpOption{
+		etcdv3.WithRange(etcdv3.GetPrefixRangeEnd(key)),
 		etcdv3.WithSort(etcdv3.SortByKey, etcdv3.SortAscend),
-		etcdv3.WithPrefix(),
 	}
-	r, err := e.kapi.Get(context.Background(), key, options...)
+	if limit > 0 {
+		options = append(options, etcdv3.WithLimit(limit))
+	}
+	r, err := e.kapi.Get(ctx, start, options...)
 	if err != nil {
 		if err == rpctypes.ErrKeyNotFound {
 			return nil, kvwrapper.ErrKeyNotFound
 		}
 		log.Warn("Could not retrieve key from etcd.", "key", key, "err", err)
-		return nil, err
+		return nil, e.clientError(err)
 	}
-	kvs := make([]*kvwrapper.KeyValue, 0)
-	num_kv := len(r.Kvs)
-	for i := 0; i < num_kv; i++ {
-		kv := &kvwrapper.KeyValue{
-			Key:         string(r.Kvs[i].Key),
-			Value:       string(r.Kvs[i].Value),
-			HasChildren: false,
+	if len(r.Kvs) == 0 && token == "" {
+		// an empty range is what v3 reports for a prefix without keys
+		return nil, kvwrapper.ErrKeyNotFound
+	}
+	page := &kvwrapper.Page{KeyValues: make([]*kvwrapper.KeyValue, 0, len(r.Kvs))}
+	for _, kv := range r.Kvs {
+		page.KeyValues = append(page.KeyValues, e.keyValue(ctx, string(kv.Key), kv, ttls))
+	}
+	if r.More && len(r.Kvs) > 0 {
+		page.Next = string(r.Kvs[len(r.Kvs)-1].Key)
+	}
+	return page, nil
+}
+
+// List returns the keys GetList returns, as tuned by opts. With Flat set, etcd sorts, strips or
+// counts the keys itself, in a single request. Otherwise the directories are derived from the keys
+// fetched a page at a time, and the keys are sorted and stripped once fetched.
+func (e EtcdV3Wrapper) List(ctx context.Context, key string, opts kvwrapper.ListOptions) (*kvwrapper.ListResult, error) {
+	if !e.Flat {
+		kvs, err := e.GetListContext(ctx, key, opts.Sorted())
+		if err != nil {
+			return nil, err
 		}
-		kvs = append(kvs, kv)
+		return opts.Apply(kvs), nil
 	}
-	return kvs, nil
+
+	start := key
+	if start == "" {
+		start = "\x00"
+	}
+	options := []etcdv3.OpOption{
+		etcdv3.WithRange(etcdv3.GetPrefixRangeEnd(key)),
+		etcdv3.WithSort(sortTargets[opts.SortBy], sortOrders[opts.Order]),
+	}
+	if opts.KeysOnly {
+		options = append(options, etcdv3.WithKeysOnly())
+	}
+	if opts.CountOnly {
+		options = append(options, etcdv3.WithCountOnly())
+	}
+	r, err := e.kapi.Get(ctx, start, options...)
+	if err != nil {
+		if err == rpctypes.ErrKeyNotFound {
+			return nil, kvwrapper.ErrKeyNotFound
+		}
+		log.Warn("Could not retrieve key from etcd.", "key", key, "err", err)
+		return nil, e.clientError(err)
+	}
+	if r.Count == 0 {
+		// an empty range is what v3 reports for a prefix without keys
+		return nil, kvwrapper.ErrKeyNotFound
+	}
+	if opts.CountOnly {
+		return &kvwrapper.ListResult{Count: r.Count}, nil
+	}
+	result := &kvwrapper.ListResult{KeyValues: make([]*kvwrapper.KeyValue, 0, len(r.Kvs)), Count: r.Count}
+	ttls := make(map[int64]int64)
+	for _, kv := range r.Kvs {
+		result.KeyValues = append(result.KeyValues, e.keyValue(ctx, string(kv.Key), kv, ttls))
+	}
+	return result, nil
 }
 
-// delete individual key
-// is candidate to be added to interface
-func Delete(e EtcdV3Wrapper, key string) error {
+var (
+	sortTargets = map[kvwrapper.SortTarget]etcdv3.SortTarget{
+		kvwrapper.SortByKey:            etcdv3.SortByKey,
+		kvwrapper.SortByValue:          etcdv3.SortByValue,
+		kvwrapper.SortByCreateRevision: etcdv3.SortByCreateRevision,
+		kvwrapper.SortByModRevision:    etcdv3.SortByModRevision,
+	}
+	sortOrders = map[kvwrapper.SortOrder]etcdv3.SortOrder{
+		kvwrapper.SortNone:    etcdv3.SortNone,
+		kvwrapper.SortAscend:  etcdv3.SortAscend,
+		kvwrapper.SortDescend: etcdv3.SortDescend,
+	}
+)
+
+// Watch streams the changes made to key, or, if recursive is set, to the directory key and every
+// key below it. With Flat set, recursive watches every key beginning with key as prefix.
+// The client already retries broken connections on its own; if the watch gets closed anyway it is
+// re-established from the revision following the last one delivered, unless that revision was
+// compacted, in which case the channel is closed since the changes in between can no longer be
+// delivered. It is closed as well once the credentials are refused or the wrapper is closed.
+// The empty key watched recursively covers the whole keyspace, keys without a leading "/" included.
+// Note that v3 does not distinguish keys removed by an expired lease from deleted keys, so no
+// EventExpire is ever sent.
+func (e EtcdV3Wrapper) Watch(ctx context.Context, key string, recursive bool) (<-chan *kvwrapper.WatchEvent, error) {
+	options := []etcdv3.OpOption{}
+	var match func(string) bool
+	if recursive {
+		options = append(options, etcdv3.WithPrefix())
+		if !e.Flat && key != "" {
+			// the prefix also matches the keys next to the directory, such as "/a/foobar" for "/a/foo"
+			match = inDir(key)
+			key = strings.TrimSuffix(key, "/")
+		}
+	}
+
+	// start from the current revision, so nothing that happens after Watch returns is missed.
+	// The range of the watch is read, as etcd refuses the empty key unless it is a prefix.
+	r, err := e.kapi.Get(ctx, key, append([]etcdv3.OpOption{etcdv3.WithCountOnly()}, options...)...)
+	if err != nil {
+		log.Warn("Could not watch key in etcd.", "key", key, "err", err)
+		return nil, e.clientError(err)
+	}
+	return e.watch(ctx, key, options, match, r.Header.Revision), nil
+}
+
+// watch streams the changes made to key after revision lastRev, leaving out the keys match
+// rejects if it is set
+func (e EtcdV3Wrapper) watch(ctx context.Context, key string, options []etcdv3.OpOption, match func(string) bool, lastRev int64) <-chan *kvwrapper.WatchEvent {
+	events := make(chan *kvwrapper.WatchEvent)
+	go func() {
+		defer close(events)
+
+		for {
+			watchOptions := append(options, etcdv3.WithRev(lastRev+1))
+			wch := e.cli.Watch(ctx, key, watchOptions...)
+			for wr := range wch {
+				if err := wr.Err(); err != nil {
+					if wr.CompactRevision != 0 {
+						log.Warn("Watch on etcd key lost the history it was resuming from.", "key", key, "err", err)
+						return
+					}
+					if e.clientError(err) == kvwrapper.ErrUnauthorized {
+						log.Warn("Watch on etcd key refused.", "key", key, "err", err)
+						return
+					}
+					log.Warn("Watch on etcd key interrupted, resuming.", "key", key, "err", err)
+					continue
+				}
+				for _, wev := range wr.Events {
+					lastRev = wev.Kv.ModRevision
+					if match != nil && !match(string(wev.Kv.Key)) {
+						continue
+					}
+					ev := &kvwrapper.WatchEvent{
+						Type:     kvwrapper.EventPut,
+						Key:      string(wev.Kv.Key),
+						Value:    string(wev.Kv.Value),
+						Revision: wev.Kv.ModRevision,
+					}
+					if wev.Type == etcdv3.EventTypeDelete {
+						ev.Type = kvwrapper.EventDelete
+					}
+
+					select {
+					case events <- ev:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			if ctx.Err() == nil && e.cli.Ctx().Err() != nil {
+				log.Warn("Watch on etcd key stopped, its client is closed.", "key", key)
+				return
+			}
+
+			select {
+			case <-time.After(kvwrapper.WatchRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// Delete removes the single key
+func (e EtcdV3Wrapper) Delete(key string) error {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.DeleteContext(ctx, key)
+}
+
+// DeleteContext is Delete bound to ctx
+func (e EtcdV3Wrapper) DeleteContext(ctx context.Context, key string) error {
 	// by default no sorting nor range expansion is performed
-	r, err := e.kapi.Delete(context.Background(), key)
+	r, err := e.kapi.Delete(ctx, key)
 	if err != nil {
 		if err == rpctypes.ErrKeyNotFound {
 			return kvwrapper.ErrKeyNotFound
 		}
 		log.Warn("Could not delete key from etcd.", "key", key, "err", err)
-		return err
+		return e.clientError(err)
 	} else if r.Deleted == 0 {
 		return kvwrapper.ErrKeyNotFound
 	}
 
+	e.releaseLeases(isKey(key))
 	return nil
 }
 
-// delete all keys beginning with this prefix
-// returns the number of key/value pairs that were deleted
-// is candidate to be added to interface
-func DeleteList(e EtcdV3Wrapper, key string) (int64, error) {
-	options := []etcdv3.OpOption{
-		etcdv3.WithPrefix(),
-	}
-	// by default no sorting nor range expansion is performed
-	r, err := e.kapi.Delete(context.Background(), key, options...)
+// DeleteList removes the directory key and every key below it, or with Flat set all keys
+// beginning with key as prefix. It returns the number of key/value pairs that were deleted.
+func (e EtcdV3Wrapper) DeleteList(key string) (int64, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.DeleteListContext(ctx, key)
+}
+
+// DeleteListContext is DeleteList bound to ctx
+func (e EtcdV3Wrapper) DeleteListContext(ctx context.Context, key string) (int64, error) {
+	deleted, matching, err := e.deleteList(ctx, key)
 	if err != nil {
 		if err == rpctypes.ErrKeyNotFound {
-			return r.Deleted, kvwrapper.ErrKeyNotFound
+			return 0, kvwrapper.ErrKeyNotFound
 		}
 		log.Warn("Could not delete key from etcd.", "key", key, "err", err)
-		return r.Deleted, err
-	} else if r.Deleted == 0 {
-		return r.Deleted, kvwrapper.ErrKeyNotFound
+		return 0, e.clientError(err)
+	} else if deleted == 0 {
+		return 0, kvwrapper.ErrKeyNotFound
+	}
+
+	e.releaseLeases(matching)
+	return deleted, nil
+}
+
+// deleteList removes the keys DeleteList is about, returning how many were deleted and a matcher for them
+func (e EtcdV3Wrapper) deleteList(ctx context.Context, key string) (int64, func(string) bool, error) {
+	if e.Flat {
+		r, err := e.kapi.Delete(ctx, key, etcdv3.WithPrefix())
+		if err != nil {
+			return 0, nil, err
+		}
+		return r.Deleted, hasPrefix(key), nil
 	}
 
-	return r.Deleted, nil
+	// the directory itself may hold a value on v3
+	ops := []etcdv3.Op{etcdv3.OpDelete(dirOf(key), etcdv3.WithPrefix())}
+	if k := strings.TrimSuffix(key, "/"); k != "" {
+		ops = append(ops, etcdv3.OpDelete(k))
+	}
+	r, err := e.kapi.Txn(ctx).Then(ops...).Commit()
+	if err != nil {
+		return 0, nil, err
+	}
+	var deleted int64
+	for _, resp := range r.Responses {
+		deleted += resp.GetResponseDeleteRange().Deleted
+	}
+	return deleted, inDir(key), nil
+}
+
+// Delete removes an individual key
+//
+// Deprecated: use EtcdV3Wrapper.Delete, which is part of the KVWrapper interface
+func Delete(e EtcdV3Wrapper, key string) error {
+	return e.Delete(key)
+}
+
+// DeleteList removes every key beginning with key as prefix, even if e is not Flat
+// returns the number of key/value pairs that were deleted
+//
+// Deprecated: use EtcdV3Wrapper.DeleteList, which is part of the KVWrapper interface. Unless e is
+// Flat, it removes the directory key and the keys below it, but not the keys next to it that
+// share its prefix.
+func DeleteList(e EtcdV3Wrapper, key string) (int64, error) {
+	e.Flat = true
+	return e.DeleteList(key)
 }
@@ -2,19 +2,37 @@ package kvwrapper_etcd_v3
 
 // package kvwrapper_etcd_v3
 import (
+	"context"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/behance/go-common/internal/etcdtest"
 	"github.com/behance/go-common/kvwrapper"
+	"github.com/behance/go-common/kvwrapper/kvwrappertest"
+	"github.com/behance/go-common/kvwrapper_cache"
 	"github.com/behance/go-common/log"
 )
 
-func TestGetSingle(t *testing.T) {
-	if os.Getenv("KV_ETCD_LOCALHOST") == "" {
-		t.Skip("skipping test; $KV_ETCD_LOCALHOST not set")
+// server is the etcd the tests run against
+var server *etcdtest.Server
+
+func TestMain(m *testing.M) {
+	var err error
+	server, err = etcdtest.Start()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not start etcd:", err)
+		os.Exit(1)
 	}
-	hosts := []string{"http://localhost:2379"}
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
+func TestGetSingle(t *testing.T) {
+	hosts := server.Servers()
 	kvw := kvwrapper.NewKVWrapperWithAuth(
 		hosts,
 		EtcdV3Wrapper{},
@@ -63,10 +81,7 @@ func TestGetSingle(t *testing.T) {
 }
 
 func TestGetMultiple(t *testing.T) {
-	if os.Getenv("KV_ETCD_LOCALHOST") == "" {
-		t.Skip("skipping test; $KV_ETCD_LOCALHOST not set")
-	}
-	hosts := []string{"http://localhost:2379"}
+	hosts := server.Servers()
 	kvw := EtcdV3Wrapper.NewKVWrapper(EtcdV3Wrapper{}, hosts, "", "")
 
 	set_err := kvw.Set("Foo/1", "Bar/1", 30)
@@ -102,11 +117,8 @@ func TestGetMultiple(t *testing.T) {
 }
 
 func TestDelSingle(t *testing.T) {
-	if os.Getenv("KV_ETCD_LOCALHOST") == "" {
-		t.Skip("skipping test; $KV_ETCD_LOCALHOST not set")
-	}
-	hosts := []string{"http://localhost:2379"}
-	kvw := EtcdV3Wrapper.NewKVWrapper(EtcdV3Wrapper{}, hosts, "", "")
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper.NewKVWrapper(EtcdV3Wrapper{Flat: true}, hosts, "", "")
 
 	kv_pairs, get_err := kvw.GetList("", false)
 	num_entries := 0
@@ -142,11 +154,8 @@ func TestDelSingle(t *testing.T) {
 }
 
 func TestDelMultiple(t *testing.T) {
-	if os.Getenv("KV_ETCD_LOCALHOST") == "" {
-		t.Skip("skipping test; $KV_ETCD_LOCALHOST not set")
-	}
-	hosts := []string{"http://localhost:2379"}
-	kvw := EtcdV3Wrapper.NewKVWrapper(EtcdV3Wrapper{}, hosts, "", "")
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper.NewKVWrapper(EtcdV3Wrapper{Flat: true}, hosts, "", "")
 
 	kv_pairs, get_err := kvw.GetList("", false)
 	var num_entries int64
@@ -198,3 +207,673 @@ func TestDelMultiple(t *testing.T) {
 	}
 
 }
+
+func TestCompareAndSwap(t *testing.T) {
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper.NewKVWrapper(EtcdV3Wrapper{}, hosts, "", "")
+	kvw.Delete("CAS")
+
+	rev, create_err := kvw.Create("CAS", "Bar", 30)
+	if create_err != nil {
+		t.Error("Failed to create CAS:Bar as Key:Value pair, got ", create_err)
+		return
+	}
+	_, create_err = kvw.Create("CAS", "Bar", 30)
+	if create_err != kvwrapper.ErrConflict {
+		t.Error("Expected creating CAS twice to conflict, got ", create_err)
+		return
+	}
+
+	_, cas_err := kvw.CompareAndSwap("CAS", "Baz", "Foo", 0)
+	if cas_err != kvwrapper.ErrConflict {
+		t.Error("Expected swapping a mismatched value to conflict, got ", cas_err)
+		return
+	}
+	_, cas_err = kvw.CompareAndSwapRevision("CAS", "Baz", rev, 0)
+	if cas_err != nil {
+		t.Error("Expected swapping a matching revision to succeed, got ", cas_err)
+		return
+	}
+	_, cas_err = kvw.CompareAndSwap("CASFoo", "Baz", "Bar", 0)
+	if cas_err != kvwrapper.ErrKeyNotFound {
+		t.Error("Expected swapping a missing key to fail with ErrKeyNotFound, got ", cas_err)
+		return
+	}
+
+	del_err := kvw.CompareAndDelete("CAS", "Baz")
+	if del_err != nil {
+		t.Error("Expected deleting a matching value to succeed, got ", del_err)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper.NewKVWrapper(EtcdV3Wrapper{}, hosts, "", "")
+	kvw.DeleteList("/Txn/")
+
+	r, txn_err := kvw.Txn().
+		If(kvwrapper.KeyMissing("/Txn/Record")).
+		Then(kvwrapper.SetOp("/Txn/Record", "Bar", 30), kvwrapper.SetOp("/Txn/Index/Bar", "/Txn/Record", 30)).
+		Commit()
+	if txn_err != nil || !r.Succeeded {
+		t.Error("Expected transaction to succeed, got ", txn_err)
+		return
+	}
+	kv_pairs, get_err := kvw.GetList("/Txn/", false)
+	if get_err != nil || len(kv_pairs) != 2 {
+		t.Error("Expected 2 entries, got ", len(kv_pairs), " error: ", get_err)
+		return
+	}
+
+	r, txn_err = kvw.Txn().
+		If(kvwrapper.KeyMissing("/Txn/Record")).
+		Then(kvwrapper.SetOp("/Txn/Record", "Baz", 30)).
+		Else(kvwrapper.GetOp("/Txn/Record")).
+		Commit()
+	if txn_err != nil || r.Succeeded {
+		t.Error("Expected transaction to fail its compares, got ", txn_err)
+		return
+	}
+	if r.Results[0].KeyValue == nil || r.Results[0].KeyValue.Value != "Bar" {
+		t.Error("Expected Else branch to read Bar, got ", r.Results[0].KeyValue)
+	}
+}
+
+func TestContext(t *testing.T) {
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper{Timeout: time.Second}.NewKVWrapper(hosts, "", "").(EtcdV3Wrapper)
+
+	set_err := kvw.Set("Foo", "Bar", 0)
+	if set_err != nil {
+		t.Error("Failed to create Foo:Bar as Key:Value pair, got ", set_err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, get_err := kvw.GetValContext(ctx, "Foo")
+	if get_err != context.Canceled {
+		t.Error("Expected cancelled context to fail GetValContext, got ", get_err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	set_err = kvw.SetContext(ctx, "Foo", "Baz", 30)
+	if set_err != kvwrapper.ErrTimeout {
+		t.Error("Expected expired context to fail SetContext with ErrTimeout, got ", set_err)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	hosts := server.Servers()
+	kvw, connect_err := EtcdV3Wrapper{CheckConnection: true}.Connect(hosts, "", "")
+	if connect_err != nil {
+		t.Fatal("Expected Connect to reach etcd, got ", connect_err)
+	}
+	set_err := kvw.Set("Connect", "Bar", 0)
+	if set_err != nil {
+		t.Error("Failed to create Connect:Bar as Key:Value pair, got ", set_err)
+	}
+	kvw.Delete("Connect")
+
+	kvw.(EtcdV3Wrapper).Close()
+	_, get_err := kvw.GetVal("Connect")
+	if get_err != kvwrapper.ErrCouldNotConnect {
+		t.Error("Expected GetVal on a closed client to fail with ErrCouldNotConnect, got ", get_err)
+	}
+
+	_, connect_err = EtcdV3Wrapper{}.Connect([]string{"http://127.0.0.1:1"}, "", "")
+	if connect_err != kvwrapper.ErrCouldNotConnect {
+		t.Error("Expected Connect to a down server to fail with ErrCouldNotConnect, got ", connect_err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper.NewKVWrapper(EtcdV3Wrapper{}, hosts, "", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, watch_err := kvw.Watch(ctx, "/Watch/", true)
+	if watch_err != nil {
+		t.Error("Watch failed with error ", watch_err)
+		return
+	}
+
+	set_err := kvw.Set("/Watch/Foo", "Bar", 0)
+	if set_err != nil {
+		t.Error("Failed to create /Watch/Foo:Bar as Key:Value pair")
+		return
+	}
+	kvw.Delete("/Watch/Foo")
+
+	expected := []kvwrapper.EventType{kvwrapper.EventPut, kvwrapper.EventDelete}
+	for _, typ := range expected {
+		select {
+		case ev := <-events:
+			if ev.Type != typ || ev.Key != "/Watch/Foo" {
+				t.Error("Expected ", typ, " event for /Watch/Foo, got ", ev)
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("Timed out waiting for ", typ, " event")
+			return
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatchDirectory(t *testing.T) {
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper.NewKVWrapper(EtcdV3Wrapper{}, hosts, "", "")
+	defer kvw.DeleteList("/WatchDir")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, watch_err := kvw.Watch(ctx, "/WatchDir/Foo", true)
+	if watch_err != nil {
+		t.Fatal("Watch failed with error ", watch_err)
+	}
+
+	// /WatchDir/Foobar shares the prefix of the directory, but is not below it
+	kvw.Set("/WatchDir/Foobar", "Ignored", 0)
+	kvw.Set("/WatchDir/Foo/1", "Bar", 0)
+	kvw.Set("/WatchDir/Foo", "Baz", 0)
+
+	for _, key := range []string{"/WatchDir/Foo/1", "/WatchDir/Foo"} {
+		select {
+		case ev := <-events:
+			if ev.Key != key {
+				t.Fatal("Expected an event for ", key, ", got ", ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for an event for ", key)
+		}
+	}
+}
+
+func TestWatchEverything(t *testing.T) {
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper.NewKVWrapper(EtcdV3Wrapper{}, hosts, "", "")
+	defer kvw.Delete("WatchEverything")
+	defer kvw.DeleteList("/WatchEverything")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, watch_err := kvw.Watch(ctx, "", true)
+	if watch_err != nil {
+		t.Fatal("Watch failed with error ", watch_err)
+	}
+
+	kvw.Set("WatchEverything", "Bar", 0)
+	kvw.Set("/WatchEverything/Foo", "Baz", 0)
+
+	for _, key := range []string{"WatchEverything", "/WatchEverything/Foo"} {
+		select {
+		case ev := <-events:
+			if ev.Key != key {
+				t.Fatal("Expected an event for ", key, ", got ", ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for an event for ", key)
+		}
+	}
+}
+
+func TestCacheUnrootedKey(t *testing.T) {
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper.NewKVWrapper(EtcdV3Wrapper{}, hosts, "", "")
+	defer kvw.Delete("CacheFoo")
+	kvw.Set("CacheFoo", "Bar", 0)
+
+	cached := kvwrapper_cache.CacheWrapper{TTL: time.Hour}.Wrap(kvw)
+	defer cached.Close()
+	if s, err := cached.GetVal("CacheFoo"); err != nil || s.Value != "Bar" {
+		t.Fatal("Expected CacheFoo to be Bar, got ", s, err)
+	}
+
+	kvw.Set("CacheFoo", "Baz", 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s, err := cached.GetVal("CacheFoo")
+		if err == nil && s.Value == "Baz" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the change to CacheFoo to invalidate the cache, got ", s, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeprecatedDeleteList(t *testing.T) {
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper.NewKVWrapper(EtcdV3Wrapper{}, hosts, "", "").(EtcdV3Wrapper)
+	kvw.Set("/DepDel/1", "Foo", 0)
+	kvw.Set("/DepDelOther", "Bar", 0)
+
+	// the free function deletes by prefix, as it always did
+	num_dels, del_err := DeleteList(kvw, "/DepDel")
+	if del_err != nil || num_dels != 2 {
+		t.Error("Expected DeleteList to delete the 2 keys beginning with /DepDel, got ", num_dels, del_err)
+	}
+}
+
+func TestWatchCompacted(t *testing.T) {
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper{}.NewKVWrapper(hosts, "", "").(EtcdV3Wrapper)
+	defer kvw.Close()
+
+	set_err := kvw.Set("/Compacted/Foo", "Bar", 0)
+	if set_err != nil {
+		t.Fatal("Failed to create /Compacted/Foo:Bar as Key:Value pair, got ", set_err)
+	}
+	kv_pair, get_err := kvw.GetVal("/Compacted/Foo")
+	if get_err != nil {
+		t.Fatal("Failed to get /Compacted/Foo, got ", get_err)
+	}
+	kvw.Set("/Compacted/Foo", "Baz", 0)
+	kvw.Set("/Compacted/Foo", "Qux", 0)
+	r, compact_err := kvw.Client().Get(context.Background(), "/Compacted/Foo")
+	if compact_err == nil {
+		_, compact_err = kvw.Client().Compact(context.Background(), r.Header.Revision)
+	}
+	if compact_err != nil {
+		t.Fatal("Failed to compact etcd, got ", compact_err)
+	}
+	defer kvw.Delete("/Compacted/Foo")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := kvw.watch(ctx, "/Compacted/Foo", nil, nil, kv_pair.ModRevision)
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			t.Fatal("Expected the watch to close once its history is compacted, got ", ev)
+		case <-timeout:
+			t.Fatal("Timed out waiting for the watch to close")
+		}
+	}
+}
+
+func TestWatchClosedClient(t *testing.T) {
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper{}.NewKVWrapper(hosts, "", "").(EtcdV3Wrapper)
+
+	events, watch_err := kvw.Watch(context.Background(), "/Closed/Foo", false)
+	if watch_err != nil {
+		t.Fatal("Watch failed with error ", watch_err)
+	}
+	kvw.Close()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			t.Fatal("Expected the watch to close along with its client, got ", ev)
+		case <-timeout:
+			t.Fatal("Timed out waiting for the watch to close")
+		}
+	}
+}
+
+func TestLeases(t *testing.T) {
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper{}.NewKVWrapper(hosts, "", "").(EtcdV3Wrapper)
+
+	lease, grant_err := kvw.Grant(30)
+	if grant_err != nil {
+		t.Error("Grant failed with error ", grant_err)
+		return
+	}
+	for _, key := range []string{"/Lease/Foo", "/Lease/Bar"} {
+		set_err := kvw.SetWithLease(key, "Baz", lease)
+		if set_err != nil {
+			t.Error("Failed to set ", key, " with lease, got ", set_err)
+			return
+		}
+		key_lease, lease_err := kvw.Lease(key)
+		if lease_err != nil || key_lease != lease {
+			t.Error("Expected ", key, " to be attached to lease ", lease, ", got ", key_lease, lease_err)
+		}
+	}
+
+	refresh_err := kvw.RefreshTTL("/Lease/Foo")
+	if refresh_err != nil {
+		t.Error("RefreshTTL failed with error ", refresh_err)
+	}
+
+	ttl_err := kvw.SetTTL("/Lease/Foo", 0)
+	if ttl_err != nil {
+		t.Error("SetTTL failed with error ", ttl_err)
+	}
+	key_lease, _ := kvw.Lease("/Lease/Foo")
+	if key_lease != 0 {
+		t.Error("Expected SetTTL of 0 to remove the lease of /Lease/Foo, got ", key_lease)
+	}
+	kv_pair, get_err := kvw.GetVal("/Lease/Foo")
+	if get_err != nil || kv_pair.Value != "Baz" {
+		t.Error("Expected SetTTL to keep the value of /Lease/Foo, got ", kv_pair, get_err)
+	}
+
+	ttl_err = kvw.SetTTL("/Lease/Missing", 30)
+	if ttl_err != kvwrapper.ErrKeyNotFound {
+		t.Error("Expected SetTTL on a missing key to fail with ErrKeyNotFound, got ", ttl_err)
+	}
+
+	kvw.Set("/Lease/Short", "Baz", 1)
+	first, _ := kvw.Lease("/Lease/Short")
+	kvw.Set("/Lease/Short", "Qux", 1)
+	second, _ := kvw.Lease("/Lease/Short")
+	if first == 0 || first != second {
+		t.Error("Expected setting /Lease/Short again with the same ttl to reuse lease ", first, ", got ", second)
+	}
+
+	alive_err := kvw.SetKeepAlive("/Lease/Alive", "Baz", 1)
+	if alive_err != nil {
+		t.Error("SetKeepAlive failed with error ", alive_err)
+		return
+	}
+	time.Sleep(3 * time.Second)
+	_, get_err = kvw.GetVal("/Lease/Alive")
+	if get_err != nil {
+		t.Error("Expected /Lease/Alive to be kept alive, got ", get_err)
+	}
+	_, get_err = kvw.GetVal("/Lease/Short")
+	if get_err != kvwrapper.ErrKeyNotFound {
+		t.Error("Expected /Lease/Short to expire, got ", get_err)
+	}
+
+	kvw.DeleteList("/Lease/")
+	kvw.Close()
+}
+
+func TestMetadata(t *testing.T) {
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper{}.NewKVWrapper(hosts, "", "").(EtcdV3Wrapper)
+
+	kvw.Set("/Metadata/Foo", "Bar", 30)
+	kvw.Set("/Metadata/Foo", "Baz", 30)
+	lease, _ := kvw.Lease("/Metadata/Foo")
+	kv_pair, get_err := kvw.GetVal("/Metadata/Foo")
+	if get_err != nil {
+		t.Fatal("GetVal failed with error ", get_err)
+	}
+	if kv_pair.Version != 2 {
+		t.Error("Expected /Metadata/Foo to be at version 2, got ", kv_pair.Version)
+	}
+	if lease == 0 || kv_pair.LeaseID != int64(lease) {
+		t.Error("Expected /Metadata/Foo to report lease ", lease, ", got ", kv_pair.LeaseID)
+	}
+	if kv_pair.TTL <= 0 || kv_pair.TTL > 30 {
+		t.Error("Expected /Metadata/Foo to report a ttl up to 30s, got ", kv_pair.TTL)
+	}
+
+	kv_list, list_err := kvw.GetList("/Metadata/", true)
+	if list_err != nil || len(kv_list) != 1 || kv_list[0].LeaseID != int64(lease) || kv_list[0].TTL <= 0 {
+		t.Error("Expected GetList to report the lease and ttl of /Metadata/Foo, got ", kv_list, list_err)
+	}
+
+	other := EtcdV3Wrapper{}.NewKVWrapper(hosts, "", "").(EtcdV3Wrapper)
+	kv_pair, get_err = other.GetVal("/Metadata/Foo")
+	if get_err != nil || kv_pair.LeaseID != int64(lease) || kv_pair.TTL != 0 {
+		t.Error("Expected a lease granted elsewhere to report no ttl, got ", kv_pair, get_err)
+	}
+	other.Close()
+	lookup := EtcdV3Wrapper{LookupTTLs: true}.NewKVWrapper(hosts, "", "").(EtcdV3Wrapper)
+	kv_pair, get_err = lookup.GetVal("/Metadata/Foo")
+	if get_err != nil || kv_pair.TTL <= 0 || kv_pair.TTL > 30 {
+		t.Error("Expected LookupTTLs to report a ttl up to 30s, got ", kv_pair, get_err)
+	}
+	lookup.Close()
+
+	kvw.DeleteList("/Metadata/")
+	kvw.Close()
+}
+
+func TestPages(t *testing.T) {
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper{}.NewKVWrapper(hosts, "", "").(EtcdV3Wrapper)
+	for _, key := range []string{"/Pages/C", "/Pages/A", "/Pages/B", "/PagesOther"} {
+		kvw.Set(key, "Baz", 0)
+	}
+
+	page, page_err := kvw.GetPage(context.Background(), "/Pages/", 2, "")
+	if page_err != nil || len(page.KeyValues) != 2 || page.KeyValues[1].Key != "/Pages/B" || page.Next != "/Pages/B" {
+		t.Error("Expected a first page of /Pages/A and /Pages/B, got ", page, page_err)
+	}
+	page, page_err = kvw.GetPage(context.Background(), "/Pages/", 2, "/Pages/B")
+	if page_err != nil || len(page.KeyValues) != 1 || page.KeyValues[0].Key != "/Pages/C" || page.Next != "" {
+		t.Error("Expected a last page of /Pages/C, got ", page, page_err)
+	}
+
+	// GetList goes through as many pages as it takes
+	page_size := kvwrapper.DefaultPageSize
+	kvwrapper.DefaultPageSize = 2
+	defer func() { kvwrapper.DefaultPageSize = page_size }()
+	kv_list, list_err := kvw.GetList("/Pages/", true)
+	if list_err != nil || len(kv_list) != 3 || kv_list[2].Key != "/Pages/C" {
+		t.Error("Expected GetList to return the 3 keys of /Pages/, got ", kv_list, list_err)
+	}
+
+	kvw.DeleteList("/Pages")
+	kvw.Close()
+}
+
+func TestDirectories(t *testing.T) {
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper{}.NewKVWrapper(hosts, "", "").(EtcdV3Wrapper)
+	for _, key := range []string{"/Dirs/A", "/Dirs/B/1", "/Dirs/B/2", "/Dirs/C", "/DirsOther"} {
+		kvw.Set(key, "Baz", 0)
+	}
+
+	// the keys right below /Dirs, with /Dirs/B as a directory
+	kv_list, list_err := kvw.GetList("/Dirs", true)
+	if list_err != nil || len(kv_list) != 3 {
+		t.Fatal("Expected GetList to return 3 entries below /Dirs, got ", kv_list, list_err)
+	}
+	if kv_list[1].Key != "/Dirs/B" || !kv_list[1].HasChildren || kv_list[2].Key != "/Dirs/C" {
+		t.Error("Expected /Dirs/B to be listed as a directory, got ", kv_list[1], kv_list[2])
+	}
+
+	kv_pair, get_err := kvw.GetVal("/Dirs/B")
+	if get_err != nil || !kv_pair.HasChildren {
+		t.Error("Expected /Dirs/B to be a directory, got ", kv_pair, get_err)
+	}
+	_, get_err = kvw.GetVal("/Dirs/D")
+	if get_err != kvwrapper.ErrKeyNotFound {
+		t.Error("Expected /Dirs/D not to exist, got ", get_err)
+	}
+
+	// the directory is walked past as a single entry across pages
+	page, page_err := kvw.GetPage(context.Background(), "/Dirs", 2, "")
+	if page_err != nil || len(page.KeyValues) != 2 || page.Next != "/Dirs/B/" {
+		t.Fatal("Expected a first page of /Dirs/A and /Dirs/B, got ", page, page_err)
+	}
+	page, page_err = kvw.GetPage(context.Background(), "/Dirs", 2, page.Next)
+	if page_err != nil || len(page.KeyValues) != 1 || page.KeyValues[0].Key != "/Dirs/C" {
+		t.Error("Expected a last page of /Dirs/C, got ", page, page_err)
+	}
+
+	// a key holding a value with keys below it is listed once, across pages as well
+	kvw.Set("/Dirs/C/1", "Baz", 0)
+	kvw.Set("/Dirs/C-2", "Baz", 0)
+	kv_list, list_err = kvw.GetList("/Dirs", true)
+	if list_err != nil || len(kv_list) != 4 || kv_list[2].Key != "/Dirs/C" || kv_list[2].Value != "Baz" ||
+		!kv_list[2].HasChildren || kv_list[3].Key != "/Dirs/C-2" || kv_list[3].HasChildren {
+		t.Error("Expected /Dirs/C to be listed once with its value and HasChildren, got ", kv_list, list_err)
+	}
+	page, page_err = kvw.GetPage(context.Background(), "/Dirs", 3, "")
+	if page_err == nil && page.Next != "" {
+		page, page_err = kvw.GetPage(context.Background(), "/Dirs", 3, page.Next)
+	}
+	if page_err != nil || len(page.KeyValues) != 1 || page.KeyValues[0].Key != "/Dirs/C-2" || page.Next != "" {
+		t.Error("Expected a last page of /Dirs/C-2, got ", page, page_err)
+	}
+
+	// deleting /Dirs leaves /DirsOther alone
+	num_dels, del_err := kvw.DeleteList("/Dirs")
+	if del_err != nil || num_dels != 6 {
+		t.Error("Expected to delete the 6 keys below /Dirs, got ", num_dels, del_err)
+	}
+	_, get_err = kvw.GetVal("/DirsOther")
+	if get_err != nil {
+		t.Error("Expected /DirsOther to be kept, got ", get_err)
+	}
+
+	// a flat wrapper lists and deletes by prefix
+	flat := EtcdV3Wrapper{Flat: true}.NewKVWrapper(hosts, "", "").(EtcdV3Wrapper)
+	kvw.Set("/Dirs/B/1", "Baz", 0)
+	kv_list, list_err = flat.GetList("/Dirs", true)
+	if list_err != nil || len(kv_list) != 2 || kv_list[0].Key != "/Dirs/B/1" || kv_list[1].Key != "/DirsOther" {
+		t.Error("Expected a flat GetList to return /Dirs/B/1 and /DirsOther, got ", kv_list, list_err)
+	}
+	num_dels, del_err = flat.DeleteList("/Dirs")
+	if del_err != nil || num_dels != 2 {
+		t.Error("Expected a flat DeleteList to delete 2 keys, got ", num_dels, del_err)
+	}
+
+	flat.Close()
+	kvw.Close()
+}
+
+func TestListOptions(t *testing.T) {
+	hosts := server.Servers()
+	kvw := EtcdV3Wrapper{Flat: true}.NewKVWrapper(hosts, "", "").(EtcdV3Wrapper)
+	for _, key := range []string{"/ListOpts/B", "/ListOpts/C", "/ListOpts/A"} {
+		kvw.Set(key, "Baz", 0)
+	}
+	kvw.Set("/ListOpts/C", "Qux", 0)
+
+	result, list_err := kvw.List(context.Background(), "/ListOpts", kvwrapper.ListOptions{SortBy: kvwrapper.SortByCreateRevision, Order: kvwrapper.SortAscend})
+	if list_err != nil || len(result.KeyValues) != 3 || result.KeyValues[0].Key != "/ListOpts/B" || result.KeyValues[2].Key != "/ListOpts/A" {
+		t.Error("Expected the keys in the order they were created, got ", result, list_err)
+	}
+	result, list_err = kvw.List(context.Background(), "/ListOpts", kvwrapper.ListOptions{SortBy: kvwrapper.SortByModRevision, Order: kvwrapper.SortDescend, KeysOnly: true})
+	if list_err != nil || len(result.KeyValues) != 3 || result.KeyValues[0].Key != "/ListOpts/C" || result.KeyValues[0].Value != "" {
+		t.Error("Expected /ListOpts/C, without its value, to be the last key modified, got ", result, list_err)
+	}
+	result, list_err = kvw.List(context.Background(), "/ListOpts", kvwrapper.ListOptions{CountOnly: true})
+	if list_err != nil || result.Count != 3 || len(result.KeyValues) != 0 {
+		t.Error("Expected a count of 3 keys, got ", result, list_err)
+	}
+
+	// directories are derived before sorting
+	dirs := EtcdV3Wrapper{}.NewKVWrapper(hosts, "", "").(EtcdV3Wrapper)
+	kvw.Set("/ListOpts/D/1", "Baz", 0)
+	result, list_err = dirs.List(context.Background(), "/ListOpts", kvwrapper.ListOptions{Order: kvwrapper.SortDescend})
+	if list_err != nil || len(result.KeyValues) != 4 || result.KeyValues[0].Key != "/ListOpts/D" || !result.KeyValues[0].HasChildren {
+		t.Error("Expected /ListOpts/D to be listed first as a directory, got ", result, list_err)
+	}
+
+	kvw.DeleteList("/ListOpts")
+	dirs.Close()
+	kvw.Close()
+}
+
+func TestConformance(t *testing.T) {
+	hosts := server.Servers()
+	kvwrappertest.Suite{
+		New: func(t *testing.T) kvwrapper.KVWrapper {
+			return kvwrapper.NewKVWrapper(hosts, EtcdV3Wrapper{})
+		},
+	}.Run(t)
+}
+
+func TestConformanceFlat(t *testing.T) {
+	hosts := server.Servers()
+	kvwrappertest.Suite{
+		New: func(t *testing.T) kvwrapper.KVWrapper {
+			return kvwrapper.NewKVWrapper(hosts, EtcdV3Wrapper{Flat: true})
+		},
+		Flat: true,
+	}.Run(t)
+}
+
+func TestOpen(t *testing.T) {
+	hosts := []string{}
+	for _, s := range server.Servers() {
+		hosts = append(hosts, strings.TrimPrefix(s, "http://"))
+	}
+	kvw, open_err := kvwrapper.Open("etcd3://" + strings.Join(hosts, ",") + "/Open?timeout=5s&flat=true")
+	if open_err != nil {
+		t.Fatal("Could not open the wrapper of the DSN: ", open_err)
+	}
+	backend, ok := kvw.(kvwrapper.NamespacedWrapper).Backend.(EtcdV3Wrapper)
+	if !ok || backend.Timeout != 5*time.Second {
+		t.Error("Expected an EtcdV3Wrapper with a timeout of 5s, got ", kvw)
+	}
+	if !backend.Flat {
+		t.Error("Expected flat=true to set Flat")
+	}
+
+	set_err := kvw.Set("Foo", "Bar", 0)
+	if set_err != nil {
+		t.Fatal("Failed to set Foo through the wrapper of the DSN: ", set_err)
+	}
+	kv_pair, get_err := backend.GetVal("/Open/Foo")
+	if get_err != nil || kv_pair.Value != "Bar" {
+		t.Error("Expected Foo to be set below /Open, got ", kv_pair, get_err)
+	}
+
+	_, open_err = kvwrapper.Open("etcd3://" + hosts[0] + "?retries=3")
+	if open_err == nil {
+		t.Error("Expected an unknown option to fail")
+	}
+	backend.DeleteList("/Open")
+	backend.Close()
+}
+
+func TestAuth(t *testing.T) {
+	auth_server, start_err := etcdtest.Start()
+	if start_err != nil {
+		t.Fatal("Could not start etcd: ", start_err)
+	}
+	defer auth_server.Close()
+	auth_err := auth_server.EnableAuth("secret")
+	if auth_err != nil {
+		t.Fatal("Could not enable auth: ", auth_err)
+	}
+	hosts := auth_server.Servers()
+
+	kvw := kvwrapper.NewKVWrapperWithAuth(hosts, EtcdV3Wrapper{}, "root", "secret")
+	if kvw == nil {
+		t.Fatal("Could not connect with valid credentials")
+	}
+	set_err := kvw.Set("/Auth/Foo", "Bar", 0)
+	if set_err != nil {
+		t.Error("Expected Set with valid credentials to succeed, got ", set_err)
+	}
+	kv_pair, get_err := kvw.GetVal("/Auth/Foo")
+	if get_err != nil || kv_pair.Value != "Bar" {
+		t.Error("Expected to get Bar with valid credentials, got ", kv_pair, get_err)
+	}
+
+	anonymous := kvwrapper.NewKVWrapper(hosts, EtcdV3Wrapper{})
+	if anonymous != nil {
+		_, get_err = anonymous.GetVal("/Auth/Foo")
+		if get_err != kvwrapper.ErrUnauthorized {
+			t.Error("Expected GetVal without credentials to fail with ErrUnauthorized, got ", get_err)
+		}
+	}
+
+	wrong := kvwrapper.NewKVWrapperWithAuth(hosts, EtcdV3Wrapper{}, "root", "wrong")
+	if wrong != nil {
+		t.Error("Expected NewKVWrapper with a wrong password to return nil, got ", wrong)
+	}
+	_, connect_err := kvwrapper.Connect(hosts, EtcdV3Wrapper{}, "root", "wrong")
+	if connect_err != kvwrapper.ErrUnauthorized {
+		t.Error("Expected Connect with a wrong password to fail with ErrUnauthorized, got ", connect_err)
+	}
+}
@@ -0,0 +1,352 @@
+package kvwrapper_etcd_v3
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	log "github.com/behance/go-logging/log"
+	etcdv3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+// leaseTracker keeps track of the leases a wrapper granted, so that setting a key again reuses
+// or releases its previous lease instead of leaving it behind, so that the leases kept alive in
+// the background can be stopped, and so that the ttl left on them is known without asking etcd.
+type leaseTracker struct {
+	mutex sync.Mutex
+	// owned holds the leases granted by Set for a single key
+	owned map[string]ownedLease
+	// keepAlives holds the functions stopping the background KeepAlive of a key
+	keepAlives map[string]context.CancelFunc
+	// expirations holds when the leases granted or renewed through the wrapper expire
+	expirations map[etcdv3.LeaseID]time.Time
+}
+
+type ownedLease struct {
+	id  etcdv3.LeaseID
+	ttl uint64
+}
+
+func newLeaseTracker() *leaseTracker {
+	return &leaseTracker{
+		owned:       make(map[string]ownedLease),
+		keepAlives:  make(map[string]context.CancelFunc),
+		expirations: make(map[etcdv3.LeaseID]time.Time),
+	}
+}
+
+// renewed records that id has ttl seconds left, forgetting the leases that expired since
+func (t *leaseTracker) renewed(id etcdv3.LeaseID, ttl int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	for lease, expiration := range t.expirations {
+		if !now.Before(expiration) {
+			delete(t.expirations, lease)
+		}
+	}
+	if ttl > 0 {
+		t.expirations[id] = now.Add(time.Duration(ttl) * time.Second)
+	}
+}
+
+// revoked forgets id
+func (t *leaseTracker) revoked(id etcdv3.LeaseID) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.expirations, id)
+}
+
+// ttl returns the number of seconds left before id expires, if it was granted or renewed through
+// the wrapper and has not expired yet
+func (t *leaseTracker) ttl(id etcdv3.LeaseID) (int64, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	expiration, ok := t.expirations[id]
+	if !ok {
+		return 0, false
+	}
+	left := time.Until(expiration)
+	if left <= 0 {
+		return 0, false
+	}
+	return int64((left + time.Second - 1) / time.Second), true
+}
+
+// lookup returns the lease key owns, if it has the given ttl
+func (t *leaseTracker) lookup(key string, ttl uint64) (etcdv3.LeaseID, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	lease, ok := t.owned[key]
+	if !ok || lease.ttl != ttl {
+		return etcdv3.NoLease, false
+	}
+	return lease.id, true
+}
+
+// own records that key is now attached to id, returning the lease it previously owned
+// (NoLease if none, or if it is id itself)
+func (t *leaseTracker) own(key string, id etcdv3.LeaseID, ttl uint64) etcdv3.LeaseID {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	prev := t.owned[key].id
+	if id == etcdv3.NoLease {
+		delete(t.owned, key)
+	} else {
+		t.owned[key] = ownedLease{id: id, ttl: ttl}
+	}
+	if prev == id {
+		return etcdv3.NoLease
+	}
+	return prev
+}
+
+// release forgets the leases owned by the keys matching, stopping their KeepAlive, and returns them
+func (t *leaseTracker) release(matching func(key string) bool) []etcdv3.LeaseID {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for key, cancel := range t.keepAlives {
+		if matching(key) {
+			cancel()
+			delete(t.keepAlives, key)
+		}
+	}
+	released := []etcdv3.LeaseID{}
+	for key, lease := range t.owned {
+		if matching(key) {
+			released = append(released, lease.id)
+			delete(t.owned, key)
+		}
+	}
+	return released
+}
+
+// stopKeepAlive stops the background KeepAlive of key, if any
+func (t *leaseTracker) stopKeepAlive(key string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	cancel, ok := t.keepAlives[key]
+	if ok {
+		cancel()
+		delete(t.keepAlives, key)
+	}
+	return ok
+}
+
+// attachLease returns the lease the key about to be set with ttl should be attached to.
+// The lease key already owns is reused when its ttl matches, after being renewed so that
+// it starts counting down again; otherwise a new lease is granted.
+func (e EtcdV3Wrapper) attachLease(ctx context.Context, key string, ttl uint64) (etcdv3.LeaseID, error) {
+	if ttl == 0 {
+		return etcdv3.NoLease, nil
+	}
+	if leaseID, ok := e.leases.lookup(key, ttl); ok {
+		r, err := e.cli.KeepAliveOnce(ctx, leaseID)
+		if err == nil {
+			e.leases.renewed(leaseID, r.TTL)
+			return leaseID, nil
+		}
+		log.Debug("go-common: could not renew lease ", leaseID, " for key ", key, ", granting a new one: ", err)
+	}
+	return e.grantLease(ctx, ttl)
+}
+
+// discardLease revokes a lease attachLease returned for key, unless key still owns it
+func (e EtcdV3Wrapper) discardLease(key string, leaseID etcdv3.LeaseID) {
+	e.leases.mutex.Lock()
+	owned := e.leases.owned[key].id == leaseID
+	e.leases.mutex.Unlock()
+
+	if !owned {
+		e.revokeLease(leaseID)
+	}
+}
+
+// ownLease records that key is now attached to leaseID, revoking the lease it owned before
+func (e EtcdV3Wrapper) ownLease(key string, leaseID etcdv3.LeaseID, ttl uint64) {
+	if prev := e.leases.own(key, leaseID, ttl); prev != etcdv3.NoLease {
+		e.leases.stopKeepAlive(key)
+		e.revokeLease(prev)
+	}
+}
+
+// releaseLeases revokes the leases owned by the keys that were deleted
+func (e EtcdV3Wrapper) releaseLeases(matching func(key string) bool) {
+	for _, leaseID := range e.leases.release(matching) {
+		e.revokeLease(leaseID)
+	}
+}
+
+// Grant acquires a lease of ttl seconds that keys can be attached to with SetWithLease.
+// All the keys attached to a lease expire together, when it does.
+func (e EtcdV3Wrapper) Grant(ttl uint64) (etcdv3.LeaseID, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+	return e.grantLease(ctx, ttl)
+}
+
+// SetWithLease sets the key = val, attached to a lease obtained from Grant
+func (e EtcdV3Wrapper) SetWithLease(key string, val string, leaseID etcdv3.LeaseID) error {
+	ctx, cancel := e.context()
+	defer cancel()
+
+	_, err := e.kapi.Put(ctx, key, val, etcdv3.WithLease(leaseID))
+	if err != nil {
+		log.Warn("Could not set key in etcd.", "key", key, "err", err)
+		return e.clientError(err)
+	}
+	e.ownLease(key, etcdv3.NoLease, 0)
+	return nil
+}
+
+// Lease returns the lease key is attached to, NoLease if it does not expire
+func (e EtcdV3Wrapper) Lease(key string) (etcdv3.LeaseID, error) {
+	ctx, cancel := e.context()
+	defer cancel()
+
+	r, err := e.kapi.Get(ctx, key)
+	if err != nil {
+		log.Warn("Could not retrieve key from etcd.", "key", key, "err", err)
+		return etcdv3.NoLease, e.clientError(err)
+	}
+	if len(r.Kvs) == 0 {
+		return etcdv3.NoLease, kvwrapper.ErrKeyNotFound
+	}
+	return etcdv3.LeaseID(r.Kvs[0].Lease), nil
+}
+
+// RefreshTTL restarts the countdown of the ttl key was set with, without rewriting its value.
+// Note that the lease of key is renewed, which refreshes every key attached to it.
+func (e EtcdV3Wrapper) RefreshTTL(key string) error {
+	leaseID, err := e.Lease(key)
+	if err != nil || leaseID == etcdv3.NoLease {
+		return err
+	}
+
+	ctx, cancel := e.context()
+	defer cancel()
+
+	r, err := e.cli.KeepAliveOnce(ctx, leaseID)
+	if err != nil {
+		if err == rpctypes.ErrLeaseNotFound {
+			// the lease expired in the meantime, and took key along
+			return kvwrapper.ErrKeyNotFound
+		}
+		log.Warn("Could not renew lease in etcd.", "key", key, "err", err)
+		return e.clientError(err)
+	}
+	e.leases.renewed(leaseID, r.TTL)
+	return nil
+}
+
+// SetTTL changes the ttl of key without rewriting its value. A ttl of 0 removes the ttl
+// altogether, the same way setting a ttl of 0 does in v2.
+func (e EtcdV3Wrapper) SetTTL(key string, ttl uint64) error {
+	ctx, cancel := e.context()
+	defer cancel()
+
+	leaseID, err := e.grantLease(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	options := []etcdv3.OpOption{etcdv3.WithIgnoreValue()}
+	if leaseID != etcdv3.NoLease {
+		options = append(options, etcdv3.WithLease(leaseID))
+	}
+
+	_, err = e.kapi.Put(ctx, key, "", options...)
+	if err != nil {
+		e.revokeLease(leaseID)
+		if err == rpctypes.ErrKeyNotFound {
+			return kvwrapper.ErrKeyNotFound
+		}
+		log.Warn("Could not change ttl of key in etcd.", "key", key, "err", err)
+		return e.clientError(err)
+	}
+	e.ownLease(key, leaseID, ttl)
+	return nil
+}
+
+// SetKeepAlive sets the key = val with a ttl of ttl, and keeps renewing it in the background
+// until StopKeepAlive or Close is called. This suits keys that should live as long as the
+// process does: should it die, they expire after ttl.
+func (e EtcdV3Wrapper) SetKeepAlive(key string, val string, ttl uint64) error {
+	if ttl == 0 {
+		return e.Set(key, val, ttl)
+	}
+	err := e.Set(key, val, ttl)
+	if err != nil {
+		return err
+	}
+	leaseID, ok := e.leases.lookup(key, ttl)
+	if !ok {
+		return kvwrapper.ErrKeyNotFound
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := e.cli.KeepAlive(ctx, leaseID)
+	if err != nil {
+		cancel()
+		log.Warn("Could not keep lease alive in etcd.", "key", key, "err", err)
+		return e.clientError(err)
+	}
+
+	e.leases.stopKeepAlive(key)
+	e.leases.mutex.Lock()
+	e.leases.keepAlives[key] = cancel
+	e.leases.mutex.Unlock()
+
+	go func() {
+		for r := range ch {
+			e.leases.renewed(leaseID, r.TTL)
+		}
+		if ctx.Err() == nil {
+			log.Warn("Lost keep alive of key in etcd.", "key", key, "lease", leaseID)
+		}
+	}()
+	return nil
+}
+
+// StopKeepAlive stops renewing key in the background, leaving it to expire after its ttl
+func (e EtcdV3Wrapper) StopKeepAlive(key string) {
+	e.leases.stopKeepAlive(key)
+}
+
+// Close stops every background KeepAlive, revoking the leases so that their keys are removed
+// right away, then closes the connection to etcd.
+func (e EtcdV3Wrapper) Close() error {
+	e.leases.mutex.Lock()
+	keys := make([]string, 0, len(e.leases.keepAlives))
+	for key := range e.leases.keepAlives {
+		keys = append(keys, key)
+	}
+	e.leases.mutex.Unlock()
+
+	for _, key := range keys {
+		e.releaseLeases(isKey(key))
+	}
+	return e.cli.Close()
+}
+
+// isKey returns a matcher for key alone
+func isKey(key string) func(k string) bool {
+	return func(k string) bool {
+		return k == key
+	}
+}
+
+// hasPrefix returns a matcher for the keys beginning with prefix
+func hasPrefix(prefix string) func(key string) bool {
+	return func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	}
+}
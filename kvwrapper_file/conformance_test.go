@@ -0,0 +1,28 @@
+package kvwrapper_file_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/behance/go-common/kvwrapper"
+	"github.com/behance/go-common/kvwrapper/kvwrappertest"
+	. "github.com/behance/go-common/kvwrapper_file"
+)
+
+func TestConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvwrapper_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kv := kvwrapper.NewKVWrapper([]string{filepath.Join(dir, "kv.log")}, FileWrapper{})
+	defer kv.(FileWrapper).Close()
+
+	kvwrappertest.Suite{
+		New: func(t *testing.T) kvwrapper.KVWrapper {
+			return kv
+		},
+	}.Run(t)
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package kvwrapper_file
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on file, failing right away if another process holds it.
+// The lock is released when file is closed.
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
@@ -0,0 +1,110 @@
+package kvwrapper_file
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/behance/go-common/internal/kvtree"
+	"github.com/behance/go-common/kvwrapper"
+	log "github.com/behance/go-logging/log"
+)
+
+// ExpiryInterval is how often the keys whose ttl ran out are removed, and reported to the watches
+var ExpiryInterval = time.Second
+
+// FileWrapper keeps its keys in memory and appends every change to a log file, so that local runs
+// need no KV server and survive restarts. It behaves like kvwrapper_etcd (v2): keys are paths, the
+// directories above a key are created along with it and show up with HasChildren set, and
+// directories can only be removed with DeleteList.
+// A log file can only be used by a single process at a time, which holds an exclusive lock on it.
+type FileWrapper struct {
+	// SyncWrites makes every change wait until the log reaches the disk
+	SyncWrites bool
+
+	kvwrapper.StoreWrapper
+	store *store
+}
+
+// store is shared by the copies of a FileWrapper
+type store struct {
+	kv      *kvtree.Store
+	log     *logFile
+	done    chan struct{}
+	closing sync.Once
+}
+
+// NewKVWrapper opens the log file at servers[0], given as a path or a file:// URL, and creates it
+// if it does not exist yet. It fails if another process has the log file open. username and
+// password are ignored.
+func (f FileWrapper) NewKVWrapper(servers []string, username, password string) kvwrapper.KVWrapper {
+	if len(servers) == 0 {
+		// even though this is a critical error, we don't want to issue log.Fatal, since that would os.Exit(1) from within the lib
+		log.Warn("Could not open KV log file.", "err", "no path given")
+		return nil
+	}
+	path := strings.TrimPrefix(servers[0], "file://")
+
+	tree := kvtree.New(nil)
+	l, err := openLog(path, tree, f.SyncWrites)
+	if err != nil {
+		log.Warn("Could not open KV log file.", "path", path, "err", err)
+		return nil
+	}
+	f.store = &store{kv: kvtree.NewStore(tree, l.journal), log: l, done: make(chan struct{})}
+	f.StoreWrapper = kvwrapper.NewStoreWrapper(f.store.kv)
+
+	f.store.kv.Expire()
+	go f.store.expireLoop(ExpiryInterval)
+	return f
+}
+
+func init() {
+	kvwrapper.Register("file", kvwrapper.DriverFunc(open))
+}
+
+// open opens the wrapper of a DSN such as file:///var/lib/app/kv.log?sync=true. The path is the
+// one of the log file, so the wrapper is not namespaced. sync=true sets SyncWrites.
+func open(dsn *kvwrapper.DSN) (kvwrapper.KVWrapper, error) {
+	if err := dsn.CheckOptions("sync"); err != nil {
+		return nil, err
+	}
+	syncWrites, err := dsn.Bool("sync")
+	if err != nil {
+		return nil, err
+	}
+	// file://kv.log names a path relative to the working directory
+	path := strings.Join(dsn.Hosts, ",") + dsn.Prefix
+	dsn.Prefix = ""
+	kv := FileWrapper{SyncWrites: syncWrites}.NewKVWrapper([]string{path}, "", "")
+	if kv == nil {
+		return nil, fmt.Errorf("Could not open KV log file %s", path)
+	}
+	return kv, nil
+}
+
+// Close stops expiring keys and closes the log file, releasing its lock. Closing again is a no-op.
+// The writes made once closed fail, and change nothing.
+func (f FileWrapper) Close() error {
+	var err error
+	f.store.closing.Do(func() {
+		close(f.store.done)
+		err = f.store.log.close()
+	})
+	return err
+}
+
+func (s *store) expireLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		s.kv.Expire()
+	}
+}
@@ -0,0 +1,13 @@
+package kvwrapper_file_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestKvwrapperFile(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "KvwrapperFile Suite")
+}
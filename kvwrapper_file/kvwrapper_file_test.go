@@ -0,0 +1,300 @@
+package kvwrapper_file_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	. "github.com/behance/go-common/kvwrapper_file"
+	log "github.com/behance/go-common/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// plain drops the metadata of kv, which depends on the history of the store
+func plain(kv *kvwrapper.KeyValue) kvwrapper.KeyValue {
+	return kvwrapper.KeyValue{Key: kv.Key, Value: kv.Value, HasChildren: kv.HasChildren}
+}
+
+var _ = Describe("KvwrapperFile", func() {
+	var (
+		dir  string
+		path string
+		kv   kvwrapper.KVWrapper
+	)
+
+	open := func() kvwrapper.KVWrapper {
+		return kvwrapper.NewKVWrapper([]string{"file://" + path}, FileWrapper{})
+	}
+	reopen := func() {
+		kv.(FileWrapper).Close()
+		kv = open()
+		Expect(kv).NotTo(BeNil())
+	}
+
+	BeforeEach(func() {
+		log.SetLevel(log.PanicLevel)
+		ExpiryInterval = 10 * time.Millisecond
+
+		var err error
+		dir, err = ioutil.TempDir("", "kvwrapper_file")
+		Expect(err).To(BeNil())
+		path = filepath.Join(dir, "kv.log")
+		kv = open()
+		kv.Set("/parent/child1", "child1val", 0)
+		kv.Set("/parent/child2", "child2val", 0)
+		kv.Set("/parent/sub/child3", "child3val", 0)
+	})
+
+	AfterEach(func() {
+		if kv != nil {
+			kv.(FileWrapper).Close()
+		}
+		os.RemoveAll(dir)
+	})
+
+	Describe("Get Wrapper", func() {
+		It("Gets single values", func() {
+			s, err := kv.GetVal("/parent/child1")
+			Expect(err).To(BeNil())
+			Expect(plain(s)).To(Equal(kvwrapper.KeyValue{Key: "/parent/child1", Value: "child1val"}))
+		})
+		It("Reports directories", func() {
+			s, err := kv.GetVal("/parent/sub")
+			Expect(err).To(BeNil())
+			Expect(s.HasChildren).To(BeTrue())
+
+			l, err := kv.GetList("/parent", true)
+			Expect(err).To(BeNil())
+			Expect(l).To(HaveLen(3))
+			Expect(plain(l[0])).To(Equal(kvwrapper.KeyValue{Key: "/parent/child1", Value: "child1val"}))
+			Expect(plain(l[1])).To(Equal(kvwrapper.KeyValue{Key: "/parent/child2", Value: "child2val"}))
+			Expect(plain(l[2])).To(Equal(kvwrapper.KeyValue{Key: "/parent/sub", HasChildren: true}))
+		})
+		It("Handles invalid values", func() {
+			s, err := kv.GetVal("xxxxxxxx")
+			Expect(err).To(MatchError(kvwrapper.ErrKeyNotFound))
+			Expect(s).To(BeNil())
+
+			l, err := kv.GetList("xxxxxxxx/phpinfo", false)
+			Expect(err).To(MatchError(kvwrapper.ErrKeyNotFound))
+			Expect(l).To(BeEmpty())
+		})
+	})
+
+	Describe("Set Wrapper", func() {
+		It("Does not set keys below a value, or over a directory", func() {
+			Expect(kv.Set("/parent/child1/below", "value", 0)).To(MatchError(kvwrapper.ErrInvalidKey))
+			Expect(kv.Set("/parent/sub", "value", 0)).To(MatchError(kvwrapper.ErrInvalidKey))
+		})
+		It("Expires keys set with a ttl", func() {
+			Expect(kv.Set("/ttl/key", "value", 1)).To(BeNil())
+			_, err := kv.GetVal("/ttl/key")
+			Expect(err).To(BeNil())
+
+			Eventually(func() error {
+				_, err := kv.GetVal("/ttl/key")
+				return err
+			}, 3*time.Second).Should(MatchError(kvwrapper.ErrKeyNotFound))
+		})
+		It("Creates, swaps and deletes conditionally", func() {
+			_, err := kv.Create("/parent/child1", "value", 0)
+			Expect(err).To(MatchError(kvwrapper.ErrConflict))
+			rev, err := kv.Create("/new", "value", 0)
+			Expect(err).To(BeNil())
+
+			_, err = kv.CompareAndSwapRevision("/new", "newvalue", rev+1, 0)
+			Expect(err).To(MatchError(kvwrapper.ErrConflict))
+			_, err = kv.CompareAndSwapRevision("/new", "newvalue", rev, 0)
+			Expect(err).To(BeNil())
+			_, err = kv.CompareAndSwap("/new", "value", "othervalue", 0)
+			Expect(err).To(MatchError(kvwrapper.ErrConflict))
+
+			Expect(kv.CompareAndDelete("/new", "value")).To(MatchError(kvwrapper.ErrConflict))
+			Expect(kv.CompareAndDelete("/new", "newvalue")).To(BeNil())
+		})
+		It("Applies transactions as a whole", func() {
+			r, err := kv.Txn().
+				If(kvwrapper.ValueEquals("/parent/child1", "child1val")).
+				Then(kvwrapper.SetOp("/parent/child1", "new", 0), kvwrapper.GetOp("/parent/child2")).
+				Commit()
+			Expect(err).To(BeNil())
+			Expect(r.Succeeded).To(BeTrue())
+			Expect(r.Results[1].KeyValue.Value).To(Equal("child2val"))
+
+			_, err = kv.Txn().Then(kvwrapper.SetOp("/a", "a", 0), kvwrapper.SetOp("/parent/sub", "b", 0)).Commit()
+			Expect(err).To(MatchError(kvwrapper.ErrInvalidKey))
+			_, err = kv.GetVal("/a")
+			Expect(err).To(MatchError(kvwrapper.ErrKeyNotFound))
+		})
+		It("Rolls back transactions that fail halfway", func() {
+			_, err := kv.Txn().Then(kvwrapper.SetOp("/a", "a", 0), kvwrapper.SetOp("/a/b", "b", 0)).Commit()
+			Expect(err).To(MatchError(kvwrapper.ErrInvalidKey))
+			_, err = kv.GetVal("/a")
+			Expect(err).To(MatchError(kvwrapper.ErrKeyNotFound))
+
+			reopen()
+			_, err = kv.GetVal("/a")
+			Expect(err).To(MatchError(kvwrapper.ErrKeyNotFound))
+		})
+	})
+
+	Describe("Delete Wrapper", func() {
+		It("Deletes directories with DeleteList only", func() {
+			Expect(kv.Delete("/parent/sub")).To(MatchError(kvwrapper.ErrInvalidKey))
+
+			n, err := kv.DeleteList("/parent")
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(int64(3)))
+			_, err = kv.GetVal("/parent")
+			Expect(err).To(MatchError(kvwrapper.ErrKeyNotFound))
+		})
+	})
+
+	Describe("Open", func() {
+		It("Opens the log file at the path of the DSN", func() {
+			kv.(FileWrapper).Close()
+			opened, err := kvwrapper.Open("file://" + path + "?sync=true")
+			Expect(err).To(BeNil())
+			kv = opened
+			Expect(kv.(FileWrapper).SyncWrites).To(BeTrue())
+
+			val, err := kv.GetVal("/parent/child1")
+			Expect(err).To(BeNil())
+			Expect(val.Value).To(Equal("child1val"))
+		})
+
+		It("Fails on unknown options", func() {
+			_, err := kvwrapper.Open("file://" + path + "?timeout=5s")
+			Expect(err).NotTo(BeNil())
+		})
+	})
+
+	Describe("Persistence", func() {
+		It("Keeps the keys across restarts", func() {
+			kv.Delete("/parent/child2")
+			rev, _ := kv.Create("/other", "value", 0)
+			reopen()
+
+			l, err := kv.GetList("/parent", true)
+			Expect(err).To(BeNil())
+			Expect(l).To(HaveLen(2))
+			_, err = kv.CompareAndSwapRevision("/other", "newvalue", rev, 0)
+			Expect(err).To(BeNil())
+		})
+		It("Keeps empty directories across restarts", func() {
+			kv.Delete("/parent/sub/child3")
+			reopen()
+
+			s, err := kv.GetVal("/parent/sub")
+			Expect(err).To(BeNil())
+			Expect(s.HasChildren).To(BeTrue())
+		})
+		It("Drops a partly written last record", func() {
+			kv.(FileWrapper).Close()
+			f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			f.WriteString(`{"op":"set","key":"/tru`)
+			f.Close()
+
+			kv = open()
+			Expect(kv).NotTo(BeNil())
+			Expect(kv.Set("/after", "value", 0)).To(BeNil())
+			reopen()
+			_, err := kv.GetVal("/after")
+			Expect(err).To(BeNil())
+		})
+		It("Refuses a log corrupt in the middle", func() {
+			kv.(FileWrapper).Close()
+			b, _ := ioutil.ReadFile(path)
+			ioutil.WriteFile(path, append([]byte("garbage\n"), b...), 0644)
+
+			kv = open()
+			Expect(kv).To(BeNil())
+		})
+		It("Compacts the log", func() {
+			old := CompactThreshold
+			CompactThreshold = 10
+			defer func() { CompactThreshold = old }()
+
+			for i := 0; i < 20; i++ {
+				Expect(kv.Set("/counter", strings.Repeat("x", i), 0)).To(BeNil())
+			}
+			b, _ := ioutil.ReadFile(path)
+			Expect(strings.Count(string(b), "\n")).To(BeNumerically("<", 10))
+
+			reopen()
+			s, err := kv.GetVal("/counter")
+			Expect(err).To(BeNil())
+			Expect(s.Value).To(Equal(strings.Repeat("x", 19)))
+		})
+	})
+
+	Describe("Lock", func() {
+		It("Refuses a log file another wrapper has open", func() {
+			Expect(open()).To(BeNil())
+
+			kv.(FileWrapper).Close()
+			kv = open()
+			Expect(kv).NotTo(BeNil())
+		})
+		It("Keeps the log file locked across compactions", func() {
+			old := CompactThreshold
+			CompactThreshold = 10
+			defer func() { CompactThreshold = old }()
+
+			for i := 0; i < 20; i++ {
+				Expect(kv.Set("/counter", strings.Repeat("x", i), 0)).To(BeNil())
+			}
+			Expect(open()).To(BeNil())
+		})
+		It("Can be closed more than once", func() {
+			Expect(kv.(FileWrapper).Close()).To(BeNil())
+			Expect(kv.(FileWrapper).Close()).To(BeNil())
+		})
+		It("Refuses the writes made once closed", func() {
+			Expect(kv.(FileWrapper).Close()).To(BeNil())
+			Expect(kv.Set("/parent/child1", "value", 0)).NotTo(BeNil())
+			_, err := kv.DeleteList("/parent")
+			Expect(err).NotTo(BeNil())
+
+			s, err := kv.GetVal("/parent/child1")
+			Expect(err).To(BeNil())
+			Expect(s.Value).To(Equal("child1val"))
+		})
+	})
+
+	Describe("Watch", func() {
+		It("Streams changes below a key", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events, err := kv.Watch(ctx, "/parent", true)
+			Expect(err).To(BeNil())
+
+			kv.Set("/parent/sub/child4", "child4val", 0)
+			kv.Set("/elsewhere", "value", 0)
+			kv.Delete("/parent/child1")
+			kv.Set("/parent/ttl", "value", 1)
+
+			var ev *kvwrapper.WatchEvent
+			Eventually(events).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(kvwrapper.EventPut))
+			Expect(ev.Key).To(Equal("/parent/sub/child4"))
+			Expect(ev.Value).To(Equal("child4val"))
+			Eventually(events).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(kvwrapper.EventDelete))
+			Expect(ev.Key).To(Equal("/parent/child1"))
+			Eventually(events).Should(Receive(&ev))
+			Expect(ev.Key).To(Equal("/parent/ttl"))
+			Eventually(events, 3*time.Second).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(kvwrapper.EventExpire))
+
+			cancel()
+			Eventually(events).Should(BeClosed())
+		})
+	})
+})
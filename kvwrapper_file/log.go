@@ -0,0 +1,312 @@
+package kvwrapper_file
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/behance/go-common/internal/kvtree"
+	log "github.com/behance/go-logging/log"
+)
+
+// CompactThreshold is how many records the log has to hold before it is rewritten to its live keys.
+// It is only rewritten once at least half of its records are stale.
+var CompactThreshold = 1000
+
+const (
+	opSet    = "set"
+	opMkdir  = "mkdir"
+	opDelete = "delete"
+	opIndex  = "index"
+)
+
+// record is a line of the log. Deletes remove the key and everything below it, and expiries are
+// logged as deletes.
+type record struct {
+	Op         string `json:"op"`
+	Key        string `json:"key,omitempty"`
+	Value      string `json:"value,omitempty"`
+	Expiration int64  `json:"expiration,omitempty"`
+	Created    uint64 `json:"created,omitempty"`
+	Version    int64  `json:"version,omitempty"`
+	Index      uint64 `json:"index"`
+}
+
+// errClosed is returned by the writes made once the wrapper is closed
+var errClosed = errors.New("KV log file is closed")
+
+// logFile is the append-only log of the changes made to a tree
+type logFile struct {
+	path    string
+	tree    *kvtree.Tree
+	sync    bool
+	records int
+
+	// mutex guards file, which is swapped by compactions and set to nil once closed
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// openLog locks the log at path and replays it into tree, creating the log if needed. A last line
+// that was only partly written is dropped, any other unreadable line is an error.
+func openLog(path string, tree *kvtree.Tree, sync bool) (*logFile, error) {
+	file, err := lockLog(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &logFile{path: path, file: file, tree: tree, sync: sync}
+
+	err = l.replay()
+	if err == nil && l.records > l.live() {
+		err = l.compact()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// lockLog opens the log at path and takes an exclusive lock on it. The log may have been
+// replaced by a compaction while waiting for the lock, in which case the new one is locked instead.
+func lockLog(path string) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := lockFile(file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s is in use by another process: %v", path, err)
+		}
+
+		locked, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(locked, current) {
+			return file, nil
+		}
+		file.Close()
+	}
+}
+
+func (l *logFile) replay() error {
+	r := bufio.NewReader(l.file)
+	var offset int64
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(b) > 0 {
+				log.Warn("Dropping the partly written end of the KV log file.", "path", l.path, "line", line)
+				return l.truncate(offset)
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var rec record
+		if err := json.Unmarshal(b, &rec); err != nil {
+			if _, err := r.Peek(1); err == io.EOF {
+				log.Warn("Dropping the partly written end of the KV log file.", "path", l.path, "line", line)
+				return l.truncate(offset)
+			}
+			return fmt.Errorf("%s:%d: corrupt record: %v", l.path, line, err)
+		}
+		if err := l.restore(rec); err != nil {
+			return fmt.Errorf("%s:%d: %v", l.path, line, err)
+		}
+		offset += int64(len(b))
+		l.records++
+	}
+	return nil
+}
+
+func (l *logFile) truncate(offset int64) error {
+	if err := l.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := l.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (l *logFile) restore(rec record) error {
+	switch rec.Op {
+	case opSet:
+		n := kvtree.Node{Key: rec.Key, Value: rec.Value, CreatedIndex: rec.Created, ModifiedIndex: rec.Index, Version: rec.Version}
+		if n.Version == 0 {
+			// logs written before versions were recorded
+			n.Version = 1
+		}
+		if rec.Expiration != 0 {
+			n.Expiration = time.Unix(0, rec.Expiration)
+		}
+		return l.tree.Restore(n)
+	case opMkdir:
+		return l.tree.Restore(kvtree.Node{Key: rec.Key, Dir: true, CreatedIndex: rec.Created, ModifiedIndex: rec.Index})
+	case opDelete:
+		l.tree.SetIndex(rec.Index - 1)
+		_, err := l.tree.Delete(rec.Key, true)
+		if err == kvtree.ErrKeyNotFound {
+			// logged after a partial write of the parent, nothing left to remove
+			err = nil
+		}
+		return err
+	case opIndex:
+		if rec.Index > l.tree.Index() {
+			l.tree.SetIndex(rec.Index)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown op %q", rec.Op)
+}
+
+// live returns how many records a compacted log would hold
+func (l *logFile) live() int {
+	count := 1
+	l.tree.Walk("/", func(n *kvtree.Node) {
+		if n.Key != "/" {
+			count++
+		}
+	})
+	return count
+}
+
+// journal appends the changes made to the tree
+func (l *logFile) journal(changes []kvtree.Change) error {
+	recs := make([]record, 0, len(changes))
+	for _, c := range changes {
+		if c.Node != nil {
+			recs = append(recs, setRecord(c.Node))
+		} else {
+			recs = append(recs, record{Op: opDelete, Key: c.Key, Index: c.Index})
+		}
+	}
+	err := l.append(recs...)
+	if err != nil {
+		log.Warn("Could not write to KV log file.", "path", l.path, "err", err)
+	}
+	return err
+}
+
+// append writes the records of a change, then compacts the log if it grew too large. A change
+// that could not be written is truncated away.
+func (l *logFile) append(recs ...record) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return errClosed
+	}
+	buf := []byte{}
+	for _, rec := range recs {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	offset, err := l.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = l.file.Write(buf); err == nil && l.sync {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		// the change is rolled back, so it must not be replayed either
+		if terr := l.truncate(offset); terr != nil {
+			log.Warn("Could not truncate KV log file.", "path", l.path, "err", terr)
+		}
+		return err
+	}
+	l.records += len(recs)
+
+	if l.records >= CompactThreshold && l.records >= 2*l.live() {
+		// the change is in the log already, the next write compacts it again
+		if err := l.compact(); err != nil {
+			log.Warn("Could not compact KV log file.", "path", l.path, "err", err)
+		}
+	}
+	return nil
+}
+
+// compact rewrites the log to the current keys and directories, then swaps it in place of the
+// current one. The new log is locked before it replaces the current one.
+func (l *logFile) compact() error {
+	tmp, err := os.Create(filepath.Join(filepath.Dir(l.path), "."+filepath.Base(l.path)+".tmp"))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = lockFile(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	recs := snapshot(l.tree)
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, rec := range recs {
+		if err = enc.Encode(rec); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	l.file.Close()
+	l.file, l.records = tmp, len(recs)
+	return nil
+}
+
+func snapshot(tree *kvtree.Tree) []record {
+	recs := []record{}
+	tree.Walk("/", func(n *kvtree.Node) {
+		switch {
+		case n.Key == "/":
+		case !n.Dir:
+			recs = append(recs, setRecord(n))
+		default:
+			recs = append(recs, record{Op: opMkdir, Key: n.Key, Created: n.CreatedIndex, Index: n.ModifiedIndex})
+		}
+	})
+	return append(recs, record{Op: opIndex, Index: tree.Index()})
+}
+
+func setRecord(n *kvtree.Node) record {
+	rec := record{Op: opSet, Key: n.Key, Value: n.Value, Created: n.CreatedIndex, Version: n.Version, Index: n.ModifiedIndex}
+	if !n.Expiration.IsZero() {
+		rec.Expiration = n.Expiration.UnixNano()
+	}
+	return rec
+}
+
+func (l *logFile) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,332 @@
+package kvwrapper_metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	// the measures go through the logger of log.Middleware rather than go-logging, so that they
+	// share its l2met output, and the level and output callers set on it
+	"github.com/behance/go-common/log"
+)
+
+// DefaultBuckets are the upper bounds of the latency histograms of the wrappers that were not given Buckets
+var DefaultBuckets = []time.Duration{
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// MetricsWrapper counts the operations made on Backend, and their errors by kind, and records
+// their latencies in histograms. The metrics are written in the Prometheus text format by
+// WritePrometheus, or served by ServeHTTP. With LogMeasures set, every operation is also logged
+// with an l2met "measure#" field, the way log.Middleware logs requests.
+type MetricsWrapper struct {
+	// Backend is the wrapped store: a template built by NewKVWrapper, or a wrapper handed to Wrap
+	Backend kvwrapper.KVWrapper
+	// Name prefixes the names of the metrics, "kv" if left blank. It has to be a valid Prometheus metric name.
+	Name string
+	// Buckets are the upper bounds of the latency histograms, in increasing order
+	Buckets []time.Duration
+	// LogMeasures logs every operation, with its latency in nanoseconds as measure#<Name>.<op>.latency
+	LogMeasures bool
+
+	metrics *metrics
+}
+
+// metrics is shared by the copies of a MetricsWrapper
+type metrics struct {
+	mutex sync.Mutex
+	ops   map[string]*opMetrics
+}
+
+type opMetrics struct {
+	count  uint64
+	errors map[string]uint64
+	// buckets counts the operations that took up to the matching Buckets, the last one counting the others
+	buckets []uint64
+	sum     time.Duration
+}
+
+// NewKVWrapper initializes Backend with servers, username and password, and wraps it
+func (m MetricsWrapper) NewKVWrapper(servers []string, username, password string) kvwrapper.KVWrapper {
+	kv := m.Backend.NewKVWrapper(servers, username, password)
+	if kv == nil {
+		return nil
+	}
+	return m.Wrap(kv)
+}
+
+// Connect is NewKVWrapper, returning the error of Backend when it cannot be initialized
+func (m MetricsWrapper) Connect(servers []string, username, password string) (kvwrapper.KVWrapper, error) {
+	kv, err := kvwrapper.Connect(servers, m.Backend, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return m.Wrap(kv), nil
+}
+
+// Wrap returns a MetricsWrapper around kv, an initialized wrapper, configured as m
+func (m MetricsWrapper) Wrap(kv kvwrapper.KVWrapper) MetricsWrapper {
+	if m.Name == "" {
+		m.Name = "kv"
+	}
+	if m.Buckets == nil {
+		m.Buckets = DefaultBuckets
+	}
+	m.Backend = kv
+	m.metrics = &metrics{ops: make(map[string]*opMetrics)}
+	return m
+}
+
+// ErrorKind names the kind of err in the metrics
+func ErrorKind(err error) string {
+	switch err {
+	case kvwrapper.ErrKeyNotFound:
+		return "not_found"
+	case kvwrapper.ErrConflict:
+		return "conflict"
+	case kvwrapper.ErrNotSupported:
+		return "not_supported"
+	case kvwrapper.ErrCouldNotConnect:
+		return "could_not_connect"
+	case kvwrapper.ErrInvalidKey:
+		return "invalid_key"
+	case kvwrapper.ErrUnauthorized:
+		return "unauthorized"
+	case kvwrapper.ErrTimeout, context.DeadlineExceeded:
+		return "timeout"
+	case context.Canceled:
+		return "canceled"
+	}
+	return "other"
+}
+
+// record accounts for an operation op that started at start and returned err
+func (m MetricsWrapper) record(op string, start time.Time, err error) {
+	latency := time.Since(start)
+
+	m.metrics.mutex.Lock()
+	o, ok := m.metrics.ops[op]
+	if !ok {
+		o = &opMetrics{errors: make(map[string]uint64), buckets: make([]uint64, len(m.Buckets)+1)}
+		m.metrics.ops[op] = o
+	}
+	o.count++
+	o.sum += latency
+	if err != nil {
+		o.errors[ErrorKind(err)]++
+	}
+	i := sort.Search(len(m.Buckets), func(i int) bool { return latency <= m.Buckets[i] })
+	o.buckets[i]++
+	m.metrics.mutex.Unlock()
+
+	if m.LogMeasures {
+		fields := []interface{}{
+			"KV operation.",
+			"op", op,
+			"took", latency,
+			fmt.Sprintf("measure#%s.%s.latency", m.Name, op), latency.Nanoseconds(),
+		}
+		if err != nil {
+			fields = append(fields, "err", err, fmt.Sprintf("count#%s.%s.errors", m.Name, op), 1)
+		}
+		log.Info(fields...)
+	}
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format
+func (m MetricsWrapper) WritePrometheus(w io.Writer) error {
+	m.metrics.mutex.Lock()
+	defer m.metrics.mutex.Unlock()
+
+	ops := make([]string, 0, len(m.metrics.ops))
+	for op := range m.metrics.ops {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "# HELP %s_operations_total Operations made on the KV store.\n", m.Name)
+	fmt.Fprintf(b, "# TYPE %s_operations_total counter\n", m.Name)
+	for _, op := range ops {
+		fmt.Fprintf(b, "%s_operations_total{op=%q} %d\n", m.Name, op, m.metrics.ops[op].count)
+	}
+
+	fmt.Fprintf(b, "# HELP %s_errors_total Operations on the KV store that failed, by kind of error.\n", m.Name)
+	fmt.Fprintf(b, "# TYPE %s_errors_total counter\n", m.Name)
+	for _, op := range ops {
+		o := m.metrics.ops[op]
+		kinds := make([]string, 0, len(o.errors))
+		for kind := range o.errors {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			fmt.Fprintf(b, "%s_errors_total{op=%q,kind=%q} %d\n", m.Name, op, kind, o.errors[kind])
+		}
+	}
+
+	fmt.Fprintf(b, "# HELP %s_operation_duration_seconds Latency of the operations on the KV store.\n", m.Name)
+	fmt.Fprintf(b, "# TYPE %s_operation_duration_seconds histogram\n", m.Name)
+	for _, op := range ops {
+		o := m.metrics.ops[op]
+		var cumulative uint64
+		for i, bound := range m.Buckets {
+			cumulative += o.buckets[i]
+			fmt.Fprintf(b, "%s_operation_duration_seconds_bucket{op=%q,le=%q} %d\n", m.Name, op, seconds(bound), cumulative)
+		}
+		fmt.Fprintf(b, "%s_operation_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", m.Name, op, o.count)
+		fmt.Fprintf(b, "%s_operation_duration_seconds_sum{op=%q} %s\n", m.Name, op, seconds(o.sum))
+		fmt.Fprintf(b, "%s_operation_duration_seconds_count{op=%q} %d\n", m.Name, op, o.count)
+	}
+	return b.Flush()
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format, to be scraped
+func (m MetricsWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WritePrometheus(w)
+}
+
+func (m MetricsWrapper) Set(key string, val string, ttl uint64) (err error) {
+	defer func(start time.Time) { m.record("set", start, err) }(time.Now())
+	return m.Backend.Set(key, val, ttl)
+}
+
+func (m MetricsWrapper) SetContext(ctx context.Context, key string, val string, ttl uint64) (err error) {
+	defer func(start time.Time) { m.record("set", start, err) }(time.Now())
+	return kvwrapper.SetContext(ctx, m.Backend, key, val, ttl)
+}
+
+func (m MetricsWrapper) GetVal(key string) (kv *kvwrapper.KeyValue, err error) {
+	defer func(start time.Time) { m.record("get_val", start, err) }(time.Now())
+	return m.Backend.GetVal(key)
+}
+
+func (m MetricsWrapper) GetValContext(ctx context.Context, key string) (kv *kvwrapper.KeyValue, err error) {
+	defer func(start time.Time) { m.record("get_val", start, err) }(time.Now())
+	return kvwrapper.GetValContext(ctx, m.Backend, key)
+}
+
+func (m MetricsWrapper) GetList(key string, sort bool) (kvs []*kvwrapper.KeyValue, err error) {
+	defer func(start time.Time) { m.record("get_list", start, err) }(time.Now())
+	return m.Backend.GetList(key, sort)
+}
+
+func (m MetricsWrapper) GetListContext(ctx context.Context, key string, sort bool) (kvs []*kvwrapper.KeyValue, err error) {
+	defer func(start time.Time) { m.record("get_list", start, err) }(time.Now())
+	return kvwrapper.GetListContext(ctx, m.Backend, key, sort)
+}
+
+// GetPage lists through GetPage on Backend, falling back to GetList if it cannot page
+func (m MetricsWrapper) GetPage(ctx context.Context, key string, limit int64, token string) (page *kvwrapper.Page, err error) {
+	defer func(start time.Time) { m.record("get_page", start, err) }(time.Now())
+	return kvwrapper.GetPage(ctx, m.Backend, key, limit, token)
+}
+
+// List lists through List on Backend, falling back to GetList if it cannot sort or strip the keys
+func (m MetricsWrapper) List(ctx context.Context, key string, opts kvwrapper.ListOptions) (result *kvwrapper.ListResult, err error) {
+	defer func(start time.Time) { m.record("list", start, err) }(time.Now())
+	return kvwrapper.List(ctx, m.Backend, key, opts)
+}
+
+func (m MetricsWrapper) Create(key string, val string, ttl uint64) (rev int64, err error) {
+	defer func(start time.Time) { m.record("create", start, err) }(time.Now())
+	return m.Backend.Create(key, val, ttl)
+}
+
+func (m MetricsWrapper) CreateContext(ctx context.Context, key string, val string, ttl uint64) (rev int64, err error) {
+	defer func(start time.Time) { m.record("create", start, err) }(time.Now())
+	return kvwrapper.CreateContext(ctx, m.Backend, key, val, ttl)
+}
+
+func (m MetricsWrapper) CompareAndSwap(key string, val string, prevVal string, ttl uint64) (rev int64, err error) {
+	defer func(start time.Time) { m.record("compare_and_swap", start, err) }(time.Now())
+	return m.Backend.CompareAndSwap(key, val, prevVal, ttl)
+}
+
+func (m MetricsWrapper) CompareAndSwapContext(ctx context.Context, key string, val string, prevVal string, ttl uint64) (rev int64, err error) {
+	defer func(start time.Time) { m.record("compare_and_swap", start, err) }(time.Now())
+	return kvwrapper.CompareAndSwapContext(ctx, m.Backend, key, val, prevVal, ttl)
+}
+
+func (m MetricsWrapper) CompareAndSwapRevision(key string, val string, prevRev int64, ttl uint64) (rev int64, err error) {
+	defer func(start time.Time) { m.record("compare_and_swap_revision", start, err) }(time.Now())
+	return m.Backend.CompareAndSwapRevision(key, val, prevRev, ttl)
+}
+
+func (m MetricsWrapper) CompareAndSwapRevisionContext(ctx context.Context, key string, val string, prevRev int64, ttl uint64) (rev int64, err error) {
+	defer func(start time.Time) { m.record("compare_and_swap_revision", start, err) }(time.Now())
+	return kvwrapper.CompareAndSwapRevisionContext(ctx, m.Backend, key, val, prevRev, ttl)
+}
+
+func (m MetricsWrapper) CompareAndDelete(key string, prevVal string) (err error) {
+	defer func(start time.Time) { m.record("compare_and_delete", start, err) }(time.Now())
+	return m.Backend.CompareAndDelete(key, prevVal)
+}
+
+func (m MetricsWrapper) CompareAndDeleteContext(ctx context.Context, key string, prevVal string) (err error) {
+	defer func(start time.Time) { m.record("compare_and_delete", start, err) }(time.Now())
+	return kvwrapper.CompareAndDeleteContext(ctx, m.Backend, key, prevVal)
+}
+
+// Txn records the commit of the transaction
+func (m MetricsWrapper) Txn() *kvwrapper.Txn {
+	return kvwrapper.NewContextTxn(
+		func(compares []kvwrapper.Compare, thenOps []kvwrapper.Op, elseOps []kvwrapper.Op) (r *kvwrapper.TxnResponse, err error) {
+			defer func(start time.Time) { m.record("txn", start, err) }(time.Now())
+			return m.Backend.Txn().If(compares...).Then(thenOps...).Else(elseOps...).Commit()
+		},
+		func(ctx context.Context, compares []kvwrapper.Compare, thenOps []kvwrapper.Op, elseOps []kvwrapper.Op) (r *kvwrapper.TxnResponse, err error) {
+			defer func(start time.Time) { m.record("txn", start, err) }(time.Now())
+			return m.Backend.Txn().If(compares...).Then(thenOps...).Else(elseOps...).CommitContext(ctx)
+		})
+}
+
+func (m MetricsWrapper) Delete(key string) (err error) {
+	defer func(start time.Time) { m.record("delete", start, err) }(time.Now())
+	return m.Backend.Delete(key)
+}
+
+func (m MetricsWrapper) DeleteContext(ctx context.Context, key string) (err error) {
+	defer func(start time.Time) { m.record("delete", start, err) }(time.Now())
+	return kvwrapper.DeleteContext(ctx, m.Backend, key)
+}
+
+func (m MetricsWrapper) DeleteList(key string) (n int64, err error) {
+	defer func(start time.Time) { m.record("delete_list", start, err) }(time.Now())
+	return m.Backend.DeleteList(key)
+}
+
+func (m MetricsWrapper) DeleteListContext(ctx context.Context, key string) (n int64, err error) {
+	defer func(start time.Time) { m.record("delete_list", start, err) }(time.Now())
+	return kvwrapper.DeleteListContext(ctx, m.Backend, key)
+}
+
+// Watch records the setup of the watch, not the events it delivers
+func (m MetricsWrapper) Watch(ctx context.Context, key string, recursive bool) (events <-chan *kvwrapper.WatchEvent, err error) {
+	defer func(start time.Time) { m.record("watch", start, err) }(time.Now())
+	return m.Backend.Watch(ctx, key, recursive)
+}
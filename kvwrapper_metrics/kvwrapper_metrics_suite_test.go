@@ -0,0 +1,13 @@
+package kvwrapper_metrics_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestKvwrapperMetrics(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "KvwrapperMetrics Suite")
+}
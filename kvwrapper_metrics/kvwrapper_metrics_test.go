@@ -0,0 +1,117 @@
+package kvwrapper_metrics_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	. "github.com/behance/go-common/kvwrapper_metrics"
+	log "github.com/behance/go-common/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("KvwrapperMetrics", func() {
+	var (
+		kv MetricsWrapper
+	)
+
+	metrics := func() string {
+		var b bytes.Buffer
+		Expect(kv.WritePrometheus(&b)).To(BeNil())
+		return b.String()
+	}
+
+	BeforeEach(func() {
+		log.SetLevel(log.PanicLevel)
+		backend := kvwrapper.NewKVWrapper(nil, kvwrapper.KVFaker{})
+		kv = MetricsWrapper{Buckets: []time.Duration{time.Millisecond, time.Hour}}.Wrap(backend)
+		kv.Set("/parent/child1", "child1val", 0)
+	})
+
+	It("Counts the operations and their errors", func() {
+		kv.GetVal("/parent/child1")
+		kv.GetVal("/missing")
+		kv.CompareAndSwap("/parent/child1", "newval", "other", 0)
+		kv.GetList("/parent", false)
+
+		m := metrics()
+		Expect(m).To(ContainSubstring("# TYPE kv_operations_total counter\n"))
+		Expect(m).To(ContainSubstring(`kv_operations_total{op="get_val"} 2` + "\n"))
+		Expect(m).To(ContainSubstring(`kv_operations_total{op="set"} 1` + "\n"))
+		Expect(m).To(ContainSubstring(`kv_operations_total{op="get_list"} 1` + "\n"))
+		Expect(m).To(ContainSubstring(`kv_errors_total{op="get_val",kind="not_found"} 1` + "\n"))
+		Expect(m).To(ContainSubstring(`kv_errors_total{op="compare_and_swap",kind="conflict"} 1` + "\n"))
+		Expect(m).NotTo(ContainSubstring(`kv_errors_total{op="set"`))
+	})
+
+	It("Records the latencies in histograms", func() {
+		kv.GetVal("/parent/child1")
+
+		m := metrics()
+		Expect(m).To(ContainSubstring("# TYPE kv_operation_duration_seconds histogram\n"))
+		Expect(m).To(ContainSubstring(`kv_operation_duration_seconds_bucket{op="get_val",le="3600"} 1` + "\n"))
+		Expect(m).To(ContainSubstring(`kv_operation_duration_seconds_bucket{op="get_val",le="+Inf"} 1` + "\n"))
+		Expect(m).To(ContainSubstring(`kv_operation_duration_seconds_count{op="get_val"} 1` + "\n"))
+		Expect(m).To(ContainSubstring(`kv_operation_duration_seconds_sum{op="get_val"} `))
+	})
+
+	It("Records transactions and watches", func() {
+		kv.Txn().Then(kvwrapper.GetOp("/parent/child1")).Commit()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		kv.Watch(ctx, "/parent", true)
+
+		m := metrics()
+		Expect(m).To(ContainSubstring(`kv_operations_total{op="txn"} 1` + "\n"))
+		Expect(m).To(ContainSubstring(`kv_operations_total{op="watch"} 1` + "\n"))
+	})
+
+	It("Records the operations bound to contexts as the others", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		kv.GetValContext(ctx, "/parent/child1")
+		kv.Txn().Then(kvwrapper.GetOp("/parent/child1")).CommitContext(ctx)
+		cancel()
+		kv.SetContext(ctx, "/parent/child1", "newval", 0)
+
+		m := metrics()
+		Expect(m).To(ContainSubstring(`kv_operations_total{op="get_val"} 1` + "\n"))
+		Expect(m).To(ContainSubstring(`kv_operations_total{op="txn"} 1` + "\n"))
+		Expect(m).To(ContainSubstring(`kv_operations_total{op="set"} 2` + "\n"))
+		Expect(m).To(ContainSubstring(`kv_errors_total{op="set",kind="canceled"} 1` + "\n"))
+	})
+
+	It("Serves the metrics over HTTP", func() {
+		kv = MetricsWrapper{Name: "registry"}.Wrap(kv.Backend)
+		kv.GetVal("/parent/child1")
+
+		w := httptest.NewRecorder()
+		kv.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		Expect(w.Header().Get("Content-Type")).To(HavePrefix("text/plain"))
+		Expect(w.Body.String()).To(ContainSubstring(`registry_operations_total{op="get_val"} 1`))
+		Expect(w.Body.String()).To(ContainSubstring(`registry_operation_duration_seconds_bucket{op="get_val",le="0.0025"} `))
+	})
+
+	It("Logs l2met measures", func() {
+		out, err := ioutil.TempFile("", "kvwrapper_metrics")
+		Expect(err).To(BeNil())
+		defer os.Remove(out.Name())
+		log.SetOutput(out)
+		log.SetLevel(log.InfoLevel)
+		defer log.SetOutput(os.Stderr)
+
+		kv = MetricsWrapper{LogMeasures: true}.Wrap(kv.Backend)
+		kv.GetVal("/parent/child1")
+		kv.GetVal("/missing")
+		log.SetLevel(log.PanicLevel)
+
+		logged, _ := ioutil.ReadFile(out.Name())
+		Expect(string(logged)).To(MatchRegexp(`measure#kv\.get_val\.latency[=:]\d+`))
+		Expect(string(logged)).To(MatchRegexp(`count#kv\.get_val\.errors[=:]1`))
+	})
+})
@@ -0,0 +1,395 @@
+package kvwrapper_retry
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	log "github.com/behance/go-logging/log"
+)
+
+var (
+	// DefaultRetries is how many times the wrappers that were not given Retries try an operation again
+	DefaultRetries = 3
+	// DefaultBaseDelay and DefaultMaxDelay bound the backoff of the wrappers that were not given delays
+	DefaultBaseDelay = 50 * time.Millisecond
+	DefaultMaxDelay  = 2 * time.Second
+	// DefaultBreakerThreshold is how many failures in a row open the breaker of the wrappers that
+	// were not given a BreakerThreshold
+	DefaultBreakerThreshold = 5
+	// DefaultBreakerCooldown is how long the breaker of the wrappers that were not given a
+	// BreakerCooldown stays open
+	DefaultBreakerCooldown = 10 * time.Second
+)
+
+// RetryWrapper tries the operations that fail on Backend again, after an exponential backoff with
+// jitter (a random delay between 0 and BaseDelay * 2^attempt, capped at MaxDelay), the way
+// httpclient does with rehttp.ExpJitterDelay.
+// Reads, Set and Watch are tried again on any retryable error. The other writes may have been
+// applied when they fail with a timeout, and trying them again would report a conflict for a
+// write that did happen, so they are only tried again when the store could not be reached.
+// The operations given a context stop waiting, and trying again, once it is done.
+//
+// It also keeps a circuit breaker: once BreakerThreshold attempts failed in a row with retryable
+// errors, the store is deemed unhealthy and every operation fails right away with
+// ErrCouldNotConnect for BreakerCooldown. A single operation is then let through, and closes the
+// breaker if it succeeds, or opens it again.
+type RetryWrapper struct {
+	// Backend is the wrapped store: a template built by NewKVWrapper, or a wrapper handed to Wrap
+	Backend kvwrapper.KVWrapper
+	// Retries is how many times an operation is tried again, at most. Set it below 0 to never retry.
+	Retries int
+	// BaseDelay and MaxDelay bound the delays between attempts
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Retryable tells whether an error may go away on its own. Retryable is used if nil.
+	Retryable func(err error) bool
+	// BreakerThreshold is how many failures in a row open the breaker. Set it below 0 to never open it.
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker stays open before letting an operation through
+	BreakerCooldown time.Duration
+
+	breaker *breaker
+}
+
+// breaker is shared by the copies of a RetryWrapper
+type breaker struct {
+	mutex    sync.Mutex
+	failures int
+	openedAt time.Time
+	// trial is set while the operation let through after the cooldown is in flight
+	trial bool
+}
+
+// Retryable is the default classification of errors: the ones stating the outcome of an
+// operation (a missing key, a conflict, an invalid key, an unsupported operation), refused
+// credentials and cancellations are permanent, any other error is deemed transient
+func Retryable(err error) bool {
+	switch err {
+	case nil, kvwrapper.ErrKeyNotFound, kvwrapper.ErrConflict, kvwrapper.ErrNotSupported,
+		kvwrapper.ErrInvalidKey, kvwrapper.ErrUnauthorized, context.Canceled:
+		return false
+	}
+	return true
+}
+
+// NewKVWrapper initializes Backend with servers, username and password, and wraps it
+func (r RetryWrapper) NewKVWrapper(servers []string, username, password string) kvwrapper.KVWrapper {
+	kv := r.Backend.NewKVWrapper(servers, username, password)
+	if kv == nil {
+		return nil
+	}
+	return r.Wrap(kv)
+}
+
+// Connect is NewKVWrapper, returning the error of Backend when it cannot be initialized
+func (r RetryWrapper) Connect(servers []string, username, password string) (kvwrapper.KVWrapper, error) {
+	kv, err := kvwrapper.Connect(servers, r.Backend, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return r.Wrap(kv), nil
+}
+
+// Wrap returns a RetryWrapper around kv, an initialized wrapper, configured as r
+func (r RetryWrapper) Wrap(kv kvwrapper.KVWrapper) RetryWrapper {
+	if r.Retries == 0 {
+		r.Retries = DefaultRetries
+	}
+	if r.BaseDelay <= 0 {
+		r.BaseDelay = DefaultBaseDelay
+	}
+	if r.MaxDelay <= 0 {
+		r.MaxDelay = DefaultMaxDelay
+	}
+	if r.Retryable == nil {
+		r.Retryable = Retryable
+	}
+	if r.BreakerThreshold == 0 {
+		r.BreakerThreshold = DefaultBreakerThreshold
+	}
+	if r.BreakerCooldown <= 0 {
+		r.BreakerCooldown = DefaultBreakerCooldown
+	}
+	r.Backend = kv
+	r.breaker = &breaker{}
+	return r
+}
+
+// Open tells whether the breaker is open, failing operations right away
+func (r RetryWrapper) Open() bool {
+	r.breaker.mutex.Lock()
+	defer r.breaker.mutex.Unlock()
+	return r.breaker.open(r.BreakerCooldown)
+}
+
+// open must be called with the mutex held
+func (b *breaker) open(cooldown time.Duration) bool {
+	return !b.openedAt.IsZero() && (time.Since(b.openedAt) < cooldown || b.trial)
+}
+
+// allow tells whether an attempt may go to the store
+func (r RetryWrapper) allow() bool {
+	b := r.breaker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.openedAt.IsZero() {
+		return true
+	}
+	if b.open(r.BreakerCooldown) {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// report accounts for the outcome of an attempt
+func (r RetryWrapper) report(err error) {
+	b := r.breaker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trial = false
+	if err == nil || !r.Retryable(err) {
+		b.failures = 0
+		b.openedAt = time.Time{}
+		return
+	}
+	b.failures++
+	if r.BreakerThreshold > 0 && (b.failures >= r.BreakerThreshold || !b.openedAt.IsZero()) {
+		if b.openedAt.IsZero() {
+			log.Warn("KV store unhealthy, failing operations for a while.", "failures", b.failures, "err", err)
+		}
+		b.openedAt = time.Now()
+	}
+}
+
+// delay returns how long to wait before the attempt following attempt
+func (r RetryWrapper) delay(attempt int) time.Duration {
+	max := r.MaxDelay
+	if attempt < 32 {
+		if d := r.BaseDelay << uint(attempt); d > 0 && d < max {
+			max = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+// do runs op until it succeeds, fails for good, runs out of retries or ctx is done, in which case
+// the error of ctx is returned. Unless idempotent is set, op is only tried again when the store
+// could not be reached.
+func (r RetryWrapper) do(ctx context.Context, idempotent bool, op func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !r.allow() {
+			return kvwrapper.ErrCouldNotConnect
+		}
+		err = op()
+		r.report(err)
+
+		retry := r.Retryable(err)
+		if !idempotent {
+			retry = err == kvwrapper.ErrCouldNotConnect
+		}
+		if !retry || attempt >= r.Retries {
+			return err
+		}
+		if ctx.Err() != nil {
+			// the operation failed because ctx is done, not because of the store
+			return ctx.Err()
+		}
+		log.Debug("Retrying KV operation.", "attempt", attempt+1, "err", err)
+
+		timer := time.NewTimer(r.delay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (r RetryWrapper) Set(key string, val string, ttl uint64) error {
+	return r.do(context.Background(), true, func() error {
+		return r.Backend.Set(key, val, ttl)
+	})
+}
+
+func (r RetryWrapper) SetContext(ctx context.Context, key string, val string, ttl uint64) error {
+	return r.do(ctx, true, func() error {
+		return kvwrapper.SetContext(ctx, r.Backend, key, val, ttl)
+	})
+}
+
+func (r RetryWrapper) GetVal(key string) (kv *kvwrapper.KeyValue, err error) {
+	err = r.do(context.Background(), true, func() error {
+		kv, err = r.Backend.GetVal(key)
+		return err
+	})
+	return kv, err
+}
+
+func (r RetryWrapper) GetValContext(ctx context.Context, key string) (kv *kvwrapper.KeyValue, err error) {
+	err = r.do(ctx, true, func() error {
+		kv, err = kvwrapper.GetValContext(ctx, r.Backend, key)
+		return err
+	})
+	return kv, err
+}
+
+func (r RetryWrapper) GetList(key string, sort bool) (kvs []*kvwrapper.KeyValue, err error) {
+	err = r.do(context.Background(), true, func() error {
+		kvs, err = r.Backend.GetList(key, sort)
+		return err
+	})
+	return kvs, err
+}
+
+func (r RetryWrapper) GetListContext(ctx context.Context, key string, sort bool) (kvs []*kvwrapper.KeyValue, err error) {
+	err = r.do(ctx, true, func() error {
+		kvs, err = kvwrapper.GetListContext(ctx, r.Backend, key, sort)
+		return err
+	})
+	return kvs, err
+}
+
+// GetPage lists through GetPage on Backend, falling back to GetList if it cannot page
+func (r RetryWrapper) GetPage(ctx context.Context, key string, limit int64, token string) (page *kvwrapper.Page, err error) {
+	err = r.do(ctx, true, func() error {
+		page, err = kvwrapper.GetPage(ctx, r.Backend, key, limit, token)
+		return err
+	})
+	return page, err
+}
+
+// List lists through List on Backend, falling back to GetList if it cannot sort or strip the keys
+func (r RetryWrapper) List(ctx context.Context, key string, opts kvwrapper.ListOptions) (result *kvwrapper.ListResult, err error) {
+	err = r.do(ctx, true, func() error {
+		result, err = kvwrapper.List(ctx, r.Backend, key, opts)
+		return err
+	})
+	return result, err
+}
+
+func (r RetryWrapper) Create(key string, val string, ttl uint64) (rev int64, err error) {
+	err = r.do(context.Background(), false, func() error {
+		rev, err = r.Backend.Create(key, val, ttl)
+		return err
+	})
+	return rev, err
+}
+
+func (r RetryWrapper) CreateContext(ctx context.Context, key string, val string, ttl uint64) (rev int64, err error) {
+	err = r.do(ctx, false, func() error {
+		rev, err = kvwrapper.CreateContext(ctx, r.Backend, key, val, ttl)
+		return err
+	})
+	return rev, err
+}
+
+func (r RetryWrapper) CompareAndSwap(key string, val string, prevVal string, ttl uint64) (rev int64, err error) {
+	err = r.do(context.Background(), false, func() error {
+		rev, err = r.Backend.CompareAndSwap(key, val, prevVal, ttl)
+		return err
+	})
+	return rev, err
+}
+
+func (r RetryWrapper) CompareAndSwapContext(ctx context.Context, key string, val string, prevVal string, ttl uint64) (rev int64, err error) {
+	err = r.do(ctx, false, func() error {
+		rev, err = kvwrapper.CompareAndSwapContext(ctx, r.Backend, key, val, prevVal, ttl)
+		return err
+	})
+	return rev, err
+}
+
+func (r RetryWrapper) CompareAndSwapRevision(key string, val string, prevRev int64, ttl uint64) (rev int64, err error) {
+	err = r.do(context.Background(), false, func() error {
+		rev, err = r.Backend.CompareAndSwapRevision(key, val, prevRev, ttl)
+		return err
+	})
+	return rev, err
+}
+
+func (r RetryWrapper) CompareAndSwapRevisionContext(ctx context.Context, key string, val string, prevRev int64, ttl uint64) (rev int64, err error) {
+	err = r.do(ctx, false, func() error {
+		rev, err = kvwrapper.CompareAndSwapRevisionContext(ctx, r.Backend, key, val, prevRev, ttl)
+		return err
+	})
+	return rev, err
+}
+
+func (r RetryWrapper) CompareAndDelete(key string, prevVal string) error {
+	return r.do(context.Background(), false, func() error {
+		return r.Backend.CompareAndDelete(key, prevVal)
+	})
+}
+
+func (r RetryWrapper) CompareAndDeleteContext(ctx context.Context, key string, prevVal string) error {
+	return r.do(ctx, false, func() error {
+		return kvwrapper.CompareAndDeleteContext(ctx, r.Backend, key, prevVal)
+	})
+}
+
+// Txn commits through Backend, trying again only when the store could not be reached
+func (r RetryWrapper) Txn() *kvwrapper.Txn {
+	return kvwrapper.NewContextTxn(
+		func(compares []kvwrapper.Compare, thenOps []kvwrapper.Op, elseOps []kvwrapper.Op) (resp *kvwrapper.TxnResponse, err error) {
+			err = r.do(context.Background(), false, func() error {
+				resp, err = r.Backend.Txn().If(compares...).Then(thenOps...).Else(elseOps...).Commit()
+				return err
+			})
+			return resp, err
+		},
+		func(ctx context.Context, compares []kvwrapper.Compare, thenOps []kvwrapper.Op, elseOps []kvwrapper.Op) (resp *kvwrapper.TxnResponse, err error) {
+			err = r.do(ctx, false, func() error {
+				resp, err = r.Backend.Txn().If(compares...).Then(thenOps...).Else(elseOps...).CommitContext(ctx)
+				return err
+			})
+			return resp, err
+		})
+}
+
+func (r RetryWrapper) Delete(key string) error {
+	return r.do(context.Background(), false, func() error {
+		return r.Backend.Delete(key)
+	})
+}
+
+func (r RetryWrapper) DeleteContext(ctx context.Context, key string) error {
+	return r.do(ctx, false, func() error {
+		return kvwrapper.DeleteContext(ctx, r.Backend, key)
+	})
+}
+
+func (r RetryWrapper) DeleteList(key string) (n int64, err error) {
+	err = r.do(context.Background(), false, func() error {
+		n, err = r.Backend.DeleteList(key)
+		return err
+	})
+	return n, err
+}
+
+func (r RetryWrapper) DeleteListContext(ctx context.Context, key string) (n int64, err error) {
+	err = r.do(ctx, false, func() error {
+		n, err = kvwrapper.DeleteListContext(ctx, r.Backend, key)
+		return err
+	})
+	return n, err
+}
+
+// Watch tries setting up the watch again. Once it is set up, keeping it alive is up to Backend.
+func (r RetryWrapper) Watch(ctx context.Context, key string, recursive bool) (events <-chan *kvwrapper.WatchEvent, err error) {
+	err = r.do(ctx, true, func() error {
+		events, err = r.Backend.Watch(ctx, key, recursive)
+		return err
+	})
+	return events, err
+}
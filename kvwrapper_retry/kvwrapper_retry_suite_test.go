@@ -0,0 +1,13 @@
+package kvwrapper_retry_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestKvwrapperRetry(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "KvwrapperRetry Suite")
+}
@@ -0,0 +1,259 @@
+package kvwrapper_retry_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	. "github.com/behance/go-common/kvwrapper_retry"
+	log "github.com/behance/go-common/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var errTransient = errors.New("etcdserver: leader changed")
+
+// faults makes the operations of a flaky store fail with err, failures times
+type faults struct {
+	mutex    sync.Mutex
+	err      error
+	failures int
+	calls    int
+}
+
+func (f *faults) fail(err error, failures int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.err, f.failures = err, failures
+}
+
+func (f *faults) next() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls++
+	if f.failures == 0 {
+		return nil
+	}
+	f.failures--
+	return f.err
+}
+
+func (f *faults) count() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.calls
+}
+
+type flaky struct {
+	kvwrapper.KVFaker
+	faults *faults
+}
+
+func (f flaky) Set(key string, val string, ttl uint64) error {
+	if err := f.faults.next(); err != nil {
+		return err
+	}
+	return f.KVFaker.Set(key, val, ttl)
+}
+
+func (f flaky) GetVal(key string) (*kvwrapper.KeyValue, error) {
+	if err := f.faults.next(); err != nil {
+		return nil, err
+	}
+	return f.KVFaker.GetVal(key)
+}
+
+func (f flaky) Create(key string, val string, ttl uint64) (int64, error) {
+	if err := f.faults.next(); err != nil {
+		return 0, err
+	}
+	return f.KVFaker.Create(key, val, ttl)
+}
+
+func (f flaky) GetPage(ctx context.Context, key string, limit int64, token string) (*kvwrapper.Page, error) {
+	if err := f.faults.next(); err != nil {
+		return nil, err
+	}
+	return f.KVFaker.GetPage(ctx, key, limit, token)
+}
+
+var _ = Describe("KvwrapperRetry", func() {
+	var (
+		f  *faults
+		kv RetryWrapper
+	)
+
+	BeforeEach(func() {
+		log.SetLevel(log.PanicLevel)
+		f = &faults{}
+		faker := kvwrapper.NewKVWrapper(nil, kvwrapper.KVFaker{}).(kvwrapper.KVFaker)
+		kv = RetryWrapper{
+			Retries:          3,
+			BaseDelay:        time.Millisecond,
+			MaxDelay:         5 * time.Millisecond,
+			BreakerThreshold: -1,
+		}.Wrap(flaky{KVFaker: faker, faults: f})
+		kv.Set("/parent/child1", "child1val", 0)
+		f.calls = 0
+	})
+
+	It("Retries transient errors", func() {
+		f.fail(errTransient, 2)
+
+		r, err := kv.GetVal("/parent/child1")
+		Expect(err).To(BeNil())
+		Expect(r.Value).To(Equal("child1val"))
+		Expect(f.count()).To(Equal(3))
+	})
+
+	It("Gives up after Retries", func() {
+		f.fail(errTransient, 10)
+
+		_, err := kv.GetVal("/parent/child1")
+		Expect(err).To(Equal(errTransient))
+		Expect(f.count()).To(Equal(4))
+	})
+
+	It("Never retries when Retries is below 0", func() {
+		kv = RetryWrapper{Retries: -1, BreakerThreshold: -1}.Wrap(kv.Backend)
+		f.fail(errTransient, 1)
+
+		Expect(kv.Set("/parent/child1", "newval", 0)).To(Equal(errTransient))
+		Expect(f.count()).To(Equal(1))
+	})
+
+	It("Stops retrying once the context is done", func() {
+		kv = RetryWrapper{Retries: 10, BaseDelay: time.Second, MaxDelay: time.Second, BreakerThreshold: -1}.Wrap(kv.Backend)
+		f.fail(errTransient, 10)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := kv.GetPage(ctx, "/parent", 10, "")
+		Expect(err).To(Equal(context.DeadlineExceeded))
+		Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+
+		calls := f.count()
+		_, err = kv.GetPage(ctx, "/parent", 10, "")
+		Expect(err).To(Equal(context.DeadlineExceeded))
+		Expect(f.count()).To(Equal(calls))
+	})
+
+	It("Binds operations to contexts", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		r, err := kv.GetValContext(ctx, "/parent/child1")
+		Expect(err).To(BeNil())
+		Expect(r.Value).To(Equal("child1val"))
+
+		cancel()
+		Expect(kv.SetContext(ctx, "/parent/child1", "newval", 0)).To(Equal(context.Canceled))
+		_, err = kv.CreateContext(ctx, "/parent/child2", "child2val", 0)
+		Expect(err).To(Equal(context.Canceled))
+		_, err = kv.Txn().Then(kvwrapper.DeleteOp("/parent/child1")).CommitContext(ctx)
+		Expect(err).To(Equal(context.Canceled))
+		r, _ = kv.GetVal("/parent/child1")
+		Expect(r.Value).To(Equal("child1val"))
+	})
+
+	It("Does not retry permanent errors", func() {
+		_, err := kv.GetVal("/missing")
+		Expect(err).To(Equal(kvwrapper.ErrKeyNotFound))
+
+		_, err = kv.Create("/parent/child1", "newval", 0)
+		Expect(err).To(Equal(kvwrapper.ErrConflict))
+		Expect(f.count()).To(Equal(2))
+	})
+
+	It("Only retries conditional writes when the store could not be reached", func() {
+		f.fail(errTransient, 1)
+		_, err := kv.Create("/parent/child2", "child2val", 0)
+		Expect(err).To(Equal(errTransient))
+		Expect(f.count()).To(Equal(1))
+
+		f.fail(kvwrapper.ErrCouldNotConnect, 1)
+		_, err = kv.Create("/parent/child2", "child2val", 0)
+		Expect(err).To(BeNil())
+		Expect(f.count()).To(Equal(3))
+	})
+
+	It("Classifies errors with Retryable", func() {
+		kv = RetryWrapper{
+			BaseDelay:        time.Millisecond,
+			BreakerThreshold: -1,
+			Retryable:        func(err error) bool { return err == kvwrapper.ErrKeyNotFound },
+		}.Wrap(kv.Backend)
+		f.fail(errTransient, 1)
+
+		Expect(kv.Set("/parent/child1", "newval", 0)).To(Equal(errTransient))
+		_, err := kv.GetVal("/missing")
+		Expect(err).To(Equal(kvwrapper.ErrKeyNotFound))
+		Expect(f.count()).To(Equal(1 + 1 + DefaultRetries))
+	})
+
+	It("Classifies errors by default", func() {
+		Expect(Retryable(errTransient)).To(BeTrue())
+		Expect(Retryable(kvwrapper.ErrCouldNotConnect)).To(BeTrue())
+		Expect(Retryable(kvwrapper.ErrKeyNotFound)).To(BeFalse())
+		Expect(Retryable(kvwrapper.ErrConflict)).To(BeFalse())
+		Expect(Retryable(kvwrapper.ErrInvalidKey)).To(BeFalse())
+		Expect(Retryable(kvwrapper.ErrUnauthorized)).To(BeFalse())
+		Expect(Retryable(kvwrapper.ErrTimeout)).To(BeTrue())
+	})
+
+	Context("With a circuit breaker", func() {
+		BeforeEach(func() {
+			kv = RetryWrapper{
+				Retries:          -1,
+				BreakerThreshold: 2,
+				BreakerCooldown:  50 * time.Millisecond,
+			}.Wrap(kv.Backend)
+		})
+
+		It("Fails fast while the store is unhealthy", func() {
+			f.fail(errTransient, 2)
+			Expect(kv.Set("/parent/child1", "newval", 0)).To(Equal(errTransient))
+			Expect(kv.Open()).To(BeFalse())
+			Expect(kv.Set("/parent/child1", "newval", 0)).To(Equal(errTransient))
+			Expect(kv.Open()).To(BeTrue())
+
+			_, err := kv.GetVal("/parent/child1")
+			Expect(err).To(Equal(kvwrapper.ErrCouldNotConnect))
+			Expect(f.count()).To(Equal(2))
+		})
+
+		It("Closes once an operation succeeds after the cooldown", func() {
+			f.fail(errTransient, 2)
+			kv.Set("/parent/child1", "newval", 0)
+			kv.Set("/parent/child1", "newval", 0)
+			Expect(kv.Open()).To(BeTrue())
+
+			Eventually(kv.Open).Should(BeFalse())
+			r, err := kv.GetVal("/parent/child1")
+			Expect(err).To(BeNil())
+			Expect(r.Value).To(Equal("child1val"))
+			Expect(kv.Open()).To(BeFalse())
+		})
+
+		It("Opens again when the trial fails", func() {
+			f.fail(errTransient, 3)
+			kv.Set("/parent/child1", "newval", 0)
+			kv.Set("/parent/child1", "newval", 0)
+
+			Eventually(kv.Open).Should(BeFalse())
+			Expect(kv.Set("/parent/child1", "newval", 0)).To(Equal(errTransient))
+			Expect(kv.Open()).To(BeTrue())
+			Expect(kv.Set("/parent/child1", "newval", 0)).To(Equal(kvwrapper.ErrCouldNotConnect))
+		})
+
+		It("Is not opened by permanent errors", func() {
+			for i := 0; i < 3; i++ {
+				_, err := kv.GetVal("/missing")
+				Expect(err).To(Equal(kvwrapper.ErrKeyNotFound))
+			}
+			Expect(kv.Open()).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,70 @@
+// Package lock provides a distributed mutex on top of a KVWrapper, so that a piece of work
+// runs on a single host at a time.
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	"github.com/behance/go-common/kvwrapper_etcd_v3"
+)
+
+var (
+	ErrLocked    = errors.New("Lock is already held")
+	ErrNotLocked = errors.New("Lock is not held")
+)
+
+// DefaultTTL is the ttl, in seconds, of the locks created with a ttl of 0
+var DefaultTTL uint64 = 60
+
+// PollInterval is how often a Lock waiting for the holder to let go checks the lock again,
+// in case the KV store did not report its release
+var PollInterval = time.Second
+
+// Mutex is a lock shared by every process using the same key on the same KV store.
+//
+// The lock expires ttl seconds after its holder stops refreshing it, so that a crashed holder
+// cannot keep it forever. Every time the lock is acquired it is given a fencing token, greater
+// than the tokens handed to the previous holders: passing it along with the writes made under
+// the lock lets their recipient reject a holder that lost the lock without noticing.
+type Mutex interface {
+	// Lock waits until the lock is acquired or ctx is done, and returns the fencing token
+	Lock(ctx context.Context) (int64, error)
+	// TryLock acquires the lock if it is free, and returns ErrLocked otherwise
+	TryLock() (int64, error)
+	// Unlock releases the lock, returning ErrNotLocked if it was lost in the meantime
+	Unlock() error
+	// Token returns the fencing token of the lock, 0 if it is not held
+	Token() int64
+	// Done is closed once the lock is no longer held: when it is released, or lost because
+	// it expired without its holder noticing
+	Done() <-chan struct{}
+}
+
+// NewMutex returns the Mutex stored under key on kv. On etcd v3 it is built on the concurrency
+// package of clientv3; on the other stores, KVFaker included, it is a key created and refreshed
+// with conditional writes. Only a bare EtcdV3Wrapper is recognized: wrapped in a namespace, the
+// metrics or the retries, it is treated as any other store.
+func NewMutex(kv kvwrapper.KVWrapper, key string, ttl uint64) Mutex {
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	if kv, ok := kv.(kvwrapper_etcd_v3.EtcdV3Wrapper); ok {
+		return newEtcdV3Mutex(kv, key, ttl)
+	}
+	return newKVMutex(kv, key, ttl)
+}
+
+// ownerID returns a value unique to this holder, telling who holds the lock to whoever reads it
+func ownerID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), hex.EncodeToString(b))
+}
@@ -0,0 +1,192 @@
+package lock_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/behance/go-common/kvwrapper"
+	"github.com/behance/go-common/kvwrapper_etcd"
+	"github.com/behance/go-common/kvwrapper_etcd_v3"
+	. "github.com/behance/go-common/lock"
+	log "github.com/behance/go-common/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// backend is a store the specs run against
+type backend struct {
+	name string
+	new  func() kvwrapper.KVWrapper
+	// lose makes the holders of the lock lose it, the way they would if it expired
+	lose func(kv kvwrapper.KVWrapper)
+}
+
+var backends = []backend{
+	{
+		name: "KVFaker",
+		new: func() kvwrapper.KVWrapper {
+			return kvwrapper.NewKVWrapper(nil, kvwrapper.KVFaker{})
+		},
+		lose: func(kv kvwrapper.KVWrapper) {
+			kv.(kvwrapper.KVFaker).Advance(time.Duration(DefaultTTL) * time.Second)
+		},
+	},
+	{
+		name: "etcd v2",
+		new: func() kvwrapper.KVWrapper {
+			return kvwrapper.NewKVWrapper(server.Servers(), kvwrapper_etcd.EtcdWrapper{})
+		},
+		lose: deleteLock,
+	},
+	{
+		name: "etcd v3",
+		new: func() kvwrapper.KVWrapper {
+			return kvwrapper.NewKVWrapper(server.Servers(), kvwrapper_etcd_v3.EtcdV3Wrapper{})
+		},
+		lose: func(kv kvwrapper.KVWrapper) {
+			// the lock belongs to the lease of a session
+			cli := kv.(kvwrapper_etcd_v3.EtcdV3Wrapper).Client()
+			leases, err := cli.Leases(context.Background())
+			Expect(err).To(BeNil())
+			for _, lease := range leases.Leases {
+				cli.Revoke(context.Background(), lease.ID)
+			}
+		},
+	},
+}
+
+func deleteLock(kv kvwrapper.KVWrapper) {
+	Expect(kv.Delete("locks/cron")).To(BeNil())
+}
+
+var _ = Describe("Lock", func() {
+	for _, b := range backends {
+		b := b
+		Context("On "+b.name, func() {
+			describeLock(b)
+		})
+	}
+})
+
+func describeLock(b backend) {
+	var (
+		kv kvwrapper.KVWrapper
+		m1 Mutex
+		m2 Mutex
+	)
+
+	BeforeEach(func() {
+		log.SetLevel(log.PanicLevel)
+		kv = b.new()
+		Expect(kv).ToNot(BeNil())
+		m1 = NewMutex(kv, "locks/cron", 0)
+		m2 = NewMutex(kv, "locks/cron", 0)
+	})
+
+	AfterEach(func() {
+		m1.Unlock()
+		m2.Unlock()
+		kv.DeleteList("locks")
+	})
+
+	Describe("TryLock", func() {
+		It("Fails while the lock is held", func() {
+			token, err := m1.TryLock()
+			Expect(err).To(BeNil())
+			Expect(token).To(BeNumerically(">", 0))
+			Expect(m1.Token()).To(Equal(token))
+
+			_, err = m2.TryLock()
+			Expect(err).To(MatchError(ErrLocked))
+			_, err = m1.TryLock()
+			Expect(err).To(MatchError(ErrLocked))
+
+			Expect(m1.Unlock()).To(BeNil())
+			Expect(m1.Token()).To(BeZero())
+			_, err = m2.TryLock()
+			Expect(err).To(BeNil())
+		})
+		It("Hands out increasing fencing tokens", func() {
+			first, _ := m1.TryLock()
+			m1.Unlock()
+			second, _ := m2.TryLock()
+			Expect(second).To(BeNumerically(">", first))
+		})
+	})
+
+	Describe("Lock", func() {
+		It("Waits for the holder to unlock", func() {
+			m1.Lock(context.Background())
+
+			acquired := make(chan int64)
+			go func() {
+				defer GinkgoRecover()
+				token, err := m2.Lock(context.Background())
+				Expect(err).To(BeNil())
+				acquired <- token
+			}()
+			Consistently(acquired, 100*time.Millisecond).ShouldNot(Receive())
+
+			m1.Unlock()
+			Eventually(acquired).Should(Receive(BeNumerically(">", 0)))
+		})
+		It("Gives up when the context is done", func() {
+			m1.Lock(context.Background())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := m2.Lock(ctx)
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+		})
+		It("Lets a single holder in at a time", func() {
+			var (
+				wg      sync.WaitGroup
+				mutex   sync.Mutex
+				holders int
+				max     int
+			)
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					m := NewMutex(kv, "locks/cron", 0)
+					_, err := m.Lock(context.Background())
+					Expect(err).To(BeNil())
+
+					mutex.Lock()
+					holders++
+					if holders > max {
+						max = holders
+					}
+					mutex.Unlock()
+					time.Sleep(10 * time.Millisecond)
+					mutex.Lock()
+					holders--
+					mutex.Unlock()
+
+					Expect(m.Unlock()).To(BeNil())
+				}()
+			}
+			wg.Wait()
+			Expect(max).To(Equal(1))
+		})
+	})
+
+	Describe("Unlock", func() {
+		It("Fails when the lock is not held", func() {
+			Expect(m1.Unlock()).To(MatchError(ErrNotLocked))
+		})
+		It("Fails when the lock was lost", func() {
+			m1.TryLock()
+			done := m1.Done()
+			Expect(done).ToNot(BeClosed())
+
+			b.lose(kv)
+			Expect(m1.Unlock()).To(MatchError(ErrNotLocked))
+			Eventually(done).Should(BeClosed())
+		})
+	})
+}
@@ -0,0 +1,146 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/behance/go-common/internal/kvlock"
+	"github.com/behance/go-common/kvwrapper"
+	"github.com/behance/go-common/kvwrapper_etcd_v3"
+	etcdv3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+// etcdV3Mutex is a Mutex built on the concurrency package of clientv3: each attempt to lock
+// creates a key below key, attached to the lease of a session, and the lock belongs to the
+// oldest of them. The session keeps the lease alive until Unlock, and the fencing token is
+// the revision at which the key of the holder was created.
+type etcdV3Mutex struct {
+	kv  kvwrapper_etcd_v3.EtcdV3Wrapper
+	key string
+	ttl uint64
+
+	mutex   sync.Mutex
+	session *concurrency.Session
+	token   int64
+}
+
+func newEtcdV3Mutex(kv kvwrapper_etcd_v3.EtcdV3Wrapper, key string, ttl uint64) *etcdV3Mutex {
+	return &etcdV3Mutex{kv: kv, key: key, ttl: ttl}
+}
+
+func (m *etcdV3Mutex) Lock(ctx context.Context) (int64, error) {
+	if m.Token() != 0 {
+		return 0, ErrLocked
+	}
+
+	session, err := concurrency.NewSession(m.kv.Client(), concurrency.WithTTL(int(m.ttl)))
+	if err != nil {
+		return 0, err
+	}
+	mutex := concurrency.NewMutex(session, m.key)
+	err = mutex.Lock(ctx)
+	if err != nil {
+		session.Close()
+		return 0, err
+	}
+
+	r, err := m.kv.Client().Get(ctx, mutex.Key())
+	if err != nil || len(r.Kvs) == 0 {
+		session.Close()
+		if err == nil {
+			err = ErrNotLocked
+		}
+		return 0, err
+	}
+	return m.hold(session, r.Kvs[0].CreateRevision)
+}
+
+// TryLock follows the same scheme as the Lock of concurrency.Mutex, but gives up instead of
+// waiting for the older keys to be removed
+func (m *etcdV3Mutex) TryLock() (int64, error) {
+	if m.Token() != 0 {
+		return 0, ErrLocked
+	}
+
+	session, err := concurrency.NewSession(m.kv.Client(), concurrency.WithTTL(int(m.ttl)))
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := kvwrapper.TimeoutContext(m.kv.Timeout)
+	defer cancel()
+
+	myKey := fmt.Sprintf("%s/%x", m.key, session.Lease())
+	put := etcdv3.OpPut(myKey, "", etcdv3.WithLease(session.Lease()))
+	getOwner := etcdv3.OpGet(m.key+"/", etcdv3.WithFirstCreate()...)
+	r, err := m.kv.Client().Txn(ctx).Then(put, getOwner).Commit()
+	if err != nil {
+		session.Close()
+		return 0, err
+	}
+
+	token := r.Header.Revision
+	owner := r.Responses[1].GetResponseRange().Kvs
+	if len(owner) > 0 && owner[0].CreateRevision != token {
+		// revoking the lease of the session removes myKey
+		session.Close()
+		return 0, ErrLocked
+	}
+	return m.hold(session, token)
+}
+
+// hold records that the lock was acquired through session
+func (m *etcdV3Mutex) hold(session *concurrency.Session, token int64) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.token != 0 {
+		// another call on this very Mutex got there first
+		session.Close()
+		return 0, ErrLocked
+	}
+	m.session, m.token = session, token
+	return token, nil
+}
+
+// Unlock closes the session, which revokes its lease and so removes the key of the holder
+func (m *etcdV3Mutex) Unlock() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.token == 0 {
+		return ErrNotLocked
+	}
+	session := m.session
+	m.session, m.token = nil, 0
+
+	lost := false
+	select {
+	case <-session.Done():
+		lost = true
+	default:
+	}
+	err := session.Close()
+	if lost || err == rpctypes.ErrLeaseNotFound {
+		return ErrNotLocked
+	}
+	return err
+}
+
+func (m *etcdV3Mutex) Token() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.token
+}
+
+func (m *etcdV3Mutex) Done() <-chan struct{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.session == nil {
+		return kvlock.Released
+	}
+	return m.session.Done()
+}
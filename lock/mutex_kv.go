@@ -0,0 +1,53 @@
+package lock
+
+import (
+	"context"
+
+	"github.com/behance/go-common/internal/kvlock"
+	"github.com/behance/go-common/kvwrapper"
+)
+
+// kvMutex is a Mutex held by whoever created its key, with a value naming the holder. The key is
+// refreshed with conditional writes by kvlock, and the fencing token is the revision at which it
+// was created.
+type kvMutex struct {
+	key *kvlock.Key
+}
+
+func newKVMutex(kv kvwrapper.KVWrapper, key string, ttl uint64) *kvMutex {
+	return &kvMutex{key: kvlock.New(kv, key, ttl)}
+}
+
+func (m *kvMutex) Lock(ctx context.Context) (int64, error) {
+	token, err := m.key.Acquire(ctx, ownerID(), PollInterval)
+	if err == kvlock.ErrHeld {
+		return 0, ErrLocked
+	}
+	return token, err
+}
+
+func (m *kvMutex) TryLock() (int64, error) {
+	token, err := m.key.TryAcquire(ownerID())
+	if err == kvlock.ErrHeld || err == kvwrapper.ErrConflict {
+		return 0, ErrLocked
+	}
+	return token, err
+}
+
+// Unlock removes the key of the lock. Should that fail, the lock is released anyway once its
+// ttl runs out.
+func (m *kvMutex) Unlock() error {
+	err := m.key.Release()
+	if err == kvlock.ErrNotHeld {
+		return ErrNotLocked
+	}
+	return err
+}
+
+func (m *kvMutex) Token() int64 {
+	return m.key.Revision()
+}
+
+func (m *kvMutex) Done() <-chan struct{} {
+	return m.key.Done()
+}